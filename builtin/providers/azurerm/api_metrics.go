@@ -0,0 +1,165 @@
+package azurerm
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+)
+
+// apiMetrics records the number and latency of the ARM calls made by the
+// provider's clients with the provider's `emit_api_metrics`, keyed by the
+// operation (the HTTP method) and the type of the resource called.
+type apiMetrics struct {
+	path string
+
+	sync.Mutex
+	calls map[apiMetricsKey]*apiMetricsValue
+}
+
+type apiMetricsKey struct {
+	ResourceType string
+	Operation    string
+}
+
+type apiMetricsValue struct {
+	Count    int
+	Duration time.Duration
+}
+
+// apiMetricsSummary is a row of the summary written to the
+// `api_metrics_file`.
+type apiMetricsSummary struct {
+	ResourceType   string  `json:"resource_type"`
+	Operation      string  `json:"operation"`
+	Count          int     `json:"count"`
+	TotalSeconds   float64 `json:"total_seconds"`
+	AverageSeconds float64 `json:"average_seconds"`
+}
+
+// newApiMetrics returns nil when the metrics aren't enabled, which
+// withApiMetrics doesn't decorate the senders for.
+func newApiMetrics(enabled bool, path string) *apiMetrics {
+	if !enabled {
+		return nil
+	}
+
+	return &apiMetrics{
+		path:  path,
+		calls: make(map[apiMetricsKey]*apiMetricsValue),
+	}
+}
+
+// record adds a call to the metrics. Since the provider isn't notified when
+// the run ends, the summary is rewritten to the `api_metrics_file` after each
+// call (or without one, the totals for the call's key are logged), so that
+// the last summary covers the whole run.
+func (m *apiMetrics) record(r *http.Request, duration time.Duration) {
+	key := apiMetricsKey{
+		ResourceType: armResourceTypeFromPath(r.URL.Path),
+		Operation:    r.Method,
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	value, ok := m.calls[key]
+	if !ok {
+		value = &apiMetricsValue{}
+		m.calls[key] = value
+	}
+	value.Count++
+	value.Duration += duration
+
+	if m.path == "" {
+		log.Printf("[INFO] AzureRM API metrics: %s %s: %d calls, %s total", key.Operation, key.ResourceType, value.Count, value.Duration)
+		return
+	}
+
+	summary, err := json.MarshalIndent(m.summary(), "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(m.path, summary, 0644)
+	}
+	if err != nil {
+		log.Printf("[WARN] Error writing the AzureRM API metrics to %q: %s", m.path, err)
+	}
+}
+
+// summary returns the metrics sorted by the total time spent, descending,
+// so that the calls dominating the run come first.
+func (m *apiMetrics) summary() []apiMetricsSummary {
+	summary := make([]apiMetricsSummary, 0, len(m.calls))
+	for key, value := range m.calls {
+		summary = append(summary, apiMetricsSummary{
+			ResourceType:   key.ResourceType,
+			Operation:      key.Operation,
+			Count:          value.Count,
+			TotalSeconds:   value.Duration.Seconds(),
+			AverageSeconds: value.Duration.Seconds() / float64(value.Count),
+		})
+	}
+
+	sort.Slice(summary, func(i, j int) bool {
+		if summary[i].TotalSeconds != summary[j].TotalSeconds {
+			return summary[i].TotalSeconds > summary[j].TotalSeconds
+		}
+		if summary[i].ResourceType != summary[j].ResourceType {
+			return summary[i].ResourceType < summary[j].ResourceType
+		}
+		return summary[i].Operation < summary[j].Operation
+	})
+
+	return summary
+}
+
+// withApiMetrics records the calls sent in metrics, leaving the sender as-is
+// when metrics are disabled.
+func withApiMetrics(metrics *apiMetrics) autorest.SendDecorator {
+	return func(s autorest.Sender) autorest.Sender {
+		if metrics == nil {
+			return s
+		}
+
+		return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+			start := time.Now()
+			resp, err := s.Do(r)
+			metrics.record(r, time.Since(start))
+			return resp, err
+		})
+	}
+}
+
+// armResourceTypeFromPath returns the type of the resource (or collection)
+// addressed by an ARM path, e.g.
+// `Microsoft.Compute/virtualMachines/extensions` for an extension. The names
+// are dropped, so that calls to resources of the same type are counted
+// together.
+func armResourceTypeFromPath(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+
+	// the types follow the namespace of the last provider in the path
+	start := 0
+	for i := len(segments) - 2; i >= 0; i-- {
+		if strings.EqualFold(segments[i], "providers") {
+			start = i + 1
+			break
+		}
+	}
+
+	types := make([]string, 0)
+	if start > 0 {
+		types = append(types, segments[start])
+		start++
+	}
+	for i := start; i < len(segments); i += 2 {
+		types = append(types, segments[i])
+	}
+
+	return strings.Join(types, "/")
+}
@@ -0,0 +1,79 @@
+package azurerm
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+)
+
+func TestArmResourceTypeFromPath(t *testing.T) {
+	cases := map[string]string{
+		"/subscriptions/00000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/hostname": "Microsoft.Compute/virtualMachines/extensions",
+		"/subscriptions/00000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines":                            "Microsoft.Compute/virtualMachines",
+		"/subscriptions/00000000/providers/Microsoft.Compute/locations/westus/operations/1234":                                    "Microsoft.Compute/locations/operations",
+		"/subscriptions/00000000/providers/Microsoft.Compute/register":                                                            "Microsoft.Compute/register",
+		"/subscriptions/00000000/resourcegroups/acctestRG":                                                                        "subscriptions/resourcegroups",
+		"/subscriptions/00000000/providers":                                                                                       "subscriptions/providers",
+	}
+
+	for path, expected := range cases {
+		if actual := armResourceTypeFromPath(path); actual != expected {
+			t.Fatalf("%s: Expected %q, got %q", path, expected, actual)
+		}
+	}
+}
+
+func TestWithApiMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "tf-azurerm-metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "metrics.json")
+	sender := autorest.CreateSender(withApiMetrics(newApiMetrics(true, path)))
+
+	for _, call := range []struct{ Method, Path string }{
+		{"GET", "/providers/Microsoft.Compute/virtualMachines/vm1/extensions/a"},
+		{"GET", "/providers/Microsoft.Compute/virtualMachines/vm2/extensions/b"},
+		{"PUT", "/providers/Microsoft.Compute/virtualMachines/vm1/extensions/a"},
+	} {
+		req, _ := http.NewRequest(call.Method, server.URL+call.Path, nil)
+		if _, err := sender.Do(req); err != nil {
+			t.Fatalf("Error sending the request: %s", err)
+		}
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Expected the metrics to be written: %s", err)
+	}
+	var summary []apiMetricsSummary
+	if err := json.Unmarshal(contents, &summary); err != nil {
+		t.Fatalf("Error decoding the metrics: %s", err)
+	}
+
+	counts := make(map[string]int)
+	for _, row := range summary {
+		counts[row.Operation+" "+row.ResourceType] = row.Count
+	}
+	if len(counts) != 2 || counts["GET Microsoft.Compute/virtualMachines/extensions"] != 2 || counts["PUT Microsoft.Compute/virtualMachines/extensions"] != 1 {
+		t.Fatalf("Expected the calls to be counted by operation and resource type, got %+v", summary)
+	}
+
+	disabled := &autorest.Client{}
+	if sender := withApiMetrics(nil)(disabled); sender != autorest.Sender(disabled) {
+		t.Fatalf("Expected the sender not to be decorated when metrics are disabled")
+	}
+}
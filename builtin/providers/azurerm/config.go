@@ -6,6 +6,9 @@ import (
 	"log"
 	"net/http"
 	"net/http/httputil"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/Azure/azure-sdk-for-go/arm/cdn"
 	"github.com/Azure/azure-sdk-for-go/arm/compute"
@@ -84,7 +87,8 @@ type ArmClient struct {
 	storageServiceClient storage.AccountsClient
 	storageUsageClient   storage.UsageOperationsClient
 
-	deploymentsClient resources.DeploymentsClient
+	deploymentsClient          resources.DeploymentsClient
+	deploymentOperationsClient resources.DeploymentOperationsClient
 
 	redisClient redis.GroupClient
 
@@ -96,6 +100,30 @@ type ArmClient struct {
 	serviceBusSubscriptionsClient servicebus.SubscriptionsClient
 
 	keyVaultClient keyvault.VaultsClient
+
+	extensionImageCache *extensionImageCache
+	prettyPrintSettings bool
+	extensionFailFast   *extensionFailFast
+	autoTagExtensions   bool
+
+	requireImportForExistingExtensions bool
+	extensionImageCatalog              *extensionImageCatalog
+
+	extensionFallbackPoller bool
+	extensionOperations     extensionOperationLimiter
+	nonFatalErrorCodes      []string
+	operationResults        *operationResults
+
+	extensionSettingsSizeLimit int
+
+	extensionSettingsSchemas  map[string]*extensionSettingsSchema
+	settingsValidationWebhook *settingsValidationWebhook
+
+	defaultExtensionPublisher string
+	defaultExtensionType      string
+
+	// the effective provider options, for azurerm_provider_config
+	providerOptions map[string]string
 }
 
 func withRequestLogging() autorest.SendDecorator {
@@ -166,6 +194,8 @@ func (c *Config) getArmClient() (*ArmClient, error) {
 	}
 	client.rivieraClient = rivieraClient
 
+	metrics := newApiMetrics(c.EmitApiMetrics, c.ApiMetricsFile)
+
 	oauthConfig, err := env.OAuthConfigForTenant(c.TenantID)
 	if err != nil {
 		return nil, err
@@ -188,270 +218,354 @@ func (c *Config) getArmClient() (*ArmClient, error) {
 	asc := compute.NewAvailabilitySetsClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&asc.Client)
 	asc.Authorizer = spt
-	asc.Sender = autorest.CreateSender(withRequestLogging())
+	asc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.availSetClient = asc
 
 	uoc := compute.NewUsageClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&uoc.Client)
 	uoc.Authorizer = spt
-	uoc.Sender = autorest.CreateSender(withRequestLogging())
+	uoc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.usageOpsClient = uoc
 
 	vmeic := compute.NewVirtualMachineExtensionImagesClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&vmeic.Client)
 	vmeic.Authorizer = spt
-	vmeic.Sender = autorest.CreateSender(withRequestLogging())
+	vmeic.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.vmExtensionImageClient = vmeic
 
 	vmec := compute.NewVirtualMachineExtensionsClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&vmec.Client)
 	vmec.Authorizer = spt
-	vmec.Sender = autorest.CreateSender(withRequestLogging())
+	vmec.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics), withTransientErrorRetry())
 	client.vmExtensionClient = vmec
 
 	vmic := compute.NewVirtualMachineImagesClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&vmic.Client)
 	vmic.Authorizer = spt
-	vmic.Sender = autorest.CreateSender(withRequestLogging())
+	vmic.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.vmImageClient = vmic
 
 	vmssc := compute.NewVirtualMachineScaleSetsClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&vmssc.Client)
 	vmssc.Authorizer = spt
-	vmssc.Sender = autorest.CreateSender(withRequestLogging())
+	vmssc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.vmScaleSetClient = vmssc
 
 	vmc := compute.NewVirtualMachinesClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&vmc.Client)
 	vmc.Authorizer = spt
-	vmc.Sender = autorest.CreateSender(withRequestLogging())
+	vmc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.vmClient = vmc
 
 	agc := network.NewApplicationGatewaysClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&agc.Client)
 	agc.Authorizer = spt
-	agc.Sender = autorest.CreateSender(withRequestLogging())
+	agc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.appGatewayClient = agc
 
 	crc := containerregistry.NewRegistriesClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&crc.Client)
 	crc.Authorizer = spt
-	crc.Sender = autorest.CreateSender(withRequestLogging())
+	crc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.containerRegistryClient = crc
 
 	csc := containerservice.NewContainerServicesClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&csc.Client)
 	csc.Authorizer = spt
-	csc.Sender = autorest.CreateSender(withRequestLogging())
+	csc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.containerServicesClient = csc
 
 	ehc := eventhub.NewEventHubsClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&ehc.Client)
 	ehc.Authorizer = spt
-	ehc.Sender = autorest.CreateSender(withRequestLogging())
+	ehc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.eventHubClient = ehc
 
 	chcgc := eventhub.NewConsumerGroupsClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&chcgc.Client)
 	chcgc.Authorizer = spt
-	chcgc.Sender = autorest.CreateSender(withRequestLogging())
+	chcgc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.eventHubConsumerGroupClient = chcgc
 
 	ehnc := eventhub.NewNamespacesClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&ehnc.Client)
 	ehnc.Authorizer = spt
-	ehnc.Sender = autorest.CreateSender(withRequestLogging())
+	ehnc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.eventHubNamespacesClient = ehnc
 
 	ifc := network.NewInterfacesClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&ifc.Client)
 	ifc.Authorizer = spt
-	ifc.Sender = autorest.CreateSender(withRequestLogging())
+	ifc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.ifaceClient = ifc
 
 	lbc := network.NewLoadBalancersClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&lbc.Client)
 	lbc.Authorizer = spt
-	lbc.Sender = autorest.CreateSender(withRequestLogging())
+	lbc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.loadBalancerClient = lbc
 
 	lgc := network.NewLocalNetworkGatewaysClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&lgc.Client)
 	lgc.Authorizer = spt
-	lgc.Sender = autorest.CreateSender(withRequestLogging())
+	lgc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.localNetConnClient = lgc
 
 	pipc := network.NewPublicIPAddressesClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&pipc.Client)
 	pipc.Authorizer = spt
-	pipc.Sender = autorest.CreateSender(withRequestLogging())
+	pipc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.publicIPClient = pipc
 
 	sgc := network.NewSecurityGroupsClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&sgc.Client)
 	sgc.Authorizer = spt
-	sgc.Sender = autorest.CreateSender(withRequestLogging())
+	sgc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.secGroupClient = sgc
 
 	src := network.NewSecurityRulesClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&src.Client)
 	src.Authorizer = spt
-	src.Sender = autorest.CreateSender(withRequestLogging())
+	src.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.secRuleClient = src
 
 	snc := network.NewSubnetsClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&snc.Client)
 	snc.Authorizer = spt
-	snc.Sender = autorest.CreateSender(withRequestLogging())
+	snc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.subnetClient = snc
 
 	vgcc := network.NewVirtualNetworkGatewayConnectionsClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&vgcc.Client)
 	vgcc.Authorizer = spt
-	vgcc.Sender = autorest.CreateSender(withRequestLogging())
+	vgcc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.vnetGatewayConnectionsClient = vgcc
 
 	vgc := network.NewVirtualNetworkGatewaysClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&vgc.Client)
 	vgc.Authorizer = spt
-	vgc.Sender = autorest.CreateSender(withRequestLogging())
+	vgc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.vnetGatewayClient = vgc
 
 	vnc := network.NewVirtualNetworksClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&vnc.Client)
 	vnc.Authorizer = spt
-	vnc.Sender = autorest.CreateSender(withRequestLogging())
+	vnc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.vnetClient = vnc
 
 	vnpc := network.NewVirtualNetworkPeeringsClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&vnpc.Client)
 	vnpc.Authorizer = spt
-	vnpc.Sender = autorest.CreateSender(withRequestLogging())
+	vnpc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.vnetPeeringsClient = vnpc
 
 	rtc := network.NewRouteTablesClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&rtc.Client)
 	rtc.Authorizer = spt
-	rtc.Sender = autorest.CreateSender(withRequestLogging())
+	rtc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.routeTablesClient = rtc
 
 	rc := network.NewRoutesClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&rc.Client)
 	rc.Authorizer = spt
-	rc.Sender = autorest.CreateSender(withRequestLogging())
+	rc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.routesClient = rc
 
 	rgc := resources.NewGroupsClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&rgc.Client)
 	rgc.Authorizer = spt
-	rgc.Sender = autorest.CreateSender(withRequestLogging())
+	rgc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.resourceGroupClient = rgc
 
 	pc := resources.NewProvidersClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&pc.Client)
 	pc.Authorizer = spt
-	pc.Sender = autorest.CreateSender(withRequestLogging())
+	pc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.providers = pc
 
 	tc := resources.NewTagsClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&tc.Client)
 	tc.Authorizer = spt
-	tc.Sender = autorest.CreateSender(withRequestLogging())
+	tc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.tagsClient = tc
 
 	rf := resources.NewGroupClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&rf.Client)
 	rf.Authorizer = spt
-	rf.Sender = autorest.CreateSender(withRequestLogging())
+	rf.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.resourceFindClient = rf
 
 	jc := scheduler.NewJobsClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&jc.Client)
 	jc.Authorizer = spt
-	jc.Sender = autorest.CreateSender(withRequestLogging())
+	jc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.jobsClient = jc
 
 	jcc := scheduler.NewJobCollectionsClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&jcc.Client)
 	jcc.Authorizer = spt
-	jcc.Sender = autorest.CreateSender(withRequestLogging())
+	jcc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.jobsCollectionsClient = jcc
 
 	ssc := storage.NewAccountsClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&ssc.Client)
 	ssc.Authorizer = spt
-	ssc.Sender = autorest.CreateSender(withRequestLogging())
+	ssc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.storageServiceClient = ssc
 
 	suc := storage.NewUsageOperationsClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&suc.Client)
 	suc.Authorizer = spt
-	suc.Sender = autorest.CreateSender(withRequestLogging())
+	suc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.storageUsageClient = suc
 
 	cpc := cdn.NewProfilesClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&cpc.Client)
 	cpc.Authorizer = spt
-	cpc.Sender = autorest.CreateSender(withRequestLogging())
+	cpc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.cdnProfilesClient = cpc
 
 	cec := cdn.NewEndpointsClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&cec.Client)
 	cec.Authorizer = spt
-	cec.Sender = autorest.CreateSender(withRequestLogging())
+	cec.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.cdnEndpointsClient = cec
 
 	dc := resources.NewDeploymentsClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&dc.Client)
 	dc.Authorizer = spt
-	dc.Sender = autorest.CreateSender(withRequestLogging())
+	dc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.deploymentsClient = dc
 
+	doc := resources.NewDeploymentOperationsClientWithBaseURI(endpoint, c.SubscriptionID)
+	setUserAgent(&doc.Client)
+	doc.Authorizer = spt
+	doc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
+	client.deploymentOperationsClient = doc
+
 	tmpc := trafficmanager.NewProfilesClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&tmpc.Client)
 	tmpc.Authorizer = spt
-	tmpc.Sender = autorest.CreateSender(withRequestLogging())
+	tmpc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.trafficManagerProfilesClient = tmpc
 
 	tmec := trafficmanager.NewEndpointsClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&tmec.Client)
 	tmec.Authorizer = spt
-	tmec.Sender = autorest.CreateSender(withRequestLogging())
+	tmec.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.trafficManagerEndpointsClient = tmec
 
 	rdc := redis.NewGroupClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&rdc.Client)
 	rdc.Authorizer = spt
-	rdc.Sender = autorest.CreateSender(withRequestLogging())
+	rdc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.redisClient = rdc
 
 	sbnc := servicebus.NewNamespacesClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&sbnc.Client)
 	sbnc.Authorizer = spt
-	sbnc.Sender = autorest.CreateSender(withRequestLogging())
+	sbnc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.serviceBusNamespacesClient = sbnc
 
 	sbtc := servicebus.NewTopicsClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&sbtc.Client)
 	sbtc.Authorizer = spt
-	sbtc.Sender = autorest.CreateSender(withRequestLogging())
+	sbtc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.serviceBusTopicsClient = sbtc
 
 	sbsc := servicebus.NewSubscriptionsClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&sbsc.Client)
 	sbsc.Authorizer = spt
-	sbsc.Sender = autorest.CreateSender(withRequestLogging())
+	sbsc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.serviceBusSubscriptionsClient = sbsc
 
 	kvc := keyvault.NewVaultsClientWithBaseURI(endpoint, c.SubscriptionID)
 	setUserAgent(&kvc.Client)
 	kvc.Authorizer = spt
-	kvc.Sender = autorest.CreateSender(withRequestLogging())
+	kvc.Sender = autorest.CreateSender(withRequestLogging(), withApiMetrics(metrics))
 	client.keyVaultClient = kvc
 
+	client.extensionImageCache = newExtensionImageCache(c.ExtensionImageCacheDir, c.ExtensionImageCacheTTL)
+	client.extensionImageCatalog = newExtensionImageCatalog(c.ValidateExtensionImages)
+	client.prettyPrintSettings = c.PrettyPrintSettings
+	client.extensionFailFast = newExtensionFailFast(c.FailFastOnExtensionError)
+	client.autoTagExtensions = c.AutoTagExtensionMetadata
+	client.requireImportForExistingExtensions = c.RequireImportForExistingExtensions
+	client.extensionFallbackPoller = c.UseFallbackExtensionPoller
+	client.extensionOperations = newExtensionOperationLimiter(c.MaxConcurrentExtensionOperations)
+	client.extensionSettingsSizeLimit = c.ExtensionSettingsSizeLimit
+	client.nonFatalErrorCodes = c.NonFatalErrorCodes
+	client.operationResults = newOperationResults(c.ResultsOutputFile)
+
+	schemas, err := loadArmExtensionSettingsSchemas(c.ExtensionSettingsSchemaDir)
+	if err != nil {
+		return nil, err
+	}
+	client.extensionSettingsSchemas = schemas
+	client.settingsValidationWebhook = newSettingsValidationWebhook(c.SettingsValidationWebhookURL, c.SettingsValidationWebhookTimeout, c.SettingsValidationWebhookFailureMode)
+	client.defaultExtensionPublisher = c.DefaultExtensionPublisher
+	client.defaultExtensionType = c.DefaultExtensionType
+	client.providerOptions = c.effectiveOptions()
+
+	log.Printf("[INFO] AzureRM provider configuration: environment=%q resource_manager_endpoint=%q active_directory_endpoint=%q subscription_id=%q tenant_id=%q client_id=%q client_secret=%q retry_attempts=%d retry_duration=%s polling_delay=%s polling_duration=%s options=%s",
+		env.Name, env.ResourceManagerEndpoint, env.ActiveDirectoryEndpoint, c.SubscriptionID, c.TenantID, c.ClientID, redactArmProviderSecret(c.ClientSecret),
+		client.vmExtensionClient.RetryAttempts, client.vmExtensionClient.RetryDuration, client.vmExtensionClient.PollingDelay, client.vmExtensionClient.PollingDuration,
+		flattenArmProviderOptions(client.providerOptions))
+
 	return &client, nil
 }
 
+// effectiveOptions returns the values of the (non-credential) provider
+// options, after defaults have been applied, keyed by their argument name.
+func (c *Config) effectiveOptions() map[string]string {
+	return map[string]string{
+		"skip_provider_registration":               strconv.FormatBool(c.SkipProviderRegistration),
+		"pretty_print_settings":                    strconv.FormatBool(c.PrettyPrintSettings),
+		"fail_fast_on_extension_error":             strconv.FormatBool(c.FailFastOnExtensionError),
+		"auto_tag_extension_metadata":              strconv.FormatBool(c.AutoTagExtensionMetadata),
+		"require_import_for_existing_extensions":   strconv.FormatBool(c.RequireImportForExistingExtensions),
+		"validate_extension_images":                strconv.FormatBool(c.ValidateExtensionImages),
+		"use_fallback_extension_poller":            strconv.FormatBool(c.UseFallbackExtensionPoller),
+		"max_concurrent_extension_operations":      strconv.Itoa(c.MaxConcurrentExtensionOperations),
+		"extension_settings_size_limit":            strconv.Itoa(c.ExtensionSettingsSizeLimit),
+		"non_fatal_error_codes":                    strings.Join(c.NonFatalErrorCodes, ","),
+		"emit_api_metrics":                         strconv.FormatBool(c.EmitApiMetrics),
+		"api_metrics_file":                         c.ApiMetricsFile,
+		"results_output_file":                      c.ResultsOutputFile,
+		"extension_image_cache_dir":                c.ExtensionImageCacheDir,
+		"extension_image_cache_ttl":                c.ExtensionImageCacheTTL.String(),
+		"extension_settings_schema_dir":            c.ExtensionSettingsSchemaDir,
+		"settings_validation_webhook_url":          flattenSettingsValidationWebhookURL(c.SettingsValidationWebhookURL),
+		"settings_validation_webhook_timeout":      c.SettingsValidationWebhookTimeout.String(),
+		"settings_validation_webhook_failure_mode": c.SettingsValidationWebhookFailureMode,
+		"default_extension_publisher":              c.DefaultExtensionPublisher,
+		"default_extension_type":                   c.DefaultExtensionType,
+	}
+}
+
+// flattenArmProviderOptions formats the options as sorted `key=value` pairs.
+func flattenArmProviderOptions(options map[string]string) string {
+	keys := make([]string, 0, len(options))
+	for k := range options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", k, options[k]))
+	}
+	return strings.Join(pairs, " ")
+}
+
+// redactArmProviderSecret only reveals whether a secret is set.
+func redactArmProviderSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "REDACTED"
+}
+
 func (armClient *ArmClient) getKeyForStorageAccount(resourceGroupName, storageAccountName string) (string, bool, error) {
 	accountKeys, err := armClient.storageServiceClient.ListKeys(resourceGroupName, storageAccountName)
 	if accountKeys.StatusCode == http.StatusNotFound {
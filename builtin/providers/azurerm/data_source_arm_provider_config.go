@@ -0,0 +1,87 @@
+package azurerm
+
+import (
+	"time"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func dataSourceArmProviderConfig() *schema.Resource {
+	return &schema.Resource{
+		Read: dataSourceArmProviderConfigRead,
+
+		Schema: map[string]*schema.Schema{
+			"environment": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"resource_manager_endpoint": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"active_directory_endpoint": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"client_id": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"tenant_id": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"subscription_id": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"retry_attempts": {
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+			"retry_duration": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"polling_delay": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"polling_duration": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"options": {
+				Type:     schema.TypeMap,
+				Computed: true,
+			},
+		},
+	}
+}
+
+func dataSourceArmProviderConfigRead(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*ArmClient)
+
+	// the retry settings are the same for all SDK clients
+	sdkClient := client.vmExtensionClient.Client
+
+	options := make(map[string]interface{}, len(client.providerOptions))
+	for k, v := range client.providerOptions {
+		options[k] = v
+	}
+
+	d.SetId(time.Now().UTC().String())
+	d.Set("environment", client.environment.Name)
+	d.Set("resource_manager_endpoint", client.environment.ResourceManagerEndpoint)
+	d.Set("active_directory_endpoint", client.environment.ActiveDirectoryEndpoint)
+	d.Set("client_id", client.clientId)
+	d.Set("tenant_id", client.tenantId)
+	d.Set("subscription_id", client.subscriptionId)
+	d.Set("retry_attempts", sdkClient.RetryAttempts)
+	d.Set("retry_duration", sdkClient.RetryDuration.String())
+	d.Set("polling_delay", sdkClient.PollingDelay.String())
+	d.Set("polling_duration", sdkClient.PollingDuration.String())
+	d.Set("options", options)
+
+	return nil
+}
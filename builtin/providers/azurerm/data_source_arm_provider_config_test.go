@@ -0,0 +1,49 @@
+package azurerm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func TestDataSourceArmProviderConfigRead(t *testing.T) {
+	config := &Config{
+		ClientSecret:                     "s3cr3t",
+		FailFastOnExtensionError:         true,
+		MaxConcurrentExtensionOperations: 4,
+		DefaultExtensionPublisher:        "Microsoft.Azure.Extensions",
+	}
+
+	client := testArmClientWithBaseURI("https://management.example.com/")
+	client.environment = azure.PublicCloud
+	client.subscriptionId = "00000000-0000-0000-0000-000000000000"
+	client.providerOptions = config.effectiveOptions()
+
+	d := schema.TestResourceDataRaw(t, dataSourceArmProviderConfig().Schema, map[string]interface{}{})
+	if err := dataSourceArmProviderConfigRead(d, client); err != nil {
+		t.Fatalf("Error reading the provider config: %s", err)
+	}
+
+	for key, expected := range map[string]string{
+		"environment":                                 "AzurePublicCloud",
+		"resource_manager_endpoint":                   "https://management.azure.com/",
+		"subscription_id":                             "00000000-0000-0000-0000-000000000000",
+		"retry_attempts":                              "3",
+		"polling_delay":                               "1m0s",
+		"options.fail_fast_on_extension_error":        "true",
+		"options.max_concurrent_extension_operations": "4",
+		"options.default_extension_publisher":         "Microsoft.Azure.Extensions",
+	} {
+		if actual := d.State().Attributes[key]; actual != expected {
+			t.Fatalf("Expected %s to be %q, got %q", key, expected, actual)
+		}
+	}
+
+	for key, value := range d.State().Attributes {
+		if strings.Contains(value, "s3cr3t") {
+			t.Fatalf("Expected the client secret not to be exposed, found in %s", key)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package azurerm
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func dataSourceArmVirtualMachineExtension() *schema.Resource {
+	return &schema.Resource{
+		Read: dataSourceArmVirtualMachineExtensionRead,
+
+		Schema: map[string]*schema.Schema{
+			"name": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+
+			"resource_group_name": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+
+			"virtual_machine_name": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+
+			"publisher": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			"type": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			"type_handler_version": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			"auto_upgrade_minor_version": {
+				Type:     schema.TypeBool,
+				Computed: true,
+			},
+
+			"settings": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			"provisioning_state": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			"tags": {
+				Type:     schema.TypeMap,
+				Computed: true,
+			},
+		},
+	}
+}
+
+func dataSourceArmVirtualMachineExtensionRead(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*ArmClient)
+	resGroup := d.Get("resource_group_name").(string)
+	vmName := d.Get("virtual_machine_name").(string)
+	name := d.Get("name").(string)
+
+	client.extensionOperations.acquire()
+	resp, err := client.vmExtensionClient.Get(resGroup, vmName, name, "")
+	client.extensionOperations.release()
+
+	if err != nil {
+		if resp.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("Virtual Machine Extension %q was not found on Virtual Machine %q (resource group %q)", name, vmName, resGroup)
+		}
+		return fmt.Errorf("Error making Read request on Virtual Machine Extension %q (Virtual Machine %q, resource group %q): %s", name, vmName, resGroup, err)
+	}
+	if resp.ID == nil {
+		return fmt.Errorf("Cannot read the ID of Virtual Machine Extension %q (Virtual Machine %q, resource group %q)", name, vmName, resGroup)
+	}
+
+	d.SetId(*resp.ID)
+	flattenAndSetTags(d, resp.Tags)
+
+	props := resp.VirtualMachineExtensionProperties
+	if props == nil {
+		return nil
+	}
+
+	d.Set("publisher", props.Publisher)
+	d.Set("type", props.Type)
+	d.Set("type_handler_version", props.TypeHandlerVersion)
+	d.Set("auto_upgrade_minor_version", props.AutoUpgradeMinorVersion)
+	d.Set("provisioning_state", props.ProvisioningState)
+
+	if props.Settings != nil {
+		settings, err := flattenArmVirtualMachineExtensionSettingsForState(*props.Settings, client.prettyPrintSettings)
+		if err != nil {
+			return fmt.Errorf("unable to parse settings from response: %s", err)
+		}
+		d.Set("settings", settings)
+	}
+
+	return nil
+}
@@ -0,0 +1,261 @@
+package azurerm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func dataSourceArmVirtualMachineExtensionRolloutStatus() *schema.Resource {
+	return &schema.Resource{
+		Read: dataSourceArmVirtualMachineExtensionRolloutStatusRead,
+
+		Schema: map[string]*schema.Schema{
+			"resource_group_name": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+
+			"name": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+
+			"publisher": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+
+			"type": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+
+			"virtual_machine_tags": {
+				Type:     schema.TypeMap,
+				Optional: true,
+			},
+
+			"total_count": {
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+
+			"succeeded_count": {
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+
+			"failed_count": {
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+
+			"provisioning_count": {
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+
+			// the number of Extensions in each provisioning state
+			"counts": {
+				Type:     schema.TypeMap,
+				Computed: true,
+				Elem:     schema.TypeInt,
+			},
+
+			"failed_extensions": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"virtual_machine_id": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+
+						"name": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+
+						"status_message": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// armVirtualMachineExtensionRolloutFilter selects the extensions counted by
+// the rollout status, each field matching everything when empty.
+type armVirtualMachineExtensionRolloutFilter struct {
+	Name      string
+	Publisher string
+	Type      string
+}
+
+func (f armVirtualMachineExtensionRolloutFilter) matches(extension compute.VirtualMachineExtension) bool {
+	var publisher, extensionType *string
+	if props := extension.VirtualMachineExtensionProperties; props != nil {
+		publisher = props.Publisher
+		extensionType = props.Type
+	}
+
+	return matchesArmRolloutFilterValue(f.Name, extension.Name) &&
+		matchesArmRolloutFilterValue(f.Publisher, publisher) &&
+		matchesArmRolloutFilterValue(f.Type, extensionType)
+}
+
+func matchesArmRolloutFilterValue(filter string, value *string) bool {
+	return filter == "" || (value != nil && strings.EqualFold(filter, *value))
+}
+
+func dataSourceArmVirtualMachineExtensionRolloutStatusRead(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*ArmClient).vmClient
+	resGroup := d.Get("resource_group_name").(string)
+	selector := d.Get("virtual_machine_tags").(map[string]interface{})
+
+	filter := armVirtualMachineExtensionRolloutFilter{
+		Name:      d.Get("name").(string),
+		Publisher: d.Get("publisher").(string),
+		Type:      d.Get("type").(string),
+	}
+
+	page, err := client.List(resGroup)
+	vms := make([]compute.VirtualMachine, 0)
+	for {
+		if err != nil {
+			return fmt.Errorf("Error listing the Virtual Machines in resource group %q: %s", resGroup, err)
+		}
+
+		if page.Value != nil {
+			for _, vm := range *page.Value {
+				if vm.Name == nil || !matchesArmTagSelector(vm.Tags, selector) {
+					continue
+				}
+
+				// the status messages are only part of the instance view
+				withInstanceView, err := client.Get(resGroup, *vm.Name, compute.InstanceView)
+				if err != nil {
+					return fmt.Errorf("Error retrieving the instance view of Virtual Machine %q (resource group %q): %s", *vm.Name, resGroup, err)
+				}
+				vms = append(vms, withInstanceView)
+			}
+		}
+
+		if page.NextLink == nil || *page.NextLink == "" {
+			break
+		}
+		page, err = client.ListNextResults(page)
+	}
+
+	counts, failed := flattenArmVirtualMachineExtensionRolloutStatus(vms, filter)
+
+	total := 0
+	countsMap := make(map[string]interface{}, len(counts))
+	for state, count := range counts {
+		total += count
+		countsMap[state] = count
+	}
+
+	d.SetId(time.Now().UTC().String())
+	d.Set("total_count", total)
+	d.Set("succeeded_count", counts["Succeeded"])
+	d.Set("failed_count", counts["Failed"])
+	d.Set("provisioning_count", total-counts["Succeeded"]-counts["Failed"])
+	if err := d.Set("counts", countsMap); err != nil {
+		return fmt.Errorf("Error flattening `counts`: %+v", err)
+	}
+	if err := d.Set("failed_extensions", failed); err != nil {
+		return fmt.Errorf("Error flattening `failed_extensions`: %+v", err)
+	}
+
+	return nil
+}
+
+// flattenArmVirtualMachineExtensionRolloutStatus counts the extensions of the
+// VMs matching the filter by provisioning state, and describes the failed
+// ones (sorted by VM and extension) with the status message of the extension.
+func flattenArmVirtualMachineExtensionRolloutStatus(vms []compute.VirtualMachine, filter armVirtualMachineExtensionRolloutFilter) (map[string]int, []interface{}) {
+	counts := make(map[string]int)
+	failed := make([]interface{}, 0)
+
+	for _, vm := range vms {
+		if vm.Resources == nil {
+			continue
+		}
+
+		vmId := ""
+		if vm.ID != nil {
+			vmId = *vm.ID
+		}
+
+		for _, extension := range *vm.Resources {
+			if !filter.matches(extension) {
+				continue
+			}
+
+			state := "Unknown"
+			if props := extension.VirtualMachineExtensionProperties; props != nil && props.ProvisioningState != nil {
+				state = *props.ProvisioningState
+			}
+			counts[state]++
+
+			if state != "Failed" {
+				continue
+			}
+
+			name := ""
+			if extension.Name != nil {
+				name = *extension.Name
+			}
+			failed = append(failed, map[string]interface{}{
+				"virtual_machine_id": vmId,
+				"name":               name,
+				"status_message":     findArmVirtualMachineExtensionStatusMessage(vm, name),
+			})
+		}
+	}
+
+	sort.Slice(failed, func(i, j int) bool {
+		a, b := failed[i].(map[string]interface{}), failed[j].(map[string]interface{})
+		if a["virtual_machine_id"] != b["virtual_machine_id"] {
+			return a["virtual_machine_id"].(string) < b["virtual_machine_id"].(string)
+		}
+		return a["name"].(string) < b["name"].(string)
+	})
+
+	return counts, failed
+}
+
+// findArmVirtualMachineExtensionStatusMessage returns the messages of the
+// statuses of the extension in the VM's instance view.
+func findArmVirtualMachineExtensionStatusMessage(vm compute.VirtualMachine, name string) string {
+	props := vm.VirtualMachineProperties
+	if props == nil || props.InstanceView == nil || props.InstanceView.Extensions == nil {
+		return ""
+	}
+
+	for _, instanceView := range *props.InstanceView.Extensions {
+		if instanceView.Name == nil || !strings.EqualFold(*instanceView.Name, name) || instanceView.Statuses == nil {
+			continue
+		}
+
+		messages := make([]string, 0)
+		for _, status := range *instanceView.Statuses {
+			if status.Message != nil && *status.Message != "" {
+				messages = append(messages, *status.Message)
+			}
+		}
+		return strings.Join(messages, "\n")
+	}
+
+	return ""
+}
@@ -0,0 +1,86 @@
+package azurerm
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func TestDataSourceArmVirtualMachineExtensionRolloutStatusRead(t *testing.T) {
+	vms := map[string]string{
+		"web1": `{"id":"/vms/web1","name":"web1","tags":{"role":"web"},"resources":[
+			{"name":"hostname","properties":{"publisher":"Microsoft.Azure.Extensions","type":"CustomScript","provisioningState":"Succeeded"}},
+			{"name":"diagnostics","properties":{"publisher":"Microsoft.OSTCExtensions","type":"LinuxDiagnostic","provisioningState":"Failed"}}
+		],"properties":{"instanceView":{"extensions":[
+			{"name":"diagnostics","statuses":[{"code":"ProvisioningState/failed","message":"storage account not found"}]}
+		]}}}`,
+		"web2": `{"id":"/vms/web2","name":"web2","tags":{"role":"web"},"resources":[
+			{"name":"hostname","properties":{"publisher":"Microsoft.Azure.Extensions","type":"CustomScript","provisioningState":"Failed"}},
+			{"name":"diagnostics","properties":{"publisher":"Microsoft.OSTCExtensions","type":"LinuxDiagnostic","provisioningState":"Creating"}}
+		],"properties":{"instanceView":{"extensions":[
+			{"name":"hostname","statuses":[{"code":"ProvisioningState/failed","message":"exit code 1"}]}
+		]}}}`,
+		"db1": `{"id":"/vms/db1","name":"db1","tags":{"role":"db"},"resources":[
+			{"name":"hostname","properties":{"publisher":"Microsoft.Azure.Extensions","type":"CustomScript","provisioningState":"Failed"}}
+		]}`,
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/virtualMachines"):
+			fmt.Fprintf(w, `{"value":[%s,%s,%s]}`, vms["web1"], vms["web2"], vms["db1"])
+		case r.Method == "GET" && strings.Contains(r.URL.Path, "/virtualMachines/"):
+			name := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+			if r.URL.Query().Get("$expand") != "instanceView" {
+				t.Errorf("Expected the instance view of %q to be requested", name)
+			}
+			fmt.Fprint(w, vms[name])
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	d := schema.TestResourceDataRaw(t, dataSourceArmVirtualMachineExtensionRolloutStatus().Schema, map[string]interface{}{
+		"resource_group_name":  "acctestrg",
+		"virtual_machine_tags": map[string]interface{}{"role": "web"},
+	})
+	if err := dataSourceArmVirtualMachineExtensionRolloutStatusRead(d, testArmClientWithBaseURI(server.URL)); err != nil {
+		t.Fatalf("Error reading the rollout status: %s", err)
+	}
+
+	for key, expected := range map[string]string{
+		"total_count":                            "4",
+		"succeeded_count":                        "1",
+		"failed_count":                           "2",
+		"provisioning_count":                     "1",
+		"counts.Creating":                        "1",
+		"failed_extensions.#":                    "2",
+		"failed_extensions.0.virtual_machine_id": "/vms/web1",
+		"failed_extensions.0.name":               "diagnostics",
+		"failed_extensions.0.status_message":     "storage account not found",
+		"failed_extensions.1.virtual_machine_id": "/vms/web2",
+		"failed_extensions.1.status_message":     "exit code 1",
+	} {
+		if actual := d.State().Attributes[key]; actual != expected {
+			t.Fatalf("Expected %s to be %q, got %q", key, expected, actual)
+		}
+	}
+
+	d = schema.TestResourceDataRaw(t, dataSourceArmVirtualMachineExtensionRolloutStatus().Schema, map[string]interface{}{
+		"resource_group_name": "acctestrg",
+		"type":                "customscript",
+	})
+	if err := dataSourceArmVirtualMachineExtensionRolloutStatusRead(d, testArmClientWithBaseURI(server.URL)); err != nil {
+		t.Fatalf("Error reading the rollout status: %s", err)
+	}
+	if total, failed := d.Get("total_count").(int), d.Get("failed_count").(int); total != 3 || failed != 2 {
+		t.Fatalf("Expected 3 CustomScript Extensions of which 2 failed, got %d and %d", total, failed)
+	}
+}
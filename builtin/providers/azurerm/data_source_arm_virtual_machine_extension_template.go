@@ -0,0 +1,109 @@
+package azurerm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/hashicorp/hil"
+	"github.com/hashicorp/hil/ast"
+	"github.com/hashicorp/terraform/config"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func dataSourceArmVirtualMachineExtensionTemplate() *schema.Resource {
+	return &schema.Resource{
+		Read: dataSourceArmVirtualMachineExtensionTemplateRead,
+
+		Schema: map[string]*schema.Schema{
+			"publisher": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+
+			"type": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+
+			"type_handler_version": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+
+			// interpolated by the provider with `vars`, so references to
+			// them are escaped as `$${name}` in the configuration
+			"settings_template": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+
+			"vars": {
+				Type:     schema.TypeMap,
+				Optional: true,
+				Default:  make(map[string]interface{}),
+			},
+
+			"settings": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+		},
+	}
+}
+
+func dataSourceArmVirtualMachineExtensionTemplateRead(d *schema.ResourceData, meta interface{}) error {
+	settings, err := renderArmVirtualMachineExtensionSettingsTemplate(d.Get("settings_template").(string), d.Get("vars").(map[string]interface{}))
+	if err != nil {
+		return err
+	}
+
+	sha := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%s/%s", d.Get("publisher").(string), d.Get("type").(string), d.Get("type_handler_version").(string), settings)))
+	d.SetId(hex.EncodeToString(sha[:]))
+	d.Set("settings", settings)
+
+	return nil
+}
+
+// renderArmVirtualMachineExtensionSettingsTemplate interpolates the template
+// with the variables (and the interpolation functions, e.g. `jsonencode`), and
+// returns the rendered settings as compact JSON, failing when the result isn't
+// a JSON object.
+func renderArmVirtualMachineExtensionSettingsTemplate(template string, vars map[string]interface{}) (string, error) {
+	root, err := hil.Parse(template)
+	if err != nil {
+		return "", fmt.Errorf("Error parsing `settings_template`: %s", err)
+	}
+
+	varmap := make(map[string]ast.Variable, len(vars))
+	for k, v := range vars {
+		s, ok := v.(string)
+		if !ok {
+			return "", fmt.Errorf("Unexpected type for variable %q: %T", k, v)
+		}
+		varmap[k] = ast.Variable{
+			Value: s,
+			Type:  ast.TypeString,
+		}
+	}
+
+	result, err := hil.Eval(root, &hil.EvalConfig{
+		GlobalScope: &ast.BasicScope{
+			VarMap:  varmap,
+			FuncMap: config.Funcs(),
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error rendering `settings_template`: %s", err)
+	}
+	if result.Type != hil.TypeString {
+		return "", fmt.Errorf("Unexpected type of the rendered `settings_template`: %v", result.Type)
+	}
+
+	settings, err := expandArmVirtualMachineExtensionSettings(result.Value.(string))
+	if err != nil {
+		return "", fmt.Errorf("The rendered `settings_template` isn't a valid JSON object: %s\n\n%s", err, result.Value.(string))
+	}
+
+	return flattenArmVirtualMachineExtensionSettings(settings)
+}
@@ -0,0 +1,50 @@
+package azurerm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderArmVirtualMachineExtensionSettingsTemplate(t *testing.T) {
+	vars := map[string]interface{}{
+		"script":  `echo "hello"`,
+		"timeout": "30",
+	}
+
+	cases := []struct {
+		Template      string
+		Expected      string
+		ExpectedError string
+	}{
+		{
+			Template: `{"commandToExecute": ${jsonencode(script)}, "timeout": ${timeout}}`,
+			Expected: `{"commandToExecute":"echo \"hello\"","timeout":30}`,
+		},
+		{
+			// the variable isn't quoted, so the result isn't JSON
+			Template:      `{"commandToExecute": ${script}}`,
+			ExpectedError: "isn't a valid JSON object",
+		},
+		{
+			Template:      `{"commandToExecute": "${missing}"}`,
+			ExpectedError: "unknown variable",
+		},
+	}
+
+	for _, tc := range cases {
+		actual, err := renderArmVirtualMachineExtensionSettingsTemplate(tc.Template, vars)
+		if tc.ExpectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.ExpectedError) {
+				t.Fatalf("%s: Expected an error containing %q, got %v", tc.Template, tc.ExpectedError, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: Error rendering the template: %s", tc.Template, err)
+		}
+		if actual != tc.Expected {
+			t.Fatalf("%s: Expected %s, got %s", tc.Template, tc.Expected, actual)
+		}
+	}
+}
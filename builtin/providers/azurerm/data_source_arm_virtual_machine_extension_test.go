@@ -0,0 +1,59 @@
+package azurerm
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func TestDataSourceArmVirtualMachineExtensionRead(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if !strings.HasSuffix(r.URL.Path, "/extensions/MDE.Linux") {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"code":"NotFound","message":"The entity was not found."}}`)
+			return
+		}
+		fmt.Fprint(w, `{"id":"/vms/acctvm/extensions/MDE.Linux","name":"MDE.Linux","tags":{"createdBy":"SecurityCenter"},"properties":{
+			"publisher":"Microsoft.Azure.AzureDefenderForServers","type":"MDE.Linux","typeHandlerVersion":"1.0",
+			"autoUpgradeMinorVersion":true,"settings":{"azureResourceId":"/vms/acctvm"},"provisioningState":"Succeeded"}}`)
+	}))
+	defer server.Close()
+
+	d := schema.TestResourceDataRaw(t, dataSourceArmVirtualMachineExtension().Schema, map[string]interface{}{
+		"name":                 "MDE.Linux",
+		"resource_group_name":  "acctestRG",
+		"virtual_machine_name": "acctvm",
+	})
+	if err := dataSourceArmVirtualMachineExtensionRead(d, testArmClientWithBaseURI(server.URL)); err != nil {
+		t.Fatalf("Error reading the Extension: %s", err)
+	}
+
+	for key, expected := range map[string]string{
+		"publisher":                  "Microsoft.Azure.AzureDefenderForServers",
+		"type":                       "MDE.Linux",
+		"type_handler_version":       "1.0",
+		"auto_upgrade_minor_version": "true",
+		"settings":                   `{"azureResourceId":"/vms/acctvm"}`,
+		"provisioning_state":         "Succeeded",
+		"tags.createdBy":             "SecurityCenter",
+	} {
+		if actual := d.State().Attributes[key]; actual != expected {
+			t.Fatalf("Expected %s to be %q, got %q", key, expected, actual)
+		}
+	}
+
+	missing := schema.TestResourceDataRaw(t, dataSourceArmVirtualMachineExtension().Schema, map[string]interface{}{
+		"name":                 "missing",
+		"resource_group_name":  "acctestRG",
+		"virtual_machine_name": "acctvm",
+	})
+	err := dataSourceArmVirtualMachineExtensionRead(missing, testArmClientWithBaseURI(server.URL))
+	if err == nil || !strings.Contains(err.Error(), "was not found") {
+		t.Fatalf("Expected a not found error for a missing Extension, got %v", err)
+	}
+}
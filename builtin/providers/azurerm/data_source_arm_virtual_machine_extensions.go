@@ -0,0 +1,131 @@
+package azurerm
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func dataSourceArmVirtualMachineExtensions() *schema.Resource {
+	return &schema.Resource{
+		Read: dataSourceArmVirtualMachineExtensionsRead,
+
+		Schema: map[string]*schema.Schema{
+			"resource_group_name": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+
+			"virtual_machine_name": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+
+			"extensions": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"name": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+
+						"publisher": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+
+						"type": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+
+						"type_handler_version": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+
+						"provisioning_state": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func dataSourceArmVirtualMachineExtensionsRead(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*ArmClient)
+	resGroup := d.Get("resource_group_name").(string)
+	vmName := d.Get("virtual_machine_name").(string)
+
+	// the vendored SDK has no operation listing the extensions, which are
+	// returned as the resources of the Virtual Machine instead - including
+	// those not managed by Terraform
+	resp, err := client.vmClient.Get(resGroup, vmName, "")
+	if err != nil {
+		if resp.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("Virtual Machine %q was not found in resource group %q", vmName, resGroup)
+		}
+		return fmt.Errorf("Error making Read request on Virtual Machine %q (resource group %q): %s", vmName, resGroup, err)
+	}
+	if resp.ID == nil {
+		return fmt.Errorf("Cannot read the ID of Virtual Machine %q (resource group %q)", vmName, resGroup)
+	}
+
+	d.SetId(*resp.ID)
+
+	if err := d.Set("extensions", flattenArmVirtualMachineExtensionsList(resp.Resources)); err != nil {
+		return fmt.Errorf("Error flattening `extensions`: %+v", err)
+	}
+
+	return nil
+}
+
+// flattenArmVirtualMachineExtensionsList returns the extensions sorted by name.
+func flattenArmVirtualMachineExtensionsList(resources *[]compute.VirtualMachineExtension) []interface{} {
+	extensions := make([]interface{}, 0)
+	if resources == nil {
+		return extensions
+	}
+
+	for _, extension := range *resources {
+		result := map[string]interface{}{
+			"name":                 "",
+			"publisher":            "",
+			"type":                 "",
+			"type_handler_version": "",
+			"provisioning_state":   "",
+		}
+		if extension.Name != nil {
+			result["name"] = *extension.Name
+		}
+		if props := extension.VirtualMachineExtensionProperties; props != nil {
+			if props.Publisher != nil {
+				result["publisher"] = *props.Publisher
+			}
+			if props.Type != nil {
+				result["type"] = *props.Type
+			}
+			if props.TypeHandlerVersion != nil {
+				result["type_handler_version"] = *props.TypeHandlerVersion
+			}
+			if props.ProvisioningState != nil {
+				result["provisioning_state"] = *props.ProvisioningState
+			}
+		}
+		extensions = append(extensions, result)
+	}
+
+	sort.Slice(extensions, func(i, j int) bool {
+		return extensions[i].(map[string]interface{})["name"].(string) < extensions[j].(map[string]interface{})["name"].(string)
+	})
+
+	return extensions
+}
@@ -0,0 +1,61 @@
+package azurerm
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func TestDataSourceArmVirtualMachineExtensionsRead(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if !strings.HasSuffix(r.URL.Path, "/virtualMachines/acctvm") {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"code":"ResourceNotFound","message":"The Resource was not found."}}`)
+			return
+		}
+		fmt.Fprint(w, `{"id":"/vms/acctvm","name":"acctvm","properties":{},"resources":[
+			{"name":"MDE.Linux","properties":{"publisher":"Microsoft.Azure.AzureDefenderForServers","type":"MDE.Linux","typeHandlerVersion":"1.0","provisioningState":"Succeeded"}},
+			{"name":"CustomScript","properties":{"publisher":"Microsoft.Azure.Extensions","type":"CustomScript","typeHandlerVersion":"2.0","provisioningState":"Failed"}},
+			{"name":"Unknown"}]}`)
+	}))
+	defer server.Close()
+
+	d := schema.TestResourceDataRaw(t, dataSourceArmVirtualMachineExtensions().Schema, map[string]interface{}{
+		"resource_group_name":  "acctestRG",
+		"virtual_machine_name": "acctvm",
+	})
+	if err := dataSourceArmVirtualMachineExtensionsRead(d, testArmClientWithBaseURI(server.URL)); err != nil {
+		t.Fatalf("Error reading the Extensions: %s", err)
+	}
+
+	for key, expected := range map[string]string{
+		"extensions.#":                      "3",
+		"extensions.0.name":                 "CustomScript",
+		"extensions.0.publisher":            "Microsoft.Azure.Extensions",
+		"extensions.0.type":                 "CustomScript",
+		"extensions.0.type_handler_version": "2.0",
+		"extensions.0.provisioning_state":   "Failed",
+		"extensions.1.name":                 "MDE.Linux",
+		"extensions.1.provisioning_state":   "Succeeded",
+		"extensions.2.name":                 "Unknown",
+		"extensions.2.publisher":            "",
+	} {
+		if actual := d.State().Attributes[key]; actual != expected {
+			t.Fatalf("Expected %s to be %q, got %q", key, expected, actual)
+		}
+	}
+
+	missing := schema.TestResourceDataRaw(t, dataSourceArmVirtualMachineExtensions().Schema, map[string]interface{}{
+		"resource_group_name":  "acctestRG",
+		"virtual_machine_name": "missing",
+	})
+	err := dataSourceArmVirtualMachineExtensionsRead(missing, testArmClientWithBaseURI(server.URL))
+	if err == nil || !strings.Contains(err.Error(), "was not found") {
+		t.Fatalf("Expected a not found error for a missing Virtual Machine, got %v", err)
+	}
+}
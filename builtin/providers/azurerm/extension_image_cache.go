@@ -0,0 +1,134 @@
+package azurerm
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// extensionImageCache is an optional on-disk cache of the versions published
+// for a Virtual Machine Extension Image, so that repeated plans (e.g. in CI)
+// don't have to query the extension images API on every run. A nil cache, or
+// one without a directory or TTL, is disabled and never stores anything.
+type extensionImageCache struct {
+	dir string
+	ttl time.Duration
+	now func() time.Time
+}
+
+type extensionImageCacheEntry struct {
+	FetchedAt time.Time `json:"fetched_at"`
+	Versions  []string  `json:"versions"`
+}
+
+func newExtensionImageCache(dir string, ttl time.Duration) *extensionImageCache {
+	return &extensionImageCache{
+		dir: dir,
+		ttl: ttl,
+		now: time.Now,
+	}
+}
+
+func (c *extensionImageCache) enabled() bool {
+	return c != nil && c.dir != "" && c.ttl > 0
+}
+
+func (c *extensionImageCache) path(location, publisher, extensionType string) string {
+	key := strings.ToLower(fmt.Sprintf("%s/%s/%s", azureRMNormalizeLocation(location), publisher, extensionType))
+	hash := sha1.Sum([]byte(key))
+	return filepath.Join(c.dir, fmt.Sprintf("extension-image-%s.json", hex.EncodeToString(hash[:])))
+}
+
+// get returns the cached versions for the Extension Image, if present and
+// younger than the TTL. Any problem reading the cache is treated as a miss.
+func (c *extensionImageCache) get(location, publisher, extensionType string) ([]string, bool) {
+	if !c.enabled() {
+		return nil, false
+	}
+
+	path := c.path(location, publisher, extensionType)
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[DEBUG] Error reading Extension Image cache file %q: %s", path, err)
+		}
+		return nil, false
+	}
+
+	var entry extensionImageCacheEntry
+	if err := json.Unmarshal(contents, &entry); err != nil {
+		log.Printf("[DEBUG] Ignoring corrupt Extension Image cache file %q: %s", path, err)
+		return nil, false
+	}
+
+	if c.now().Sub(entry.FetchedAt) > c.ttl {
+		log.Printf("[DEBUG] Extension Image cache entry for %s/%s in %q has expired", publisher, extensionType, location)
+		return nil, false
+	}
+
+	return entry.Versions, true
+}
+
+// put stores the versions for the Extension Image. Failing to write the cache
+// isn't fatal, since it only means the next run queries Azure again.
+func (c *extensionImageCache) put(location, publisher, extensionType string, versions []string) {
+	if !c.enabled() {
+		return
+	}
+
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		log.Printf("[WARN] Error creating Extension Image cache directory %q: %s", c.dir, err)
+		return
+	}
+
+	contents, err := json.Marshal(extensionImageCacheEntry{
+		FetchedAt: c.now(),
+		Versions:  versions,
+	})
+	if err != nil {
+		log.Printf("[WARN] Error encoding Extension Image cache entry: %s", err)
+		return
+	}
+
+	// write to a temporary file first so concurrent readers never see a partial entry
+	path := c.path(location, publisher, extensionType)
+	tmp, err := ioutil.TempFile(c.dir, "extension-image-")
+	if err != nil {
+		log.Printf("[WARN] Error writing Extension Image cache file %q: %s", path, err)
+		return
+	}
+	_, err = tmp.Write(contents)
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("[WARN] Error writing Extension Image cache file %q: %s", path, err)
+	}
+}
+
+// listArmVirtualMachineExtensionImageVersions returns the versions published
+// for the given Extension Image, consulting the provider's cache first.
+func listArmVirtualMachineExtensionImageVersions(client *ArmClient, location, publisher, extensionType string) ([]string, error) {
+	if versions, ok := client.extensionImageCache.get(location, publisher, extensionType); ok {
+		return versions, nil
+	}
+
+	resp, err := client.vmExtensionImageClient.ListVersions(location, publisher, extensionType, "", nil, "")
+	if err != nil {
+		return nil, fmt.Errorf("Error listing versions of Virtual Machine Extension Image %s/%s in %q: %s", publisher, extensionType, location, err)
+	}
+
+	versions := flattenArmVirtualMachineExtensionImageVersions(resp.Value)
+	client.extensionImageCache.put(location, publisher, extensionType, versions)
+
+	return versions, nil
+}
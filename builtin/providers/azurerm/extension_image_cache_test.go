@@ -0,0 +1,96 @@
+package azurerm
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExtensionImageCache_roundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tf-azurerm-extension-images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	cache := newExtensionImageCache(dir, time.Hour)
+	cache.now = func() time.Time { return now }
+
+	if _, ok := cache.get("West US", "Microsoft.Azure.Extensions", "CustomScript"); ok {
+		t.Fatalf("Expected a miss on an empty cache")
+	}
+
+	versions := []string{"2.0.0", "2.0.2"}
+	cache.put("West US", "Microsoft.Azure.Extensions", "CustomScript", versions)
+
+	// the location is normalized, so both spellings share an entry
+	actual, ok := cache.get("westus", "Microsoft.Azure.Extensions", "CustomScript")
+	if !ok {
+		t.Fatalf("Expected a hit after storing the versions")
+	}
+	if !reflect.DeepEqual(actual, versions) {
+		t.Fatalf("Expected %v, got %v", versions, actual)
+	}
+
+	if _, ok := cache.get("westus", "Microsoft.Azure.Extensions", "DockerExtension"); ok {
+		t.Fatalf("Expected a miss for a different Extension Image")
+	}
+
+	now = now.Add(61 * time.Minute)
+	if _, ok := cache.get("westus", "Microsoft.Azure.Extensions", "CustomScript"); ok {
+		t.Fatalf("Expected a miss once the TTL has expired")
+	}
+}
+
+func TestExtensionImageCache_disabled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tf-azurerm-extension-images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		Name  string
+		Cache *extensionImageCache
+	}{
+		{"nil", nil},
+		{"no directory", newExtensionImageCache("", time.Hour)},
+		{"zero TTL", newExtensionImageCache(dir, 0)},
+	}
+
+	for _, tc := range cases {
+		tc.Cache.put("westus", "Microsoft.Azure.Extensions", "CustomScript", []string{"2.0.0"})
+		if _, ok := tc.Cache.get("westus", "Microsoft.Azure.Extensions", "CustomScript"); ok {
+			t.Fatalf("%s: Expected the cache to be disabled", tc.Name)
+		}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("Expected a disabled cache not to write any files, got %d", len(files))
+	}
+}
+
+func TestExtensionImageCache_corrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tf-azurerm-extension-images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache := newExtensionImageCache(dir, time.Hour)
+	path := cache.path("westus", "Microsoft.Azure.Extensions", "CustomScript")
+	if err := ioutil.WriteFile(path, []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := cache.get("westus", "Microsoft.Azure.Extensions", "CustomScript"); ok {
+		t.Fatalf("Expected a corrupt cache file to be treated as a miss")
+	}
+}
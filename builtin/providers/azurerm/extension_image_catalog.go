@@ -0,0 +1,116 @@
+package azurerm
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// extensionImageCatalog validates the publisher, type and version of an
+// Extension against the Virtual Machine Extension Images published in its
+// location. The types of a publisher are listed once per location for the
+// lifetime of the provider, while the versions of a type go through the
+// (optional) on-disk extensionImageCache. A nil catalog is disabled.
+type extensionImageCatalog struct {
+	mu    sync.Mutex
+	types map[string][]string
+}
+
+func newExtensionImageCatalog(enabled bool) *extensionImageCatalog {
+	if !enabled {
+		return nil
+	}
+	return &extensionImageCatalog{
+		types: make(map[string][]string),
+	}
+}
+
+// listTypes returns the extension types of the publisher in the location,
+// which is nil when Azure doesn't know the publisher there.
+func (c *extensionImageCatalog) listTypes(client *ArmClient, location, publisher string) ([]string, error) {
+	key := strings.ToLower(fmt.Sprintf("%s/%s", location, publisher))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if types, ok := c.types[key]; ok {
+		return types, nil
+	}
+
+	resp, err := client.vmExtensionImageClient.ListTypes(location, publisher)
+	if err != nil && resp.StatusCode != http.StatusNotFound {
+		return nil, fmt.Errorf("Error listing the types of Virtual Machine Extension Images published by %q in %q: %s", publisher, location, err)
+	}
+
+	var types []string
+	if err == nil {
+		types = flattenArmVirtualMachineExtensionImageVersions(resp.Value)
+	}
+	c.types[key] = types
+
+	return types, nil
+}
+
+// validate returns an error when the publisher, type or version isn't
+// published in the location. Publishers and types are compared
+// case-insensitively, as Azure does.
+func (c *extensionImageCatalog) validate(client *ArmClient, location, publisher, extensionType, typeHandlerVersion string) error {
+	if c == nil {
+		return nil
+	}
+
+	location = azureRMNormalizeLocation(location)
+	types, err := c.listTypes(client, location, publisher)
+	if err != nil {
+		return err
+	}
+	if len(types) == 0 {
+		return fmt.Errorf("The publisher %q has no Virtual Machine Extension Images in %q - check `publisher` for typos", publisher, location)
+	}
+
+	found := ""
+	for _, t := range types {
+		if strings.EqualFold(t, extensionType) {
+			found = t
+			break
+		}
+	}
+	if found == "" {
+		sort.Strings(types)
+		return fmt.Errorf("The publisher %q has no Virtual Machine Extension Image of type %q in %q - available types are: %s", publisher, extensionType, location, strings.Join(types, ", "))
+	}
+
+	versions, err := listArmVirtualMachineExtensionImageVersions(client, location, publisher, found)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		if isArmVirtualMachineExtensionImageVersionMatch(typeHandlerVersion, v) {
+			return nil
+		}
+	}
+	return fmt.Errorf("No version of Virtual Machine Extension Image %s/%s in %q matches the `type_handler_version` %q - available versions are: %s", publisher, found, location, typeHandlerVersion, strings.Join(versions, ", "))
+}
+
+// isArmVirtualMachineExtensionImageVersionMatch returns whether the published
+// image version (such as `2.0.3`) satisfies the `type_handler_version` (such
+// as `2.0`, `2.*` or `2.0.3`).
+func isArmVirtualMachineExtensionImageVersionMatch(typeHandlerVersion, imageVersion string) bool {
+	wanted := strings.Split(typeHandlerVersion, ".")
+	published := strings.Split(imageVersion, ".")
+	if len(wanted) > len(published) {
+		return false
+	}
+
+	for i, segment := range wanted {
+		if segment == "*" {
+			return true
+		}
+		if segment != published[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package azurerm
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIsArmVirtualMachineExtensionImageVersionMatch(t *testing.T) {
+	cases := []struct {
+		TypeHandlerVersion string
+		ImageVersion       string
+		Expected           bool
+	}{
+		{TypeHandlerVersion: "2.0", ImageVersion: "2.0.3", Expected: true},
+		{TypeHandlerVersion: "2.0", ImageVersion: "2.1.0", Expected: false},
+		{TypeHandlerVersion: "2.*", ImageVersion: "2.1.0", Expected: true},
+		{TypeHandlerVersion: "2.*", ImageVersion: "1.9.0", Expected: false},
+		{TypeHandlerVersion: "2.0.3", ImageVersion: "2.0.3", Expected: true},
+		{TypeHandlerVersion: "2.0.3", ImageVersion: "2.0.4", Expected: false},
+		{TypeHandlerVersion: "2.0.3", ImageVersion: "2.0", Expected: false},
+		{TypeHandlerVersion: "1.2", ImageVersion: "1.20.0", Expected: false},
+	}
+
+	for _, tc := range cases {
+		if actual := isArmVirtualMachineExtensionImageVersionMatch(tc.TypeHandlerVersion, tc.ImageVersion); actual != tc.Expected {
+			t.Fatalf("Expected %q matching %q to be %t, got %t", tc.TypeHandlerVersion, tc.ImageVersion, tc.Expected, actual)
+		}
+	}
+}
+
+func TestExtensionImageCatalog_validate(t *testing.T) {
+	var typeRequests int
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/publishers/Microsoft.Azure.Extensions/artifacttypes/vmextension/types"):
+			typeRequests++
+			fmt.Fprint(w, `[{"name":"CustomScript"},{"name":"DockerExtension"}]`)
+		case strings.HasSuffix(r.URL.Path, "/types/CustomScript/versions"):
+			fmt.Fprint(w, `[{"name":"2.0.2"},{"name":"2.0.3"}]`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"code":"NotFound","message":"Artifact: VMExtensionType was not found."}}`)
+		}
+	}))
+	defer server.Close()
+
+	client := testArmClientWithBaseURI(server.URL)
+	catalog := newExtensionImageCatalog(true)
+
+	cases := []struct {
+		Publisher          string
+		Type               string
+		TypeHandlerVersion string
+		Error              string
+	}{
+		{Publisher: "Microsoft.Azure.Extensions", Type: "CustomScript", TypeHandlerVersion: "2.0"},
+		{Publisher: "microsoft.azure.extensions", Type: "customscript", TypeHandlerVersion: "2.*"},
+		{Publisher: "Microsoft.Azure.Extensions", Type: "CustomScript", TypeHandlerVersion: "1.5", Error: "available versions are: 2.0.2, 2.0.3"},
+		{Publisher: "Microsoft.Azure.Extensions", Type: "CustomScriptForLinux", TypeHandlerVersion: "2.0", Error: "available types are: CustomScript, DockerExtension"},
+		{Publisher: "Microsoft.Azure.Extension", Type: "CustomScript", TypeHandlerVersion: "2.0", Error: "check `publisher` for typos"},
+	}
+
+	for _, tc := range cases {
+		err := catalog.validate(client, "West US", tc.Publisher, tc.Type, tc.TypeHandlerVersion)
+		if tc.Error == "" && err != nil {
+			t.Fatalf("Expected %s/%s %s to be valid, got %s", tc.Publisher, tc.Type, tc.TypeHandlerVersion, err)
+		}
+		if tc.Error != "" && (err == nil || !strings.Contains(err.Error(), tc.Error)) {
+			t.Fatalf("Expected %s/%s %s to fail with %q, got %v", tc.Publisher, tc.Type, tc.TypeHandlerVersion, tc.Error, err)
+		}
+	}
+
+	// the publisher's types were listed once for both casings
+	if typeRequests != 1 {
+		t.Fatalf("Expected the types to be listed once, got %d requests", typeRequests)
+	}
+}
+
+func TestExtensionImageCatalog_disabled(t *testing.T) {
+	var catalog *extensionImageCatalog
+	if err := catalog.validate(nil, "westus", "Microsoft.Azure.Extension", "CustomScript", "2.0"); err != nil {
+		t.Fatalf("Expected a disabled catalog not to validate anything, got %s", err)
+	}
+	if newExtensionImageCatalog(false) != nil {
+		t.Fatal("Expected the catalog to be disabled")
+	}
+}
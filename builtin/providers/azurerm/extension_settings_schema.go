@@ -0,0 +1,205 @@
+package azurerm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// extensionSettingsSchema is the subset of JSON Schema used to describe the
+// settings of an extension type: the type of a value, the properties of an
+// object (and which are required), the items of an array and enumerations.
+type extensionSettingsSchema struct {
+	Type                 string                              `json:"type"`
+	Properties           map[string]*extensionSettingsSchema `json:"properties"`
+	Required             []string                            `json:"required"`
+	AdditionalProperties *bool                               `json:"additionalProperties"`
+	Items                *extensionSettingsSchema            `json:"items"`
+	Enum                 []interface{}                       `json:"enum"`
+}
+
+// builtinExtensionSettingsSchemas are the schemas of the settings (merged with
+// the protected settings) of common extensions, keyed by `publisher/type`
+// (lowercased), as documented by Azure.
+var builtinExtensionSettingsSchemas = map[string]string{
+	"microsoft.azure.extensions/customscript": `{
+		"type": "object",
+		"properties": {
+			"fileUris": {"type": "array", "items": {"type": "string"}},
+			"commandToExecute": {"type": "string"},
+			"script": {"type": "string"},
+			"skipDos2Unix": {"type": "boolean"},
+			"timestamp": {"type": "integer"},
+			"storageAccountName": {"type": "string"},
+			"storageAccountKey": {"type": "string"},
+			"managedIdentity": {"type": "object"}
+		}
+	}`,
+	"microsoft.compute/customscriptextension": `{
+		"type": "object",
+		"properties": {
+			"fileUris": {"type": "array", "items": {"type": "string"}},
+			"commandToExecute": {"type": "string"},
+			"timestamp": {"type": "integer"},
+			"storageAccountName": {"type": "string"},
+			"storageAccountKey": {"type": "string"},
+			"managedIdentity": {"type": "object"}
+		},
+		"required": ["commandToExecute"]
+	}`,
+	"microsoft.ostcextensions/customscriptforlinux": `{
+		"type": "object",
+		"properties": {
+			"fileUris": {"type": "array", "items": {"type": "string"}},
+			"commandToExecute": {"type": "string"},
+			"enableInternalDNSCheck": {"type": "boolean"},
+			"timestamp": {"type": "integer"},
+			"storageAccountName": {"type": "string"},
+			"storageAccountKey": {"type": "string"}
+		},
+		"required": ["commandToExecute"]
+	}`,
+}
+
+// loadArmExtensionSettingsSchemas returns the built-in schemas, overridden by
+// any `<publisher>.<type>.json` files in dir. A file containing `{}` disables
+// the validation of an extension type which has a built-in schema.
+func loadArmExtensionSettingsSchemas(dir string) (map[string]*extensionSettingsSchema, error) {
+	raw := make(map[string]string, len(builtinExtensionSettingsSchemas))
+	for k, v := range builtinExtensionSettingsSchemas {
+		raw[k] = v
+	}
+
+	if dir != "" {
+		files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+		if err != nil {
+			return nil, fmt.Errorf("Error listing the Extension settings schemas in %q: %s", dir, err)
+		}
+		for _, file := range files {
+			name := strings.TrimSuffix(filepath.Base(file), ".json")
+			separator := strings.LastIndex(name, ".")
+			if separator < 1 {
+				return nil, fmt.Errorf("Extension settings schema %q must be named `<publisher>.<type>.json`", file)
+			}
+
+			contents, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("Error reading Extension settings schema %q: %s", file, err)
+			}
+			raw[strings.ToLower(name[:separator]+"/"+name[separator+1:])] = string(contents)
+		}
+	}
+
+	schemas := make(map[string]*extensionSettingsSchema, len(raw))
+	for k, v := range raw {
+		var s extensionSettingsSchema
+		if err := json.Unmarshal([]byte(v), &s); err != nil {
+			return nil, fmt.Errorf("Error parsing the Extension settings schema for %q: %s", k, err)
+		}
+		schemas[k] = &s
+	}
+
+	return schemas, nil
+}
+
+// validateArmVirtualMachineExtensionSettingsSchema validates the settings
+// against the schema of the extension type, returning an error describing
+// every violation. Extension types without a schema aren't validated.
+func validateArmVirtualMachineExtensionSettingsSchema(schemas map[string]*extensionSettingsSchema, publisher, extensionType string, settings map[string]interface{}) error {
+	s, ok := schemas[strings.ToLower(fmt.Sprintf("%s/%s", publisher, extensionType))]
+	if !ok {
+		return nil
+	}
+
+	violations := make([]string, 0)
+	validateArmExtensionSettingsValue(s, "settings", settings, &violations)
+	if len(violations) == 0 {
+		return nil
+	}
+
+	sort.Strings(violations)
+	return fmt.Errorf("The settings of the %s/%s Extension don't match its schema:\n%s", publisher, extensionType, strings.Join(violations, "\n"))
+}
+
+func validateArmExtensionSettingsValue(s *extensionSettingsSchema, path string, value interface{}, violations *[]string) {
+	if s.Type != "" && !isArmExtensionSettingsValueOfType(value, s.Type) {
+		*violations = append(*violations, fmt.Sprintf("%s: must be of type %s", path, s.Type))
+		return
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, allowed := range s.Enum {
+			if fmt.Sprintf("%v", allowed) == fmt.Sprintf("%v", value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			*violations = append(*violations, fmt.Sprintf("%s: must be one of %v", path, s.Enum))
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, key := range s.Required {
+			if _, ok := v[key]; !ok {
+				*violations = append(*violations, fmt.Sprintf("%s.%s: is required", path, key))
+			}
+		}
+		for key, inner := range v {
+			if property, ok := s.Properties[key]; ok {
+				validateArmExtensionSettingsValue(property, path+"."+key, inner, violations)
+			} else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				*violations = append(*violations, fmt.Sprintf("%s.%s: isn't supported", path, key))
+			}
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, inner := range v {
+				validateArmExtensionSettingsValue(s.Items, fmt.Sprintf("%s.%d", path, i), inner, violations)
+			}
+		}
+	}
+}
+
+func isArmExtensionSettingsValueOfType(value interface{}, t string) bool {
+	switch t {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "number":
+		switch v := value.(type) {
+		case json.Number:
+			_, err := v.Float64()
+			return err == nil
+		case float64:
+			return true
+		}
+		return false
+	case "integer":
+		switch v := value.(type) {
+		case json.Number:
+			_, err := v.Int64()
+			return err == nil
+		case float64:
+			return v == float64(int64(v))
+		}
+		return false
+	}
+
+	// unknown types aren't validated
+	return true
+}
@@ -0,0 +1,114 @@
+package azurerm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateArmVirtualMachineExtensionSettingsSchema(t *testing.T) {
+	schemas, err := loadArmExtensionSettingsSchemas("")
+	if err != nil {
+		t.Fatalf("Error loading the built-in schemas: %s", err)
+	}
+
+	cases := []struct {
+		Publisher  string
+		Type       string
+		Settings   string
+		Violations []string
+	}{
+		{
+			Publisher: "Microsoft.OSTCExtensions",
+			Type:      "CustomScriptForLinux",
+			Settings:  `{"commandToExecute":"hostname","fileUris":["https://example.com/a.sh"],"timestamp":123}`,
+		},
+		{
+			Publisher:  "Microsoft.OSTCExtensions",
+			Type:       "CustomScriptForLinux",
+			Settings:   `{"fileUris":"https://example.com/a.sh","timestamp":1.5}`,
+			Violations: []string{"settings.commandToExecute: is required", "settings.fileUris: must be of type array", "settings.timestamp: must be of type integer"},
+		},
+		{
+			Publisher:  "microsoft.azure.extensions",
+			Type:       "customscript",
+			Settings:   `{"fileUris":["https://example.com/a.sh", 1],"skipDos2Unix":"true"}`,
+			Violations: []string{"settings.fileUris.1: must be of type string", "settings.skipDos2Unix: must be of type boolean"},
+		},
+		{
+			// extensions without a schema aren't validated
+			Publisher: "Example",
+			Type:      "Unknown",
+			Settings:  `{"anything":["goes"]}`,
+		},
+	}
+
+	for _, tc := range cases {
+		settings, err := expandArmVirtualMachineExtensionSettings(tc.Settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = validateArmVirtualMachineExtensionSettingsSchema(schemas, tc.Publisher, tc.Type, settings)
+		if len(tc.Violations) == 0 {
+			if err != nil {
+				t.Fatalf("%s/%s: Expected %s to be valid, got: %s", tc.Publisher, tc.Type, tc.Settings, err)
+			}
+			continue
+		}
+
+		if err == nil {
+			t.Fatalf("%s/%s: Expected %s to be invalid", tc.Publisher, tc.Type, tc.Settings)
+		}
+		for _, violation := range tc.Violations {
+			if !strings.Contains(err.Error(), violation) {
+				t.Fatalf("%s/%s: Expected the error to contain %q, got: %s", tc.Publisher, tc.Type, violation, err)
+			}
+		}
+	}
+}
+
+func TestLoadArmExtensionSettingsSchemas_overrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tf-azurerm-extension-schemas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		// disables the built-in schema
+		"Microsoft.OSTCExtensions.CustomScriptForLinux.json": `{}`,
+		"Example.Monitoring.json":                            `{"type":"object","properties":{"level":{"enum":["info","debug"]}},"additionalProperties":false}`,
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	schemas, err := loadArmExtensionSettingsSchemas(dir)
+	if err != nil {
+		t.Fatalf("Error loading the schemas: %s", err)
+	}
+
+	if err := validateArmVirtualMachineExtensionSettingsSchema(schemas, "Microsoft.OSTCExtensions", "CustomScriptForLinux", map[string]interface{}{}); err != nil {
+		t.Fatalf("Expected the overridden schema to accept any settings, got: %s", err)
+	}
+	if err := validateArmVirtualMachineExtensionSettingsSchema(schemas, "Microsoft.Compute", "CustomScriptExtension", map[string]interface{}{}); err == nil {
+		t.Fatalf("Expected the built-in schemas which aren't overridden to be kept")
+	}
+
+	err = validateArmVirtualMachineExtensionSettingsSchema(schemas, "Example", "Monitoring", map[string]interface{}{"level": "trace", "other": true})
+	if err == nil || !strings.Contains(err.Error(), "settings.level: must be one of") || !strings.Contains(err.Error(), "settings.other: isn't supported") {
+		t.Fatalf("Expected the added schema to be used, got: %v", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "Invalid.json"), []byte(`{}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadArmExtensionSettingsSchemas(dir); err == nil {
+		t.Fatalf("Expected an error for a schema without a publisher")
+	}
+}
@@ -8,3 +8,20 @@ func TestAzureRMNormalizeLocation(t *testing.T) {
 		t.Fatalf("expected location to equal westus, actual %s", s)
 	}
 }
+
+func TestAzureRMSuppressLocationDiff(t *testing.T) {
+	cases := []struct {
+		Old, New string
+		Suppress bool
+	}{
+		{Old: "westus", New: "West US", Suppress: true},
+		{Old: "westus", New: "WESTUS", Suppress: true},
+		{Old: "westus", New: "West US 2", Suppress: false},
+	}
+
+	for _, tc := range cases {
+		if actual := azureRMSuppressLocationDiff("location", tc.Old, tc.New, nil); actual != tc.Suppress {
+			t.Fatalf("Expected suppressing %q to %q to be %t, got %t", tc.Old, tc.New, tc.Suppress, actual)
+		}
+	}
+}
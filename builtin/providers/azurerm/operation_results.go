@@ -0,0 +1,132 @@
+package azurerm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// operationResults records the outcome of every Virtual Machine Extension
+// operation of the run in the provider's `results_output_file`, for CI
+// systems to parse.
+type operationResults struct {
+	path string
+
+	sync.Mutex
+	results []operationResult
+}
+
+type operationResult struct {
+	ResourceID      string  `json:"resource_id"`
+	Action          string  `json:"action"`
+	Outcome         string  `json:"outcome"`
+	StartedAt       string  `json:"started_at"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// newOperationResults returns nil without a `results_output_file`, which
+// record does nothing for.
+func newOperationResults(path string) *operationResults {
+	if path == "" {
+		return nil
+	}
+
+	return &operationResults{
+		path:    path,
+		results: make([]operationResult, 0),
+	}
+}
+
+// record adds the outcome of an operation. Like the API metrics, the file is
+// rewritten after each operation, so that it's complete even when the run
+// fails part way through.
+func (o *operationResults) record(resourceID, action, outcome string, start time.Time, err error) {
+	if o == nil {
+		return
+	}
+
+	result := operationResult{
+		ResourceID:      resourceID,
+		Action:          action,
+		Outcome:         outcome,
+		StartedAt:       start.UTC().Format(time.RFC3339),
+		DurationSeconds: time.Since(start).Seconds(),
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	o.results = append(o.results, result)
+
+	if err := o.write(); err != nil {
+		log.Printf("[WARN] Error writing the AzureRM operation results to %q: %s", o.path, err)
+	}
+}
+
+// write replaces the file in one go, so that it's never read half-written.
+func (o *operationResults) write() error {
+	contents, err := json.MarshalIndent(o.results, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(o.path), filepath.Base(o.path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), o.path)
+}
+
+// withArmVirtualMachineExtensionOperationResult records the outcome of f, one
+// of the Create, Update or Delete functions of azurerm_virtual_machine_extension,
+// in the provider's `results_output_file`.
+func withArmVirtualMachineExtensionOperationResult(action string, f func(*schema.ResourceData, interface{}) error) func(*schema.ResourceData, interface{}) error {
+	return func(d *schema.ResourceData, meta interface{}) error {
+		start := time.Now()
+		err := f(d, meta)
+
+		client := meta.(*ArmClient)
+		if client.operationResults == nil {
+			return err
+		}
+
+		outcome := "succeeded"
+		if err != nil {
+			outcome = "failed"
+		} else if skipped, _ := d.Get("skipped").(bool); skipped && action == "create" {
+			outcome = "skipped"
+		}
+
+		// an Extension which failed to be created has no ID yet
+		resourceID := d.Id()
+		if resourceID == "" {
+			resGroup, vmName, _ := armVirtualMachineExtensionVirtualMachine(d)
+			resourceID = fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachines/%s/extensions/%s",
+				client.subscriptionId, resGroup, vmName, d.Get("name").(string))
+		}
+
+		client.operationResults.record(resourceID, action, outcome, start, err)
+		return err
+	}
+}
@@ -0,0 +1,80 @@
+package azurerm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func TestWithArmVirtualMachineExtensionOperationResult(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tf-azurerm-results")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "results.json")
+
+	client := &ArmClient{
+		subscriptionId:   "00000000-0000-0000-0000-000000000000",
+		operationResults: newOperationResults(path),
+	}
+
+	created := withArmVirtualMachineExtensionOperationResult("create", func(d *schema.ResourceData, meta interface{}) error {
+		d.SetId("/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/vm1/extensions/hostname")
+		return nil
+	})
+	failed := withArmVirtualMachineExtensionOperationResult("create", func(d *schema.ResourceData, meta interface{}) error {
+		return fmt.Errorf("VMExtensionProvisioningError")
+	})
+
+	for _, tc := range []struct {
+		VM string
+		F  func(*schema.ResourceData, interface{}) error
+	}{{"vm1", created}, {"vm2", failed}} {
+		d := schema.TestResourceDataRaw(t, resourceArmVirtualMachineExtensions().Schema, map[string]interface{}{
+			"name":                 "hostname",
+			"resource_group_name":  "acctestRG",
+			"virtual_machine_name": tc.VM,
+		})
+		tc.F(d, client)
+	}
+
+	// the file is complete even though the last operation failed
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading the results: %s", err)
+	}
+	var results []operationResult
+	if err := json.Unmarshal(contents, &results); err != nil {
+		t.Fatalf("Error parsing the results: %s\n\n%s", err, contents)
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %+v", results)
+	}
+	if r := results[0]; r.Action != "create" || r.Outcome != "succeeded" || r.Error != "" || r.StartedAt == "" ||
+		r.ResourceID != "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/vm1/extensions/hostname" {
+		t.Fatalf("Unexpected result for the successful operation: %+v", r)
+	}
+	if r := results[1]; r.Outcome != "failed" || r.Error != "VMExtensionProvisioningError" ||
+		r.ResourceID != "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/vm2/extensions/hostname" {
+		t.Fatalf("Unexpected result for the failed operation: %+v", r)
+	}
+}
+
+func TestWithArmVirtualMachineExtensionOperationResult_disabled(t *testing.T) {
+	expected := fmt.Errorf("failed")
+	f := withArmVirtualMachineExtensionOperationResult("delete", func(d *schema.ResourceData, meta interface{}) error {
+		return expected
+	})
+
+	d := schema.TestResourceDataRaw(t, resourceArmVirtualMachineExtensions().Schema, map[string]interface{}{})
+	if err := f(d, &ArmClient{}); err != expected {
+		t.Fatalf("Expected the error to be passed through, got %v", err)
+	}
+}
@@ -6,15 +6,18 @@ import (
 	"encoding/hex"
 	"fmt"
 	"log"
+	"math"
 	"reflect"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/arm/resources/resources"
 	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/terraform/helper/mutexkv"
 	"github.com/hashicorp/terraform/helper/resource"
 	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
 	"github.com/hashicorp/terraform/terraform"
 	riviera "github.com/jen20/riviera/azure"
 )
@@ -59,10 +62,134 @@ func Provider() terraform.ResourceProvider {
 				Optional:    true,
 				DefaultFunc: schema.EnvDefaultFunc("ARM_SKIP_PROVIDER_REGISTRATION", false),
 			},
+
+			"pretty_print_settings": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"fail_fast_on_extension_error": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"max_concurrent_extension_operations": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      0,
+				ValidateFunc: validation.IntBetween(0, math.MaxInt32),
+			},
+
+			"extension_settings_size_limit": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      defaultExtensionSettingsSizeLimit,
+				ValidateFunc: validation.IntBetween(0, math.MaxInt32),
+			},
+
+			"use_fallback_extension_poller": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"non_fatal_error_codes": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+
+			"emit_api_metrics": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"api_metrics_file": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+
+			"results_output_file": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+
+			"extension_settings_schema_dir": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+
+			"settings_validation_webhook_url": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+
+			"settings_validation_webhook_timeout": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "10s",
+				ValidateFunc: validateDuration,
+			},
+
+			"settings_validation_webhook_failure_mode": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "block",
+				ValidateFunc: validation.StringInSlice([]string{"block", "warn"}, false),
+			},
+
+			"auto_tag_extension_metadata": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"require_import_for_existing_extensions": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"validate_extension_images": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"default_extension_publisher": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+
+			"default_extension_type": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+
+			"extension_image_cache_dir": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("ARM_EXTENSION_IMAGE_CACHE_DIR", ""),
+			},
+
+			"extension_image_cache_ttl": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				DefaultFunc:  schema.EnvDefaultFunc("ARM_EXTENSION_IMAGE_CACHE_TTL", "1h"),
+				ValidateFunc: validateDuration,
+			},
 		},
 
 		DataSourcesMap: map[string]*schema.Resource{
-			"azurerm_client_config": dataSourceArmClientConfig(),
+			"azurerm_client_config":                            dataSourceArmClientConfig(),
+			"azurerm_provider_config":                          dataSourceArmProviderConfig(),
+			"azurerm_virtual_machine_extension":                dataSourceArmVirtualMachineExtension(),
+			"azurerm_virtual_machine_extension_rollout_status": dataSourceArmVirtualMachineExtensionRolloutStatus(),
+			"azurerm_virtual_machine_extension_template":       dataSourceArmVirtualMachineExtensionTemplate(),
+			"azurerm_virtual_machine_extensions":               dataSourceArmVirtualMachineExtensions(),
 		},
 
 		ResourcesMap: map[string]*schema.Resource{
@@ -113,6 +240,15 @@ func Provider() terraform.ResourceProvider {
 			"azurerm_virtual_network":           resourceArmVirtualNetwork(),
 			"azurerm_virtual_network_peering":   resourceArmVirtualNetworkPeering(),
 
+			"azurerm_virtual_machine_extension_batch":              resourceArmVirtualMachineExtensionBatch(),
+			"azurerm_virtual_machine_extension_conditional":        resourceArmVirtualMachineExtensionConditional(),
+			"azurerm_virtual_machine_extension_fleet":              resourceArmVirtualMachineExtensionFleet(),
+			"azurerm_virtual_machine_extension_health_probe":       resourceArmVirtualMachineExtensionHealthProbe(),
+			"azurerm_virtual_machine_extension_image_version_lock": resourceArmVirtualMachineExtensionImageVersionLock(),
+			"azurerm_virtual_machine_extension_set":                resourceArmVirtualMachineExtensionSet(),
+			"azurerm_virtual_machine_extensions_group":             resourceArmVirtualMachineExtensionsGroup(),
+			"azurerm_virtual_machine_scale_set_extension":          resourceArmVirtualMachineScaleSetExtension(),
+
 			// These resources use the Riviera SDK
 			"azurerm_dns_a_record":      resourceArmDnsARecord(),
 			"azurerm_dns_aaaa_record":   resourceArmDnsAAAARecord(),
@@ -147,6 +283,35 @@ type Config struct {
 	Environment              string
 	SkipProviderRegistration bool
 
+	PrettyPrintSettings      bool
+	FailFastOnExtensionError bool
+	ExtensionImageCacheDir   string
+	ExtensionImageCacheTTL   time.Duration
+	AutoTagExtensionMetadata bool
+
+	RequireImportForExistingExtensions bool
+	ValidateExtensionImages            bool
+
+	UseFallbackExtensionPoller bool
+	NonFatalErrorCodes         []string
+
+	EmitApiMetrics bool
+	ApiMetricsFile string
+
+	ResultsOutputFile string
+
+	MaxConcurrentExtensionOperations int
+	ExtensionSettingsSizeLimit       int
+
+	ExtensionSettingsSchemaDir string
+
+	SettingsValidationWebhookURL         string
+	SettingsValidationWebhookTimeout     time.Duration
+	SettingsValidationWebhookFailureMode string
+
+	DefaultExtensionPublisher string
+	DefaultExtensionType      string
+
 	validateCredentialsOnce sync.Once
 }
 
@@ -175,14 +340,44 @@ func (c *Config) validate() error {
 func providerConfigure(p *schema.Provider) schema.ConfigureFunc {
 	return func(d *schema.ResourceData) (interface{}, error) {
 		config := &Config{
-			SubscriptionID:           d.Get("subscription_id").(string),
-			ClientID:                 d.Get("client_id").(string),
-			ClientSecret:             d.Get("client_secret").(string),
-			TenantID:                 d.Get("tenant_id").(string),
-			Environment:              d.Get("environment").(string),
-			SkipProviderRegistration: d.Get("skip_provider_registration").(bool),
+			SubscriptionID:             d.Get("subscription_id").(string),
+			ClientID:                   d.Get("client_id").(string),
+			ClientSecret:               d.Get("client_secret").(string),
+			TenantID:                   d.Get("tenant_id").(string),
+			Environment:                d.Get("environment").(string),
+			SkipProviderRegistration:   d.Get("skip_provider_registration").(bool),
+			PrettyPrintSettings:        d.Get("pretty_print_settings").(bool),
+			FailFastOnExtensionError:   d.Get("fail_fast_on_extension_error").(bool),
+			ExtensionImageCacheDir:     d.Get("extension_image_cache_dir").(string),
+			AutoTagExtensionMetadata:   d.Get("auto_tag_extension_metadata").(bool),
+			UseFallbackExtensionPoller: d.Get("use_fallback_extension_poller").(bool),
+			EmitApiMetrics:             d.Get("emit_api_metrics").(bool),
+			ApiMetricsFile:             d.Get("api_metrics_file").(string),
+			ResultsOutputFile:          d.Get("results_output_file").(string),
+
+			MaxConcurrentExtensionOperations: d.Get("max_concurrent_extension_operations").(int),
+			ExtensionSettingsSizeLimit:       d.Get("extension_settings_size_limit").(int),
+
+			RequireImportForExistingExtensions: d.Get("require_import_for_existing_extensions").(bool),
+			ValidateExtensionImages:            d.Get("validate_extension_images").(bool),
+
+			ExtensionSettingsSchemaDir: d.Get("extension_settings_schema_dir").(string),
+
+			SettingsValidationWebhookURL:         d.Get("settings_validation_webhook_url").(string),
+			SettingsValidationWebhookFailureMode: d.Get("settings_validation_webhook_failure_mode").(string),
+
+			DefaultExtensionPublisher: d.Get("default_extension_publisher").(string),
+			DefaultExtensionType:      d.Get("default_extension_type").(string),
 		}
 
+		for _, code := range d.Get("non_fatal_error_codes").([]interface{}) {
+			config.NonFatalErrorCodes = append(config.NonFatalErrorCodes, code.(string))
+		}
+
+		// validated by validateDuration
+		config.ExtensionImageCacheTTL, _ = time.ParseDuration(d.Get("extension_image_cache_ttl").(string))
+		config.SettingsValidationWebhookTimeout, _ = time.ParseDuration(d.Get("settings_validation_webhook_timeout").(string))
+
 		if err := config.validate(); err != nil {
 			return nil, err
 		}
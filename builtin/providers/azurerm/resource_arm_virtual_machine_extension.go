@@ -1,71 +1,446 @@
 package azurerm
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
-	"reflect"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/hashicorp/go-version"
 	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
 )
 
 func resourceArmVirtualMachineExtensions() *schema.Resource {
 	return &schema.Resource{
-		Create: resourceArmVirtualMachineExtensionsCreate,
+		Create: withArmVirtualMachineExtensionOperationResult("create", resourceArmVirtualMachineExtensionsCreate),
 		Read:   resourceArmVirtualMachineExtensionsRead,
-		Update: resourceArmVirtualMachineExtensionsCreate,
-		Delete: resourceArmVirtualMachineExtensionsDelete,
+		Update: withArmVirtualMachineExtensionOperationResult("update", resourceArmVirtualMachineExtensionsUpdate),
+		Delete: withArmVirtualMachineExtensionOperationResult("delete", resourceArmVirtualMachineExtensionsDelete),
 		Importer: &schema.ResourceImporter{
-			State: schema.ImportStatePassthrough,
+			State: resourceArmVirtualMachineExtensionsImportState,
+		},
+
+		// long running Custom Script extensions can take far longer than
+		// Azure's own operations
+		Timeouts: &schema.ResourceTimeout{
+			Create: schema.DefaultTimeout(60 * time.Minute),
+			Update: schema.DefaultTimeout(60 * time.Minute),
+			Read:   schema.DefaultTimeout(5 * time.Minute),
+			Delete: schema.DefaultTimeout(30 * time.Minute),
 		},
 
 		Schema: map[string]*schema.Schema{
+			// Azure looks up extensions by name case-insensitively, so a
+			// change of its case alone refers to the same Extension
 			"name": &schema.Schema{
-				Type:     schema.TypeString,
-				Required: true,
-				ForceNew: true,
+				Type:             schema.TypeString,
+				Required:         true,
+				ForceNew:         true,
+				ValidateFunc:     validateArmVirtualMachineExtensionName,
+				DiffSuppressFunc: ignoreCaseDiffSuppressFunc,
 			},
 
 			"location": locationSchema(),
 
+			// the Virtual Machine is either given by its ID or by its name
+			// and resource group, which are all read back regardless
 			"resource_group_name": &schema.Schema{
-				Type:     schema.TypeString,
-				Required: true,
-				ForceNew: true,
+				Type:          schema.TypeString,
+				Optional:      true,
+				Computed:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"virtual_machine_id"},
 			},
 
 			"virtual_machine_name": &schema.Schema{
-				Type:     schema.TypeString,
-				Required: true,
-				ForceNew: true,
+				Type:          schema.TypeString,
+				Optional:      true,
+				Computed:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"virtual_machine_id"},
+			},
+
+			"virtual_machine_id": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				Computed:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"virtual_machine_name", "resource_group_name"},
+				ValidateFunc:  validateArmVirtualMachineID,
 			},
 
+			// both default to the provider's `default_extension_publisher` and
+			// `default_extension_type`, which are only known at apply time.
+			// Azure can't switch the handler of an existing Extension.
 			"publisher": &schema.Schema{
-				Type:     schema.TypeString,
-				Required: true,
+				Type:             schema.TypeString,
+				Optional:         true,
+				Computed:         true,
+				ForceNew:         true,
+				DiffSuppressFunc: ignoreCaseDiffSuppressFunc,
 			},
 
 			"type": &schema.Schema{
-				Type:     schema.TypeString,
-				Required: true,
+				Type:             schema.TypeString,
+				Optional:         true,
+				Computed:         true,
+				ForceNew:         true,
+				DiffSuppressFunc: ignoreCaseDiffSuppressFunc,
 			},
 
 			"type_handler_version": &schema.Schema{
+				Type:         schema.TypeString,
+				Required:     true,
+				ValidateFunc: validateArmVirtualMachineExtensionTypeHandlerVersion,
+			},
+
+			// the Compute API version the Extension is managed with, for
+			// extension types only supported by a later one
+			"api_version": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validation.StringInSlice(armVirtualMachineExtensionAPIVersions, false),
+			},
+
+			// changing this re-runs the Extension handler, even when nothing
+			// else changed
+			"force_update_tag": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+
+			// the tags of the Virtual Machine are merged in when the Extension
+			// is created or updated, and recorded in `inherited_tags`
+			"inherit_tags_from_vm": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"inherited_tags": &schema.Schema{
+				Type:     schema.TypeMap,
+				Computed: true,
+			},
+
+			// the delete is sent, but not waited for
+			"skip_delete_wait": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"create_delay": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validateDurationAtMost(30 * time.Minute),
+			},
+
+			"retry_after_guest_agent_ready": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			// checks that the VM has a system-assigned identity before the
+			// Extension is sent, for extensions fetching secrets from Key Vault
+			"requires_managed_identity": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"skip_if_vm_not_running": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"skipped": &schema.Schema{
+				Type:     schema.TypeBool,
+				Computed: true,
+			},
+
+			"skip_reason": &schema.Schema{
 				Type:     schema.TypeString,
-				Required: true,
+				Computed: true,
+			},
+
+			"skip_settings_schema_validation": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"forbid_version_downgrade": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"rollback_settings_on_update_failure": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"replace_on_settings_moved_to_protected": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			// the lowest tested version, which Azure auto-upgrading (or rolling
+			// back) the Extension mustn't leave it below
+			"minimum_version_floor": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validateVersion,
 			},
 
+			// when omitted, the value Azure has is kept rather than reset to
+			// false, e.g. for an Extension created with it enabled elsewhere
 			"auto_upgrade_minor_version": {
 				Type:     schema.TypeBool,
 				Optional: true,
+				Computed: true,
 			},
 
 			"settings": &schema.Schema{
 				Type:             schema.TypeString,
 				Optional:         true,
-				ValidateFunc:     validateJsonString,
+				ValidateFunc:     validateArmVirtualMachineExtensionPlaintextSettings,
 				DiffSuppressFunc: suppressDiffVirtualMachineExtensionSettings,
+				ConflictsWith:    []string{"settings_map", "patch_settings", "custom_script_settings", "settings_file_path"},
+			},
+
+			// the string values of the map are assembled into the settings,
+			// numbers and booleans being sent as such
+			"settings_map": &schema.Schema{
+				Type:          schema.TypeMap,
+				Optional:      true,
+				Elem:          &schema.Schema{Type: schema.TypeString},
+				ConflictsWith: []string{"settings", "base_settings", "ordered_settings", "patch_settings", "custom_script_settings", "settings_file_path"},
+			},
+
+			// sends the keys of `settings` in the order configured
+			"ordered_settings": &schema.Schema{
+				Type:          schema.TypeBool,
+				Optional:      true,
+				Default:       false,
+				ConflictsWith: []string{"settings_map", "base_settings", "patch_settings", "custom_script_settings", "settings_file_path", "settings_env_substitution", "vm_attribute_references", "merge_settings"},
+			},
+
+			// deep-merges the settings over those the Extension has in Azure,
+			// keeping the keys added outside of Terraform
+			"merge_settings": &schema.Schema{
+				Type:          schema.TypeBool,
+				Optional:      true,
+				Default:       false,
+				ConflictsWith: []string{"ordered_settings"},
+			},
+
+			// deep-merged with `settings`, which take precedence
+			"base_settings": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ValidateFunc:  validateArmVirtualMachineExtensionPlaintextSettings,
+				ConflictsWith: []string{"settings_map", "patch_settings", "custom_script_settings", "settings_file_path"},
+			},
+
+			// only a hash of the file's contents is stored in the state, so
+			// that changing the file is a diff
+			"settings_file_path": &schema.Schema{
+				Type:          schema.TypeString,
+				Optional:      true,
+				ValidateFunc:  validateArmVirtualMachineExtensionSettingsFile,
+				StateFunc:     armVirtualMachineExtensionSettingsFileStateFunc,
+				ConflictsWith: []string{"settings", "settings_map", "patch_settings", "custom_script_settings"},
+			},
+
+			// a typed alternative to `settings` for the VM patching extension
+			"patch_settings": &schema.Schema{
+				Type:          schema.TypeList,
+				Optional:      true,
+				MaxItems:      1,
+				ConflictsWith: []string{"settings", "settings_map", "custom_script_settings", "settings_file_path"},
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"patch_mode": {
+							Type:     schema.TypeString,
+							Optional: true,
+							ValidateFunc: validation.StringInSlice([]string{
+								"AutomaticByOS",
+								"AutomaticByPlatform",
+								"ImageDefault",
+								"Manual",
+							}, false),
+						},
+
+						"assessment_mode": {
+							Type:     schema.TypeString,
+							Optional: true,
+							ValidateFunc: validation.StringInSlice([]string{
+								"AutomaticByPlatform",
+								"ImageDefault",
+							}, false),
+						},
+
+						"reboot_setting": {
+							Type:     schema.TypeString,
+							Optional: true,
+							ValidateFunc: validation.StringInSlice([]string{
+								"Always",
+								"IfRequired",
+								"Never",
+							}, false),
+						},
+					},
+				},
+			},
+
+			// a typed alternative to `settings` for the Custom Script extensions
+			"custom_script_settings": &schema.Schema{
+				Type:          schema.TypeList,
+				Optional:      true,
+				MaxItems:      1,
+				ConflictsWith: []string{"settings", "settings_map", "patch_settings", "settings_file_path"},
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"command_to_execute": {
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+
+						"file_uris": {
+							Type:     schema.TypeList,
+							Optional: true,
+							Elem:     &schema.Schema{Type: schema.TypeString},
+						},
+
+						"storage_account_name": {
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+					},
+				},
+			},
+
+			"settings_env_substitution": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			// substituted for the `${vm:NAME}` tokens of the settings
+			"vm_attribute_references": &schema.Schema{
+				Type:          schema.TypeList,
+				Optional:      true,
+				ConflictsWith: []string{"ordered_settings"},
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"name": {
+							Type:         schema.TypeString,
+							Required:     true,
+							ValidateFunc: validateArmVirtualMachineAttributeReferenceName,
+						},
+
+						"attribute": {
+							Type:         schema.TypeString,
+							Required:     true,
+							ValidateFunc: validation.StringInSlice(armVirtualMachineReferenceableAttributes, false),
+						},
+					},
+				},
+			},
+
+			// the values of `vm_attribute_references` resolved by the last apply
+			"vm_attribute_values": &schema.Schema{
+				Type:     schema.TypeMap,
+				Computed: true,
+			},
+
+			"forbid_secrets_in_settings": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"forbid_secret_patterns": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type:         schema.TypeString,
+					ValidateFunc: validateRegexp,
+				},
+			},
+
+			// keys the extension treats case-insensitively, at any depth
+			"case_insensitive_settings_keys": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+
+			// keys the extension handler adds to the settings, which are ignored
+			// when comparing unless they're configured
+			"settings_ignore_keys": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+
+			// collapses runs of whitespace within the string values when comparing
+			"normalize_string_whitespace": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			// arrays (at any depth) whose order is insignificant to the extension
+			"unordered_settings_array_keys": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"key": {
+							Type:     schema.TypeString,
+							Required: true,
+						},
+
+						"sort_by": {
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+					},
+				},
+			},
+
+			"mutually_exclusive_settings_keys": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"keys": {
+							Type:     schema.TypeList,
+							Required: true,
+							MinItems: 2,
+							Elem:     &schema.Schema{Type: schema.TypeString},
+						},
+					},
+				},
 			},
 
 			// due to the sensitive nature, these are not returned by the API
@@ -73,26 +448,177 @@ func resourceArmVirtualMachineExtensions() *schema.Resource {
 				Type:             schema.TypeString,
 				Optional:         true,
 				Sensitive:        true,
-				ValidateFunc:     validateJsonString,
+				ValidateFunc:     validateArmVirtualMachineExtensionSettingsObject,
 				DiffSuppressFunc: suppressDiffVirtualMachineExtensionSettings,
 			},
 
+			// a hash of the settings as returned by Azure after the last
+			// create/update, which later refreshes are compared against
+			"applied_settings_hash": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			"settings_drifted": &schema.Schema{
+				Type:     schema.TypeBool,
+				Computed: true,
+			},
+
+			// the top-level keys of the settings returned, without the values
+			"applied_settings_keys": &schema.Schema{
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+
+			// whether the last create/update sent protected settings to Azure
+			"protected_settings_sent": &schema.Schema{
+				Type:     schema.TypeBool,
+				Computed: true,
+			},
+
+			// set by an import, since the protected settings can't be read
+			// back, until the Extension is next sent to Azure
+			"protected_settings_imported": &schema.Schema{
+				Type:     schema.TypeBool,
+				Computed: true,
+			},
+
+			// the API doesn't return a hash of the applied protected settings,
+			// so this is computed from the value which was last sent. It's
+			// keyed with a random salt, so that guessed values can't be
+			// confirmed against the state
+			"protected_settings_hash": &schema.Schema{
+				Type:      schema.TypeString,
+				Computed:  true,
+				Sensitive: true,
+			},
+
+			"protected_settings_hash_salt": &schema.Schema{
+				Type:      schema.TypeString,
+				Computed:  true,
+				Sensitive: true,
+			},
+
+			// populated when creating or updating the Extension fails
+			"last_error_code": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			"last_error_message": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			"resource_json": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			"target_os_type": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			// only set when Azure returns an ETag for the Extension
+			"etag": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			"provisioning_state": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			// the statuses of the instance view, next to provisioning_state
+			"statuses": armInstanceViewStatusesSchema(),
+
+			"instance_view": &schema.Schema{
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"statuses":    armInstanceViewStatusesSchema(),
+						"substatuses": armInstanceViewStatusesSchema(),
+					},
+				},
+			},
+
+			// the stdout and stderr of the Custom Script extensions, from the
+			// substatuses of the instance view
+			"output": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			"error_output": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			// derived from the levels of all statuses of the instance view
+			"has_warnings": &schema.Schema{
+				Type:     schema.TypeBool,
+				Computed: true,
+			},
+
+			"has_errors": &schema.Schema{
+				Type:     schema.TypeBool,
+				Computed: true,
+			},
+
 			"tags": tagsSchema(),
 		},
 	}
 }
 
 func resourceArmVirtualMachineExtensionsCreate(d *schema.ResourceData, meta interface{}) error {
+	meta = armClientWithVirtualMachineExtensionAPIVersion(d, meta)
 	client := meta.(*ArmClient).vmExtensionClient
 
 	name := d.Get("name").(string)
 	location := d.Get("location").(string)
-	vmName := d.Get("virtual_machine_name").(string)
-	resGroup := d.Get("resource_group_name").(string)
-	publisher := d.Get("publisher").(string)
-	extensionType := d.Get("type").(string)
+	resGroup, vmName, err := armVirtualMachineExtensionVirtualMachine(d)
+	if err != nil {
+		return err
+	}
+	setArmVirtualMachineExtensionVirtualMachine(d, meta.(*ArmClient).subscriptionId, resGroup, vmName)
+	publisher, extensionType, err := armVirtualMachineExtensionPublisherAndType(d, meta.(*ArmClient))
+	if err != nil {
+		return err
+	}
 	typeHandlerVersion := d.Get("type_handler_version").(string)
 	autoUpgradeMinor := d.Get("auto_upgrade_minor_version").(bool)
+
+	if floor := d.Get("minimum_version_floor").(string); floor != "" && isArmVirtualMachineExtensionVersionBelowFloor(typeHandlerVersion, floor) {
+		return fmt.Errorf("`type_handler_version` %q cannot be lower than the `minimum_version_floor` %q", typeHandlerVersion, floor)
+	}
+	// helper/schema can't check one attribute against another during the
+	// plan, so this is checked before anything is sent to Azure instead
+	if autoUpgradeMinor && isArmVirtualMachineExtensionVersionBuildPinned(typeHandlerVersion) {
+		parts := strings.Split(typeHandlerVersion, ".")
+		return fmt.Errorf("`auto_upgrade_minor_version` cannot be enabled with the `type_handler_version` %q, which pins a build - use a `major.minor` version (such as %q) to have minor versions upgraded, or disable `auto_upgrade_minor_version` to stay on this build", typeHandlerVersion, parts[0]+"."+parts[1])
+	}
+
+	// like the checks above, this can't be done during the plan, where the
+	// publisher and type may not be known yet
+	if err := meta.(*ArmClient).extensionImageCatalog.validate(meta.(*ArmClient), location, publisher, extensionType, typeHandlerVersion); err != nil {
+		return err
+	}
+
+	// a CreateOrUpdate would otherwise silently take over (and overwrite) an
+	// Extension of the same name, such as one managed by another module
+	if meta.(*ArmClient).requireImportForExistingExtensions && d.IsNewResource() {
+		existing, err := client.Get(resGroup, vmName, name, "")
+		if err == nil && existing.ID != nil {
+			return armVirtualMachineExtensionRequiresImportError(*existing.ID, name, vmName)
+		}
+		if err != nil && existing.StatusCode != http.StatusNotFound {
+			return fmt.Errorf("Error checking for an existing Virtual Machine Extension %q on Virtual Machine %q: %s", name, vmName, err)
+		}
+	}
 	tags := d.Get("tags").(map[string]interface{})
 
 	extension := compute.VirtualMachineExtension{
@@ -105,86 +631,573 @@ func resourceArmVirtualMachineExtensionsCreate(d *schema.ResourceData, meta inte
 		},
 		Tags: expandTags(tags),
 	}
+	if forceUpdateTag := d.Get("force_update_tag").(string); forceUpdateTag != "" {
+		extension.VirtualMachineExtensionProperties.ForceUpdateTag = &forceUpdateTag
+	}
+	if meta.(*ArmClient).autoTagExtensions {
+		expandArmVirtualMachineExtensionMetadataTags(extension.Tags, publisher, extensionType, typeHandlerVersion)
+	}
+	inheritedTags := make(map[string]interface{})
+	if d.Get("inherit_tags_from_vm").(bool) {
+		if inheritedTags, err = expandArmVirtualMachineExtensionInheritedTags(meta.(*ArmClient), resGroup, vmName, name, extension.Tags); err != nil {
+			return err
+		}
+	}
+
+	// the attributes may only be known once the VM has been created in the
+	// same apply, so are resolved right before the Extension is sent
+	var vmAttributes map[string]string
+	if references := expandArmVirtualMachineAttributeReferences(d); len(references) > 0 {
+		if vmAttributes, err = resolveArmVirtualMachineAttributeReferences(meta.(*ArmClient), resGroup, vmName, name, references); err != nil {
+			return err
+		}
+	}
 
-	if settingsString := d.Get("settings").(string); settingsString != "" {
-		settings, err := expandArmVirtualMachineExtensionSettings(settingsString)
+	if _, ok := d.GetOk("patch_settings"); ok {
+		settings := expandArmVirtualMachineExtensionPatchSettings(d)
+		extension.VirtualMachineExtensionProperties.Settings = &settings
+	} else if _, ok := d.GetOk("custom_script_settings"); ok {
+		// the type may come from the provider's `default_extension_type`,
+		// so this can only be checked once it's known
+		if !isArmCustomScriptExtension(publisher, extensionType) {
+			return fmt.Errorf("`custom_script_settings` can only be used with the Custom Script extensions, not %s/%s - use `settings` instead", publisher, extensionType)
+		}
+		settings := expandArmVirtualMachineExtensionCustomScriptSettings(d)
+		extension.VirtualMachineExtensionProperties.Settings = &settings
+	} else if settingsString, baseSettingsString, settingsMap := d.Get("settings").(string), d.Get("base_settings").(string), d.Get("settings_map").(map[string]interface{}); settingsString != "" || baseSettingsString != "" || len(settingsMap) > 0 {
+		settings := expandArmVirtualMachineExtensionSettingsMap(settingsMap)
+		if len(settingsMap) == 0 {
+			if settings, err = expandArmVirtualMachineExtensionSettingsWithBase(baseSettingsString, settingsString); err != nil {
+				return err
+			}
+		}
+		if d.Get("settings_env_substitution").(bool) {
+			if settings, err = substituteArmVirtualMachineExtensionSettingsEnv(settings); err != nil {
+				return fmt.Errorf("Error substituting environment variables in `settings`: %s", err)
+			}
+		}
+		if vmAttributes != nil {
+			if settings, err = substituteArmVirtualMachineExtensionSettingsVMAttributes(settings, vmAttributes); err != nil {
+				return fmt.Errorf("Error substituting Virtual Machine attributes in `settings`: %s", err)
+			}
+		}
+		extension.VirtualMachineExtensionProperties.Settings = &settings
+	} else if _, ok := d.GetOk("settings_file_path"); ok {
+		settings, err := expandArmVirtualMachineExtensionSettingsFile(d, meta.(*ArmClient))
 		if err != nil {
-			return fmt.Errorf("unable to parse settings: %s", err)
+			return err
 		}
 		extension.VirtualMachineExtensionProperties.Settings = &settings
 	}
 
+	if settings := extension.VirtualMachineExtensionProperties.Settings; settings != nil {
+		if patterns, enabled := armVirtualMachineExtensionSecretPatterns(d); enabled {
+			if err := validateArmVirtualMachineExtensionSettingsSecrets(*settings, patterns); err != nil {
+				return err
+			}
+		}
+	}
+
 	if protectedSettingsString := d.Get("protected_settings").(string); protectedSettingsString != "" {
 		protectedSettings, err := expandArmVirtualMachineExtensionSettings(protectedSettingsString)
 		if err != nil {
 			return fmt.Errorf("unable to parse protected_settings: %s", err)
 		}
+		if d.Get("settings_env_substitution").(bool) {
+			if protectedSettings, err = substituteArmVirtualMachineExtensionSettingsEnv(protectedSettings); err != nil {
+				return fmt.Errorf("Error substituting environment variables in `protected_settings`: %s", err)
+			}
+		}
+		if vmAttributes != nil {
+			if protectedSettings, err = substituteArmVirtualMachineExtensionSettingsVMAttributes(protectedSettings, vmAttributes); err != nil {
+				return fmt.Errorf("Error substituting Virtual Machine attributes in `protected_settings`: %s", err)
+			}
+		}
 		extension.VirtualMachineExtensionProperties.ProtectedSettings = &protectedSettings
 	}
 
-	_, err := client.CreateOrUpdate(resGroup, vmName, name, extension, make(chan struct{}))
-	if err != nil {
-		return err
+	// helper/schema can't inspect the rendered settings during the plan, so
+	// this is checked before anything is sent to Azure instead
+	props := extension.VirtualMachineExtensionProperties
+	if !d.Get("skip_settings_schema_validation").(bool) {
+		// the schemas describe the settings along with the protected settings
+		combined := make(map[string]interface{})
+		for _, s := range []*map[string]interface{}{props.Settings, props.ProtectedSettings} {
+			if s != nil {
+				combined = mergeArmVirtualMachineExtensionSettings(combined, *s)
+			}
+		}
+		if err := validateArmVirtualMachineExtensionSettingsSchema(meta.(*ArmClient).extensionSettingsSchemas, publisher, extensionType, combined); err != nil {
+			return err
+		}
 	}
 
-	read, err := client.Get(resGroup, vmName, name, "")
-	if err != nil {
-		return err
+	if limit := meta.(*ArmClient).extensionSettingsSizeLimit; limit > 0 {
+		if err := validateArmVirtualMachineExtensionSettingsSize("settings", props.Settings, limit); err != nil {
+			return err
+		}
+		if err := validateArmVirtualMachineExtensionSettingsSize("protected_settings", props.ProtectedSettings, limit); err != nil {
+			return err
+		}
 	}
 
-	if read.ID == nil {
-		return fmt.Errorf("Cannot read  Virtual Machine Extension %s (resource group %s) ID", name, resGroup)
+	if webhook := meta.(*ArmClient).settingsValidationWebhook; webhook != nil {
+		request := settingsValidationRequest{
+			ResourceID:         fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachines/%s/extensions/%s", meta.(*ArmClient).subscriptionId, resGroup, vmName, name),
+			Name:               name,
+			ResourceGroupName:  resGroup,
+			VirtualMachineName: vmName,
+			Location:           location,
+			Publisher:          publisher,
+			Type:               extensionType,
+			TypeHandlerVersion: typeHandlerVersion,
+			Settings:           make(map[string]interface{}),
+			ProtectedSettings:  expandSettingsValidationRequestProtectedSettings(props.ProtectedSettings),
+		}
+		if props.Settings != nil {
+			request.Settings = *props.Settings
+		}
+		if err := webhook.validate(request); err != nil {
+			return err
+		}
 	}
 
-	d.SetId(*read.ID)
-
-	return resourceArmVirtualMachineExtensionsRead(d, meta)
-}
+	exclusiveKeys := armVirtualMachineExtensionMutuallyExclusiveKeys(d, publisher, extensionType)
+	if err := validateArmVirtualMachineExtensionMutuallyExclusiveKeys(exclusiveKeys, props.Settings, props.ProtectedSettings); err != nil {
+		return err
+	}
 
-func resourceArmVirtualMachineExtensionsRead(d *schema.ResourceData, meta interface{}) error {
-	client := meta.(*ArmClient).vmExtensionClient
+	// the OS of a VM created in the same apply isn't known during the plan,
+	// so like the other settings checks, this is done before sending them
+	if keys, ok := osSpecificSettingsKeys[strings.ToLower(fmt.Sprintf("%s/%s", publisher, extensionType))]; ok {
+		vm, err := meta.(*ArmClient).vmClient.Get(resGroup, vmName, "")
+		if err != nil {
+			if vm.StatusCode == http.StatusNotFound {
+				return armVirtualMachineExtensionParentNotFoundError(resGroup, vmName, name)
+			}
+			return fmt.Errorf("Error making Read request on Virtual Machine %s: %s", vmName, err)
+		}
+		if err := validateArmVirtualMachineExtensionOSSpecificKeys(keys, flattenArmVirtualMachineOSType(vm), props.Settings, props.ProtectedSettings); err != nil {
+			return err
+		}
+	}
 
-	id, err := parseAzureResourceID(d.Id())
-	if err != nil {
-		return err
+	// like the other checks of the VM, this can't be made during the plan
+	// since the VM may be created in the same apply
+	if d.Get("requires_managed_identity").(bool) {
+		if err := validateArmVirtualMachineExtensionManagedIdentity(meta.(*ArmClient), resGroup, vmName, name); err != nil {
+			return err
+		}
 	}
-	resGroup := id.ResourceGroup
-	vmName := id.Path["virtualMachines"]
-	name := id.Path["extensions"]
 
-	resp, err := client.Get(resGroup, vmName, name, "")
+	if d.Get("skip_if_vm_not_running").(bool) && d.IsNewResource() {
+		vm, err := meta.(*ArmClient).vmClient.Get(resGroup, vmName, compute.InstanceView)
+		if err != nil {
+			if vm.StatusCode == http.StatusNotFound {
+				return armVirtualMachineExtensionParentNotFoundError(resGroup, vmName, name)
+			}
+			return fmt.Errorf("Error retrieving the instance view of Virtual Machine %q (resource group %q): %s", vmName, resGroup, err)
+		}
 
-	if err != nil {
-		if resp.StatusCode == http.StatusNotFound {
-			d.SetId("")
+		// the Extension doesn't exist, so is created once the VM is running
+		// again since the next refresh removes it from the state
+		if powerState := flattenArmVirtualMachinePowerState(vm); powerState != "" && powerState != "running" {
+			log.Printf("[INFO] Skipping the creation of Virtual Machine Extension %q since Virtual Machine %q is %s", name, vmName, powerState)
+			d.SetId(fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachines/%s/extensions/%s", meta.(*ArmClient).subscriptionId, resGroup, vmName, name))
+			d.Set("skipped", true)
+			d.Set("skip_reason", fmt.Sprintf("Virtual Machine %q is %s", vmName, powerState))
 			return nil
 		}
-		return fmt.Errorf("Error making Read request on Virtual Machine Extension %s: %s", name, err)
 	}
 
-	d.Set("name", resp.Name)
-	d.Set("location", azureRMNormalizeLocation(*resp.Location))
-	d.Set("virtual_machine_name", vmName)
-	d.Set("resource_group_name", resGroup)
-	d.Set("publisher", resp.VirtualMachineExtensionProperties.Publisher)
-	d.Set("type", resp.VirtualMachineExtensionProperties.Type)
-	d.Set("type_handler_version", resp.VirtualMachineExtensionProperties.TypeHandlerVersion)
-	d.Set("auto_upgrade_minor_version", resp.VirtualMachineExtensionProperties.AutoUpgradeMinorVersion)
+	timeout, operation := d.Timeout(schema.TimeoutCreate), "created"
+	if !d.IsNewResource() {
+		timeout, operation = d.Timeout(schema.TimeoutUpdate), "updated"
+	}
+	ctx, cancel := context.WithTimeout(meta.(*ArmClient).StopContext, timeout)
+	defer cancel()
 
-	if resp.VirtualMachineExtensionProperties.Settings != nil {
-		settings, err := flattenArmVirtualMachineExtensionSettings(*resp.VirtualMachineExtensionProperties.Settings)
-		if err != nil {
-			return fmt.Errorf("unable to parse settings from response: %s", err)
+	// the delay counts against the create timeout, and ends early when
+	// Terraform is interrupted
+	if v, ok := d.GetOk("create_delay"); ok && d.IsNewResource() {
+		// validated by validateDurationAtMost
+		delay, _ := time.ParseDuration(v.(string))
+		log.Printf("[DEBUG] Waiting %s before creating Virtual Machine Extension %q", delay, name)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return fmt.Errorf("Stopped waiting %s (`create_delay`) before creating Virtual Machine Extension %q on Virtual Machine %q: %s", delay, name, vmName, ctx.Err())
 		}
-		d.Set("settings", settings)
 	}
 
-	flattenAndSetTags(d, resp.Tags)
+	var orderedSettings json.RawMessage
+	if settingsString := d.Get("settings").(string); d.Get("ordered_settings").(bool) && settingsString != "" {
+		if orderedSettings, err = expandArmVirtualMachineExtensionOrderedSettings(settingsString); err != nil {
+			return err
+		}
+	}
 
-	return nil
-}
+	// the current settings are read last, so that keys added since the plan
+	// are kept too
+	if d.Get("merge_settings").(bool) {
+		if extension.VirtualMachineExtensionProperties.Settings, err = expandArmVirtualMachineExtensionMergedSettings(meta.(*ArmClient), resGroup, vmName, name, props.Settings); err != nil {
+			return err
+		}
+	}
+
+	retryAfterGuestAgentReady := d.Get("retry_after_guest_agent_ready").(bool)
+	deadline, _ := ctx.Deadline()
+	err = createArmVirtualMachineExtension(meta.(*ArmClient), resGroup, vmName, name, extension, orderedSettings, retryAfterGuestAgentReady, guestAgentReadyTimeout, deadline, ctx.Done())
+	if err == nil {
+		err = waitForArmVirtualMachineExtensionProvisioned(meta.(*ArmClient), resGroup, vmName, name, time.Until(deadline), ctx.Done())
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("Timed out after %s waiting for Virtual Machine Extension %q on Virtual Machine %q to be %s: %s", timeout, name, vmName, operation, err)
+	}
+	if err != nil && isArmResourceNotFoundError(err) {
+		if vm, vmErr := meta.(*ArmClient).vmClient.Get(resGroup, vmName, ""); vmErr != nil && vm.StatusCode == http.StatusNotFound {
+			err = armVirtualMachineExtensionParentNotFoundError(resGroup, vmName, name)
+		}
+	}
+	if err != nil {
+		// the ID is set regardless, so that the (tainted) state records why
+		// the Extension failed
+		if d.IsNewResource() {
+			d.SetId(fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachines/%s/extensions/%s", meta.(*ArmClient).subscriptionId, resGroup, vmName, name))
+		}
+		code, message := flattenArmVirtualMachineExtensionError(err, props.ProtectedSettings)
+		d.Set("last_error_code", code)
+		d.Set("last_error_message", message)
+		return err
+	}
+
+	// the Extension exists from here on, so its ID is known (and saved in the
+	// state) even if reading it back fails
+	d.SetId(fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachines/%s/extensions/%s", meta.(*ArmClient).subscriptionId, resGroup, vmName, name))
+	d.Set("vm_attribute_values", vmAttributes)
+	d.Set("inherited_tags", inheritedTags)
+	d.Set("protected_settings_sent", extension.VirtualMachineExtensionProperties.ProtectedSettings != nil)
+	d.Set("protected_settings_imported", false)
+	protectedSettingsHash, err := hashArmVirtualMachineExtensionProtectedSettingsForState(d)
+	if err != nil {
+		return fmt.Errorf("Error hashing `protected_settings`: %s", err)
+	}
+	d.Set("protected_settings_hash", protectedSettingsHash)
+	// the settings are re-baselined from what Azure returns, so that any
+	// defaults it adds aren't considered drift
+	d.Set("applied_settings_hash", "")
+	d.Set("etag", "")
+	d.Set("last_error_code", "")
+	d.Set("last_error_message", "")
+	d.Set("skipped", false)
+	d.Set("skip_reason", "")
+
+	read, err := client.Get(resGroup, vmName, name, "")
+	if err != nil {
+		return fmt.Errorf("Virtual Machine Extension %q was %s, but reading it back failed: %s", name, operation, err)
+	}
+	if read.ID == nil {
+		return fmt.Errorf("Cannot read  Virtual Machine Extension %s (resource group %s) ID", name, resGroup)
+	}
+	d.SetId(*read.ID)
+
+	return resourceArmVirtualMachineExtensionsRead(d, meta)
+}
+
+func resourceArmVirtualMachineExtensionsUpdate(d *schema.ResourceData, meta interface{}) error {
+	meta = armClientWithVirtualMachineExtensionAPIVersion(d, meta)
+
+	// helper/schema has no way of hooking into the plan, so downgrades are
+	// detected at apply time, before anything is sent to Azure
+	if d.HasChange("type_handler_version") {
+		old, new := d.GetChange("type_handler_version")
+		downgrade, err := isArmVirtualMachineExtensionVersionDowngrade(old.(string), new.(string))
+		if err != nil {
+			log.Printf("[DEBUG] Unable to compare `type_handler_version` %q to %q: %s", old, new, err)
+		} else if downgrade {
+			if d.Get("forbid_version_downgrade").(bool) {
+				return fmt.Errorf("`type_handler_version` cannot be downgraded from %q to %q when `forbid_version_downgrade` is set", old, new)
+			}
+			log.Printf("[WARN] Downgrading `type_handler_version` of Virtual Machine Extension %q from %q to %q - Azure may reject or ignore this", d.Get("name").(string), old, new)
+		}
+	}
+
+	if isArmVirtualMachineExtensionAPIVersionOnlyChange(d) {
+		return resourceArmVirtualMachineExtensionsRead(d, meta)
+	}
+
+	// a CreateOrUpdate may run the extension handler (and its side effects)
+	// again, which a change of the tags alone doesn't need
+	if isArmVirtualMachineExtensionTagsOnlyChange(d) {
+		return resourceArmVirtualMachineExtensionsUpdateTags(d, meta)
+	}
+
+	// the handler may keep the value it was given in plain text on the VM's
+	// disk, which only a new Extension clears
+	if moved := armVirtualMachineExtensionSettingsMovedToProtected(d); len(moved) > 0 {
+		if !d.Get("replace_on_settings_moved_to_protected").(bool) {
+			return armVirtualMachineExtensionSettingsMovedToProtectedError(d.Get("name").(string), moved)
+		}
+		return resourceArmVirtualMachineExtensionsReplace(d, meta, moved)
+	}
+
+	if !d.Get("rollback_settings_on_update_failure").(bool) {
+		return resourceArmVirtualMachineExtensionsCreate(d, meta)
+	}
+
+	// the settings in the state may come from a file or one of the typed
+	// blocks, so those Azure applied are read back before they're updated -
+	// only the protected settings (which Azure doesn't return) come from the
+	// state
+	client := meta.(*ArmClient)
+	name := d.Get("name").(string)
+	resGroup, vmName, err := armVirtualMachineExtensionVirtualMachine(d)
+	if err != nil {
+		return err
+	}
+	previous, err := client.vmExtensionClient.Get(resGroup, vmName, name, "")
+	if err != nil {
+		return fmt.Errorf("Error retrieving the settings of Virtual Machine Extension %q to roll back to: %s", name, err)
+	}
+	oldProtectedSettings, _ := d.GetChange("protected_settings")
+	oldVMAttributes := flattenArmVirtualMachineAttributeValues(d)
+
+	updateErr := resourceArmVirtualMachineExtensionsCreate(d, meta)
+	if updateErr == nil {
+		return nil
+	}
+
+	log.Printf("[WARN] Updating Virtual Machine Extension %q failed, restoring its previous settings: %s", name, updateErr)
+	rollback, err := expandArmVirtualMachineExtensionRollback(previous, oldProtectedSettings.(string), d.Get("settings_env_substitution").(bool), oldVMAttributes)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(client.StopContext, d.Timeout(schema.TimeoutUpdate))
+		defer cancel()
+		lockKey := armVirtualMachineExtensionsLockKey(resGroup, vmName)
+		armMutexKV.Lock(lockKey)
+		err = createOrUpdateArmVirtualMachineExtension(client, resGroup, vmName, name, rollback, nil, ctx.Done())
+		armMutexKV.Unlock(lockKey)
+		if err == nil {
+			deadline, _ := ctx.Deadline()
+			err = waitForArmVirtualMachineExtensionProvisioned(client, resGroup, vmName, name, time.Until(deadline), ctx.Done())
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s\n\nAdditionally, restoring the previous settings of the Extension failed: %s", updateErr, err)
+	}
+
+	// the state keeps the previous configuration, which is what's applied
+	d.Partial(true)
+	d.SetPartial("last_error_code")
+	d.SetPartial("last_error_message")
+
+	return fmt.Errorf("%s\n\nThe previous settings of the Extension have been restored, since `rollback_settings_on_update_failure` is set.", updateErr)
+}
+
+// expandArmVirtualMachineExtensionRollback returns the request restoring the
+// extension as it was read before an update, with the protected settings
+// (and the Virtual Machine attributes substituted in them) which were last
+// applied.
+func expandArmVirtualMachineExtensionRollback(previous compute.VirtualMachineExtension, protectedSettingsString string, envSubstitution bool, vmAttributes map[string]string) (compute.VirtualMachineExtension, error) {
+	rollback := compute.VirtualMachineExtension{
+		Location:                          previous.Location,
+		Tags:                              previous.Tags,
+		VirtualMachineExtensionProperties: &compute.VirtualMachineExtensionProperties{},
+	}
+	if props := previous.VirtualMachineExtensionProperties; props != nil {
+		rollback.VirtualMachineExtensionProperties = &compute.VirtualMachineExtensionProperties{
+			ForceUpdateTag:          props.ForceUpdateTag,
+			Publisher:               props.Publisher,
+			Type:                    props.Type,
+			TypeHandlerVersion:      props.TypeHandlerVersion,
+			AutoUpgradeMinorVersion: props.AutoUpgradeMinorVersion,
+			Settings:                props.Settings,
+		}
+	}
+
+	if protectedSettingsString != "" {
+		protectedSettings, err := expandArmVirtualMachineExtensionSettings(protectedSettingsString)
+		if err != nil {
+			return rollback, fmt.Errorf("unable to parse the previous protected_settings: %s", err)
+		}
+		if envSubstitution {
+			if protectedSettings, err = substituteArmVirtualMachineExtensionSettingsEnv(protectedSettings); err != nil {
+				return rollback, fmt.Errorf("Error substituting environment variables in the previous `protected_settings`: %s", err)
+			}
+		}
+		if len(vmAttributes) > 0 {
+			if protectedSettings, err = substituteArmVirtualMachineExtensionSettingsVMAttributes(protectedSettings, vmAttributes); err != nil {
+				return rollback, fmt.Errorf("Error substituting Virtual Machine attributes in the previous `protected_settings`: %s", err)
+			}
+		}
+		rollback.VirtualMachineExtensionProperties.ProtectedSettings = &protectedSettings
+	}
+
+	return rollback, nil
+}
+
+func resourceArmVirtualMachineExtensionsRead(d *schema.ResourceData, meta interface{}) error {
+	meta = armClientWithVirtualMachineExtensionAPIVersion(d, meta)
+	client := meta.(*ArmClient).vmExtensionClient
+
+	id, err := parseAzureResourceID(d.Id())
+	if err != nil {
+		return err
+	}
+	resGroup := id.ResourceGroup
+	vmName := id.Path["virtualMachines"]
+	name := id.Path["extensions"]
+
+	ctx, cancel := context.WithTimeout(meta.(*ArmClient).StopContext, d.Timeout(schema.TimeoutRead))
+	defer cancel()
+
+	meta.(*ArmClient).extensionOperations.acquire()
+	resp, notModified, err := getArmVirtualMachineExtensionIfChanged(client, resGroup, vmName, name, d.Get("etag").(string), ctx.Done())
+	meta.(*ArmClient).extensionOperations.release()
+
+	if err != nil {
+		// a Virtual Machine (or resource group) removed outside of Terraform
+		// takes its Extensions with it
+		if (resp.Response.Response != nil && resp.StatusCode == http.StatusNotFound) || isArmResourceNotFoundError(err) {
+			log.Printf("[WARN] %s", armVirtualMachineExtensionRemovedMessage(meta.(*ArmClient), resGroup, vmName, name, d.Get("skipped").(bool)))
+			d.SetId("")
+			return nil
+		}
+		return fmt.Errorf("Error making Read request on Virtual Machine Extension %s: %s", name, err)
+	}
+	if notModified {
+		log.Printf("[DEBUG] Virtual Machine Extension %q is unchanged (ETag %s)", name, d.Get("etag").(string))
+		return nil
+	}
+	if resp.Response.Response != nil {
+		d.Set("etag", resp.Header.Get("ETag"))
+	}
+
+	d.Set("name", flattenArmCaseInsensitiveString(d.Get("name").(string), resp.Name))
+	d.Set("location", azureRMNormalizeLocation(*resp.Location))
+	setArmVirtualMachineExtensionVirtualMachine(d, id.SubscriptionID, resGroup, vmName)
+	// Azure may return these in a different case than they were configured
+	d.Set("publisher", flattenArmCaseInsensitiveString(d.Get("publisher").(string), resp.VirtualMachineExtensionProperties.Publisher))
+	d.Set("type", flattenArmCaseInsensitiveString(d.Get("type").(string), resp.VirtualMachineExtensionProperties.Type))
+	// Azure returns no version for some of the extensions it manages, which
+	// would otherwise be a diff against the configured version
+	if version := resp.VirtualMachineExtensionProperties.TypeHandlerVersion; version != nil && *version != "" {
+		d.Set("type_handler_version", version)
+	} else {
+		log.Printf("[DEBUG] Virtual Machine Extension %q returned no `type_handler_version`, keeping %q", name, d.Get("type_handler_version").(string))
+	}
+	if floor := d.Get("minimum_version_floor").(string); floor != "" && resp.VirtualMachineExtensionProperties.TypeHandlerVersion != nil {
+		// the configured version is at least the floor, so storing the lower
+		// version is enough for the next plan to update the Extension back
+		if current := *resp.VirtualMachineExtensionProperties.TypeHandlerVersion; isArmVirtualMachineExtensionVersionBelowFloor(current, floor) {
+			log.Printf("[WARN] Virtual Machine Extension %q is at version %q, below the `minimum_version_floor` %q", name, current, floor)
+		}
+	}
+	d.Set("auto_upgrade_minor_version", resp.VirtualMachineExtensionProperties.AutoUpgradeMinorVersion)
+	d.Set("force_update_tag", resp.VirtualMachineExtensionProperties.ForceUpdateTag)
+	d.Set("provisioning_state", resp.VirtualMachineExtensionProperties.ProvisioningState)
+
+	if _, ok := d.GetOk("patch_settings"); ok {
+		if err := d.Set("patch_settings", flattenArmVirtualMachineExtensionPatchSettings(resp.VirtualMachineExtensionProperties.Settings)); err != nil {
+			return fmt.Errorf("Error flattening `patch_settings`: %+v", err)
+		}
+	} else if _, ok := d.GetOk("custom_script_settings"); ok {
+		if err := d.Set("custom_script_settings", flattenArmVirtualMachineExtensionCustomScriptSettings(resp.VirtualMachineExtensionProperties.Settings)); err != nil {
+			return fmt.Errorf("Error flattening `custom_script_settings`: %+v", err)
+		}
+	} else if _, ok := d.GetOk("settings_file_path"); ok {
+		// the settings are tracked by the hash of the file instead
+	} else if _, ok := d.GetOk("settings_map"); ok {
+		// the substituted values aren't those configured, so drift is only
+		// reported through `settings_drifted`
+		if !d.Get("settings_env_substitution").(bool) && len(d.Get("vm_attribute_values").(map[string]interface{})) == 0 && isArmVirtualMachineExtensionSettingsReturned(resp) {
+			d.Set("settings_map", flattenArmVirtualMachineExtensionSettingsMap(d.Get("settings_map").(map[string]interface{}), *resp.VirtualMachineExtensionProperties.Settings))
+		}
+	} else if isArmVirtualMachineExtensionSettingsReturned(resp) {
+		d.Set("settings", flattenArmVirtualMachineExtensionReturnedSettings(d, meta.(*ArmClient), resGroup, name, *resp.VirtualMachineExtensionProperties.Settings))
+	}
+
+	if isArmVirtualMachineExtensionSettingsReturned(resp) {
+		d.Set("applied_settings_keys", flattenArmVirtualMachineExtensionSettingsKeys(*resp.VirtualMachineExtensionProperties.Settings))
+	}
+
+	// like the settings themselves, settings which can't be hashed leave the
+	// drift as it was rather than failing the refresh
+	appliedSettingsHash, err := hashArmVirtualMachineExtensionSettings(resp.VirtualMachineExtensionProperties.Settings)
+	if err != nil {
+		log.Printf("[WARN] Unable to hash the settings of Virtual Machine Extension %q (resource group %q) returned by Azure, `settings_drifted` is left as it was: %s", name, resGroup, err)
+	} else if lastApplied := d.Get("applied_settings_hash").(string); lastApplied == "" {
+		d.Set("applied_settings_hash", appliedSettingsHash)
+		d.Set("settings_drifted", false)
+	} else {
+		d.Set("settings_drifted", lastApplied != appliedSettingsHash)
+	}
+
+	protectedSettingsHash, err := hashArmVirtualMachineExtensionProtectedSettingsForState(d)
+	if err != nil {
+		return fmt.Errorf("Error hashing `protected_settings`: %s", err)
+	}
+	d.Set("protected_settings_hash", protectedSettingsHash)
+
+	var protectedSettings *map[string]interface{}
+	if v := d.Get("protected_settings").(string); v != "" {
+		if parsed, err := expandArmVirtualMachineExtensionSettings(v); err == nil {
+			protectedSettings = &parsed
+		}
+	}
+	instanceView, hasWarnings, hasErrors := flattenArmVirtualMachineExtensionInstanceView(resp.VirtualMachineExtensionProperties.InstanceView, protectedSettings)
+	if err := d.Set("instance_view", instanceView); err != nil {
+		return fmt.Errorf("Error flattening `instance_view`: %+v", err)
+	}
+	statuses := make([]interface{}, 0)
+	if len(instanceView) > 0 {
+		statuses = instanceView[0].(map[string]interface{})["statuses"].([]interface{})
+	}
+	if err := d.Set("statuses", statuses); err != nil {
+		return fmt.Errorf("Error flattening `statuses`: %+v", err)
+	}
+	d.Set("has_warnings", hasWarnings)
+	d.Set("has_errors", hasErrors)
+	d.Set("output", flattenArmVirtualMachineExtensionScriptOutput(resp.VirtualMachineExtensionProperties.InstanceView, "ComponentStatus/StdOut/succeeded", protectedSettings))
+	d.Set("error_output", flattenArmVirtualMachineExtensionScriptOutput(resp.VirtualMachineExtensionProperties.InstanceView, "ComponentStatus/StdErr/succeeded", protectedSettings))
+
+	resourceJSON, err := flattenArmVirtualMachineExtensionResourceJSON(resp)
+	if err != nil {
+		return fmt.Errorf("Error encoding Virtual Machine Extension %s as JSON: %s", name, err)
+	}
+	d.Set("resource_json", resourceJSON)
+
+	// the OS type is informational, so failing to read it keeps the previous
+	// value rather than failing the refresh
+	meta.(*ArmClient).extensionOperations.acquire()
+	vm, err := getArmVirtualMachine(meta.(*ArmClient).vmClient, resGroup, vmName, "", ctx.Done())
+	meta.(*ArmClient).extensionOperations.release()
+	if err != nil {
+		log.Printf("[WARN] Unable to read Virtual Machine %q (resource group %q), `target_os_type` is left as it was: %s", vmName, resGroup, err)
+	} else {
+		osType := flattenArmVirtualMachineOSType(vm)
+		if osType == "" {
+			log.Printf("[DEBUG] Unable to determine the OS type of Virtual Machine %q (resource group %q)", vmName, resGroup)
+		}
+		d.Set("target_os_type", osType)
+	}
+
+	if meta.(*ArmClient).autoTagExtensions {
+		resp.Tags = flattenArmVirtualMachineExtensionMetadataTags(resp.Tags, d.Get("tags").(map[string]interface{}))
+	}
+	resp.Tags = flattenArmVirtualMachineExtensionInheritedTags(resp.Tags, d.Get("inherited_tags").(map[string]interface{}), d.Get("tags").(map[string]interface{}))
+	flattenAndSetTags(d, resp.Tags)
+
+	return nil
+}
 
 func resourceArmVirtualMachineExtensionsDelete(d *schema.ResourceData, meta interface{}) error {
+	return deleteArmVirtualMachineExtension(d, meta, !d.Get("skip_delete_wait").(bool))
+}
+
+// deleteArmVirtualMachineExtension deletes the Extension, waiting for the
+// deletion to complete unless wait is false.
+func deleteArmVirtualMachineExtension(d *schema.ResourceData, meta interface{}, wait bool) error {
+	meta = armClientWithVirtualMachineExtensionAPIVersion(d, meta)
 	client := meta.(*ArmClient).vmExtensionClient
 
 	id, err := parseAzureResourceID(d.Id())
@@ -195,17 +1208,102 @@ func resourceArmVirtualMachineExtensionsDelete(d *schema.ResourceData, meta inte
 	name := id.Path["extensions"]
 	vmName := id.Path["virtualMachines"]
 
-	_, err = client.Delete(resGroup, vmName, name, make(chan struct{}))
+	timeout := d.Timeout(schema.TimeoutDelete)
+	ctx, cancel := context.WithTimeout(meta.(*ArmClient).StopContext, timeout)
+	defer cancel()
+
+	lockKey := armVirtualMachineExtensionsLockKey(resGroup, vmName)
+	armMutexKV.Lock(lockKey)
+	defer armMutexKV.Unlock(lockKey)
+
+	meta.(*ArmClient).extensionOperations.acquire()
+	var resp autorest.Response
+	if !wait {
+		log.Printf("[DEBUG] Not waiting for Virtual Machine Extension %q to be deleted, since `skip_delete_wait` is set", name)
+		resp, err = startArmVirtualMachineExtensionDelete(meta.(*ArmClient), resGroup, vmName, name, ctx.Done())
+	} else {
+		resp, err = client.Delete(resGroup, vmName, name, ctx.Done())
+	}
+	meta.(*ArmClient).extensionOperations.release()
+
+	if err != nil {
+		// the Extension is already gone
+		if resp.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("Timed out after %s waiting for Virtual Machine Extension %q on Virtual Machine %q to be deleted: %s", timeout, name, vmName, err)
+		}
+		return fmt.Errorf("Error deleting Virtual Machine Extension %q (Virtual Machine %q / resource group %q): %s", name, vmName, resGroup, err)
+	}
 
 	return nil
 }
 
+// flattenArmVirtualMachineExtensionSettingsKeys returns the sorted top-level
+// keys of the settings.
+func flattenArmVirtualMachineExtensionSettingsKeys(settings map[string]interface{}) []string {
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// armVirtualMachineExtensionRequiresImportError is returned when creating an
+// Extension which already exists, with `require_import_for_existing_extensions`.
+func armVirtualMachineExtensionRequiresImportError(id, name, vmName string) error {
+	return fmt.Errorf("Virtual Machine Extension %q already exists on Virtual Machine %q, and wasn't created by this Terraform state - to be managed via Terraform it needs to be imported into the state, e.g. with:\n\n  terraform import azurerm_virtual_machine_extension.example %s\n\nOtherwise, choose a different `name` (or remove the existing Extension) - creating it would overwrite the existing Extension's configuration.", name, vmName, id)
+}
+
+// armVirtualMachineExtensionParentNotFoundError is returned in place of the
+// generic not found error for an Extension whose Virtual Machine doesn't
+// exist, which is usually missing a dependency on the VM.
+func armVirtualMachineExtensionParentNotFoundError(resGroup, vmName, name string) error {
+	return fmt.Errorf("Virtual Machine %q in resource group %q was not found - create it before attaching Virtual Machine Extension %q, e.g. by interpolating `virtual_machine_name` from the `azurerm_virtual_machine` so that it's created first", vmName, resGroup, name)
+}
+
+// armVirtualMachineExtensionRemovedMessage explains an Extension which is
+// removed from the state since it no longer exists, and whether it's recreated
+// by the next apply. ARM doesn't say who removed it: besides users, Azure
+// removes Extensions itself, e.g. with Azure Security Center's
+// auto-provisioning.
+func armVirtualMachineExtensionRemovedMessage(client *ArmClient, resGroup, vmName, name string, skipped bool) string {
+	if skipped {
+		return fmt.Sprintf("Virtual Machine Extension %q was skipped since Virtual Machine %q wasn't running, it will be created by the next apply", name, vmName)
+	}
+
+	vm, err := client.vmClient.Get(resGroup, vmName, "")
+	if err != nil {
+		if vm.StatusCode == http.StatusNotFound {
+			return fmt.Sprintf("Virtual Machine Extension %q no longer exists since Virtual Machine %q (resource group %q) was removed, it will only be recreated along with the Virtual Machine", name, vmName, resGroup)
+		}
+		return fmt.Sprintf("Virtual Machine Extension %q no longer exists on Virtual Machine %q (resource group %q), it will be recreated by the next apply", name, vmName, resGroup)
+	}
+
+	return fmt.Sprintf("Virtual Machine Extension %q no longer exists on Virtual Machine %q (resource group %q), and will be recreated by the next apply. It was removed outside of Terraform, either by a user or by Azure itself (e.g. by Azure Security Center's auto-provisioning) - the Activity Log of the Virtual Machine shows which.", name, vmName, resGroup)
+}
+
+// expandArmVirtualMachineExtensionSettings decodes the settings JSON, keeping
+// numbers as json.Number so that large integers are sent to Azure exactly as
+// they were written rather than being rounded through a float64.
 func expandArmVirtualMachineExtensionSettings(jsonString string) (map[string]interface{}, error) {
 	var result map[string]interface{}
 
-	err := json.Unmarshal([]byte(jsonString), &result)
+	decoder := json.NewDecoder(strings.NewReader(jsonString))
+	decoder.UseNumber()
+	if err := decoder.Decode(&result); err != nil {
+		return nil, err
+	}
 
-	return result, err
+	// json.Unmarshal rejects trailing data, the Decoder has to be asked
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("invalid character after top-level value")
+	}
+
+	return result, nil
 }
 
 func flattenArmVirtualMachineExtensionSettings(settingsMap map[string]interface{}) (string, error) {
@@ -217,16 +1315,668 @@ func flattenArmVirtualMachineExtensionSettings(settingsMap map[string]interface{
 	return string(result), nil
 }
 
+// hashArmVirtualMachineExtensionProtectedSettings returns an HMAC-SHA-256,
+// keyed with the salt, of the canonical form of the protected settings, so
+// that reformatting them doesn't change the hash. An empty string is returned
+// when none are set.
+func hashArmVirtualMachineExtensionProtectedSettings(protectedSettings, salt string) (string, error) {
+	if protectedSettings == "" {
+		return "", nil
+	}
+
+	canonical, err := canonicalizeArmVirtualMachineExtensionSettings(protectedSettings)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(canonical))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// hashArmVirtualMachineExtensionProtectedSettingsForState hashes the protected
+// settings in the state with the salt of the resource, generating the salt
+// the first time it's needed.
+func hashArmVirtualMachineExtensionProtectedSettingsForState(d *schema.ResourceData) (string, error) {
+	salt := d.Get("protected_settings_hash_salt").(string)
+	if salt == "" {
+		random := make([]byte, 32)
+		if _, err := rand.Read(random); err != nil {
+			return "", fmt.Errorf("unable to generate the salt: %s", err)
+		}
+		salt = hex.EncodeToString(random)
+		d.Set("protected_settings_hash_salt", salt)
+	}
+
+	return hashArmVirtualMachineExtensionProtectedSettings(d.Get("protected_settings").(string), salt)
+}
+
+// hashArmVirtualMachineExtensionSettings returns a SHA-256 of the canonical
+// form of the settings returned by the API.
+func hashArmVirtualMachineExtensionSettings(settings *map[string]interface{}) (string, error) {
+	var value interface{}
+	if settings != nil {
+		value = canonicalizeArmVirtualMachineExtensionSettingsNumbers(*settings)
+	}
+
+	canonical, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(canonical)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// isArmVirtualMachineExtensionVersionDowngrade compares two handler versions
+// semantically, so that e.g. `1.10` is considered newer than `1.9`.
+func isArmVirtualMachineExtensionVersionDowngrade(old, new string) (bool, error) {
+	oldVersion, err := version.NewVersion(old)
+	if err != nil {
+		return false, err
+	}
+
+	newVersion, err := version.NewVersion(new)
+	if err != nil {
+		return false, err
+	}
+
+	return newVersion.LessThan(oldVersion), nil
+}
+
+// expandArmVirtualMachineExtensionSettingsWithBase returns the settings
+// deep-merged over the base settings, either of which may be empty.
+func expandArmVirtualMachineExtensionSettingsWithBase(baseSettingsString, settingsString string) (map[string]interface{}, error) {
+	base := make(map[string]interface{})
+	if baseSettingsString != "" {
+		var err error
+		if base, err = expandArmVirtualMachineExtensionSettings(baseSettingsString); err != nil {
+			return nil, fmt.Errorf("unable to parse base_settings: %s", err)
+		}
+	}
+
+	settings := make(map[string]interface{})
+	if settingsString != "" {
+		var err error
+		if settings, err = expandArmVirtualMachineExtensionSettings(settingsString); err != nil {
+			return nil, fmt.Errorf("unable to parse settings: %s", err)
+		}
+	}
+
+	return mergeArmVirtualMachineExtensionSettings(base, settings), nil
+}
+
+func validateArmVirtualMachineExtensionSettingsObject(v interface{}, k string) (ws []string, errors []error) {
+	value := v.(string)
+	if value == "" {
+		return
+	}
+
+	var settings interface{}
+	if err := json.Unmarshal([]byte(value), &settings); err != nil {
+		errors = append(errors, fmt.Errorf("%q contains an invalid JSON: %s", k, describeJsonError(value, err)))
+		return
+	}
+
+	// Azure rejects anything else, but only once the extension is sent
+	if _, ok := settings.(map[string]interface{}); !ok {
+		errors = append(errors, fmt.Errorf("%q must be a JSON object (`{ ... }`), got %s", k, describeJsonType(settings)))
+	}
+	return
+}
+
+// describeJsonType returns the JSON type of the decoded value.
+func describeJsonType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case []interface{}:
+		return "an array"
+	case string:
+		return "a string"
+	case float64:
+		return "a number"
+	case bool:
+		return "a boolean"
+	default:
+		return "an object"
+	}
+}
+
+// armVirtualMachineExtensionPublisherAndType returns the effective publisher
+// and type of the extension: those of the resource when set, otherwise the
+// provider's defaults.
+func armVirtualMachineExtensionPublisherAndType(d *schema.ResourceData, client *ArmClient) (string, string, error) {
+	publisher := d.Get("publisher").(string)
+	if publisher == "" {
+		publisher = client.defaultExtensionPublisher
+	}
+
+	extensionType := d.Get("type").(string)
+	if extensionType == "" {
+		extensionType = client.defaultExtensionType
+	}
+
+	if publisher == "" {
+		return "", "", fmt.Errorf("`publisher` must be set, either on the resource or as the provider's `default_extension_publisher`")
+	}
+	if extensionType == "" {
+		return "", "", fmt.Errorf("`type` must be set, either on the resource or as the provider's `default_extension_type`")
+	}
+
+	return publisher, extensionType, nil
+}
+
+func armInstanceViewStatusesSchema() *schema.Schema {
+	return &schema.Schema{
+		Type:     schema.TypeList,
+		Computed: true,
+		Elem: &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"code": {
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+				"level": {
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+				"display_status": {
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+				"message": {
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+				"time": {
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+			},
+		},
+	}
+}
+
+// flattenArmVirtualMachineExtensionInstanceView flattens every status and
+// substatus of the instance view (redacting the values of the protected
+// settings from their messages), and returns whether any of them is at the
+// Warning or Error level.
+func flattenArmVirtualMachineExtensionInstanceView(instanceView *compute.VirtualMachineExtensionInstanceView, protectedSettings *map[string]interface{}) ([]interface{}, bool, bool) {
+	if instanceView == nil {
+		return []interface{}{}, false, false
+	}
+
+	hasWarnings, hasErrors := false, false
+	flatten := func(input *[]compute.InstanceViewStatus) []interface{} {
+		statuses := make([]interface{}, 0)
+		if input == nil {
+			return statuses
+		}
+
+		for _, status := range *input {
+			switch status.Level {
+			case compute.Warning:
+				hasWarnings = true
+			case compute.Error:
+				hasErrors = true
+			}
+
+			output := map[string]interface{}{
+				"level": string(status.Level),
+			}
+			if status.Code != nil {
+				output["code"] = *status.Code
+			}
+			if status.DisplayStatus != nil {
+				output["display_status"] = *status.DisplayStatus
+			}
+			if status.Message != nil {
+				output["message"] = redactArmVirtualMachineExtensionProtectedValues(*status.Message, protectedSettings)
+			}
+			if status.Time != nil {
+				output["time"] = status.Time.String()
+			}
+			statuses = append(statuses, output)
+		}
+		return statuses
+	}
+
+	result := map[string]interface{}{
+		"statuses":    flatten(instanceView.Statuses),
+		"substatuses": flatten(instanceView.Substatuses),
+	}
+	return []interface{}{result}, hasWarnings, hasErrors
+}
+
+// flattenArmVirtualMachineOSType returns the OS type of the VM from its OS
+// disk, falling back to the configuration of its OS profile. This is empty
+// when neither is known, e.g. while the VM is still being provisioned.
+func flattenArmVirtualMachineOSType(vm compute.VirtualMachine) string {
+	props := vm.VirtualMachineProperties
+	if props == nil {
+		return ""
+	}
+
+	if profile := props.StorageProfile; profile != nil && profile.OsDisk != nil && profile.OsDisk.OsType != "" {
+		return string(profile.OsDisk.OsType)
+	}
+
+	if profile := props.OsProfile; profile != nil {
+		if profile.WindowsConfiguration != nil {
+			return string(compute.Windows)
+		}
+		if profile.LinuxConfiguration != nil {
+			return string(compute.Linux)
+		}
+	}
+
+	return ""
+}
+
+// expandArmVirtualMachineExtensionSettingsFile returns the settings from the
+// `settings_file_path`. Since the state only holds a hash of the file, its path
+// is only known when it (or the file) has changed - otherwise the applied
+// settings are reused, as they still match the file.
+func expandArmVirtualMachineExtensionSettingsFile(d *schema.ResourceData, client *ArmClient) (map[string]interface{}, error) {
+	if d.IsNewResource() || d.HasChange("settings_file_path") {
+		return readArmVirtualMachineExtensionSettingsFile(d.Get("settings_file_path").(string))
+	}
+
+	id, err := parseAzureResourceID(d.Id())
+	if err != nil {
+		return nil, err
+	}
+	name := id.Path["extensions"]
+
+	resp, err := client.vmExtensionClient.Get(id.ResourceGroup, id.Path["virtualMachines"], name, "")
+	if err != nil {
+		return nil, fmt.Errorf("Error making Read request on Virtual Machine Extension %s: %s", name, err)
+	}
+	if props := resp.VirtualMachineExtensionProperties; props != nil && props.Settings != nil {
+		return *props.Settings, nil
+	}
+	return map[string]interface{}{}, nil
+}
+
+func readArmVirtualMachineExtensionSettingsFile(path string) (map[string]interface{}, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading `settings_file_path` %q: %s", path, err)
+	}
+
+	settings, err := expandArmVirtualMachineExtensionSettings(string(contents))
+	if err != nil {
+		return nil, fmt.Errorf("`settings_file_path` %q contains an invalid JSON: %s", path, err)
+	}
+	return settings, nil
+}
+
+// validateArmVirtualMachineExtensionSettingsFile fails the plan when the file
+// is missing, unreadable or isn't a JSON object. Interpolated paths which are
+// only known at apply time are checked when the Extension is created instead.
+func validateArmVirtualMachineExtensionSettingsFile(v interface{}, k string) (ws []string, errors []error) {
+	if _, err := readArmVirtualMachineExtensionSettingsFile(v.(string)); err != nil {
+		errors = append(errors, fmt.Errorf("%q: %s", k, err))
+	}
+	return
+}
+
+func armVirtualMachineExtensionSettingsFileStateFunc(v interface{}) string {
+	contents, err := ioutil.ReadFile(v.(string))
+	if err != nil {
+		// already reported by validateArmVirtualMachineExtensionSettingsFile
+		return ""
+	}
+
+	hash := sha256.Sum256(contents)
+	return hex.EncodeToString(hash[:])
+}
+
+// isArmVirtualMachineExtensionVersionBelowFloor reports whether the handler
+// version is semantically lower than the floor. Versions which can't be
+// parsed are never considered below the floor.
+func isArmVirtualMachineExtensionVersionBelowFloor(current, floor string) bool {
+	below, err := isArmVirtualMachineExtensionVersionDowngrade(floor, current)
+	if err != nil {
+		log.Printf("[DEBUG] Unable to compare version %q to the floor %q: %s", current, floor, err)
+		return false
+	}
+	return below
+}
+
+// flattenArmVirtualMachineExtensionSettingsForState encodes the settings for
+// the state, indented when the provider's `pretty_print_settings` is set. The
+// diff is suppressed for semantically equal settings, so the formatting never
+// causes a diff against the configuration.
+func flattenArmVirtualMachineExtensionSettingsForState(settingsMap map[string]interface{}, pretty bool) (string, error) {
+	if !pretty {
+		return flattenArmVirtualMachineExtensionSettings(settingsMap)
+	}
+
+	result, err := json.MarshalIndent(settingsMap, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return string(result), nil
+}
+
+// flattenArmVirtualMachineExtensionReturnedSettings returns the `settings` to
+// store for those returned by Azure. Returned settings which can't be
+// flattened (e.g. since Azure returned a value of an unexpected type) are
+// logged along with the raw value, and the previous `settings` are kept, so
+// that a single Extension doesn't break the refresh of the whole configuration.
+func flattenArmVirtualMachineExtensionReturnedSettings(d *schema.ResourceData, client *ArmClient, resGroup, name string, returned map[string]interface{}) string {
+	current := d.Get("settings").(string)
+	settings, err := armVirtualMachineExtensionSettingsForState(current, returned, client.prettyPrintSettings, d.Get("settings_env_substitution").(bool), flattenArmVirtualMachineAttributeValues(d))
+	if err != nil {
+		log.Printf("[WARN] Unable to flatten the settings of Virtual Machine Extension %q (resource group %q) returned by Azure, keeping the previous `settings` in the state: %s (returned value: %#v)", name, resGroup, err, returned)
+		return current
+	}
+
+	// the settings as written (key order, formatting) are kept while they're
+	// the same as those returned, so that the state matches the configuration
+	// - unless they're to be stored indented
+	if current != "" && !client.prettyPrintSettings && suppressDiffVirtualMachineExtensionSettings("settings", settings, current, d) {
+		return current
+	}
+	return settings
+}
+
+// armVirtualMachineExtensionSettingsForState returns the settings to store in
+// the state, always in their canonical (key-sorted) form so that the state
+// converges on it even when Azure returns the keys in a different order. With
+// `settings_env_substitution` or `vm_attribute_references`, the current
+// template is stored instead (also in its canonical form) for as long as it
+// matches the returned settings.
+func armVirtualMachineExtensionSettingsForState(current string, returned map[string]interface{}, pretty, envSubstitution bool, vmAttributes map[string]string) (string, error) {
+	settings, err := flattenArmVirtualMachineExtensionSettingsForState(returned, pretty)
+	if err != nil {
+		return "", err
+	}
+
+	if (envSubstitution || len(vmAttributes) > 0) && armVirtualMachineExtensionSettingsTemplateMatches(current, settings, envSubstitution, vmAttributes) {
+		if template, err := expandArmVirtualMachineExtensionSettings(current); err == nil {
+			return flattenArmVirtualMachineExtensionSettingsForState(template, pretty)
+		}
+	}
+
+	return settings, nil
+}
+
+// armVirtualMachineExtensionSecretPatterns returns the patterns the plaintext
+// settings are checked against, and whether the check is enabled at all.
+// Specifying `forbid_secret_patterns` replaces the default patterns.
+func armVirtualMachineExtensionSecretPatterns(d *schema.ResourceData) ([]string, bool) {
+	if v, ok := d.GetOk("forbid_secret_patterns"); ok {
+		patterns := make([]string, 0)
+		for _, p := range v.([]interface{}) {
+			patterns = append(patterns, p.(string))
+		}
+		return patterns, true
+	}
+
+	if d.Get("forbid_secrets_in_settings").(bool) {
+		return defaultForbiddenSecretPatterns, true
+	}
+
+	return nil, false
+}
+
+func armVirtualMachineExtensionMutuallyExclusiveKeys(d *schema.ResourceData, publisher, extensionType string) [][]string {
+	groups := defaultMutuallyExclusiveSettingsKeys[strings.ToLower(fmt.Sprintf("%s/%s", publisher, extensionType))]
+
+	for _, v := range d.Get("mutually_exclusive_settings_keys").([]interface{}) {
+		group := v.(map[string]interface{})
+		keys := make([]string, 0)
+		for _, key := range group["keys"].([]interface{}) {
+			keys = append(keys, key.(string))
+		}
+		groups = append(groups, keys)
+	}
+
+	return groups
+}
+
+// patchSettingsKeys maps the fields of the `patch_settings` block to the keys
+// the patching extension expects in its settings.
+var patchSettingsKeys = map[string]string{
+	"patch_mode":      "patchMode",
+	"assessment_mode": "assessmentMode",
+	"reboot_setting":  "rebootSetting",
+}
+
+func expandArmVirtualMachineExtensionPatchSettings(d *schema.ResourceData) map[string]interface{} {
+	settings := make(map[string]interface{})
+
+	patchSettings := d.Get("patch_settings").([]interface{})
+	if len(patchSettings) == 0 || patchSettings[0] == nil {
+		return settings
+	}
+
+	config := patchSettings[0].(map[string]interface{})
+	for field, key := range patchSettingsKeys {
+		if v, ok := config[field].(string); ok && v != "" {
+			settings[key] = v
+		}
+	}
+
+	return settings
+}
+
+func flattenArmVirtualMachineExtensionPatchSettings(settings *map[string]interface{}) []interface{} {
+	result := make(map[string]interface{})
+
+	if settings != nil {
+		for field, key := range patchSettingsKeys {
+			if v, ok := (*settings)[key].(string); ok {
+				result[field] = v
+			}
+		}
+	}
+
+	return []interface{}{result}
+}
+
+// customScriptExtensionTypes are the `publisher/type` (lowercased) of the
+// extensions accepting the settings of the `custom_script_settings` block.
+var customScriptExtensionTypes = map[string]bool{
+	"microsoft.azure.extensions/customscript":       true,
+	"microsoft.compute/customscriptextension":       true,
+	"microsoft.ostcextensions/customscriptforlinux": true,
+}
+
+func isArmCustomScriptExtension(publisher, extensionType string) bool {
+	return customScriptExtensionTypes[strings.ToLower(fmt.Sprintf("%s/%s", publisher, extensionType))]
+}
+
+func expandArmVirtualMachineExtensionCustomScriptSettings(d *schema.ResourceData) map[string]interface{} {
+	settings := make(map[string]interface{})
+
+	customScriptSettings := d.Get("custom_script_settings").([]interface{})
+	if len(customScriptSettings) == 0 || customScriptSettings[0] == nil {
+		return settings
+	}
+
+	config := customScriptSettings[0].(map[string]interface{})
+	if v, ok := config["command_to_execute"].(string); ok && v != "" {
+		settings["commandToExecute"] = v
+	}
+	if v, ok := config["file_uris"].([]interface{}); ok && len(v) > 0 {
+		fileUris := make([]interface{}, 0, len(v))
+		for _, uri := range v {
+			fileUris = append(fileUris, uri.(string))
+		}
+		settings["fileUris"] = fileUris
+	}
+	if v, ok := config["storage_account_name"].(string); ok && v != "" {
+		settings["storageAccountName"] = v
+	}
+
+	return settings
+}
+
+func flattenArmVirtualMachineExtensionCustomScriptSettings(settings *map[string]interface{}) []interface{} {
+	result := make(map[string]interface{})
+
+	if settings != nil {
+		if v, ok := (*settings)["commandToExecute"].(string); ok {
+			result["command_to_execute"] = v
+		}
+		if v, ok := (*settings)["fileUris"].([]interface{}); ok {
+			fileUris := make([]interface{}, 0, len(v))
+			for _, uri := range v {
+				if s, ok := uri.(string); ok {
+					fileUris = append(fileUris, s)
+				}
+			}
+			result["file_uris"] = fileUris
+		}
+		if v, ok := (*settings)["storageAccountName"].(string); ok {
+			result["storage_account_name"] = v
+		}
+	}
+
+	return []interface{}{result}
+}
+
 func suppressDiffVirtualMachineExtensionSettings(k, old, new string, d *schema.ResourceData) bool {
-	oldMap, err := expandArmVirtualMachineExtensionSettings(old)
+	// Azure returns the settings merged with the `base_settings`
+	if k == "settings" && d != nil {
+		if base, ok := d.GetOk("base_settings"); ok {
+			merged, err := expandArmVirtualMachineExtensionSettingsWithBase(base.(string), new)
+			if err != nil {
+				return false
+			}
+			if new, err = flattenArmVirtualMachineExtensionSettings(merged); err != nil {
+				return false
+			}
+		}
+	}
+
+	// Azure never returns the protected settings, so they're compared to the
+	// hash of those last sent instead of the value in the state
+	if k == "protected_settings" && d != nil {
+		// those of an imported Extension are unknown
+		if imported, _ := d.Get("protected_settings_imported").(bool); imported && old == "" {
+			log.Printf("[WARN] The `protected_settings` of the imported Virtual Machine Extension %q can't be read from Azure, so aren't compared until the Extension is next updated - they're re-supplied by the apply after that", d.Get("name").(string))
+			return true
+		}
+		// hashes stored before the salt was introduced can't be compared
+		sent, _ := d.Get("protected_settings_hash").(string)
+		salt, _ := d.Get("protected_settings_hash_salt").(string)
+		if sent != "" && salt != "" {
+			hash, err := hashArmVirtualMachineExtensionProtectedSettings(new, salt)
+			return err == nil && hmac.Equal([]byte(hash), []byte(sent))
+		}
+	}
+
+	oldCanonical, err := canonicalizeArmVirtualMachineExtensionSettings(old)
 	if err != nil {
 		return false
 	}
 
-	newMap, err := expandArmVirtualMachineExtensionSettings(new)
+	newCanonical, err := canonicalizeArmVirtualMachineExtensionSettings(new)
 	if err != nil {
 		return false
 	}
 
-	return reflect.DeepEqual(oldMap, newMap)
+	if oldCanonical == newCanonical {
+		return true
+	}
+
+	// the stored settings may hold values encrypted by a registered decryptor
+	decrypted, ok, err := decryptArmVirtualMachineExtensionSettings(old)
+	if err != nil {
+		log.Printf("[DEBUG] Error decrypting %q for comparison: %s", k, err)
+		return false
+	}
+	if ok {
+		if decrypted == newCanonical {
+			return true
+		}
+		oldCanonical = decrypted
+	}
+
+	// not every resource using this function has these options
+	if d == nil {
+		return false
+	}
+	// the settings returned are the union of those configured and the keys
+	// added outside of Terraform
+	if v, ok := d.GetOk("merge_settings"); ok && v.(bool) && isArmVirtualMachineExtensionSettingsMergedSubset(oldCanonical, newCanonical) {
+		return true
+	}
+
+	// the keys added by the extension handler are only compared when configured
+	if ignoreKeys := armVirtualMachineExtensionSettingsIgnoreKeys(d); len(ignoreKeys) > 0 {
+		if oldCanonical, err = removeArmVirtualMachineExtensionSettingsIgnoredKeys(oldCanonical, newCanonical, ignoreKeys); err != nil {
+			return false
+		}
+		if oldCanonical == newCanonical {
+			return true
+		}
+	}
+
+	caseInsensitiveKeys := armVirtualMachineExtensionCaseInsensitiveKeys(d)
+	unorderedArrayKeys := armVirtualMachineExtensionUnorderedArrayKeys(d)
+	// the fleet resource shares this function but not the option
+	normalizeWhitespace := false
+	if v, ok := d.GetOk("normalize_string_whitespace"); ok {
+		normalizeWhitespace = v.(bool)
+	}
+	if len(caseInsensitiveKeys) == 0 && len(unorderedArrayKeys) == 0 && !normalizeWhitespace {
+		return false
+	}
+
+	oldNormalized, err := normalizeArmVirtualMachineExtensionSettingsForComparison(oldCanonical, caseInsensitiveKeys, unorderedArrayKeys, normalizeWhitespace)
+	if err != nil {
+		return false
+	}
+	newNormalized, err := normalizeArmVirtualMachineExtensionSettingsForComparison(newCanonical, caseInsensitiveKeys, unorderedArrayKeys, normalizeWhitespace)
+	if err != nil {
+		return false
+	}
+
+	return oldNormalized == newNormalized
+}
+
+func armVirtualMachineExtensionCaseInsensitiveKeys(d *schema.ResourceData) []string {
+	keys := make([]string, 0)
+	if raw, ok := d.GetOk("case_insensitive_settings_keys"); ok {
+		for _, v := range raw.([]interface{}) {
+			keys = append(keys, v.(string))
+		}
+	}
+	return keys
+}
+
+func armVirtualMachineExtensionSettingsIgnoreKeys(d *schema.ResourceData) []string {
+	keys := make([]string, 0)
+	if raw, ok := d.GetOk("settings_ignore_keys"); ok {
+		for _, v := range raw.([]interface{}) {
+			keys = append(keys, v.(string))
+		}
+	}
+	return keys
+}
+
+// armVirtualMachineExtensionUnorderedArrayKeys returns the array-valued keys
+// whose order is insignificant, mapped to the sub-key they're sorted by: the
+// defaults for the extension type, overridden by those configured.
+func armVirtualMachineExtensionUnorderedArrayKeys(d *schema.ResourceData) map[string]string {
+	keys := make(map[string]string)
+	publisher, _ := d.Get("publisher").(string)
+	extensionType, _ := d.Get("type").(string)
+	for key, sortBy := range defaultUnorderedSettingsArrayKeys[strings.ToLower(fmt.Sprintf("%s/%s", publisher, extensionType))] {
+		keys[key] = sortBy
+	}
+	if raw, ok := d.GetOk("unordered_settings_array_keys"); ok {
+		for _, v := range raw.([]interface{}) {
+			config := v.(map[string]interface{})
+			keys[config["key"].(string)] = config["sort_by"].(string)
+		}
+	}
+	return keys
 }
@@ -0,0 +1,426 @@
+package azurerm
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/azure-sdk-for-go/arm/resources/resources"
+	"github.com/hashicorp/terraform/helper/resource"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// resourceArmVirtualMachineExtensionBatch deploys the same Virtual Machine
+// Extension to an ordered list of Virtual Machines, a batch at a time, halting
+// the rollout when any Extension in a batch fails.
+func resourceArmVirtualMachineExtensionBatch() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceArmVirtualMachineExtensionBatchCreateUpdate,
+		Read:   resourceArmVirtualMachineExtensionBatchRead,
+		Update: resourceArmVirtualMachineExtensionBatchCreateUpdate,
+		Delete: resourceArmVirtualMachineExtensionBatchDelete,
+
+		Timeouts: &schema.ResourceTimeout{
+			Create: schema.DefaultTimeout(60 * time.Minute),
+			Update: schema.DefaultTimeout(60 * time.Minute),
+		},
+
+		Schema: map[string]*schema.Schema{
+			"name": {
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+
+			"location": locationSchema(),
+
+			// the order of the VMs is the order of the rollout
+			"virtual_machine_ids": {
+				Type:     schema.TypeList,
+				Required: true,
+				ForceNew: true,
+				MinItems: 1,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+
+			// the last batch size is repeated for the remaining VMs
+			"batch_sizes": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type:         schema.TypeInt,
+					ValidateFunc: validateBatchSize,
+				},
+			},
+
+			"rollback_on_failure": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"publisher": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+
+			"type": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+
+			"type_handler_version": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+
+			"auto_upgrade_minor_version": {
+				Type:     schema.TypeBool,
+				Optional: true,
+			},
+
+			"settings": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				ValidateFunc:     validateArmVirtualMachineExtensionSettingsObject,
+				DiffSuppressFunc: suppressDiffVirtualMachineExtensionSettings,
+			},
+
+			"protected_settings": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				Sensitive:        true,
+				ValidateFunc:     validateArmVirtualMachineExtensionSettingsObject,
+				DiffSuppressFunc: suppressDiffVirtualMachineExtensionSettings,
+			},
+
+			"succeeded_batches": {
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+
+			// the provisioning state (or error) of the Extension, keyed by VM ID
+			"results": {
+				Type:     schema.TypeMap,
+				Computed: true,
+			},
+		},
+	}
+}
+
+func resourceArmVirtualMachineExtensionBatchCreateUpdate(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*ArmClient)
+
+	name := d.Get("name").(string)
+	location := d.Get("location").(string)
+
+	timeout := d.Timeout(schema.TimeoutCreate)
+	if !d.IsNewResource() {
+		timeout = d.Timeout(schema.TimeoutUpdate)
+	}
+	deadline := time.Now().Add(timeout)
+
+	extension, err := expandArmVirtualMachineExtensionBatch(d)
+	if err != nil {
+		return err
+	}
+
+	vms := make([]resources.GenericResource, 0)
+	for _, v := range d.Get("virtual_machine_ids").([]interface{}) {
+		id := v.(string)
+		vms = append(vms, resources.GenericResource{ID: &id, Location: &location})
+	}
+
+	batchSizes := make([]int, 0)
+	for _, v := range d.Get("batch_sizes").([]interface{}) {
+		batchSizes = append(batchSizes, v.(int))
+	}
+
+	results, previous, succeeded, rolloutErr := rolloutArmVirtualMachineExtensionBatches(client, name, extension, vms, batchSizes, deadline)
+
+	if rolloutErr != nil && d.Get("rollback_on_failure").(bool) {
+		// the Extensions found when the resource is created weren't deployed by
+		// it, so their protected settings are unknown
+		oldProtectedSettings, _ := d.GetChange("protected_settings")
+		if err := rollbackArmVirtualMachineExtensionBatches(client, name, previous, oldProtectedSettings.(string), !d.IsNewResource(), len(previous)+1, deadline); err != nil {
+			return fmt.Errorf("%s\n\nAdditionally, rolling back the deployed Extensions failed: %s", rolloutErr, err)
+		}
+
+		if d.IsNewResource() {
+			return rolloutErr
+		}
+		for vmId := range previous {
+			results[vmId] = "RolledBack"
+		}
+		succeeded = 0
+	}
+
+	// the deployed Extensions are kept in the state (tainted, on failure) so
+	// that they're removed when the resource is destroyed
+	if d.IsNewResource() {
+		d.SetId(resource.UniqueId())
+	}
+	d.Set("results", results)
+	d.Set("succeeded_batches", succeeded)
+
+	return rolloutErr
+}
+
+func resourceArmVirtualMachineExtensionBatchRead(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*ArmClient).vmExtensionClient
+	name := d.Get("name").(string)
+
+	results := make(map[string]interface{})
+	for _, v := range d.Get("virtual_machine_ids").([]interface{}) {
+		vmId := v.(string)
+		id, err := parseAzureResourceID(vmId)
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Get(id.ResourceGroup, id.Path["virtualMachines"], name, "")
+		if err != nil {
+			if resp.StatusCode == http.StatusNotFound {
+				results[vmId] = "NotFound"
+				continue
+			}
+			return fmt.Errorf("Error making Read request on Virtual Machine Extension %s on %q: %s", name, vmId, err)
+		}
+
+		state := "Unknown"
+		if props := resp.VirtualMachineExtensionProperties; props != nil && props.ProvisioningState != nil {
+			state = *props.ProvisioningState
+		}
+		results[vmId] = state
+	}
+
+	d.Set("results", results)
+
+	return nil
+}
+
+func resourceArmVirtualMachineExtensionBatchDelete(d *schema.ResourceData, meta interface{}) error {
+	vmIds := make([]string, 0)
+	for _, v := range d.Get("virtual_machine_ids").([]interface{}) {
+		vmIds = append(vmIds, v.(string))
+	}
+
+	parallelism := 1
+	for _, v := range d.Get("batch_sizes").([]interface{}) {
+		if size := v.(int); size > parallelism {
+			parallelism = size
+		}
+	}
+
+	return deleteArmVirtualMachineExtensionFleet(meta.(*ArmClient), d.Get("name").(string), vmIds, parallelism)
+}
+
+func expandArmVirtualMachineExtensionBatch(d *schema.ResourceData) (compute.VirtualMachineExtension, error) {
+	// the fleet resource shares the same extension arguments
+	return expandArmVirtualMachineExtensionFleet(d)
+}
+
+// splitArmVirtualMachineExtensionBatches splits the VMs into consecutive
+// batches of the given sizes, repeating the last size for the remaining VMs.
+// Without any sizes, all of the VMs are deployed in a single batch.
+func splitArmVirtualMachineExtensionBatches(vms []resources.GenericResource, sizes []int) [][]resources.GenericResource {
+	batches := make([][]resources.GenericResource, 0)
+	if len(sizes) == 0 {
+		return append(batches, vms)
+	}
+
+	for i := 0; len(vms) > 0; i++ {
+		size := sizes[len(sizes)-1]
+		if i < len(sizes) {
+			size = sizes[i]
+		}
+		if size > len(vms) {
+			size = len(vms)
+		}
+
+		batches = append(batches, vms[:size])
+		vms = vms[size:]
+	}
+
+	return batches
+}
+
+// rolloutArmVirtualMachineExtensionBatches deploys the extension one batch
+// at a time, stopping after the first batch containing a failure or once the
+// deadline has passed. The VMs in a batch are deployed concurrently. Along
+// with the results it returns the Extension each VM deployed to had before,
+// which is nil for those created by the rollout.
+func rolloutArmVirtualMachineExtensionBatches(client *ArmClient, name string, extension compute.VirtualMachineExtension, vms []resources.GenericResource, sizes []int, deadline time.Time) (map[string]interface{}, map[string]*compute.VirtualMachineExtension, int, error) {
+	results := make(map[string]interface{}, len(vms))
+	previous := make(map[string]*compute.VirtualMachineExtension, len(vms))
+	batches := splitArmVirtualMachineExtensionBatches(vms, sizes)
+
+	// the deployments in flight are cancelled once the deadline passes, so
+	// that a single stuck VM doesn't hold up the rollout past its timeout
+	cancel := make(chan struct{})
+	timer := time.AfterFunc(time.Until(deadline), func() { close(cancel) })
+	defer timer.Stop()
+
+	for i, batch := range batches {
+		if time.Now().After(deadline) {
+			return results, previous, i, fmt.Errorf("Timed out rolling out Virtual Machine Extension %q after %d of %d batches", name, i, len(batches))
+		}
+
+		log.Printf("[DEBUG] Deploying Virtual Machine Extension %q to batch %d of %d (%d Virtual Machines)", name, i+1, len(batches), len(batch))
+		batchResults, batchPrevious := deployArmVirtualMachineExtensionBatch(client, name, extension, batch, deadline, cancel)
+
+		failed := make([]string, 0)
+		for vmId, result := range batchResults {
+			results[vmId] = result
+			if result != "Succeeded" {
+				failed = append(failed, fmt.Sprintf("%s: %s", vmId, result))
+			}
+		}
+		for vmId, extension := range batchPrevious {
+			previous[vmId] = extension
+		}
+
+		if len(failed) > 0 {
+			sort.Strings(failed)
+			return results, previous, i, fmt.Errorf("Halting the rollout of Virtual Machine Extension %q: batch %d of %d failed on %d Virtual Machine(s):\n%s", name, i+1, len(batches), len(failed), strings.Join(failed, "\n"))
+		}
+	}
+
+	return results, previous, len(batches), nil
+}
+
+// deployArmVirtualMachineExtensionBatch deploys the extension to the VMs of a
+// batch concurrently, waiting for each to be provisioned until the deadline.
+// The Extension each VM had is read first, so that it can be restored.
+func deployArmVirtualMachineExtensionBatch(client *ArmClient, name string, extension compute.VirtualMachineExtension, vms []resources.GenericResource, deadline time.Time, cancel <-chan struct{}) (map[string]interface{}, map[string]*compute.VirtualMachineExtension) {
+	results := make(map[string]interface{}, len(vms))
+	previous := make(map[string]*compute.VirtualMachineExtension, len(vms))
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, vm := range vms {
+		wg.Add(1)
+		go func(vm resources.GenericResource) {
+			defer wg.Done()
+
+			id, err := parseAzureResourceID(*vm.ID)
+			if err != nil {
+				lock.Lock()
+				results[*vm.ID] = err.Error()
+				lock.Unlock()
+				return
+			}
+			resGroup, vmName := id.ResourceGroup, id.Path["virtualMachines"]
+
+			existing, err := client.vmExtensionClient.Get(resGroup, vmName, name, "")
+			var before *compute.VirtualMachineExtension
+			if err == nil {
+				before = &existing
+			} else if existing.Response.Response == nil || existing.StatusCode != http.StatusNotFound {
+				lock.Lock()
+				results[*vm.ID] = fmt.Sprintf("Error reading the existing Extension: %s", err)
+				lock.Unlock()
+				return
+			}
+
+			vmExtension := extension
+			vmExtension.Location = vm.Location
+			err = createArmVirtualMachineExtension(client, resGroup, vmName, name, vmExtension, nil, false, 0, deadline, cancel)
+			if err == nil {
+				err = waitForArmVirtualMachineExtensionProvisioned(client, resGroup, vmName, name, time.Until(deadline), cancel)
+			}
+
+			result := "Succeeded"
+			if err != nil {
+				result = err.Error()
+			}
+
+			lock.Lock()
+			results[*vm.ID] = result
+			previous[*vm.ID] = before
+			lock.Unlock()
+		}(vm)
+	}
+
+	wg.Wait()
+	return results, previous
+}
+
+// rollbackArmVirtualMachineExtensionBatches undoes a rollout: the Extensions
+// it created are deleted, while those it updated are restored to the
+// definition they had before (along with the previous protected settings,
+// which Azure doesn't return) until the deadline. Unless restoreUpdated is
+// set, the protected settings of the updated Extensions are unknown, so they
+// aren't restored and an error lists them. VMs the rollout didn't reach are
+// left as-is.
+func rollbackArmVirtualMachineExtensionBatches(client *ArmClient, name string, previous map[string]*compute.VirtualMachineExtension, oldProtectedSettings string, restoreUpdated bool, parallelism int, deadline time.Time) error {
+	created := make([]string, 0)
+	restored := make([]string, 0)
+	for vmId, extension := range previous {
+		if extension == nil {
+			created = append(created, vmId)
+		} else {
+			restored = append(restored, vmId)
+		}
+	}
+	sort.Strings(created)
+	sort.Strings(restored)
+
+	log.Printf("[DEBUG] Rolling back Virtual Machine Extension %q: deleting it from %d and restoring it on %d Virtual Machine(s)", name, len(created), len(restored))
+	if err := deleteArmVirtualMachineExtensionFleet(client, name, created, parallelism); err != nil {
+		return err
+	}
+
+	if !restoreUpdated {
+		if len(restored) > 0 {
+			return fmt.Errorf("Not restoring the previous Virtual Machine Extension %q on %d Virtual Machine(s), since it existed before this resource and its protected settings are unknown. The rolled out Extension is left on:\n%s", name, len(restored), strings.Join(restored, "\n"))
+		}
+		return nil
+	}
+
+	cancel := make(chan struct{})
+	timer := time.AfterFunc(time.Until(deadline), func() { close(cancel) })
+	defer timer.Stop()
+
+	failed := make([]string, 0)
+	for _, vmId := range restored {
+		err := restoreArmVirtualMachineExtensionBatchExtension(client, name, vmId, *previous[vmId], oldProtectedSettings, deadline, cancel)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", vmId, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Error restoring the previous Virtual Machine Extension %q on %d Virtual Machine(s):\n%s", name, len(failed), strings.Join(failed, "\n"))
+	}
+
+	return nil
+}
+
+func restoreArmVirtualMachineExtensionBatchExtension(client *ArmClient, name, vmId string, previous compute.VirtualMachineExtension, oldProtectedSettings string, deadline time.Time, cancel <-chan struct{}) error {
+	id, err := parseAzureResourceID(vmId)
+	if err != nil {
+		return err
+	}
+
+	rollback, err := expandArmVirtualMachineExtensionRollback(previous, oldProtectedSettings, false, nil)
+	if err != nil {
+		return err
+	}
+	if err := createArmVirtualMachineExtension(client, id.ResourceGroup, id.Path["virtualMachines"], name, rollback, nil, false, 0, deadline, cancel); err != nil {
+		return err
+	}
+
+	return waitForArmVirtualMachineExtensionProvisioned(client, id.ResourceGroup, id.Path["virtualMachines"], name, time.Until(deadline), cancel)
+}
+
+func validateBatchSize(v interface{}, k string) (ws []string, errors []error) {
+	if v.(int) < 1 {
+		errors = append(errors, fmt.Errorf("%q must be at least 1", k))
+	}
+	return
+}
@@ -0,0 +1,227 @@
+package azurerm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/azure-sdk-for-go/arm/resources/resources"
+)
+
+func testVirtualMachineExtensionBatchVMs(names ...string) []resources.GenericResource {
+	location := "westus"
+	vms := make([]resources.GenericResource, 0, len(names))
+	for _, name := range names {
+		id := fmt.Sprintf("/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/%s", name)
+		vms = append(vms, resources.GenericResource{ID: &id, Location: &location})
+	}
+	return vms
+}
+
+func TestSplitArmVirtualMachineExtensionBatches(t *testing.T) {
+	vms := testVirtualMachineExtensionBatchVMs("a", "b", "c", "d", "e", "f", "g")
+
+	cases := []struct {
+		Sizes    []int
+		Expected []int
+	}{
+		{Sizes: nil, Expected: []int{7}},
+		{Sizes: []int{1}, Expected: []int{1, 1, 1, 1, 1, 1, 1}},
+		{Sizes: []int{1, 3}, Expected: []int{1, 3, 3}},
+		{Sizes: []int{2, 10}, Expected: []int{2, 5}},
+		{Sizes: []int{10}, Expected: []int{7}},
+	}
+
+	for _, tc := range cases {
+		batches := splitArmVirtualMachineExtensionBatches(vms, tc.Sizes)
+		actual := make([]int, 0)
+		for _, batch := range batches {
+			actual = append(actual, len(batch))
+		}
+		if fmt.Sprint(actual) != fmt.Sprint(tc.Expected) {
+			t.Fatalf("Expected batch sizes %v for %v, got %v", tc.Expected, tc.Sizes, actual)
+		}
+	}
+}
+
+func TestRolloutArmVirtualMachineExtensionBatches_haltsOnFailure(t *testing.T) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "GET" {
+			fmt.Fprint(w, `{"name":"hostname","properties":{"provisioningState":"Succeeded"}}`)
+			return
+		}
+		atomic.AddInt32(&requests, 1)
+		if strings.Contains(r.URL.Path, "/virtualMachines/c/") {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, `{"error":{"code":"OperationNotAllowed","message":"The VM is deallocated."}}`)
+			return
+		}
+		fmt.Fprint(w, `{"name":"hostname","properties":{"provisioningState":"Succeeded"}}`)
+	}))
+	defer server.Close()
+
+	client := testArmClientWithBaseURI(server.URL)
+	vms := testVirtualMachineExtensionBatchVMs("a", "b", "c", "d", "e")
+
+	results, _, succeeded, err := rolloutArmVirtualMachineExtensionBatches(client, "hostname", compute.VirtualMachineExtension{}, vms, []int{1, 2}, time.Now().Add(time.Minute))
+	if err == nil {
+		t.Fatalf("Expected the rollout to fail")
+	}
+	if succeeded != 1 {
+		t.Fatalf("Expected only the canary batch to succeed, got %d", succeeded)
+	}
+	if requests != 3 {
+		t.Fatalf("Expected the rollout to halt after the second batch, got %d requests", requests)
+	}
+	if len(results) != 3 {
+		t.Fatalf("Expected results for the 3 VMs which were deployed to, got %d", len(results))
+	}
+}
+
+func TestRolloutArmVirtualMachineExtensionBatches_deadline(t *testing.T) {
+	client := testArmClientWithBaseURI("http://127.0.0.1:0")
+	vms := testVirtualMachineExtensionBatchVMs("a", "b")
+
+	_, _, succeeded, err := rolloutArmVirtualMachineExtensionBatches(client, "hostname", compute.VirtualMachineExtension{}, vms, []int{1}, time.Now().Add(-time.Second))
+	if err == nil || !strings.Contains(err.Error(), "Timed out") {
+		t.Fatalf("Expected the rollout to time out, got %v", err)
+	}
+	if succeeded != 0 {
+		t.Fatalf("Expected no batches to succeed, got %d", succeeded)
+	}
+}
+
+func TestRolloutArmVirtualMachineExtensionBatches_deadlineCancelsBatch(t *testing.T) {
+	block := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "GET" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"code":"NotFound","message":"The entity was not found."}}`)
+			return
+		}
+		// the VM never responds
+		<-block
+	}))
+	defer server.Close()
+	defer close(block)
+
+	client := testArmClientWithBaseURI(server.URL)
+	vms := testVirtualMachineExtensionBatchVMs("a")
+
+	done := make(chan error)
+	go func() {
+		_, _, _, err := rolloutArmVirtualMachineExtensionBatches(client, "hostname", compute.VirtualMachineExtension{}, vms, nil, time.Now().Add(500*time.Millisecond))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatalf("Expected the stuck deployment to fail")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Expected the deadline to cancel the stuck deployment")
+	}
+}
+
+func TestRollbackArmVirtualMachineExtensionBatches(t *testing.T) {
+	var lock sync.Mutex
+	requests := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		lock.Lock()
+		if r.Method != "GET" {
+			body, _ := ioutil.ReadAll(r.Body)
+			requests = append(requests, fmt.Sprintf("%s %s %s", r.Method, r.URL.Path, body))
+		}
+		lock.Unlock()
+		if r.Method == "DELETE" {
+			return
+		}
+		fmt.Fprint(w, `{"name":"hostname","properties":{"provisioningState":"Succeeded"}}`)
+	}))
+	defer server.Close()
+
+	settings := map[string]interface{}{"commandToExecute": "previous"}
+	publisher, extensionType, version := "Microsoft.OSTCExtensions", "CustomScriptForLinux", "1.2"
+	vms := testVirtualMachineExtensionBatchVMs("created", "updated")
+	previous := map[string]*compute.VirtualMachineExtension{
+		*vms[0].ID: nil,
+		*vms[1].ID: {
+			VirtualMachineExtensionProperties: &compute.VirtualMachineExtensionProperties{
+				Publisher:          &publisher,
+				Type:               &extensionType,
+				TypeHandlerVersion: &version,
+				Settings:           &settings,
+			},
+		},
+	}
+
+	client := testArmClientWithBaseURI(server.URL)
+	if err := rollbackArmVirtualMachineExtensionBatches(client, "hostname", previous, `{"secret":"old"}`, true, 2, time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("Error rolling back: %s", err)
+	}
+
+	if len(requests) != 2 {
+		t.Fatalf("Expected the created Extension to be deleted and the updated one restored, got %v", requests)
+	}
+	for _, request := range requests {
+		switch {
+		case strings.HasPrefix(request, "DELETE ") && strings.Contains(request, "/virtualMachines/created/"):
+		case strings.HasPrefix(request, "PUT ") && strings.Contains(request, "/virtualMachines/updated/"):
+			if !strings.Contains(request, `"commandToExecute":"previous"`) || !strings.Contains(request, `"secret":"old"`) {
+				t.Fatalf("Expected the previous definition to be restored, got %s", request)
+			}
+		default:
+			t.Fatalf("Unexpected request %s", request)
+		}
+	}
+}
+
+func TestRollbackArmVirtualMachineExtensionBatches_existingExtensions(t *testing.T) {
+	var lock sync.Mutex
+	requests := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		if r.Method != "GET" {
+			requests = append(requests, fmt.Sprintf("%s %s", r.Method, r.URL.Path))
+		}
+		lock.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	publisher := "Microsoft.OSTCExtensions"
+	vms := testVirtualMachineExtensionBatchVMs("created", "existing")
+	previous := map[string]*compute.VirtualMachineExtension{
+		*vms[0].ID: nil,
+		*vms[1].ID: {
+			VirtualMachineExtensionProperties: &compute.VirtualMachineExtensionProperties{
+				Publisher: &publisher,
+			},
+		},
+	}
+
+	// the Extensions found when the resource was created aren't restored
+	// without their protected settings
+	client := testArmClientWithBaseURI(server.URL)
+	err := rollbackArmVirtualMachineExtensionBatches(client, "hostname", previous, "", false, 2, time.Now().Add(time.Minute))
+	if err == nil || !strings.Contains(err.Error(), *vms[1].ID) {
+		t.Fatalf("Expected an error listing the Extension which wasn't restored, got %v", err)
+	}
+
+	if len(requests) != 1 || !strings.HasPrefix(requests[0], "DELETE ") || !strings.Contains(requests[0], "/virtualMachines/created/") {
+		t.Fatalf("Expected only the created Extension to be deleted, got %v", requests)
+	}
+}
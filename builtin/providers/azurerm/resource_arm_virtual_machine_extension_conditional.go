@@ -0,0 +1,95 @@
+package azurerm
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// armVirtualMachineExtensionConditionalSkipReason is the `skip_reason` of an
+// Extension which isn't deployed since its `condition` is false.
+const armVirtualMachineExtensionConditionalSkipReason = "`condition` is false"
+
+// resourceArmVirtualMachineExtensionConditional is an
+// azurerm_virtual_machine_extension which is only deployed while its
+// `condition` is true, so that an Extension can be toggled without the
+// resource being destroyed and recreated through `count`.
+func resourceArmVirtualMachineExtensionConditional() *schema.Resource {
+	r := resourceArmVirtualMachineExtensions()
+
+	r.Create = withArmVirtualMachineExtensionOperationResult("create", resourceArmVirtualMachineExtensionConditionalCreate)
+	r.Read = resourceArmVirtualMachineExtensionConditionalRead
+	r.Update = withArmVirtualMachineExtensionOperationResult("update", resourceArmVirtualMachineExtensionConditionalUpdate)
+	r.Delete = withArmVirtualMachineExtensionOperationResult("delete", resourceArmVirtualMachineExtensionConditionalDelete)
+	// an imported Extension has no `condition` to read back
+	r.Importer = nil
+
+	r.Schema["condition"] = &schema.Schema{
+		Type:     schema.TypeBool,
+		Required: true,
+	}
+
+	return r
+}
+
+func resourceArmVirtualMachineExtensionConditionalCreate(d *schema.ResourceData, meta interface{}) error {
+	if d.Get("condition").(bool) {
+		return resourceArmVirtualMachineExtensionsCreate(d, meta)
+	}
+
+	name := d.Get("name").(string)
+	resGroup, vmName, err := armVirtualMachineExtensionVirtualMachine(d)
+	if err != nil {
+		return err
+	}
+	setArmVirtualMachineExtensionVirtualMachine(d, meta.(*ArmClient).subscriptionId, resGroup, vmName)
+	log.Printf("[INFO] Not creating Virtual Machine Extension %q since its `condition` is false", name)
+
+	// the ID is that of the Extension, so that the Delete of the underlying
+	// resource removes it once it's been deployed
+	d.SetId(fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachines/%s/extensions/%s", meta.(*ArmClient).subscriptionId, resGroup, vmName, name))
+	d.Set("skipped", true)
+	d.Set("skip_reason", armVirtualMachineExtensionConditionalSkipReason)
+	return nil
+}
+
+func resourceArmVirtualMachineExtensionConditionalRead(d *schema.ResourceData, meta interface{}) error {
+	// there's nothing in Azure to read, and unlike a skipped Extension this
+	// one mustn't be removed from the state for being missing
+	if !d.Get("condition").(bool) {
+		return nil
+	}
+
+	return resourceArmVirtualMachineExtensionsRead(d, meta)
+}
+
+func resourceArmVirtualMachineExtensionConditionalUpdate(d *schema.ResourceData, meta interface{}) error {
+	old, new := d.GetChange("condition")
+
+	switch {
+	case new.(bool) && !old.(bool):
+		// the Extension doesn't exist yet, so is created rather than updated
+		d.MarkNewResource()
+		return resourceArmVirtualMachineExtensionsCreate(d, meta)
+	case new.(bool):
+		return resourceArmVirtualMachineExtensionsUpdate(d, meta)
+	case old.(bool):
+		log.Printf("[INFO] Deleting Virtual Machine Extension %q since its `condition` is now false", d.Get("name").(string))
+		if err := resourceArmVirtualMachineExtensionsDelete(d, meta); err != nil {
+			return err
+		}
+	}
+
+	d.Set("skipped", true)
+	d.Set("skip_reason", armVirtualMachineExtensionConditionalSkipReason)
+	return nil
+}
+
+func resourceArmVirtualMachineExtensionConditionalDelete(d *schema.ResourceData, meta interface{}) error {
+	if !d.Get("condition").(bool) {
+		return nil
+	}
+
+	return resourceArmVirtualMachineExtensionsDelete(d, meta)
+}
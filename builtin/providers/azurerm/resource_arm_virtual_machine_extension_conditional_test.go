@@ -0,0 +1,93 @@
+package azurerm
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hashicorp/terraform/config"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestResourceArmVirtualMachineExtensionConditional_toggle(t *testing.T) {
+	var puts, deletes int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "PUT" && strings.Contains(r.URL.Path, "/extensions/"):
+			atomic.AddInt32(&puts, 1)
+			fmt.Fprint(w, `{"name":"hostname","properties":{"provisioningState":"Succeeded"}}`)
+		case r.Method == "DELETE" && strings.Contains(r.URL.Path, "/extensions/"):
+			atomic.AddInt32(&deletes, 1)
+		case strings.Contains(r.URL.Path, "/extensions/"):
+			fmt.Fprint(w, `{"id":"/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/hostname","name":"hostname","location":"westus","properties":{"publisher":"Microsoft.OSTCExtensions","type":"CustomScriptForLinux","typeHandlerVersion":"1.2","provisioningState":"Succeeded"}}`)
+		default:
+			fmt.Fprint(w, `{"name":"acctvm","properties":{}}`)
+		}
+	}))
+	defer server.Close()
+
+	client := testArmClientWithBaseURI(server.URL)
+	client.subscriptionId = "00000000-0000-0000-0000-000000000000"
+	resource := resourceArmVirtualMachineExtensionConditional()
+
+	apply := func(state *terraform.InstanceState, condition bool) *terraform.InstanceState {
+		raw, err := config.NewRawConfig(map[string]interface{}{
+			"name":                 "hostname",
+			"location":             "westus",
+			"resource_group_name":  "acctestRG",
+			"virtual_machine_name": "acctvm",
+			"publisher":            "Microsoft.OSTCExtensions",
+			"type":                 "CustomScriptForLinux",
+			"type_handler_version": "1.2",
+			"condition":            condition,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		diff, err := resource.Diff(state, terraform.NewResourceConfig(raw))
+		if err != nil {
+			t.Fatalf("Error planning the Extension with the condition %t: %s", condition, err)
+		}
+		state, err = resource.Apply(state, diff, client)
+		if err != nil {
+			t.Fatalf("Error applying the Extension with the condition %t: %s", condition, err)
+		}
+		if state == nil || state.ID == "" {
+			t.Fatalf("Expected the Extension with the condition %t to be kept in the state, got %+v", condition, state)
+		}
+		return state
+	}
+
+	state := apply(nil, false)
+	if puts != 0 || state.Attributes["skipped"] != "true" {
+		t.Fatalf("Expected the Extension not to be created while the condition is false, got %d requests and %+v", puts, state.Attributes)
+	}
+
+	state, err := resource.Refresh(state, client)
+	if err != nil || state == nil {
+		t.Fatalf("Expected the Extension to be kept in the state on refresh, got %+v (%v)", state, err)
+	}
+
+	state = apply(state, true)
+	if puts != 1 || state.Attributes["skipped"] != "false" {
+		t.Fatalf("Expected the Extension to be created once the condition is true, got %d requests and %+v", puts, state.Attributes)
+	}
+
+	state = apply(state, false)
+	if deletes != 1 || state.Attributes["skipped"] != "true" {
+		t.Fatalf("Expected the Extension to be deleted once the condition is false, got %d requests and %+v", deletes, state.Attributes)
+	}
+
+	if _, err := resource.Apply(state, &terraform.InstanceDiff{Destroy: true}, client); err != nil {
+		t.Fatalf("Error destroying the Extension: %s", err)
+	}
+	if deletes != 1 {
+		t.Fatalf("Expected no Extension to be deleted while the condition is false, got %d requests", deletes)
+	}
+}
@@ -0,0 +1,394 @@
+package azurerm
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/azure-sdk-for-go/arm/resources/resources"
+	"github.com/hashicorp/terraform/helper/resource"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+// resourceArmVirtualMachineExtensionFleet is an experimental resource which
+// deploys the same Virtual Machine Extension to every Virtual Machine matching
+// a tag selector.
+func resourceArmVirtualMachineExtensionFleet() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceArmVirtualMachineExtensionFleetCreateUpdate,
+		Read:   resourceArmVirtualMachineExtensionFleetRead,
+		Update: resourceArmVirtualMachineExtensionFleetCreateUpdate,
+		Delete: resourceArmVirtualMachineExtensionFleetDelete,
+
+		Timeouts: &schema.ResourceTimeout{
+			Create: schema.DefaultTimeout(60 * time.Minute),
+			Update: schema.DefaultTimeout(60 * time.Minute),
+		},
+
+		Schema: map[string]*schema.Schema{
+			"name": {
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+
+			// optionally limits the selection to a single Resource Group
+			"resource_group_name": {
+				Type:     schema.TypeString,
+				Optional: true,
+				ForceNew: true,
+			},
+
+			"tag_selector": {
+				Type:     schema.TypeMap,
+				Required: true,
+			},
+
+			"publisher": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+
+			"type": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+
+			"type_handler_version": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+
+			"auto_upgrade_minor_version": {
+				Type:     schema.TypeBool,
+				Optional: true,
+			},
+
+			"settings": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				ValidateFunc:     validateArmVirtualMachineExtensionSettingsObject,
+				DiffSuppressFunc: suppressDiffVirtualMachineExtensionSettings,
+			},
+
+			"protected_settings": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				Sensitive:        true,
+				ValidateFunc:     validateArmVirtualMachineExtensionSettingsObject,
+				DiffSuppressFunc: suppressDiffVirtualMachineExtensionSettings,
+			},
+
+			"parallelism": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      10,
+				ValidateFunc: validation.IntBetween(1, 100),
+			},
+
+			"virtual_machine_ids": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+
+			// the provisioning state (or error) of the Extension, keyed by VM ID
+			"results": {
+				Type:     schema.TypeMap,
+				Computed: true,
+			},
+		},
+	}
+}
+
+func resourceArmVirtualMachineExtensionFleetCreateUpdate(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*ArmClient)
+
+	name := d.Get("name").(string)
+	resGroup := d.Get("resource_group_name").(string)
+	selector := d.Get("tag_selector").(map[string]interface{})
+	parallelism := d.Get("parallelism").(int)
+
+	timeout := d.Timeout(schema.TimeoutCreate)
+	if !d.IsNewResource() {
+		timeout = d.Timeout(schema.TimeoutUpdate)
+	}
+	deadline := time.Now().Add(timeout)
+
+	extension, err := expandArmVirtualMachineExtensionFleet(d)
+	if err != nil {
+		return err
+	}
+
+	vms, err := findArmVirtualMachinesByTags(client, resGroup, selector)
+	if err != nil {
+		return err
+	}
+
+	vmIds := make([]string, 0, len(vms))
+	for _, vm := range vms {
+		vmIds = append(vmIds, *vm.ID)
+	}
+
+	results := deployArmVirtualMachineExtensionFleet(client, name, extension, vms, parallelism, deadline)
+
+	// remove the Extension from any VMs which no longer match the selector
+	if !d.IsNewResource() {
+		old, _ := d.GetChange("virtual_machine_ids")
+		removed := make([]string, 0)
+		for _, v := range old.([]interface{}) {
+			if _, selected := results[v.(string)]; !selected {
+				removed = append(removed, v.(string))
+			}
+		}
+		if err := deleteArmVirtualMachineExtensionFleet(client, name, removed, parallelism); err != nil {
+			return err
+		}
+	}
+
+	if d.IsNewResource() {
+		d.SetId(resource.UniqueId())
+	}
+	d.Set("virtual_machine_ids", vmIds)
+	d.Set("results", results)
+
+	// the Extensions deployed are kept in the state (tainted, when created),
+	// along with the results of the failed ones
+	failed := make([]string, 0)
+	for vmId, result := range results {
+		if result != "Succeeded" {
+			failed = append(failed, fmt.Sprintf("%s: %s", vmId, result))
+		}
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("Virtual Machine Extension %q failed on %d of %d Virtual Machine(s), see `results` for details:\n%s", name, len(failed), len(results), strings.Join(failed, "\n"))
+	}
+
+	return nil
+}
+
+func resourceArmVirtualMachineExtensionFleetRead(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*ArmClient).vmExtensionClient
+	name := d.Get("name").(string)
+
+	results := make(map[string]interface{})
+	for _, v := range d.Get("virtual_machine_ids").([]interface{}) {
+		vmId := v.(string)
+		id, err := parseAzureResourceID(vmId)
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Get(id.ResourceGroup, id.Path["virtualMachines"], name, "")
+		if err != nil {
+			if resp.StatusCode == http.StatusNotFound {
+				results[vmId] = "NotFound"
+				continue
+			}
+			return fmt.Errorf("Error making Read request on Virtual Machine Extension %s on %q: %s", name, vmId, err)
+		}
+
+		state := "Unknown"
+		if props := resp.VirtualMachineExtensionProperties; props != nil && props.ProvisioningState != nil {
+			state = *props.ProvisioningState
+		}
+		results[vmId] = state
+	}
+
+	d.Set("results", results)
+
+	return nil
+}
+
+func resourceArmVirtualMachineExtensionFleetDelete(d *schema.ResourceData, meta interface{}) error {
+	vmIds := make([]string, 0)
+	for _, v := range d.Get("virtual_machine_ids").([]interface{}) {
+		vmIds = append(vmIds, v.(string))
+	}
+
+	return deleteArmVirtualMachineExtensionFleet(meta.(*ArmClient), d.Get("name").(string), vmIds, d.Get("parallelism").(int))
+}
+
+func expandArmVirtualMachineExtensionFleet(d *schema.ResourceData) (compute.VirtualMachineExtension, error) {
+	publisher := d.Get("publisher").(string)
+	extensionType := d.Get("type").(string)
+	typeHandlerVersion := d.Get("type_handler_version").(string)
+	autoUpgradeMinor := d.Get("auto_upgrade_minor_version").(bool)
+
+	extension := compute.VirtualMachineExtension{
+		VirtualMachineExtensionProperties: &compute.VirtualMachineExtensionProperties{
+			Publisher:               &publisher,
+			Type:                    &extensionType,
+			TypeHandlerVersion:      &typeHandlerVersion,
+			AutoUpgradeMinorVersion: &autoUpgradeMinor,
+		},
+	}
+
+	if settingsString := d.Get("settings").(string); settingsString != "" {
+		settings, err := expandArmVirtualMachineExtensionSettings(settingsString)
+		if err != nil {
+			return extension, fmt.Errorf("unable to parse settings: %s", err)
+		}
+		extension.VirtualMachineExtensionProperties.Settings = &settings
+	}
+
+	if protectedSettingsString := d.Get("protected_settings").(string); protectedSettingsString != "" {
+		protectedSettings, err := expandArmVirtualMachineExtensionSettings(protectedSettingsString)
+		if err != nil {
+			return extension, fmt.Errorf("unable to parse protected_settings: %s", err)
+		}
+		extension.VirtualMachineExtensionProperties.ProtectedSettings = &protectedSettings
+	}
+
+	return extension, nil
+}
+
+// findArmVirtualMachinesByTags returns the Virtual Machines (optionally in a
+// single Resource Group) which have all of the tags in the selector. Tag names
+// are matched case-insensitively, as Azure does, values must match exactly.
+func findArmVirtualMachinesByTags(client *ArmClient, resGroup string, selector map[string]interface{}) ([]resources.GenericResource, error) {
+	filter := "resourceType eq 'Microsoft.Compute/virtualMachines'"
+
+	// the later pages are requested with the same client as the first
+	var page resources.ListResult
+	var err error
+	var next func(resources.ListResult) (resources.ListResult, error)
+	if resGroup != "" {
+		page, err = client.resourceGroupClient.ListResources(resGroup, filter, "", nil)
+		next = client.resourceGroupClient.ListResourcesNextResults
+	} else {
+		page, err = client.resourceFindClient.List(filter, "", nil)
+		next = client.resourceFindClient.ListNextResults
+	}
+
+	vms := make([]resources.GenericResource, 0)
+	for {
+		if err != nil {
+			return nil, fmt.Errorf("Error making resource request for query %s: %s", filter, err)
+		}
+
+		if page.Value != nil {
+			for _, vm := range *page.Value {
+				if vm.ID != nil && matchesArmTagSelector(vm.Tags, selector) {
+					vms = append(vms, vm)
+				}
+			}
+		}
+
+		if page.NextLink == nil || *page.NextLink == "" {
+			break
+		}
+		page, err = next(page)
+	}
+
+	return vms, nil
+}
+
+func matchesArmTagSelector(tags *map[string]*string, selector map[string]interface{}) bool {
+	for key, value := range selector {
+		if tags == nil {
+			return false
+		}
+
+		matched := false
+		for k, v := range *tags {
+			if strings.EqualFold(k, key) && v != nil && *v == value.(string) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// deployArmVirtualMachineExtensionFleet deploys the extension to each of the
+// VMs, at most parallelism at a time, returning the outcome keyed by VM ID.
+// The deployments still in flight when the deadline passes are cancelled.
+func deployArmVirtualMachineExtensionFleet(client *ArmClient, name string, extension compute.VirtualMachineExtension, vms []resources.GenericResource, parallelism int, deadline time.Time) map[string]interface{} {
+	results := make(map[string]interface{}, len(vms))
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallelism)
+
+	cancel := make(chan struct{})
+	timer := time.AfterFunc(time.Until(deadline), func() { close(cancel) })
+	defer timer.Stop()
+
+	for _, vm := range vms {
+		wg.Add(1)
+		go func(vm resources.GenericResource) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			result := "Succeeded"
+			id, err := parseAzureResourceID(*vm.ID)
+			if err == nil {
+				vmExtension := extension
+				vmExtension.Location = vm.Location
+				err = createArmVirtualMachineExtension(client, id.ResourceGroup, id.Path["virtualMachines"], name, vmExtension, nil, false, 0, deadline, cancel)
+			}
+			if err != nil {
+				result = err.Error()
+			}
+
+			lock.Lock()
+			results[*vm.ID] = result
+			lock.Unlock()
+		}(vm)
+	}
+
+	wg.Wait()
+	return results
+}
+
+func deleteArmVirtualMachineExtensionFleet(client *ArmClient, name string, vmIds []string, parallelism int) error {
+	errors := make([]string, 0)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallelism)
+
+	for _, vmId := range vmIds {
+		wg.Add(1)
+		go func(vmId string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			id, err := parseAzureResourceID(vmId)
+			if err == nil {
+				lockKey := armVirtualMachineExtensionsLockKey(id.ResourceGroup, id.Path["virtualMachines"])
+				armMutexKV.Lock(lockKey)
+				resp, deleteErr := client.vmExtensionClient.Delete(id.ResourceGroup, id.Path["virtualMachines"], name, make(chan struct{}))
+				armMutexKV.Unlock(lockKey)
+				if deleteErr != nil && resp.StatusCode != http.StatusNotFound {
+					err = deleteErr
+				}
+			}
+
+			if err != nil {
+				lock.Lock()
+				errors = append(errors, fmt.Sprintf("%s: %s", vmId, err))
+				lock.Unlock()
+			}
+		}(vmId)
+	}
+
+	wg.Wait()
+
+	if len(errors) > 0 {
+		return fmt.Errorf("Error deleting Virtual Machine Extension %q from %d Virtual Machine(s):\n%s", name, len(errors), strings.Join(errors, "\n"))
+	}
+
+	return nil
+}
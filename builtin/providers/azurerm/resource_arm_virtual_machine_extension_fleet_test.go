@@ -0,0 +1,185 @@
+package azurerm
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/azure-sdk-for-go/arm/resources/resources"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func TestMatchesArmTagSelector(t *testing.T) {
+	prod := "production"
+	web := "web"
+	tags := &map[string]*string{
+		"Environment": &prod,
+		"role":        &web,
+	}
+
+	cases := []struct {
+		Selector map[string]interface{}
+		Tags     *map[string]*string
+		Matches  bool
+	}{
+		{Selector: map[string]interface{}{}, Tags: nil, Matches: true},
+		{Selector: map[string]interface{}{"environment": "production"}, Tags: tags, Matches: true},
+		{Selector: map[string]interface{}{"environment": "production", "role": "web"}, Tags: tags, Matches: true},
+		{Selector: map[string]interface{}{"environment": "Production"}, Tags: tags, Matches: false},
+		{Selector: map[string]interface{}{"environment": "production", "role": "db"}, Tags: tags, Matches: false},
+		{Selector: map[string]interface{}{"owner": "ops"}, Tags: tags, Matches: false},
+		{Selector: map[string]interface{}{"owner": "ops"}, Tags: nil, Matches: false},
+	}
+
+	for i, tc := range cases {
+		if actual := matchesArmTagSelector(tc.Tags, tc.Selector); actual != tc.Matches {
+			t.Fatalf("Case %d: Expected %t, got %t", i, tc.Matches, actual)
+		}
+	}
+}
+
+func TestDeployArmVirtualMachineExtensionFleet(t *testing.T) {
+	var inFlight, maxInFlight int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if current <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, current) {
+				break
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.Path, "/virtualMachines/broken/") {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, `{"error":{"code":"OperationNotAllowed","message":"The VM is deallocated."}}`)
+			return
+		}
+		fmt.Fprint(w, `{"name":"hostname","properties":{"provisioningState":"Succeeded"}}`)
+	}))
+	defer server.Close()
+
+	location := "westus"
+	vms := make([]resources.GenericResource, 0)
+	for _, name := range []string{"web1", "web2", "web3", "broken"} {
+		id := fmt.Sprintf("/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/%s", name)
+		vms = append(vms, resources.GenericResource{ID: &id, Location: &location})
+	}
+
+	client := testArmClientWithBaseURI(server.URL)
+	results := deployArmVirtualMachineExtensionFleet(client, "hostname", compute.VirtualMachineExtension{}, vms, 2, time.Now().Add(time.Minute))
+
+	if len(results) != len(vms) {
+		t.Fatalf("Expected a result for each of the %d VMs, got %d", len(vms), len(results))
+	}
+	for id, result := range results {
+		broken := strings.HasSuffix(id, "/broken")
+		if broken && result == "Succeeded" {
+			t.Fatalf("Expected the deployment to %q to fail", id)
+		}
+		if !broken && result != "Succeeded" {
+			t.Fatalf("Expected the deployment to %q to succeed, got %q", id, result)
+		}
+	}
+
+	if maxInFlight > 2 {
+		t.Fatalf("Expected at most 2 concurrent requests, got %d", maxInFlight)
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionFleetCreate_failedVirtualMachines(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/resourceGroups/acctestRG/resources"):
+			fmt.Fprint(w, `{"value":[{"id":"/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/web1","location":"westus","tags":{"role":"web"}},{"id":"/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/broken","location":"westus","tags":{"role":"web"}}]}`)
+		case strings.Contains(r.URL.Path, "/virtualMachines/broken/"):
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, `{"error":{"code":"OperationNotAllowed","message":"The VM is deallocated."}}`)
+		default:
+			fmt.Fprint(w, `{"name":"hostname","properties":{"provisioningState":"Succeeded"}}`)
+		}
+	}))
+	defer server.Close()
+
+	client := testArmClientWithBaseURI(server.URL)
+	client.resourceGroupClient = resources.NewGroupsClientWithBaseURI(server.URL, "00000000-0000-0000-0000-000000000000")
+
+	d := testArmResourceDataRaw(t, resourceArmVirtualMachineExtensionFleet(), map[string]interface{}{
+		"name":                 "hostname",
+		"resource_group_name":  "acctestRG",
+		"tag_selector":         map[string]interface{}{"role": "web"},
+		"publisher":            "Microsoft.OSTCExtensions",
+		"type":                 "CustomScriptForLinux",
+		"type_handler_version": "1.2",
+	})
+
+	// the failures are returned, while the results are kept in the state
+	err := resourceArmVirtualMachineExtensionFleetCreateUpdate(d, client)
+	if err == nil || !strings.Contains(err.Error(), "/virtualMachines/broken: ") || strings.Contains(err.Error(), "/virtualMachines/web1: ") {
+		t.Fatalf("Expected an error listing the failed Virtual Machine, got %v", err)
+	}
+	if d.Id() == "" {
+		t.Fatalf("Expected the deployed Extensions to be kept in the state")
+	}
+	results := d.Get("results").(map[string]interface{})
+	if len(results) != 2 || results["/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/web1"] != "Succeeded" {
+		t.Fatalf("Expected the results of both Virtual Machines, got %v", results)
+	}
+}
+
+func TestFindArmVirtualMachinesByTags_resourceGroupPages(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("page") == "" {
+			fmt.Fprintf(w, `{"value":[{"id":"/vms/web1","tags":{"role":"web"}}],"nextLink":"%s/next?page=2"}`, server.URL)
+			return
+		}
+		fmt.Fprint(w, `{"value":[{"id":"/vms/web2","tags":{"role":"web"}},{"id":"/vms/db1","tags":{"role":"db"}}]}`)
+	}))
+	defer server.Close()
+
+	var groupRequests, findRequests int32
+	client := testArmClientWithBaseURI(server.URL)
+	client.resourceGroupClient = resources.NewGroupsClientWithBaseURI(server.URL, "00000000-0000-0000-0000-000000000000")
+	client.resourceGroupClient.RequestInspector = testArmCountRequests(&groupRequests)
+	client.resourceFindClient = resources.NewGroupClientWithBaseURI(server.URL, "00000000-0000-0000-0000-000000000000")
+	client.resourceFindClient.RequestInspector = testArmCountRequests(&findRequests)
+
+	vms, err := findArmVirtualMachinesByTags(client, "acctestRG", map[string]interface{}{"role": "web"})
+	if err != nil {
+		t.Fatalf("Error finding the Virtual Machines: %s", err)
+	}
+	if len(vms) != 2 || *vms[0].ID != "/vms/web1" || *vms[1].ID != "/vms/web2" {
+		t.Fatalf("Expected the matching VMs of both pages, got %+v", vms)
+	}
+	if groupRequests != 2 || findRequests != 0 {
+		t.Fatalf("Expected both pages to be requested with the Resource Group client, got %d and %d requests", groupRequests, findRequests)
+	}
+}
+
+func testArmCountRequests(count *int32) autorest.PrepareDecorator {
+	return func(p autorest.Preparer) autorest.Preparer {
+		return autorest.PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			atomic.AddInt32(count, 1)
+			return p.Prepare(r)
+		})
+	}
+}
+
+func TestSuppressDiffVirtualMachineExtensionSettings_fleet(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceArmVirtualMachineExtensionFleet().Schema, map[string]interface{}{})
+
+	if suppressDiffVirtualMachineExtensionSettings("settings", `{"A":"1"}`, `{"a":"1"}`, d) {
+		t.Fatalf("Expected differently cased keys to be a diff")
+	}
+}
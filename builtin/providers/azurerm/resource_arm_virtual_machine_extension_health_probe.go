@@ -0,0 +1,182 @@
+package azurerm
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/hashicorp/terraform/helper/resource"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// extensionHealthPollInterval is how often the VM instance view is polled
+// while waiting for an extension handler to report ready, overridden in tests.
+var extensionHealthPollInterval = 15 * time.Second
+
+func resourceArmVirtualMachineExtensionHealthProbe() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceArmVirtualMachineExtensionHealthProbeCreate,
+		Read:   resourceArmVirtualMachineExtensionHealthProbeRead,
+		Delete: resourceArmVirtualMachineExtensionHealthProbeDelete,
+
+		Timeouts: &schema.ResourceTimeout{
+			Create: schema.DefaultTimeout(10 * time.Minute),
+		},
+
+		Schema: map[string]*schema.Schema{
+			"virtual_machine_extension_id": {
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+
+			"require_healthy": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				ForceNew: true,
+				Default:  true,
+			},
+
+			"healthy": {
+				Type:     schema.TypeBool,
+				Computed: true,
+			},
+
+			"status_code": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			"status_message": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+		},
+	}
+}
+
+func resourceArmVirtualMachineExtensionHealthProbeCreate(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*ArmClient)
+	extensionId := d.Get("virtual_machine_extension_id").(string)
+
+	id, err := parseAzureResourceID(extensionId)
+	if err != nil {
+		return err
+	}
+	resGroup := id.ResourceGroup
+	vmName := id.Path["virtualMachines"]
+	name := id.Path["extensions"]
+
+	log.Printf("[DEBUG] Waiting for the handler of Virtual Machine Extension %q on %q to report ready", name, vmName)
+	stateConf := &resource.StateChangeConf{
+		Pending:    []string{"NotReady"},
+		Target:     []string{"Ready"},
+		Refresh:    extensionHealthStateRefreshFunc(client, resGroup, vmName, name),
+		Timeout:    d.Timeout(schema.TimeoutCreate),
+		MinTimeout: extensionHealthPollInterval,
+	}
+	_, waitErr := stateConf.WaitForState()
+
+	d.SetId(extensionId)
+
+	if err := resourceArmVirtualMachineExtensionHealthProbeRead(d, meta); err != nil {
+		return err
+	}
+
+	if waitErr != nil {
+		if d.Get("require_healthy").(bool) {
+			return fmt.Errorf("Error waiting for Virtual Machine Extension %q on %q to become healthy: %s", name, vmName, waitErr)
+		}
+		log.Printf("[WARN] Virtual Machine Extension %q on %q didn't become healthy: %s", name, vmName, waitErr)
+	}
+
+	return nil
+}
+
+func resourceArmVirtualMachineExtensionHealthProbeRead(d *schema.ResourceData, meta interface{}) error {
+	id, err := parseAzureResourceID(d.Id())
+	if err != nil {
+		return err
+	}
+
+	client := meta.(*ArmClient)
+	resp, err := client.vmExtensionClient.Get(id.ResourceGroup, id.Path["virtualMachines"], id.Path["extensions"], "")
+	if err != nil {
+		if resp.StatusCode == http.StatusNotFound {
+			d.SetId("")
+			return nil
+		}
+		return fmt.Errorf("Error making Read request on Virtual Machine Extension %s: %s", id.Path["extensions"], err)
+	}
+
+	health, _, err := extensionHealthStateRefreshFunc(client, id.ResourceGroup, id.Path["virtualMachines"], id.Path["extensions"])()
+	if err != nil {
+		return err
+	}
+
+	status := health.(compute.InstanceViewStatus)
+	d.Set("healthy", isArmExtensionHandlerReady(&status))
+	d.Set("status_code", status.Code)
+	d.Set("status_message", status.Message)
+
+	return nil
+}
+
+func resourceArmVirtualMachineExtensionHealthProbeDelete(d *schema.ResourceData, meta interface{}) error {
+	// the probe only exists in state, there's nothing to remove in Azure
+	d.SetId("")
+	return nil
+}
+
+// extensionHealthStateRefreshFunc reports the status of the extension's
+// handler from the VM Agent's instance view, which is `Ready` once the
+// extension is actually running in the guest (rather than just provisioned).
+func extensionHealthStateRefreshFunc(client *ArmClient, resGroup, vmName, name string) resource.StateRefreshFunc {
+	return func() (interface{}, string, error) {
+		extension, err := client.vmExtensionClient.Get(resGroup, vmName, name, "")
+		if err != nil {
+			return nil, "", fmt.Errorf("Error making Read request on Virtual Machine Extension %s: %s", name, err)
+		}
+
+		handlerType := ""
+		if props := extension.VirtualMachineExtensionProperties; props != nil && props.Publisher != nil && props.Type != nil {
+			handlerType = fmt.Sprintf("%s.%s", *props.Publisher, *props.Type)
+		}
+
+		vm, err := client.vmClient.Get(resGroup, vmName, compute.InstanceView)
+		if err != nil {
+			return nil, "", fmt.Errorf("Error retrieving the instance view of Virtual Machine %q (resource group %q): %s", vmName, resGroup, err)
+		}
+
+		status := findArmExtensionHandlerStatus(vm, handlerType)
+		if status == nil {
+			return compute.InstanceViewStatus{}, "NotReady", nil
+		}
+		if isArmExtensionHandlerReady(status) {
+			return *status, "Ready", nil
+		}
+		return *status, "NotReady", nil
+	}
+}
+
+func findArmExtensionHandlerStatus(vm compute.VirtualMachine, handlerType string) *compute.InstanceViewStatus {
+	props := vm.VirtualMachineProperties
+	if props == nil || props.InstanceView == nil || props.InstanceView.VMAgent == nil || props.InstanceView.VMAgent.ExtensionHandlers == nil {
+		return nil
+	}
+
+	for _, handler := range *props.InstanceView.VMAgent.ExtensionHandlers {
+		if handler.Type != nil && strings.EqualFold(*handler.Type, handlerType) {
+			return handler.Status
+		}
+	}
+
+	return nil
+}
+
+func isArmExtensionHandlerReady(status *compute.InstanceViewStatus) bool {
+	return status != nil && status.DisplayStatus != nil && strings.EqualFold(*status.DisplayStatus, "Ready")
+}
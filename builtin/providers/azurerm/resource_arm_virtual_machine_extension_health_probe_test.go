@@ -0,0 +1,62 @@
+package azurerm
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/terraform/helper/resource"
+)
+
+func TestExtensionHealthStateRefreshFunc(t *testing.T) {
+	defer func(interval time.Duration) { extensionHealthPollInterval = interval }(extensionHealthPollInterval)
+	extensionHealthPollInterval = 10 * time.Millisecond
+
+	var vmRequests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.Contains(r.URL.Path, "/extensions/"):
+			fmt.Fprint(w, `{"name":"hostname","properties":{"publisher":"Microsoft.Azure.Extensions","type":"CustomScript","provisioningState":"Succeeded"}}`)
+		case strings.HasSuffix(r.URL.Path, "/virtualMachines/acctvm"):
+			status := "Not Ready"
+			if atomic.AddInt32(&vmRequests, 1) > 2 {
+				status = "Ready"
+			}
+			fmt.Fprintf(w, `{"name":"acctvm","properties":{"instanceView":{"vmAgent":{"extensionHandlers":[
+				{"type":"Microsoft.OSTCExtensions.VMAccessForLinux","status":{"code":"ProvisioningState/succeeded","displayStatus":"Ready"}},
+				{"type":"Microsoft.Azure.Extensions.CustomScript","status":{"code":"ProvisioningState/succeeded","displayStatus":%q,"message":"Plugin enabled"}}
+			]}}}}`, status)
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	client := testArmClientWithBaseURI(server.URL)
+
+	_, state, err := extensionHealthStateRefreshFunc(client, "acctestRG", "acctvm", "hostname")()
+	if err != nil {
+		t.Fatalf("Error refreshing the extension health: %s", err)
+	}
+	if state != "NotReady" {
+		t.Fatalf("Expected the handler to be not ready at first, got %q", state)
+	}
+
+	stateConf := &resource.StateChangeConf{
+		Pending:    []string{"NotReady"},
+		Target:     []string{"Ready"},
+		Refresh:    extensionHealthStateRefreshFunc(client, "acctestRG", "acctvm", "hostname"),
+		Timeout:    time.Minute,
+		MinTimeout: extensionHealthPollInterval,
+	}
+	if _, err := stateConf.WaitForState(); err != nil {
+		t.Fatalf("Expected the handler to become ready, got: %s", err)
+	}
+}
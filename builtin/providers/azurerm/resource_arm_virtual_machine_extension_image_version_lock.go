@@ -0,0 +1,206 @@
+package azurerm
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/hashicorp/go-version"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func resourceArmVirtualMachineExtensionImageVersionLock() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceArmVirtualMachineExtensionImageVersionLockCreate,
+		Read:   resourceArmVirtualMachineExtensionImageVersionLockRead,
+		Update: resourceArmVirtualMachineExtensionImageVersionLockCreate,
+		Delete: resourceArmVirtualMachineExtensionImageVersionLockDelete,
+
+		Schema: map[string]*schema.Schema{
+			"location": locationSchema(),
+
+			"publisher": {
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+
+			"type": {
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+
+			"version": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+
+			"fail_on_newer_version": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+
+			"type_handler_version": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			"latest_version": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+
+			"newer_version_available": {
+				Type:     schema.TypeBool,
+				Computed: true,
+			},
+		},
+	}
+}
+
+func resourceArmVirtualMachineExtensionImageVersionLockCreate(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*ArmClient).vmExtensionImageClient
+
+	location := azureRMNormalizeLocation(d.Get("location").(string))
+	publisher := d.Get("publisher").(string)
+	extensionType := d.Get("type").(string)
+	lockedVersion := d.Get("version").(string)
+
+	image, err := client.Get(location, publisher, extensionType, lockedVersion)
+	if err != nil {
+		if image.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("Locked version %q of Virtual Machine Extension Image %s/%s was not found in %q", lockedVersion, publisher, extensionType, location)
+		}
+		return fmt.Errorf("Error making Read request on Virtual Machine Extension Image %s/%s (version %s): %s", publisher, extensionType, lockedVersion, err)
+	}
+
+	if image.ID == nil {
+		return fmt.Errorf("Cannot read Virtual Machine Extension Image %s/%s (version %s) ID", publisher, extensionType, lockedVersion)
+	}
+
+	// this is only checked when the lock is applied, since failing a refresh
+	// would also fail every plan (and destroy) of the configuration
+	if d.Get("fail_on_newer_version").(bool) {
+		versions, err := listArmVirtualMachineExtensionImageVersions(meta.(*ArmClient), location, publisher, extensionType)
+		if err != nil {
+			return err
+		}
+		latest, newer, err := latestArmVirtualMachineExtensionImageVersion(lockedVersion, versions)
+		if err != nil {
+			return err
+		}
+		if newer {
+			return fmt.Errorf("A newer version (%s) of Virtual Machine Extension Image %s/%s is available than the locked version %s", latest, publisher, extensionType, lockedVersion)
+		}
+	}
+
+	d.SetId(*image.ID)
+
+	return resourceArmVirtualMachineExtensionImageVersionLockRead(d, meta)
+}
+
+func resourceArmVirtualMachineExtensionImageVersionLockRead(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*ArmClient)
+
+	location := azureRMNormalizeLocation(d.Get("location").(string))
+	publisher := d.Get("publisher").(string)
+	extensionType := d.Get("type").(string)
+	lockedVersion := d.Get("version").(string)
+
+	versions, err := listArmVirtualMachineExtensionImageVersions(client, location, publisher, extensionType)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, v := range versions {
+		if v == lockedVersion {
+			found = true
+			break
+		}
+	}
+	if !found {
+		log.Printf("[WARN] Locked version %q of Virtual Machine Extension Image %s/%s is no longer listed in %q", lockedVersion, publisher, extensionType, location)
+		d.SetId("")
+		return nil
+	}
+
+	latest, newer, err := latestArmVirtualMachineExtensionImageVersion(lockedVersion, versions)
+	if err != nil {
+		return err
+	}
+
+	if newer {
+		log.Printf("[WARN] A newer version (%s) of Virtual Machine Extension Image %s/%s is available than the locked version %s", latest, publisher, extensionType, lockedVersion)
+	}
+
+	d.Set("location", location)
+	d.Set("type_handler_version", typeHandlerVersionFromImageVersion(lockedVersion))
+	d.Set("latest_version", latest)
+	d.Set("newer_version_available", newer)
+
+	return nil
+}
+
+func resourceArmVirtualMachineExtensionImageVersionLockDelete(d *schema.ResourceData, meta interface{}) error {
+	// the lock only exists in state, there's nothing to remove in Azure
+	d.SetId("")
+	return nil
+}
+
+func flattenArmVirtualMachineExtensionImageVersions(images *[]compute.VirtualMachineExtensionImage) []string {
+	versions := make([]string, 0)
+	if images == nil {
+		return versions
+	}
+
+	for _, image := range *images {
+		if image.Name != nil {
+			versions = append(versions, *image.Name)
+		}
+	}
+
+	return versions
+}
+
+// latestArmVirtualMachineExtensionImageVersion returns the highest of the
+// available versions and whether it is newer than the locked version.
+// Versions which can't be parsed are ignored.
+func latestArmVirtualMachineExtensionImageVersion(locked string, available []string) (string, bool, error) {
+	lockedVersion, err := version.NewVersion(locked)
+	if err != nil {
+		return "", false, fmt.Errorf("Error parsing locked version %q: %s", locked, err)
+	}
+
+	latest := lockedVersion
+	latestRaw := locked
+	for _, raw := range available {
+		v, err := version.NewVersion(raw)
+		if err != nil {
+			log.Printf("[DEBUG] Ignoring unparseable Virtual Machine Extension Image version %q: %s", raw, err)
+			continue
+		}
+
+		if v.GreaterThan(latest) {
+			latest = v
+			latestRaw = raw
+		}
+	}
+
+	return latestRaw, latest.GreaterThan(lockedVersion), nil
+}
+
+// typeHandlerVersionFromImageVersion converts an image version such as
+// `2.0.3` into the `major.minor` form expected by `type_handler_version`.
+func typeHandlerVersionFromImageVersion(imageVersion string) string {
+	segments := strings.Split(imageVersion, ".")
+	if len(segments) < 2 {
+		return imageVersion
+	}
+
+	return strings.Join(segments[:2], ".")
+}
@@ -0,0 +1,140 @@
+package azurerm
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/resource"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func TestLatestArmVirtualMachineExtensionImageVersion(t *testing.T) {
+	cases := []struct {
+		Locked      string
+		Available   []string
+		Latest      string
+		Newer       bool
+		ExpectError bool
+	}{
+		{
+			Locked:    "2.0.2",
+			Available: []string{"2.0.0", "2.0.1", "2.0.2"},
+			Latest:    "2.0.2",
+			Newer:     false,
+		},
+		{
+			Locked:    "2.0.2",
+			Available: []string{"2.0.2", "2.0.10", "2.0.3"},
+			Latest:    "2.0.10",
+			Newer:     true,
+		},
+		{
+			Locked:    "1.5",
+			Available: []string{"1.5", "not-a-version"},
+			Latest:    "1.5",
+			Newer:     false,
+		},
+		{
+			Locked:      "latest",
+			Available:   []string{"1.5"},
+			ExpectError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		latest, newer, err := latestArmVirtualMachineExtensionImageVersion(tc.Locked, tc.Available)
+		if tc.ExpectError {
+			if err == nil {
+				t.Fatalf("Expected an error for locked version %q", tc.Locked)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error for locked version %q: %s", tc.Locked, err)
+		}
+		if latest != tc.Latest || newer != tc.Newer {
+			t.Fatalf("Expected (%q, %t) for %q in %v, got (%q, %t)", tc.Latest, tc.Newer, tc.Locked, tc.Available, latest, newer)
+		}
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionImageVersionLock_failOnNewerVersion(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/versions") {
+			fmt.Fprint(w, `[{"name":"2.0.2"},{"name":"2.0.3"}]`)
+			return
+		}
+		fmt.Fprint(w, `{"id":"/Subscriptions/00000000-0000-0000-0000-000000000000/Providers/Microsoft.Compute/Locations/westus/Publishers/Microsoft.Azure.Extensions/ArtifactTypes/VMExtension/Types/CustomScript/Versions/2.0.2","name":"2.0.2"}`)
+	}))
+	defer server.Close()
+
+	client := testArmClientWithBaseURI(server.URL)
+	d := schema.TestResourceDataRaw(t, resourceArmVirtualMachineExtensionImageVersionLock().Schema, map[string]interface{}{
+		"location":              "West US",
+		"publisher":             "Microsoft.Azure.Extensions",
+		"type":                  "CustomScript",
+		"version":               "2.0.2",
+		"fail_on_newer_version": true,
+	})
+
+	// applying the lock fails
+	err := resourceArmVirtualMachineExtensionImageVersionLockCreate(d, client)
+	if err == nil || !strings.Contains(err.Error(), "A newer version (2.0.3)") {
+		t.Fatalf("Expected creating the lock to fail, got %v", err)
+	}
+
+	// while refreshing it only warns, so plans and destroys keep working
+	d.SetId("lock")
+	if err := resourceArmVirtualMachineExtensionImageVersionLockRead(d, client); err != nil {
+		t.Fatalf("Expected refreshing the lock not to fail, got %s", err)
+	}
+	if !d.Get("newer_version_available").(bool) || d.Get("latest_version").(string) != "2.0.3" {
+		t.Fatalf("Expected the newer version to be recorded, got %q", d.Get("latest_version").(string))
+	}
+}
+
+func TestTypeHandlerVersionFromImageVersion(t *testing.T) {
+	cases := map[string]string{
+		"2.0.3":   "2.0",
+		"1.5":     "1.5",
+		"1.4.0.1": "1.4",
+		"3":       "3",
+	}
+
+	for input, expected := range cases {
+		if actual := typeHandlerVersionFromImageVersion(input); actual != expected {
+			t.Fatalf("Expected %q to become %q, got %q", input, expected, actual)
+		}
+	}
+}
+
+func TestAccAzureRMVirtualMachineExtensionImageVersionLock_basic(t *testing.T) {
+	resourceName := "azurerm_virtual_machine_extension_image_version_lock.test"
+
+	resource.Test(t, resource.TestCase{
+		PreCheck:  func() { testAccPreCheck(t) },
+		Providers: testAccProviders,
+		Steps: []resource.TestStep{
+			resource.TestStep{
+				Config: testAccAzureRMVirtualMachineExtensionImageVersionLock_basic,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttr(resourceName, "type_handler_version", "2.0"),
+					resource.TestCheckResourceAttrSet(resourceName, "latest_version"),
+				),
+			},
+		},
+	})
+}
+
+var testAccAzureRMVirtualMachineExtensionImageVersionLock_basic = `
+resource "azurerm_virtual_machine_extension_image_version_lock" "test" {
+    location = "West US"
+    publisher = "Microsoft.Azure.Extensions"
+    type = "CustomScript"
+    version = "2.0.2"
+}
+`
@@ -0,0 +1,472 @@
+package azurerm
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/azure-sdk-for-go/arm/resources/resources"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// virtualMachineExtensionTemplateAPIVersion is the API version of the
+// extensions in the generated template, matching the vendored compute SDK.
+const virtualMachineExtensionTemplateAPIVersion = "2016-04-30-preview"
+
+// resourceArmVirtualMachineExtensionSet (experimental) deploys several
+// Virtual Machine Extensions to a Virtual Machine as a single ARM Template
+// Deployment, removing the Extensions it created (and restoring those it
+// updated) when the deployment fails.
+func resourceArmVirtualMachineExtensionSet() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceArmVirtualMachineExtensionSetCreateUpdate,
+		Read:   resourceArmVirtualMachineExtensionSetRead,
+		Update: resourceArmVirtualMachineExtensionSetCreateUpdate,
+		Delete: resourceArmVirtualMachineExtensionSetDelete,
+
+		Timeouts: &schema.ResourceTimeout{
+			Create: schema.DefaultTimeout(40 * time.Minute),
+			Update: schema.DefaultTimeout(40 * time.Minute),
+		},
+
+		Schema: map[string]*schema.Schema{
+			// the name of the Template Deployment
+			"name": {
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+
+			"location": locationSchema(),
+
+			"resource_group_name": {
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+
+			"virtual_machine_name": {
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+
+			"extension": {
+				Type:     schema.TypeList,
+				Required: true,
+				MinItems: 1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"name": {
+							Type:     schema.TypeString,
+							Required: true,
+						},
+
+						"publisher": {
+							Type:     schema.TypeString,
+							Required: true,
+						},
+
+						"type": {
+							Type:     schema.TypeString,
+							Required: true,
+						},
+
+						"type_handler_version": {
+							Type:     schema.TypeString,
+							Required: true,
+						},
+
+						"auto_upgrade_minor_version": {
+							Type:     schema.TypeBool,
+							Optional: true,
+						},
+
+						"settings": {
+							Type:             schema.TypeString,
+							Optional:         true,
+							ValidateFunc:     validateArmVirtualMachineExtensionSettingsObject,
+							DiffSuppressFunc: suppressDiffVirtualMachineExtensionSettings,
+						},
+
+						"protected_settings": {
+							Type:             schema.TypeString,
+							Optional:         true,
+							Sensitive:        true,
+							ValidateFunc:     validateArmVirtualMachineExtensionSettingsObject,
+							DiffSuppressFunc: suppressDiffVirtualMachineExtensionSettings,
+						},
+					},
+				},
+			},
+
+			// the provisioning state of each Extension, keyed by name
+			"results": {
+				Type:     schema.TypeMap,
+				Computed: true,
+			},
+		},
+	}
+}
+
+func resourceArmVirtualMachineExtensionSetCreateUpdate(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*ArmClient)
+
+	name := d.Get("name").(string)
+	location := d.Get("location").(string)
+	resGroup := d.Get("resource_group_name").(string)
+	vmName := d.Get("virtual_machine_name").(string)
+
+	timeout := d.Timeout(schema.TimeoutCreate)
+	if !d.IsNewResource() {
+		timeout = d.Timeout(schema.TimeoutUpdate)
+	}
+
+	template, parameters, err := expandArmVirtualMachineExtensionSetTemplate(vmName, location, d.Get("extension").([]interface{}))
+	if err != nil {
+		return err
+	}
+
+	// serializes the deployment (and the deletes below) with the other
+	// extension operations on the Virtual Machine
+	lockKey := armVirtualMachineExtensionsLockKey(resGroup, vmName)
+	armMutexKV.Lock(lockKey)
+	defer armMutexKV.Unlock(lockKey)
+
+	// when the deployment fails, the Extensions which didn't exist before are
+	// deleted, while those it updated are restored as read here
+	created := make([]string, 0)
+	previous := make(map[string]compute.VirtualMachineExtension)
+	for _, extensionName := range armVirtualMachineExtensionSetNames(d) {
+		resp, err := client.vmExtensionClient.Get(resGroup, vmName, extensionName, "")
+		if err != nil {
+			if resp.StatusCode != http.StatusNotFound {
+				return fmt.Errorf("Error making Read request on Virtual Machine Extension %s: %s", extensionName, err)
+			}
+			created = append(created, extensionName)
+			continue
+		}
+		previous[extensionName] = resp
+	}
+
+	deployment := resources.Deployment{
+		Properties: &resources.DeploymentProperties{
+			Mode:       resources.Incremental,
+			Template:   &template,
+			Parameters: &parameters,
+		},
+	}
+
+	log.Printf("[DEBUG] Deploying %d Virtual Machine Extension(s) to %q as Template Deployment %q", len(d.Get("extension").([]interface{})), vmName, name)
+	cancel := make(chan struct{})
+	timer := time.AfterFunc(timeout, func() { close(cancel) })
+	defer timer.Stop()
+	_, deployErr := client.deploymentsClient.CreateOrUpdate(resGroup, name, deployment, cancel)
+
+	if deployErr != nil {
+		operations, err := client.deploymentOperationsClient.List(resGroup, name, nil)
+		if err != nil {
+			log.Printf("[DEBUG] Unable to list the operations of Template Deployment %q: %s", name, err)
+		} else if details := flattenArmDeploymentOperationErrors(operations.Value); details != "" {
+			deployErr = fmt.Errorf("%s\n\nFailed operations:\n%s", deployErr, details)
+		}
+
+		log.Printf("[DEBUG] Rolling back the %d Virtual Machine Extension(s) created by Template Deployment %q", len(created), name)
+		if err := deleteArmVirtualMachineExtensionSetExtensions(client, resGroup, vmName, created); err != nil {
+			return fmt.Errorf("Error deploying Virtual Machine Extensions to %q: %s\n\nAdditionally, rolling back the created Extensions failed: %s", vmName, deployErr, err)
+		}
+
+		// only the protected settings of the Extensions this resource deployed
+		// before are known, the others can't be restored
+		oldExtensions, _ := d.GetChange("extension")
+		owned := make(map[string]string)
+		if !d.IsNewResource() {
+			for _, v := range oldExtensions.([]interface{}) {
+				extension := v.(map[string]interface{})
+				owned[extension["name"].(string)] = extension["protected_settings"].(string)
+			}
+		}
+
+		restored, notRestored, err := restoreArmVirtualMachineExtensionSetExtensions(client, resGroup, vmName, previous, owned, cancel)
+		if err != nil {
+			return fmt.Errorf("Error deploying Virtual Machine Extensions to %q: %s\n\nAdditionally, restoring the updated Extensions failed: %s", vmName, deployErr, err)
+		}
+
+		deployErr = fmt.Errorf("Error deploying Virtual Machine Extensions to %q (the %d Extension(s) it created have been removed, and the %d it updated restored): %s", vmName, len(created), restored, deployErr)
+		if len(notRestored) > 0 {
+			deployErr = fmt.Errorf("%s\n\nThe Extension(s) %s existed before this resource and have been left as deployed, since their previous protected settings are unknown.", deployErr, strings.Join(notRestored, ", "))
+		}
+		return deployErr
+	}
+
+	// the deployment is incremental, so the Extensions whose blocks were
+	// removed are left on the Virtual Machine unless they're deleted here
+	if !d.IsNewResource() {
+		oldExtensions, newExtensions := d.GetChange("extension")
+		removed := armVirtualMachineExtensionSetRemovedNames(oldExtensions.([]interface{}), newExtensions.([]interface{}))
+		log.Printf("[DEBUG] Removing the %d Virtual Machine Extension(s) no longer in Template Deployment %q", len(removed), name)
+		if err := deleteArmVirtualMachineExtensionSetExtensions(client, resGroup, vmName, removed); err != nil {
+			return err
+		}
+	}
+
+	read, err := client.deploymentsClient.Get(resGroup, name)
+	if err != nil {
+		return err
+	}
+	if read.ID == nil {
+		return fmt.Errorf("Cannot read Template Deployment %s (resource group %s) ID", name, resGroup)
+	}
+
+	d.SetId(*read.ID)
+
+	return resourceArmVirtualMachineExtensionSetRead(d, meta)
+}
+
+func resourceArmVirtualMachineExtensionSetRead(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*ArmClient).vmExtensionClient
+	resGroup := d.Get("resource_group_name").(string)
+	vmName := d.Get("virtual_machine_name").(string)
+
+	// the Extensions which no longer exist are dropped from the state, so
+	// that the next plan deploys them again
+	found := make([]interface{}, 0)
+	results := make(map[string]interface{})
+	for _, v := range d.Get("extension").([]interface{}) {
+		name := v.(map[string]interface{})["name"].(string)
+		resp, err := client.Get(resGroup, vmName, name, "")
+		if err != nil {
+			if resp.StatusCode == http.StatusNotFound {
+				log.Printf("[DEBUG] Virtual Machine Extension %q of Template Deployment %q no longer exists - removing it from state", name, d.Get("name").(string))
+				results[name] = "NotFound"
+				continue
+			}
+			return fmt.Errorf("Error making Read request on Virtual Machine Extension %s: %s", name, err)
+		}
+
+		found = append(found, v)
+		state := "Unknown"
+		if props := resp.VirtualMachineExtensionProperties; props != nil && props.ProvisioningState != nil {
+			state = *props.ProvisioningState
+		}
+		results[name] = state
+	}
+
+	if len(found) == 0 {
+		log.Printf("[DEBUG] None of the Virtual Machine Extensions of Template Deployment %q exist - removing from state", d.Get("name").(string))
+		d.SetId("")
+		return nil
+	}
+
+	if err := d.Set("extension", found); err != nil {
+		return fmt.Errorf("Error setting `extension`: %+v", err)
+	}
+	d.Set("results", results)
+
+	return nil
+}
+
+func resourceArmVirtualMachineExtensionSetDelete(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*ArmClient)
+	resGroup := d.Get("resource_group_name").(string)
+	vmName := d.Get("virtual_machine_name").(string)
+
+	lockKey := armVirtualMachineExtensionsLockKey(resGroup, vmName)
+	armMutexKV.Lock(lockKey)
+	err := deleteArmVirtualMachineExtensionSetExtensions(client, resGroup, vmName, armVirtualMachineExtensionSetNames(d))
+	armMutexKV.Unlock(lockKey)
+	if err != nil {
+		return err
+	}
+
+	// deleting the deployment only removes it from the deployment history
+	name := d.Get("name").(string)
+	resp, err := client.deploymentsClient.Delete(resGroup, name, make(chan struct{}))
+	if err != nil && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("Error deleting Template Deployment %q: %s", name, err)
+	}
+
+	return nil
+}
+
+func armVirtualMachineExtensionSetNames(d *schema.ResourceData) []string {
+	names := make([]string, 0)
+	for _, v := range d.Get("extension").([]interface{}) {
+		names = append(names, v.(map[string]interface{})["name"].(string))
+	}
+	return names
+}
+
+// armVirtualMachineExtensionSetRemovedNames returns the names of the old
+// extension blocks which aren't in the new ones.
+func armVirtualMachineExtensionSetRemovedNames(old, new []interface{}) []string {
+	kept := make(map[string]bool)
+	for _, v := range new {
+		kept[v.(map[string]interface{})["name"].(string)] = true
+	}
+
+	removed := make([]string, 0)
+	for _, v := range old {
+		name := v.(map[string]interface{})["name"].(string)
+		if !kept[name] {
+			removed = append(removed, name)
+		}
+	}
+	return removed
+}
+
+// expandArmVirtualMachineExtensionSetTemplate composes the template deploying
+// the extensions to the VM. The protected settings are passed as secureObject
+// parameters, so that they aren't retained in the deployment history.
+func expandArmVirtualMachineExtensionSetTemplate(vmName, location string, extensions []interface{}) (map[string]interface{}, map[string]interface{}, error) {
+	templateParameters := make(map[string]interface{})
+	parameters := make(map[string]interface{})
+	templateResources := make([]interface{}, 0, len(extensions))
+
+	for i, v := range extensions {
+		extension := v.(map[string]interface{})
+		name := extension["name"].(string)
+
+		properties := map[string]interface{}{
+			"publisher":               extension["publisher"].(string),
+			"type":                    extension["type"].(string),
+			"typeHandlerVersion":      extension["type_handler_version"].(string),
+			"autoUpgradeMinorVersion": extension["auto_upgrade_minor_version"].(bool),
+		}
+
+		if settingsString := extension["settings"].(string); settingsString != "" {
+			settings, err := expandArmVirtualMachineExtensionSettings(settingsString)
+			if err != nil {
+				return nil, nil, fmt.Errorf("unable to parse settings of Extension %q: %s", name, err)
+			}
+			properties["settings"] = settings
+		}
+
+		if protectedSettingsString := extension["protected_settings"].(string); protectedSettingsString != "" {
+			protectedSettings, err := expandArmVirtualMachineExtensionSettings(protectedSettingsString)
+			if err != nil {
+				return nil, nil, fmt.Errorf("unable to parse protected_settings of Extension %q: %s", name, err)
+			}
+
+			parameter := fmt.Sprintf("protectedSettings%d", i)
+			templateParameters[parameter] = map[string]interface{}{"type": "secureObject"}
+			parameters[parameter] = map[string]interface{}{"value": protectedSettings}
+			properties["protectedSettings"] = fmt.Sprintf("[parameters('%s')]", parameter)
+		}
+
+		templateResources = append(templateResources, map[string]interface{}{
+			"type":       "Microsoft.Compute/virtualMachines/extensions",
+			"name":       fmt.Sprintf("%s/%s", vmName, name),
+			"apiVersion": virtualMachineExtensionTemplateAPIVersion,
+			"location":   location,
+			"properties": properties,
+		})
+	}
+
+	template := map[string]interface{}{
+		"$schema":        "https://schema.management.azure.com/schemas/2015-01-01/deploymentTemplate.json#",
+		"contentVersion": "1.0.0.0",
+		"parameters":     templateParameters,
+		"resources":      templateResources,
+	}
+
+	return template, parameters, nil
+}
+
+// flattenArmDeploymentOperationErrors describes the failed operations of a
+// Template Deployment, one per line, sorted by the name of their resource.
+func flattenArmDeploymentOperationErrors(operations *[]resources.DeploymentOperation) string {
+	if operations == nil {
+		return ""
+	}
+
+	failures := make([]string, 0)
+	for _, operation := range *operations {
+		props := operation.Properties
+		if props == nil || props.ProvisioningState == nil || !strings.EqualFold(*props.ProvisioningState, "Failed") {
+			continue
+		}
+
+		target := "unknown resource"
+		if props.TargetResource != nil && props.TargetResource.ResourceName != nil {
+			target = *props.TargetResource.ResourceName
+		}
+
+		message := "no status message"
+		if props.StatusMessage != nil {
+			if encoded, err := json.Marshal(*props.StatusMessage); err == nil {
+				message = string(encoded)
+			}
+		}
+
+		failures = append(failures, fmt.Sprintf("%s: %s", target, message))
+	}
+
+	sort.Strings(failures)
+	return strings.Join(failures, "\n")
+}
+
+// restoreArmVirtualMachineExtensionSetExtensions restores the Extensions
+// updated by a failed deployment to their previous definition, along with the
+// protected settings they were last deployed with by this resource (keyed by
+// name in owned). It returns the number restored and the names of those which
+// weren't, since they aren't owned. The caller holds the Virtual Machine's
+// armVirtualMachineExtensionsLockKey.
+func restoreArmVirtualMachineExtensionSetExtensions(client *ArmClient, resGroup, vmName string, previous map[string]compute.VirtualMachineExtension, owned map[string]string, cancel <-chan struct{}) (int, []string, error) {
+	names := make([]string, 0, len(previous))
+	for name := range previous {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	restored := 0
+	notRestored := make([]string, 0)
+	errors := make([]string, 0)
+	for _, name := range names {
+		protectedSettings, ok := owned[name]
+		if !ok {
+			notRestored = append(notRestored, name)
+			continue
+		}
+
+		rollback, err := expandArmVirtualMachineExtensionRollback(previous[name], protectedSettings, false, nil)
+		if err == nil {
+			err = createOrUpdateArmVirtualMachineExtension(client, resGroup, vmName, name, rollback, nil, cancel)
+		}
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("%s: %s", name, err))
+			continue
+		}
+		restored++
+	}
+
+	if len(errors) > 0 {
+		return restored, notRestored, fmt.Errorf("Error restoring %d Virtual Machine Extension(s) on %q:\n%s", len(errors), vmName, strings.Join(errors, "\n"))
+	}
+
+	return restored, notRestored, nil
+}
+
+// deleteArmVirtualMachineExtensionSetExtensions deletes the Extensions from
+// the Virtual Machine. The caller holds the Virtual Machine's
+// armVirtualMachineExtensionsLockKey.
+func deleteArmVirtualMachineExtensionSetExtensions(client *ArmClient, resGroup, vmName string, names []string) error {
+	errors := make([]string, 0)
+	for _, name := range names {
+		resp, err := client.vmExtensionClient.Delete(resGroup, vmName, name, make(chan struct{}))
+		if err != nil && resp.StatusCode != http.StatusNotFound {
+			errors = append(errors, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("Error deleting %d Virtual Machine Extension(s) from %q:\n%s", len(errors), vmName, strings.Join(errors, "\n"))
+	}
+
+	return nil
+}
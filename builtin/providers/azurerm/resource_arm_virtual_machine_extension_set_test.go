@@ -0,0 +1,351 @@
+package azurerm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/resources/resources"
+	"github.com/hashicorp/terraform/config"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestExpandArmVirtualMachineExtensionSetTemplate(t *testing.T) {
+	extensions := []interface{}{
+		map[string]interface{}{
+			"name":                       "hostname",
+			"publisher":                  "Microsoft.Azure.Extensions",
+			"type":                       "CustomScript",
+			"type_handler_version":       "2.0",
+			"auto_upgrade_minor_version": true,
+			"settings":                   `{"commandToExecute":"hostname"}`,
+			"protected_settings":         "",
+		},
+		map[string]interface{}{
+			"name":                       "diagnostics",
+			"publisher":                  "Microsoft.OSTCExtensions",
+			"type":                       "LinuxDiagnostic",
+			"type_handler_version":       "2.3",
+			"auto_upgrade_minor_version": false,
+			"settings":                   "",
+			"protected_settings":         `{"storageAccountKey":"s3cr3t"}`,
+		},
+	}
+
+	template, parameters, err := expandArmVirtualMachineExtensionSetTemplate("acctvm", "westus", extensions)
+	if err != nil {
+		t.Fatalf("Error expanding the template: %s", err)
+	}
+
+	encoded, err := json.Marshal(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(encoded), "s3cr3t") {
+		t.Fatalf("Expected the protected settings not to be part of the template: %s", encoded)
+	}
+
+	templateResources := template["resources"].([]interface{})
+	if len(templateResources) != 2 {
+		t.Fatalf("Expected a resource per Extension, got %d", len(templateResources))
+	}
+
+	first := templateResources[0].(map[string]interface{})
+	if first["name"] != "acctvm/hostname" || first["type"] != "Microsoft.Compute/virtualMachines/extensions" {
+		t.Fatalf("Unexpected resource: %+v", first)
+	}
+	if _, ok := first["properties"].(map[string]interface{})["protectedSettings"]; ok {
+		t.Fatalf("Expected no protectedSettings without protected_settings")
+	}
+
+	second := templateResources[1].(map[string]interface{})
+	if actual := second["properties"].(map[string]interface{})["protectedSettings"]; actual != "[parameters('protectedSettings1')]" {
+		t.Fatalf("Expected the protected settings to reference their parameter, got %v", actual)
+	}
+	if _, ok := template["parameters"].(map[string]interface{})["protectedSettings1"]; !ok {
+		t.Fatalf("Expected the template to declare the protectedSettings1 parameter")
+	}
+
+	value := parameters["protectedSettings1"].(map[string]interface{})["value"].(map[string]interface{})
+	if value["storageAccountKey"] != "s3cr3t" {
+		t.Fatalf("Expected the protected settings to be passed as a parameter, got %+v", parameters)
+	}
+}
+
+func TestExpandArmVirtualMachineExtensionSetTemplate_invalidSettings(t *testing.T) {
+	extensions := []interface{}{
+		map[string]interface{}{
+			"name":                       "hostname",
+			"publisher":                  "Microsoft.Azure.Extensions",
+			"type":                       "CustomScript",
+			"type_handler_version":       "2.0",
+			"auto_upgrade_minor_version": false,
+			"settings":                   `{"commandToExecute":`,
+			"protected_settings":         "",
+		},
+	}
+
+	if _, _, err := expandArmVirtualMachineExtensionSetTemplate("acctvm", "westus", extensions); err == nil || !strings.Contains(err.Error(), `"hostname"`) {
+		t.Fatalf("Expected an error naming the Extension, got %v", err)
+	}
+}
+
+func TestFlattenArmDeploymentOperationErrors(t *testing.T) {
+	failed := "Failed"
+	succeeded := "Succeeded"
+	hostname := "acctvm/hostname"
+	diagnostics := "acctvm/diagnostics"
+
+	operations := &[]resources.DeploymentOperation{
+		{
+			Properties: &resources.DeploymentOperationProperties{
+				ProvisioningState: &succeeded,
+				TargetResource:    &resources.TargetResource{ResourceName: &diagnostics},
+			},
+		},
+		{
+			Properties: &resources.DeploymentOperationProperties{
+				ProvisioningState: &failed,
+				TargetResource:    &resources.TargetResource{ResourceName: &hostname},
+				StatusMessage: &map[string]interface{}{
+					"error": map[string]interface{}{"code": "VMExtensionProvisioningError", "message": "exit code 1"},
+				},
+			},
+		},
+		{
+			Properties: &resources.DeploymentOperationProperties{
+				ProvisioningState: &failed,
+			},
+		},
+	}
+
+	expected := `acctvm/hostname: {"error":{"code":"VMExtensionProvisioningError","message":"exit code 1"}}
+unknown resource: no status message`
+	if actual := flattenArmDeploymentOperationErrors(operations); actual != expected {
+		t.Fatalf("Expected:\n%s\n\nGot:\n%s", expected, actual)
+	}
+
+	if actual := flattenArmDeploymentOperationErrors(nil); actual != "" {
+		t.Fatalf("Expected no errors without any operations, got %q", actual)
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionSet(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	existing := make(map[string]bool)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		name := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		deployment := strings.Contains(r.URL.Path, "/deployments/")
+		switch {
+		case deployment && r.Method == "PUT":
+			var body struct {
+				Properties struct {
+					Template struct {
+						Resources []struct {
+							Name string `json:"name"`
+						} `json:"resources"`
+					} `json:"template"`
+				} `json:"properties"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Errorf("Error decoding the deployment: %s", err)
+			}
+			for _, resource := range body.Properties.Template.Resources {
+				extension := resource.Name[strings.Index(resource.Name, "/")+1:]
+				requests = append(requests, "DEPLOY "+extension)
+				existing[extension] = true
+			}
+			fmt.Fprint(w, `{"properties":{"provisioningState":"Succeeded"}}`)
+		case deployment:
+			fmt.Fprintf(w, `{"id":"/deployments/%s","properties":{"provisioningState":"Succeeded"}}`, name)
+		case r.Method == "DELETE":
+			requests = append(requests, "DELETE "+name)
+			delete(existing, name)
+			w.WriteHeader(http.StatusOK)
+		default:
+			if !existing[name] {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"error":{"code":"NotFound","message":"The Resource was not found."}}`)
+				return
+			}
+			fmt.Fprintf(w, `{"name":%q,"properties":{"provisioningState":"Succeeded"}}`, name)
+		}
+	}))
+	defer server.Close()
+
+	client := testArmClientWithBaseURI(server.URL)
+	client.deploymentsClient = resources.NewDeploymentsClientWithBaseURI(server.URL, "00000000-0000-0000-0000-000000000000")
+	resource := resourceArmVirtualMachineExtensionSet()
+
+	apply := func(state *terraform.InstanceState, names ...string) *terraform.InstanceState {
+		blocks := make([]interface{}, 0)
+		for _, name := range names {
+			blocks = append(blocks, map[string]interface{}{
+				"name":                 name,
+				"publisher":            "Microsoft.Azure.Extensions",
+				"type":                 "CustomScript",
+				"type_handler_version": "2.0",
+			})
+		}
+		raw, err := config.NewRawConfig(map[string]interface{}{
+			"name":                 "acctestdeployment",
+			"location":             "westus",
+			"resource_group_name":  "acctestRG",
+			"virtual_machine_name": "acctvm",
+			"extension":            blocks,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		diff, err := resource.Diff(state, terraform.NewResourceConfig(raw))
+		if err != nil {
+			t.Fatalf("Error planning the set: %s", err)
+		}
+		requests = nil
+		state, err = resource.Apply(state, diff, client)
+		if err != nil {
+			t.Fatalf("Error applying the set: %s", err)
+		}
+		return state
+	}
+
+	state := apply(nil, "first", "second", "third")
+	if expected := []string{"DEPLOY first", "DEPLOY second", "DEPLOY third"}; !reflect.DeepEqual(requests, expected) {
+		t.Fatalf("Expected %v, got %v", expected, requests)
+	}
+
+	// the Extension whose block is removed is deleted after the deployment
+	state = apply(state, "second", "third")
+	if expected := []string{"DEPLOY second", "DEPLOY third", "DELETE first"}; !reflect.DeepEqual(requests, expected) {
+		t.Fatalf("Expected %v, got %v", expected, requests)
+	}
+
+	// an Extension deleted outside of Terraform is deployed again
+	mu.Lock()
+	delete(existing, "second")
+	mu.Unlock()
+	state, err := resource.Refresh(state, client)
+	if err != nil {
+		t.Fatalf("Error refreshing the set: %s", err)
+	}
+	if state.Attributes["extension.#"] != "1" || state.Attributes["results.second"] != "NotFound" {
+		t.Fatalf("Expected the deleted Extension to be removed from the state, got %+v", state.Attributes)
+	}
+	apply(state, "second", "third")
+	if expected := []string{"DEPLOY second", "DEPLOY third"}; !reflect.DeepEqual(requests, expected) {
+		t.Fatalf("Expected %v, got %v", expected, requests)
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionSet_rollback(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	existing := map[string]bool{"preexisting": true}
+	failDeployment := false
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		name := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		deployment := strings.Contains(r.URL.Path, "/deployments/")
+		switch {
+		case deployment && r.Method == "PUT":
+			if failDeployment {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error":{"code":"DeploymentFailed","message":"At least one resource deployment operation failed."}}`)
+				return
+			}
+			existing["first"] = true
+			fmt.Fprint(w, `{"properties":{"provisioningState":"Succeeded"}}`)
+		case deployment && strings.HasSuffix(r.URL.Path, "/operations"):
+			fmt.Fprint(w, `{"value":[]}`)
+		case deployment:
+			fmt.Fprintf(w, `{"id":"/deployments/%s","properties":{"provisioningState":"Succeeded"}}`, name)
+		case r.Method == "DELETE":
+			requests = append(requests, "DELETE "+name)
+			delete(existing, name)
+		case r.Method == "PUT":
+			body, _ := ioutil.ReadAll(r.Body)
+			requests = append(requests, fmt.Sprintf("RESTORE %s %s", name, body))
+			fmt.Fprintf(w, `{"name":%q,"properties":{"provisioningState":"Succeeded"}}`, name)
+		default:
+			if !existing[name] {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"error":{"code":"NotFound","message":"The Resource was not found."}}`)
+				return
+			}
+			fmt.Fprintf(w, `{"name":%q,"properties":{"publisher":"Microsoft.Azure.Extensions","type":"CustomScript","typeHandlerVersion":"2.0","settings":{"commandToExecute":%q},"provisioningState":"Succeeded"}}`, name, name)
+		}
+	}))
+	defer server.Close()
+
+	client := testArmClientWithBaseURI(server.URL)
+	client.deploymentsClient = resources.NewDeploymentsClientWithBaseURI(server.URL, "00000000-0000-0000-0000-000000000000")
+	client.deploymentOperationsClient = resources.NewDeploymentOperationsClientWithBaseURI(server.URL, "00000000-0000-0000-0000-000000000000")
+	resource := resourceArmVirtualMachineExtensionSet()
+
+	apply := func(state *terraform.InstanceState, names ...string) (*terraform.InstanceState, error) {
+		blocks := make([]interface{}, 0)
+		for _, name := range names {
+			blocks = append(blocks, map[string]interface{}{
+				"name":                 name,
+				"publisher":            "Microsoft.Azure.Extensions",
+				"type":                 "CustomScript",
+				"type_handler_version": "2.0",
+				"protected_settings":   fmt.Sprintf(`{"secret":"%s-%d"}`, name, len(names)),
+			})
+		}
+		raw, err := config.NewRawConfig(map[string]interface{}{
+			"name":                 "acctestdeployment",
+			"location":             "westus",
+			"resource_group_name":  "acctestRG",
+			"virtual_machine_name": "acctvm",
+			"extension":            blocks,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		diff, err := resource.Diff(state, terraform.NewResourceConfig(raw))
+		if err != nil {
+			t.Fatalf("Error planning the set: %s", err)
+		}
+		requests = nil
+		return resource.Apply(state, diff, client)
+	}
+
+	state, err := apply(nil, "first")
+	if err != nil {
+		t.Fatalf("Error applying the set: %s", err)
+	}
+
+	// the Extension it created is deleted and the one it deployed before is
+	// restored, while the one which existed before the resource is left alone
+	failDeployment = true
+	_, err = apply(state, "first", "preexisting", "created")
+	if err == nil || !strings.Contains(err.Error(), "The Extension(s) preexisting existed before this resource") {
+		t.Fatalf("Expected the deployment to fail, naming the Extension which wasn't restored, got %v", err)
+	}
+
+	if len(requests) != 2 || requests[0] != "DELETE created" || !strings.HasPrefix(requests[1], "RESTORE first ") {
+		t.Fatalf("Expected the created Extension to be deleted and the owned one restored, got %v", requests)
+	}
+	if !strings.Contains(requests[1], `"commandToExecute":"first"`) || !strings.Contains(requests[1], `"secret":"first-1"`) {
+		t.Fatalf("Expected the previous definition and protected settings to be restored, got %s", requests[1])
+	}
+}
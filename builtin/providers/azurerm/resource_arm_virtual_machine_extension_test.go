@@ -1,17 +1,1780 @@
 package azurerm
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"regexp"
 
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/hashicorp/terraform/config"
 	"github.com/hashicorp/terraform/helper/acctest"
 	"github.com/hashicorp/terraform/helper/resource"
+	"github.com/hashicorp/terraform/helper/schema"
 	"github.com/hashicorp/terraform/terraform"
 )
 
+func TestIsArmVirtualMachineExtensionVersionDowngrade(t *testing.T) {
+	cases := []struct {
+		Old       string
+		New       string
+		Downgrade bool
+		Error     bool
+	}{
+		{Old: "2.0", New: "2.0", Downgrade: false},
+		{Old: "2.0", New: "2.1", Downgrade: false},
+		{Old: "1.9", New: "1.10", Downgrade: false},
+		{Old: "1.10", New: "1.9", Downgrade: true},
+		{Old: "2.0", New: "1.4", Downgrade: true},
+		{Old: "2.0", New: "latest", Error: true},
+	}
+
+	for _, tc := range cases {
+		downgrade, err := isArmVirtualMachineExtensionVersionDowngrade(tc.Old, tc.New)
+		if tc.Error {
+			if err == nil {
+				t.Fatalf("Expected an error comparing %q to %q", tc.Old, tc.New)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Error comparing %q to %q: %s", tc.Old, tc.New, err)
+		}
+		if downgrade != tc.Downgrade {
+			t.Fatalf("Expected %q -> %q downgrade to be %t, got %t", tc.Old, tc.New, tc.Downgrade, downgrade)
+		}
+	}
+}
+
+func TestIsArmVirtualMachineExtensionVersionBelowFloor(t *testing.T) {
+	cases := []struct {
+		Current string
+		Floor   string
+		Below   bool
+	}{
+		{Current: "2.0", Floor: "2.0", Below: false},
+		{Current: "2.1", Floor: "2.0", Below: false},
+		{Current: "1.9", Floor: "2.0", Below: true},
+		{Current: "1.9", Floor: "1.10", Below: true},
+		{Current: "unknown", Floor: "2.0", Below: false},
+	}
+
+	for _, tc := range cases {
+		if actual := isArmVirtualMachineExtensionVersionBelowFloor(tc.Current, tc.Floor); actual != tc.Below {
+			t.Fatalf("Expected %q below the floor %q to be %t, got %t", tc.Current, tc.Floor, tc.Below, actual)
+		}
+	}
+}
+
+func TestArmVirtualMachineExtensionSettingsFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "tf-azurerm-extension-settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.WriteString(`{"commandToExecute":"hostname","port":8080}`); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	if _, errors := validateArmVirtualMachineExtensionSettingsFile(file.Name(), "settings_file_path"); len(errors) != 0 {
+		t.Fatalf("Expected the settings file to be valid, got %v", errors)
+	}
+
+	settings, err := readArmVirtualMachineExtensionSettingsFile(file.Name())
+	if err != nil {
+		t.Fatalf("Error reading the settings file: %s", err)
+	}
+	if settings["commandToExecute"] != "hostname" || settings["port"] != json.Number("8080") {
+		t.Fatalf("Unexpected settings: %+v", settings)
+	}
+
+	hash := armVirtualMachineExtensionSettingsFileStateFunc(file.Name())
+	if hash == "" || hash == file.Name() {
+		t.Fatalf("Expected the state to hold a hash of the file, got %q", hash)
+	}
+
+	// editing the file changes what's stored in the state, which is a diff
+	if err := ioutil.WriteFile(file.Name(), []byte(`{"commandToExecute":"uptime","port":8080}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if armVirtualMachineExtensionSettingsFileStateFunc(file.Name()) == hash {
+		t.Fatalf("Expected the hash to change along with the contents of the file")
+	}
+
+	if err := ioutil.WriteFile(file.Name(), []byte(`{"commandToExecute":`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, errors := validateArmVirtualMachineExtensionSettingsFile(file.Name(), "settings_file_path"); len(errors) != 1 {
+		t.Fatalf("Expected an invalid JSON file to trigger 1 error, got %d", len(errors))
+	}
+
+	if _, errors := validateArmVirtualMachineExtensionSettingsFile(file.Name()+".missing", "settings_file_path"); len(errors) != 1 {
+		t.Fatalf("Expected a missing file to trigger 1 error, got %d", len(errors))
+	}
+}
+
+func TestFlattenArmVirtualMachineOSType(t *testing.T) {
+	cases := []struct {
+		Name     string
+		VM       compute.VirtualMachine
+		Expected string
+	}{
+		{
+			Name:     "no properties",
+			VM:       compute.VirtualMachine{},
+			Expected: "",
+		},
+		{
+			Name: "OS disk",
+			VM: compute.VirtualMachine{
+				VirtualMachineProperties: &compute.VirtualMachineProperties{
+					StorageProfile: &compute.StorageProfile{OsDisk: &compute.OSDisk{OsType: compute.Windows}},
+					OsProfile:      &compute.OSProfile{LinuxConfiguration: &compute.LinuxConfiguration{}},
+				},
+			},
+			Expected: "Windows",
+		},
+		{
+			Name: "OS profile",
+			VM: compute.VirtualMachine{
+				VirtualMachineProperties: &compute.VirtualMachineProperties{
+					StorageProfile: &compute.StorageProfile{OsDisk: &compute.OSDisk{}},
+					OsProfile:      &compute.OSProfile{LinuxConfiguration: &compute.LinuxConfiguration{}},
+				},
+			},
+			Expected: "Linux",
+		},
+		{
+			Name: "unknown",
+			VM: compute.VirtualMachine{
+				VirtualMachineProperties: &compute.VirtualMachineProperties{
+					StorageProfile: &compute.StorageProfile{},
+				},
+			},
+			Expected: "",
+		},
+	}
+
+	for _, tc := range cases {
+		if actual := flattenArmVirtualMachineOSType(tc.VM); actual != tc.Expected {
+			t.Fatalf("%s: Expected %q, got %q", tc.Name, tc.Expected, actual)
+		}
+	}
+}
+
+func TestArmVirtualMachineExtensionPublisherAndType(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Raw       map[string]interface{}
+		Client    *ArmClient
+		Publisher string
+		Type      string
+		Error     bool
+	}{
+		{
+			Name:      "resource values",
+			Raw:       map[string]interface{}{"publisher": "Microsoft.OSTCExtensions", "type": "CustomScriptForLinux"},
+			Client:    &ArmClient{defaultExtensionPublisher: "Microsoft.Azure.Extensions", defaultExtensionType: "CustomScript"},
+			Publisher: "Microsoft.OSTCExtensions",
+			Type:      "CustomScriptForLinux",
+		},
+		{
+			Name:      "provider defaults",
+			Raw:       map[string]interface{}{},
+			Client:    &ArmClient{defaultExtensionPublisher: "Microsoft.Azure.Extensions", defaultExtensionType: "CustomScript"},
+			Publisher: "Microsoft.Azure.Extensions",
+			Type:      "CustomScript",
+		},
+		{
+			Name:      "mixed",
+			Raw:       map[string]interface{}{"type": "DockerExtension"},
+			Client:    &ArmClient{defaultExtensionPublisher: "Microsoft.Azure.Extensions", defaultExtensionType: "CustomScript"},
+			Publisher: "Microsoft.Azure.Extensions",
+			Type:      "DockerExtension",
+		},
+		{
+			Name:   "no publisher",
+			Raw:    map[string]interface{}{"type": "CustomScript"},
+			Client: &ArmClient{},
+			Error:  true,
+		},
+		{
+			Name:   "no type",
+			Raw:    map[string]interface{}{},
+			Client: &ArmClient{defaultExtensionPublisher: "Microsoft.Azure.Extensions"},
+			Error:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		d := schema.TestResourceDataRaw(t, resourceArmVirtualMachineExtensions().Schema, tc.Raw)
+		publisher, extensionType, err := armVirtualMachineExtensionPublisherAndType(d, tc.Client)
+		if tc.Error {
+			if err == nil {
+				t.Fatalf("%s: Expected an error", tc.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: Unexpected error: %s", tc.Name, err)
+		}
+		if publisher != tc.Publisher || extensionType != tc.Type {
+			t.Fatalf("%s: Expected %s/%s, got %s/%s", tc.Name, tc.Publisher, tc.Type, publisher, extensionType)
+		}
+	}
+}
+
+func TestSuppressDiffVirtualMachineExtensionSettings_baseSettings(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceArmVirtualMachineExtensions().Schema, map[string]interface{}{
+		"base_settings": `{"logging":{"level":"info","syslog":true},"timeout":300}`,
+	})
+
+	// the state holds the merged settings, as returned by Azure
+	old := `{"commandToExecute":"hostname","logging":{"level":"info","syslog":false},"timeout":300}`
+
+	if !suppressDiffVirtualMachineExtensionSettings("settings", old, `{"commandToExecute":"hostname","logging":{"syslog":false}}`, d) {
+		t.Fatalf("Expected no diff when the merged settings match")
+	}
+	if suppressDiffVirtualMachineExtensionSettings("settings", old, `{"commandToExecute":"hostname"}`, d) {
+		t.Fatalf("Expected a diff when the base value is no longer overridden")
+	}
+	if suppressDiffVirtualMachineExtensionSettings("protected_settings", old, `{"commandToExecute":"hostname","logging":{"syslog":false}}`, d) {
+		t.Fatalf("Expected the base settings not to apply to protected_settings")
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionsRead_settingsNotReturned(t *testing.T) {
+	cases := []struct {
+		Publisher string
+		Type      string
+		Expected  string
+	}{
+		// the BGInfo extension never returns its settings
+		{Publisher: "Microsoft.Compute", Type: "BGInfo", Expected: `{"timeout":30}`},
+		{Publisher: "Microsoft.Azure.Extensions", Type: "CustomScript", Expected: `{}`},
+	}
+
+	for _, tc := range cases {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if strings.Contains(r.URL.Path, "/extensions/") {
+				fmt.Fprintf(w, `{"name":"test","location":"westus","properties":{"publisher":%q,"type":%q,"typeHandlerVersion":"2.0","settings":{},"provisioningState":"Succeeded"}}`, tc.Publisher, tc.Type)
+				return
+			}
+			fmt.Fprint(w, `{"name":"acctvm","properties":{}}`)
+		}))
+
+		d := testArmResourceDataRaw(t, resourceArmVirtualMachineExtensions(), map[string]interface{}{
+			"settings": `{"timeout":30}`,
+		})
+		d.SetId("/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/test")
+
+		err := resourceArmVirtualMachineExtensionsRead(d, testArmClientWithBaseURI(server.URL))
+		server.Close()
+		if err != nil {
+			t.Fatalf("%s/%s: Error reading the Extension: %s", tc.Publisher, tc.Type, err)
+		}
+
+		if actual := d.Get("settings").(string); actual != tc.Expected {
+			t.Fatalf("%s/%s: Expected the settings %s, got %s", tc.Publisher, tc.Type, tc.Expected, actual)
+		}
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionsDelete_skipDeleteWait(t *testing.T) {
+	cases := []struct {
+		StatusCode  int
+		Body        string
+		ExpectError bool
+	}{
+		{StatusCode: http.StatusAccepted},
+		{StatusCode: http.StatusNoContent},
+		{StatusCode: http.StatusNotFound, Body: `{"error":{"code":"NotFound","message":"The Resource was not found."}}`},
+		{StatusCode: http.StatusConflict, Body: `{"error":{"code":"ScopeLocked","message":"The scope is locked."}}`, ExpectError: true},
+	}
+
+	for _, tc := range cases {
+		var polls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if r.Method != "DELETE" {
+				atomic.AddInt32(&polls, 1)
+				fmt.Fprint(w, `{"status":"InProgress"}`)
+				return
+			}
+			w.Header().Set("Azure-AsyncOperation", "http://"+r.Host+"/operations/delete")
+			w.WriteHeader(tc.StatusCode)
+			fmt.Fprint(w, tc.Body)
+		}))
+
+		d := testArmResourceDataRaw(t, resourceArmVirtualMachineExtensions(), map[string]interface{}{
+			"skip_delete_wait": true,
+		})
+		d.SetId("/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/test")
+
+		err := resourceArmVirtualMachineExtensionsDelete(d, testArmClientWithBaseURI(server.URL))
+		server.Close()
+
+		if tc.ExpectError {
+			if err == nil || !strings.Contains(err.Error(), "ScopeLocked") {
+				t.Fatalf("%d: Expected the error to be returned, got %v", tc.StatusCode, err)
+			}
+		} else if err != nil {
+			t.Fatalf("%d: Expected the delete to succeed, got: %s", tc.StatusCode, err)
+		}
+		if polls != 0 {
+			t.Fatalf("%d: Expected the delete not to be waited for, got %d polls", tc.StatusCode, polls)
+		}
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionsRead_settingsFormatting(t *testing.T) {
+	cases := []struct {
+		Returned string
+		Pretty   bool
+		Expected string
+	}{
+		{Returned: `{"commandToExecute":"hostname","timestamp":1}`, Expected: "{\n  \"timestamp\": 1,\n  \"commandToExecute\": \"hostname\"\n}"},
+		// changed out-of-band
+		{Returned: `{"commandToExecute":"uptime","timestamp":1}`, Expected: `{"commandToExecute":"uptime","timestamp":1}`},
+		{Returned: `{"commandToExecute":"hostname","timestamp":1}`, Pretty: true, Expected: "{\n  \"commandToExecute\": \"hostname\",\n  \"timestamp\": 1\n}"},
+	}
+
+	for _, tc := range cases {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if strings.Contains(r.URL.Path, "/extensions/") {
+				fmt.Fprintf(w, `{"name":"test","location":"westus","properties":{"publisher":"Microsoft.Azure.Extensions","type":"CustomScript","typeHandlerVersion":"2.0","settings":%s,"provisioningState":"Succeeded"}}`, tc.Returned)
+				return
+			}
+			fmt.Fprint(w, `{"name":"acctvm","properties":{}}`)
+		}))
+
+		d := testArmResourceDataRaw(t, resourceArmVirtualMachineExtensions(), map[string]interface{}{
+			"settings": "{\n  \"timestamp\": 1,\n  \"commandToExecute\": \"hostname\"\n}",
+		})
+		d.SetId("/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/test")
+
+		client := testArmClientWithBaseURI(server.URL)
+		client.prettyPrintSettings = tc.Pretty
+		err := resourceArmVirtualMachineExtensionsRead(d, client)
+		server.Close()
+		if err != nil {
+			t.Fatalf("Error reading the Extension: %s", err)
+		}
+
+		if actual := d.Get("settings").(string); actual != tc.Expected {
+			t.Fatalf("Expected the settings %q to be stored for %s (pretty %t), got %q", tc.Expected, tc.Returned, tc.Pretty, actual)
+		}
+	}
+}
+
+func TestFlattenArmVirtualMachineExtensionReturnedSettings(t *testing.T) {
+	client := testArmClientWithBaseURI("http://localhost")
+	d := schema.TestResourceDataRaw(t, resourceArmVirtualMachineExtensions().Schema, map[string]interface{}{
+		"settings": `{"commandToExecute": "hostname"}`,
+	})
+
+	// the settings as written are kept while they're the same as those returned
+	if actual := flattenArmVirtualMachineExtensionReturnedSettings(d, client, "acctestRG", "test", map[string]interface{}{"commandToExecute": "hostname"}); actual != `{"commandToExecute": "hostname"}` {
+		t.Fatalf("Expected the configured settings to be kept, got %s", actual)
+	}
+	if actual := flattenArmVirtualMachineExtensionReturnedSettings(d, client, "acctestRG", "test", map[string]interface{}{"commandToExecute": "uptime"}); actual != `{"commandToExecute":"uptime"}` {
+		t.Fatalf("Expected the returned settings, got %s", actual)
+	}
+
+	// settings which can't be flattened leave the previous value
+	if actual := flattenArmVirtualMachineExtensionReturnedSettings(d, client, "acctestRG", "test", map[string]interface{}{"commandToExecute": make(chan int)}); actual != `{"commandToExecute": "hostname"}` {
+		t.Fatalf("Expected the previous settings to be kept, got %s", actual)
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionsRead_targetOSType(t *testing.T) {
+	var vmStatus int32 = http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.Path, "/extensions/") {
+			fmt.Fprint(w, `{"name":"hostname","location":"westus","properties":{"publisher":"Microsoft.Azure.Extensions","type":"CustomScript","typeHandlerVersion":"2.0","provisioningState":"Succeeded"}}`)
+			return
+		}
+		if status := atomic.LoadInt32(&vmStatus); status != http.StatusOK {
+			w.WriteHeader(int(status))
+			fmt.Fprint(w, `{"error":{"code":"AuthorizationFailed","message":"The client does not have authorization to perform action."}}`)
+			return
+		}
+		fmt.Fprint(w, `{"name":"acctvm","properties":{"storageProfile":{"osDisk":{"osType":"Windows"}}}}`)
+	}))
+	defer server.Close()
+
+	d := testArmResourceDataRaw(t, resourceArmVirtualMachineExtensions(), map[string]interface{}{})
+	d.SetId("/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/hostname")
+
+	if err := resourceArmVirtualMachineExtensionsRead(d, testArmClientWithBaseURI(server.URL)); err != nil {
+		t.Fatalf("Error reading the Extension: %s", err)
+	}
+	if actual := d.Get("target_os_type").(string); actual != "Windows" {
+		t.Fatalf("Expected the OS type to be read, got %q", actual)
+	}
+
+	// failing to read the Virtual Machine doesn't fail the refresh
+	atomic.StoreInt32(&vmStatus, http.StatusForbidden)
+	if err := resourceArmVirtualMachineExtensionsRead(d, testArmClientWithBaseURI(server.URL)); err != nil {
+		t.Fatalf("Expected the refresh to succeed without the Virtual Machine, got: %s", err)
+	}
+	if actual := d.Get("target_os_type").(string); actual != "Windows" {
+		t.Fatalf("Expected the previous OS type to be kept, got %q", actual)
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionsRead_nameCase(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.Path, "/extensions/") {
+			fmt.Fprint(w, `{"name":"CustomScript","location":"westus","properties":{"publisher":"Microsoft.Azure.Extensions","type":"CustomScript","typeHandlerVersion":"2.0","settings":{},"provisioningState":"Succeeded"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"name":"acctvm","properties":{}}`)
+	}))
+	defer server.Close()
+
+	cases := []struct {
+		Current  string
+		Expected string
+	}{
+		{Current: "customscript", Expected: "customscript"},
+		{Current: "CustomScript", Expected: "CustomScript"},
+		// imported
+		{Current: "", Expected: "CustomScript"},
+	}
+
+	for _, tc := range cases {
+		d := testArmResourceDataRaw(t, resourceArmVirtualMachineExtensions(), map[string]interface{}{
+			"name": tc.Current,
+		})
+		d.SetId("/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/customscript")
+
+		if err := resourceArmVirtualMachineExtensionsRead(d, testArmClientWithBaseURI(server.URL)); err != nil {
+			t.Fatalf("Error reading the Extension: %s", err)
+		}
+		if actual := d.Get("name").(string); actual != tc.Expected {
+			t.Fatalf("Expected the name %q to be read back as %q, got %q", tc.Current, tc.Expected, actual)
+		}
+	}
+
+	// the Extension isn't replaced for a change of the case of its name
+	state := &terraform.InstanceState{
+		ID: "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/CustomScript",
+		Attributes: map[string]string{
+			"name": "CustomScript",
+		},
+	}
+	raw, err := config.NewRawConfig(map[string]interface{}{
+		"name": "customscript",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff, err := resourceArmVirtualMachineExtensions().Diff(state, terraform.NewResourceConfig(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.RequiresNew() || diff.Attributes["name"] != nil {
+		t.Fatalf("Expected no diff of the name, got %+v", diff.Attributes["name"])
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionsDelete(t *testing.T) {
+	cases := []struct {
+		StatusCode  int
+		Body        string
+		ExpectError bool
+	}{
+		{StatusCode: http.StatusOK},
+		{StatusCode: http.StatusNoContent},
+		{StatusCode: http.StatusNotFound, Body: `{"error":{"code":"NotFound","message":"The Resource was not found."}}`},
+		{StatusCode: http.StatusConflict, Body: `{"error":{"code":"ScopeLocked","message":"The scope is locked."}}`, ExpectError: true},
+	}
+
+	for _, tc := range cases {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "DELETE" {
+				t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(tc.StatusCode)
+			fmt.Fprint(w, tc.Body)
+		}))
+
+		d := testArmResourceDataRaw(t, resourceArmVirtualMachineExtensions(), map[string]interface{}{})
+		d.SetId("/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/test")
+
+		err := resourceArmVirtualMachineExtensionsDelete(d, testArmClientWithBaseURI(server.URL))
+		server.Close()
+
+		if tc.ExpectError {
+			if err == nil || !strings.Contains(err.Error(), "ScopeLocked") {
+				t.Fatalf("%d: Expected the error to be returned, got %v", tc.StatusCode, err)
+			}
+		} else if err != nil {
+			t.Fatalf("%d: Expected the delete to succeed, got: %s", tc.StatusCode, err)
+		}
+	}
+}
+
+func TestResourceArmVirtualMachineExtensions_importLowercasedID(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/virtualMachines/acctvm/extensions/hostname"):
+			fmt.Fprint(w, `{"id":"/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/hostname","name":"hostname","location":"westus","properties":{"publisher":"Microsoft.OSTCExtensions","type":"CustomScriptForLinux","typeHandlerVersion":"1.2","provisioningState":"Succeeded"}}`)
+		case strings.HasSuffix(r.URL.Path, "/virtualMachines/acctvm"):
+			fmt.Fprint(w, `{"name":"acctvm","properties":{"storageProfile":{"osDisk":{"osType":"Linux"}}}}`)
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	resource := resourceArmVirtualMachineExtensions()
+	d := testArmResourceDataRaw(t, resource, map[string]interface{}{})
+	d.SetId("/subscriptions/00000000-0000-0000-0000-000000000000/resourcegroups/acctestRG/providers/Microsoft.Compute/virtualmachines/acctvm/extensions/hostname")
+
+	client := testArmClientWithBaseURI(server.URL)
+	imported, err := resource.Importer.State(d, client)
+	if err != nil || len(imported) != 1 {
+		t.Fatalf("Error importing the Extension: %v", err)
+	}
+	if err := resourceArmVirtualMachineExtensionsRead(imported[0], client); err != nil {
+		t.Fatalf("Error reading the imported Extension: %s", err)
+	}
+
+	for key, expected := range map[string]string{
+		"name":                 "hostname",
+		"virtual_machine_name": "acctvm",
+		"resource_group_name":  "acctestRG",
+	} {
+		if actual := imported[0].Get(key).(string); actual != expected {
+			t.Fatalf("Expected %s to be %q, got %q", key, expected, actual)
+		}
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionsCreate_timeout(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "PUT":
+			w.Header().Set("Azure-AsyncOperation", server.URL+"/operations/1")
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"name":"hostname","properties":{"provisioningState":"Creating"}}`)
+		case strings.HasSuffix(r.URL.Path, "/operations/1"):
+			w.Header().Set("Retry-After", "1")
+			fmt.Fprint(w, `{"status":"InProgress"}`)
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	raw, err := config.NewRawConfig(map[string]interface{}{
+		"name":                 "hostname",
+		"location":             "westus",
+		"resource_group_name":  "acctestRG",
+		"virtual_machine_name": "acctvm",
+		"publisher":            "Microsoft.OSTCExtensions",
+		"type":                 "CustomScriptForLinux",
+		"type_handler_version": "1.2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := terraform.NewResourceConfig(raw)
+	rc.Config["timeouts"] = []map[string]interface{}{{"create": "200ms"}}
+
+	resource := resourceArmVirtualMachineExtensions()
+	diff, err := resource.Diff(nil, rc)
+	if err != nil {
+		t.Fatalf("Error planning the Extension: %s", err)
+	}
+
+	start := time.Now()
+	_, err = resource.Apply(nil, diff, testArmClientWithBaseURI(server.URL))
+	if err == nil || !strings.Contains(err.Error(), "Timed out after 200ms") || !strings.Contains(err.Error(), `"hostname"`) {
+		t.Fatalf("Expected a timeout error naming the Extension, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Expected the polling to stop at the timeout, took %s", elapsed)
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionsUpdate_rollbackSettingsOnUpdateFailure(t *testing.T) {
+	var puts int32
+	var rollback compute.VirtualMachineExtension
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case "GET":
+			fmt.Fprint(w, `{"id":"/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/hostname","name":"hostname","location":"westus","properties":{"publisher":"Microsoft.OSTCExtensions","type":"CustomScriptForLinux","typeHandlerVersion":"1.2","settings":{"commandToExecute":"v1"},"provisioningState":"Succeeded"}}`)
+		case "PUT":
+			if atomic.AddInt32(&puts, 1) == 1 {
+				fmt.Fprint(w, `{"name":"hostname","properties":{"provisioningState":"Failed"}}`)
+				return
+			}
+			if err := json.NewDecoder(r.Body).Decode(&rollback); err != nil {
+				t.Errorf("Error decoding the rollback: %s", err)
+			}
+			fmt.Fprint(w, `{"name":"hostname","properties":{"provisioningState":"Succeeded"}}`)
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	state := &terraform.InstanceState{
+		ID: "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/hostname",
+		Attributes: map[string]string{
+			"name":                                "hostname",
+			"location":                            "westus",
+			"resource_group_name":                 "acctestRG",
+			"virtual_machine_name":                "acctvm",
+			"publisher":                           "Microsoft.OSTCExtensions",
+			"type":                                "CustomScriptForLinux",
+			"type_handler_version":                "1.2",
+			"settings":                            `{"commandToExecute":"v1"}`,
+			"protected_settings":                  `{"token":"old"}`,
+			"rollback_settings_on_update_failure": "true",
+		},
+	}
+	raw, err := config.NewRawConfig(map[string]interface{}{
+		"name":                                "hostname",
+		"location":                            "westus",
+		"resource_group_name":                 "acctestRG",
+		"virtual_machine_name":                "acctvm",
+		"publisher":                           "Microsoft.OSTCExtensions",
+		"type":                                "CustomScriptForLinux",
+		"type_handler_version":                "1.2",
+		"settings":                            `{"commandToExecute":"v2"}`,
+		"protected_settings":                  `{"token":"new"}`,
+		"rollback_settings_on_update_failure": true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resource := resourceArmVirtualMachineExtensions()
+	diff, err := resource.Diff(state, terraform.NewResourceConfig(raw))
+	if err != nil {
+		t.Fatalf("Error planning the update: %s", err)
+	}
+
+	updated, err := resource.Apply(state, diff, testArmClientWithBaseURI(server.URL))
+	if err == nil || !strings.Contains(err.Error(), "previous settings of the Extension have been restored") {
+		t.Fatalf("Expected the update error with the rollback, got %v", err)
+	}
+	if puts != 2 {
+		t.Fatalf("Expected the update followed by the rollback, got %d requests", puts)
+	}
+
+	props := rollback.VirtualMachineExtensionProperties
+	if props == nil || props.Settings == nil || (*props.Settings)["commandToExecute"] != "v1" {
+		t.Fatalf("Expected the previous settings to be restored, got %+v", props)
+	}
+	if props.ProtectedSettings == nil || (*props.ProtectedSettings)["token"] != "old" {
+		t.Fatalf("Expected the previous protected settings to be restored, got %+v", props.ProtectedSettings)
+	}
+	if updated == nil || updated.Attributes["settings"] != `{"commandToExecute":"v1"}` {
+		t.Fatalf("Expected the state to keep the previous settings, got %+v", updated)
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionsRead_emptyTypeHandlerVersion(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.Path, "/extensions/") {
+			fmt.Fprint(w, `{"name":"MDE.Linux","location":"westus","properties":{"publisher":"Microsoft.Azure.AzureDefenderForServers","type":"MDE.Linux","typeHandlerVersion":"","provisioningState":"Succeeded"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"name":"acctvm"}`)
+	}))
+	defer server.Close()
+
+	d := testArmResourceDataRaw(t, resourceArmVirtualMachineExtensions(), map[string]interface{}{
+		"type_handler_version": "1.0",
+	})
+	d.SetId("/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/MDE.Linux")
+
+	if err := resourceArmVirtualMachineExtensionsRead(d, testArmClientWithBaseURI(server.URL)); err != nil {
+		t.Fatalf("Error reading the Extension: %s", err)
+	}
+	if version := d.Get("type_handler_version").(string); version != "1.0" {
+		t.Fatalf("Expected the configured version to be kept, got %q", version)
+	}
+}
+
+func TestResourceArmVirtualMachineExtensions_publisherForcesNew(t *testing.T) {
+	state := &terraform.InstanceState{
+		ID: "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/hostname",
+		Attributes: map[string]string{
+			"name":                 "hostname",
+			"location":             "westus",
+			"resource_group_name":  "acctestRG",
+			"virtual_machine_name": "acctvm",
+			"publisher":            "Microsoft.OSTCExtensions",
+			"type":                 "CustomScriptForLinux",
+			"type_handler_version": "1.2",
+		},
+	}
+
+	cases := []struct {
+		Changes     map[string]interface{}
+		RequiresNew bool
+	}{
+		{Changes: map[string]interface{}{"publisher": "Microsoft.Azure.Extensions"}, RequiresNew: true},
+		{Changes: map[string]interface{}{"type": "CustomScript"}, RequiresNew: true},
+		{Changes: map[string]interface{}{"type_handler_version": "1.5"}, RequiresNew: false},
+		{Changes: map[string]interface{}{"settings": `{"commandToExecute":"hostname"}`}, RequiresNew: false},
+	}
+
+	for i, tc := range cases {
+		attributes := map[string]interface{}{
+			"name":                 "hostname",
+			"location":             "westus",
+			"resource_group_name":  "acctestRG",
+			"virtual_machine_name": "acctvm",
+			"publisher":            "Microsoft.OSTCExtensions",
+			"type":                 "CustomScriptForLinux",
+			"type_handler_version": "1.2",
+		}
+		for k, v := range tc.Changes {
+			attributes[k] = v
+		}
+		raw, err := config.NewRawConfig(attributes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		diff, err := resourceArmVirtualMachineExtensions().Diff(state, terraform.NewResourceConfig(raw))
+		if err != nil {
+			t.Fatalf("Case %d: Error planning the Extension: %s", i, err)
+		}
+		if diff == nil || diff.RequiresNew() != tc.RequiresNew {
+			t.Fatalf("Case %d: Expected the change of %v to require a new resource to be %t, got %#v", i, tc.Changes, tc.RequiresNew, diff)
+		}
+	}
+}
+
+func TestResourceArmVirtualMachineExtensions_locationCasing(t *testing.T) {
+	state := &terraform.InstanceState{
+		ID: "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/hostname",
+		Attributes: map[string]string{
+			"name":                 "hostname",
+			"location":             "westus",
+			"resource_group_name":  "acctestRG",
+			"virtual_machine_name": "acctvm",
+			"publisher":            "Microsoft.OSTCExtensions",
+			"type":                 "CustomScriptForLinux",
+			"type_handler_version": "1.2",
+		},
+	}
+	raw, err := config.NewRawConfig(map[string]interface{}{
+		"name":                 "hostname",
+		"location":             "West US",
+		"resource_group_name":  "acctestRG",
+		"virtual_machine_name": "acctvm",
+		"publisher":            "Microsoft.OSTCExtensions",
+		"type":                 "CustomScriptForLinux",
+		"type_handler_version": "1.2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := resourceArmVirtualMachineExtensions().Diff(state, terraform.NewResourceConfig(raw))
+	if err != nil {
+		t.Fatalf("Error planning the Extension: %s", err)
+	}
+	if diff != nil {
+		if attr, ok := diff.Attributes["location"]; ok {
+			t.Fatalf("Expected no diff of the location, got %#v", attr)
+		}
+		if diff.RequiresNew() {
+			t.Fatalf("Expected the Extension not to be recreated, got %#v", diff)
+		}
+	}
+}
+
+func TestResourceArmVirtualMachineExtensions_publisherCasing(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.Path, "/extensions/") {
+			fmt.Fprint(w, `{"id":"/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/hostname","name":"hostname","location":"westus","properties":{"publisher":"microsoft.ostcextensions","type":"customscriptforlinux","typeHandlerVersion":"1.2","provisioningState":"Succeeded"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"name":"acctvm","properties":{}}`)
+	}))
+	defer server.Close()
+
+	resource := resourceArmVirtualMachineExtensions()
+	state := &terraform.InstanceState{
+		ID: "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/hostname",
+		Attributes: map[string]string{
+			"name":                 "hostname",
+			"location":             "westus",
+			"resource_group_name":  "acctestRG",
+			"virtual_machine_name": "acctvm",
+			"publisher":            "Microsoft.OSTCExtensions",
+			"type":                 "CustomScriptForLinux",
+			"type_handler_version": "1.2",
+		},
+	}
+
+	refreshed, err := resource.Refresh(state, testArmClientWithBaseURI(server.URL))
+	if err != nil {
+		t.Fatalf("Error refreshing the Extension: %s", err)
+	}
+	if refreshed.Attributes["publisher"] != "Microsoft.OSTCExtensions" || refreshed.Attributes["type"] != "CustomScriptForLinux" {
+		t.Fatalf("Expected the configured casing to be kept in the state, got %q and %q", refreshed.Attributes["publisher"], refreshed.Attributes["type"])
+	}
+
+	// e.g. an imported Extension has the casing Azure returned
+	refreshed.Attributes["publisher"] = "microsoft.ostcextensions"
+	refreshed.Attributes["type"] = "customscriptforlinux"
+	raw, err := config.NewRawConfig(map[string]interface{}{
+		"name":                 "hostname",
+		"location":             "westus",
+		"resource_group_name":  "acctestRG",
+		"virtual_machine_name": "acctvm",
+		"publisher":            "Microsoft.OSTCExtensions",
+		"type":                 "CustomScriptForLinux",
+		"type_handler_version": "1.2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := resource.Diff(refreshed, terraform.NewResourceConfig(raw))
+	if err != nil {
+		t.Fatalf("Error planning the Extension: %s", err)
+	}
+	if diff != nil {
+		for _, k := range []string{"publisher", "type"} {
+			if attr, ok := diff.Attributes[k]; ok {
+				t.Fatalf("Expected no diff of the %s, got %#v", k, attr)
+			}
+		}
+		if diff.RequiresNew() {
+			t.Fatalf("Expected the Extension not to be recreated, got %#v", diff)
+		}
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionsRead_nilTags(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.Path, "/extensions/") {
+			fmt.Fprint(w, `{"id":"/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/hostname","name":"hostname","location":"westus","tags":null,"properties":{"publisher":"Microsoft.OSTCExtensions","type":"CustomScriptForLinux","typeHandlerVersion":"1.2","provisioningState":"Succeeded"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"name":"acctvm","properties":{}}`)
+	}))
+	defer server.Close()
+
+	client := testArmClientWithBaseURI(server.URL)
+	resource := resourceArmVirtualMachineExtensions()
+	state := &terraform.InstanceState{
+		ID: "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/hostname",
+		Attributes: map[string]string{
+			"name":                 "hostname",
+			"location":             "westus",
+			"resource_group_name":  "acctestRG",
+			"virtual_machine_name": "acctvm",
+			"publisher":            "Microsoft.OSTCExtensions",
+			"type":                 "CustomScriptForLinux",
+			"type_handler_version": "1.2",
+		},
+	}
+
+	for _, tags := range []interface{}{nil, map[string]interface{}{}} {
+		attributes := map[string]interface{}{
+			"name":                 "hostname",
+			"location":             "westus",
+			"resource_group_name":  "acctestRG",
+			"virtual_machine_name": "acctvm",
+			"publisher":            "Microsoft.OSTCExtensions",
+			"type":                 "CustomScriptForLinux",
+			"type_handler_version": "1.2",
+		}
+		if tags != nil {
+			attributes["tags"] = tags
+		}
+		raw, err := config.NewRawConfig(attributes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			refreshed, err := resource.Refresh(state, client)
+			if err != nil {
+				t.Fatalf("Error reading the Extension: %s", err)
+			}
+			if refreshed.Attributes["tags.%"] != "0" {
+				t.Fatalf("Expected the tags to be an empty map, got %#v", refreshed.Attributes)
+			}
+
+			diff, err := resource.Diff(refreshed, terraform.NewResourceConfig(raw))
+			if err != nil {
+				t.Fatalf("Error planning the Extension: %s", err)
+			}
+			if diff != nil {
+				for key, attr := range diff.Attributes {
+					if strings.HasPrefix(key, "tags") {
+						t.Fatalf("Expected no diff of the tags after reading (config tags %#v), got %q: %#v", tags, key, attr)
+					}
+				}
+			}
+			state = refreshed
+		}
+	}
+}
+
+func TestArmVirtualMachineExtensionRemovedMessage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/virtualMachines/removedvm") {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"code":"ResourceNotFound","message":"The Resource was not found."}}`)
+			return
+		}
+		fmt.Fprint(w, `{"name":"acctvm","properties":{}}`)
+	}))
+	defer server.Close()
+
+	client := testArmClientWithBaseURI(server.URL)
+	cases := []struct {
+		VM       string
+		Skipped  bool
+		Expected string
+	}{
+		{VM: "acctvm", Expected: "removed outside of Terraform, either by a user or by Azure itself"},
+		{VM: "removedvm", Expected: "will only be recreated along with the Virtual Machine"},
+		{VM: "acctvm", Skipped: true, Expected: "was skipped"},
+	}
+
+	for _, tc := range cases {
+		if message := armVirtualMachineExtensionRemovedMessage(client, "acctestRG", tc.VM, "hostname", tc.Skipped); !strings.Contains(message, tc.Expected) {
+			t.Fatalf("Expected the message for %q (skipped %t) to contain %q, got %q", tc.VM, tc.Skipped, tc.Expected, message)
+		}
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionsRead_appliedSettingsKeys(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(r.URL.Path, "/extensions/") {
+			fmt.Fprint(w, `{"name":"hostname","location":"westus","properties":{"publisher":"Microsoft.Azure.Extensions","type":"CustomScript","typeHandlerVersion":"2.0","settings":{"fileUris":["https://example.com/a.sh"],"commandToExecute":"sh a.sh","timestamp":1},"provisioningState":"Succeeded"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"name":"acctvm"}`)
+	}))
+	defer server.Close()
+
+	d := testArmResourceDataRaw(t, resourceArmVirtualMachineExtensions(), map[string]interface{}{
+		"protected_settings": `{"storageAccountKey":"secret"}`,
+	})
+	d.SetId("/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/hostname")
+
+	if err := resourceArmVirtualMachineExtensionsRead(d, testArmClientWithBaseURI(server.URL)); err != nil {
+		t.Fatalf("Error reading the Extension: %s", err)
+	}
+
+	keys := d.Get("applied_settings_keys").([]interface{})
+	if expected := []interface{}{"commandToExecute", "fileUris", "timestamp"}; !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("Expected the applied settings keys %v, got %v", expected, keys)
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionsCreate_forceUpdateTag(t *testing.T) {
+	var sent compute.VirtualMachineExtension
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "PUT" && strings.Contains(r.URL.Path, "/extensions/"):
+			if err := json.NewDecoder(r.Body).Decode(&sent); err != nil {
+				t.Errorf("Error decoding the Extension: %s", err)
+			}
+			fmt.Fprint(w, `{"name":"test","properties":{"provisioningState":"Succeeded"}}`)
+		case strings.Contains(r.URL.Path, "/extensions/"):
+			fmt.Fprint(w, `{"id":"/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/test","name":"test","location":"westus","properties":{"publisher":"Microsoft.Azure.Extensions","type":"CustomScript","typeHandlerVersion":"2.0","forceUpdateTag":"2","settings":{},"provisioningState":"Succeeded"}}`)
+		default:
+			fmt.Fprint(w, `{"name":"acctvm","properties":{}}`)
+		}
+	}))
+	defer server.Close()
+
+	d := testArmResourceDataRaw(t, resourceArmVirtualMachineExtensions(), map[string]interface{}{
+		"name":                 "test",
+		"location":             "West US",
+		"resource_group_name":  "acctestRG",
+		"virtual_machine_name": "acctvm",
+		"publisher":            "Microsoft.Azure.Extensions",
+		"type":                 "CustomScript",
+		"type_handler_version": "2.0",
+		"force_update_tag":     "2",
+	})
+	d.MarkNewResource()
+
+	if err := resourceArmVirtualMachineExtensionsCreate(d, testArmClientWithBaseURI(server.URL)); err != nil {
+		t.Fatalf("Error creating the Extension: %s", err)
+	}
+
+	if props := sent.VirtualMachineExtensionProperties; props == nil || props.ForceUpdateTag == nil || *props.ForceUpdateTag != "2" {
+		t.Fatalf("Expected the forceUpdateTag to be sent, got %+v", props)
+	}
+	if actual := d.Get("force_update_tag").(string); actual != "2" {
+		t.Fatalf("Expected the force_update_tag to be read back, got %q", actual)
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionsCreate_virtualMachineNotFound(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		if strings.Contains(r.URL.Path, "/extensions/") {
+			fmt.Fprint(w, `{"error":{"code":"ParentResourceNotFound","message":"Can not perform requested operation on nested resource. Parent resource 'acctvm' not found."}}`)
+			return
+		}
+		fmt.Fprint(w, `{"error":{"code":"ResourceNotFound","message":"The Resource 'Microsoft.Compute/virtualMachines/acctvm' under resource group 'acctestRG' was not found."}}`)
+	}))
+	defer server.Close()
+
+	d := testArmResourceDataRaw(t, resourceArmVirtualMachineExtensions(), map[string]interface{}{
+		"name":                 "test",
+		"location":             "West US",
+		"resource_group_name":  "acctestRG",
+		"virtual_machine_name": "acctvm",
+		"publisher":            "Microsoft.OSTCExtensions",
+		"type":                 "CustomScriptForLinux",
+		"type_handler_version": "1.2",
+	})
+	d.MarkNewResource()
+
+	err := resourceArmVirtualMachineExtensionsCreate(d, testArmClientWithBaseURI(server.URL))
+	if err == nil || !strings.Contains(err.Error(), `Virtual Machine "acctvm" in resource group "acctestRG" was not found - create it before attaching Virtual Machine Extension "test"`) {
+		t.Fatalf("Expected an error saying the Virtual Machine doesn't exist, got %v", err)
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionsCreate_createDelayStopped(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "PUT" {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		fmt.Fprint(w, `{"name":"acctvm","properties":{}}`)
+	}))
+	defer server.Close()
+
+	d := testArmResourceDataRaw(t, resourceArmVirtualMachineExtensions(), map[string]interface{}{
+		"name":                 "test",
+		"location":             "West US",
+		"resource_group_name":  "acctestRG",
+		"virtual_machine_name": "acctvm",
+		"publisher":            "Microsoft.OSTCExtensions",
+		"type":                 "CustomScriptForLinux",
+		"type_handler_version": "1.2",
+		"create_delay":         "10m",
+	})
+	d.MarkNewResource()
+
+	// interrupting Terraform ends the delay
+	client := testArmClientWithBaseURI(server.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	client.StopContext = ctx
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := resourceArmVirtualMachineExtensionsCreate(d, client)
+	if err == nil || !strings.Contains(err.Error(), "`create_delay`") {
+		t.Fatalf("Expected an error saying the delay was stopped, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("Expected the delay to end when stopped, took %s", elapsed)
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionsCreate_autoUpgradeBuildPinned(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+	}))
+	defer server.Close()
+
+	d := schema.TestResourceDataRaw(t, resourceArmVirtualMachineExtensions().Schema, map[string]interface{}{
+		"name":                       "test",
+		"location":                   "West US",
+		"resource_group_name":        "acctestRG",
+		"virtual_machine_name":       "acctvm",
+		"publisher":                  "Microsoft.Azure.Extensions",
+		"type":                       "CustomScript",
+		"type_handler_version":       "2.0.1",
+		"auto_upgrade_minor_version": true,
+	})
+	d.MarkNewResource()
+
+	err := resourceArmVirtualMachineExtensionsCreate(d, testArmClientWithBaseURI(server.URL))
+	if err == nil || !strings.Contains(err.Error(), `use a `+"`major.minor`"+` version (such as "2.0")`) {
+		t.Fatalf("Expected an error suggesting a `major.minor` version, got %v", err)
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionsCreate_requiresImport(t *testing.T) {
+	for _, existing := range []bool{true, false} {
+		var puts int
+		exists := existing
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch {
+			case r.Method == "PUT" && strings.Contains(r.URL.Path, "/extensions/"):
+				puts++
+				exists = true
+				fmt.Fprint(w, `{"name":"CustomScript","properties":{"provisioningState":"Succeeded"}}`)
+			case strings.Contains(r.URL.Path, "/extensions/") && !exists:
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"error":{"code":"NotFound","message":"The entity was not found."}}`)
+			case strings.Contains(r.URL.Path, "/extensions/"):
+				fmt.Fprint(w, `{"id":"/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/CustomScript","name":"CustomScript","location":"westus","properties":{"publisher":"Microsoft.OSTCExtensions","type":"CustomScriptForLinux","typeHandlerVersion":"1.2","provisioningState":"Succeeded"}}`)
+			default:
+				fmt.Fprint(w, `{"name":"acctvm","properties":{}}`)
+			}
+		}))
+
+		d := testArmResourceDataRaw(t, resourceArmVirtualMachineExtensions(), map[string]interface{}{
+			"name":                 "CustomScript",
+			"location":             "West US",
+			"resource_group_name":  "acctestRG",
+			"virtual_machine_name": "acctvm",
+			"publisher":            "Microsoft.OSTCExtensions",
+			"type":                 "CustomScriptForLinux",
+			"type_handler_version": "1.2",
+		})
+		d.MarkNewResource()
+
+		client := testArmClientWithBaseURI(server.URL)
+		client.requireImportForExistingExtensions = true
+		err := resourceArmVirtualMachineExtensionsCreate(d, client)
+		server.Close()
+
+		if !existing {
+			if err != nil || puts != 1 {
+				t.Fatalf("Expected a new Extension to be created, got %d requests (%v)", puts, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), "terraform import azurerm_virtual_machine_extension.example /subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/CustomScript") {
+			t.Fatalf("Expected an error pointing at `terraform import`, got %v", err)
+		}
+		if puts != 0 {
+			t.Fatalf("Expected the existing Extension not to be overwritten, got %d requests", puts)
+		}
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionsCreate_vmAttributeReferences(t *testing.T) {
+	var sent compute.VirtualMachineExtension
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "PUT" && strings.Contains(r.URL.Path, "/extensions/"):
+			if err := json.NewDecoder(r.Body).Decode(&sent); err != nil {
+				t.Errorf("Error decoding the Extension: %s", err)
+			}
+			fmt.Fprint(w, `{"name":"test","properties":{"provisioningState":"Succeeded"}}`)
+		case strings.Contains(r.URL.Path, "/extensions/"):
+			fmt.Fprint(w, `{"id":"/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/test","name":"test","location":"westus","properties":{"publisher":"Microsoft.Azure.Extensions","type":"CustomScript","typeHandlerVersion":"2.0","settings":{"commandToExecute":"register acctvm 10.0.0.4"},"provisioningState":"Succeeded"}}`)
+		case strings.Contains(r.URL.Path, "/networkInterfaces/"):
+			fmt.Fprint(w, `{"name":"acctni","properties":{"ipConfigurations":[{"name":"secondary","properties":{"privateIPAddress":"10.0.0.5","primary":false}},{"name":"primary","properties":{"privateIPAddress":"10.0.0.4","primary":true}}]}}`)
+		default:
+			fmt.Fprint(w, `{"name":"acctvm","properties":{"osProfile":{"computerName":"acctvm"},"networkProfile":{"networkInterfaces":[{"id":"/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Network/networkInterfaces/acctni"}]}}}`)
+		}
+	}))
+	defer server.Close()
+
+	raw := map[string]interface{}{
+		"name":                 "test",
+		"location":             "West US",
+		"resource_group_name":  "acctestRG",
+		"virtual_machine_name": "acctvm",
+		"publisher":            "Microsoft.Azure.Extensions",
+		"type":                 "CustomScript",
+		"type_handler_version": "2.0",
+		"vm_attribute_references": []interface{}{
+			map[string]interface{}{"name": "host", "attribute": "computer_name"},
+			map[string]interface{}{"name": "ip", "attribute": "private_ip_address"},
+		},
+	}
+	// the raw configuration would interpolate the tokens
+	d := testArmResourceDataRaw(t, resourceArmVirtualMachineExtensions(), raw)
+	d.Set("settings", `{"commandToExecute":"register ${vm:host} ${vm:ip}"}`)
+	d.MarkNewResource()
+
+	if err := resourceArmVirtualMachineExtensionsCreate(d, testArmClientWithBaseURI(server.URL)); err != nil {
+		t.Fatalf("Error creating the Extension: %s", err)
+	}
+
+	if props := sent.VirtualMachineExtensionProperties; props == nil || props.Settings == nil || (*props.Settings)["commandToExecute"] != "register acctvm 10.0.0.4" {
+		t.Fatalf("Expected the Virtual Machine attributes to be substituted, got %+v", props)
+	}
+	// the template is kept, so that the substituted settings aren't a diff
+	if settings := d.Get("settings").(string); settings != `{"commandToExecute":"register ${vm:host} ${vm:ip}"}` {
+		t.Fatalf("Expected the settings template to be kept in the state, got %q", settings)
+	}
+	if ip := d.Get("vm_attribute_values.ip").(string); ip != "10.0.0.4" {
+		t.Fatalf("Expected the resolved private IP address to be stored, got %q", ip)
+	}
+
+	d = testArmResourceDataRaw(t, resourceArmVirtualMachineExtensions(), raw)
+	d.Set("settings", `{"commandToExecute":"register ${vm:hostname}"}`)
+	d.MarkNewResource()
+
+	err := resourceArmVirtualMachineExtensionsCreate(d, testArmClientWithBaseURI(server.URL))
+	if err == nil || !strings.Contains(err.Error(), "hostname") {
+		t.Fatalf("Expected an error about the undefined name, got %v", err)
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionsRead_instanceView(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if !strings.Contains(r.URL.Path, "/extensions/") {
+			fmt.Fprint(w, `{"name":"acctvm","properties":{}}`)
+			return
+		}
+
+		if r.URL.Query().Get("$expand") != "instanceView" {
+			t.Errorf("Expected the instance view to be requested")
+		}
+		fmt.Fprint(w, `{"name":"test","location":"westus","properties":{"publisher":"Microsoft.Azure.Extensions","type":"CustomScript","typeHandlerVersion":"2.0","settings":{},"provisioningState":"Succeeded","instanceView":{
+			"statuses":[
+				{"code":"ProvisioningState/succeeded","level":"Info","displayStatus":"Provisioning succeeded","message":"Enable succeeded"},
+				{"code":"ComponentStatus/deprecation","level":"Warning","message":"This version is deprecated"}
+			],
+			"substatuses":[
+				{"code":"ComponentStatus/StdOut/succeeded","level":"Info","message":"bootstrapping"},
+				{"code":"ComponentStatus/StdErr/succeeded","level":"Info","message":"login with s3cr3t failed"}
+			]
+		}}}`)
+	}))
+	defer server.Close()
+
+	d := testArmResourceDataRaw(t, resourceArmVirtualMachineExtensions(), map[string]interface{}{
+		"protected_settings": `{"password":"s3cr3t"}`,
+	})
+	d.SetId("/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/test")
+
+	if err := resourceArmVirtualMachineExtensionsRead(d, testArmClientWithBaseURI(server.URL)); err != nil {
+		t.Fatalf("Error reading the Extension: %s", err)
+	}
+
+	for key, expected := range map[string]string{
+		"instance_view.0.statuses.#":                "2",
+		"instance_view.0.statuses.0.level":          "Info",
+		"instance_view.0.statuses.0.display_status": "Provisioning succeeded",
+		"instance_view.0.statuses.1.level":          "Warning",
+		"instance_view.0.statuses.1.message":        "This version is deprecated",
+		"instance_view.0.substatuses.#":             "2",
+		"instance_view.0.substatuses.1.message":     "login with REDACTED failed",
+		"output":                                    "bootstrapping",
+		"error_output":                              "login with REDACTED failed",
+		"provisioning_state":                        "Succeeded",
+		"statuses.#":                                "2",
+		"statuses.0.code":                           "ProvisioningState/succeeded",
+		"statuses.0.display_status":                 "Provisioning succeeded",
+		"statuses.1.level":                          "Warning",
+		"statuses.1.message":                        "This version is deprecated",
+		"has_warnings":                              "true",
+		"has_errors":                                "false",
+	} {
+		if actual := d.State().Attributes[key]; actual != expected {
+			t.Fatalf("Expected %s to be %q, got %q", key, expected, actual)
+		}
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionsRead_virtualMachineRemoved(t *testing.T) {
+	cases := []struct {
+		Status  int
+		Body    string
+		Removed bool
+	}{
+		{
+			Status:  http.StatusNotFound,
+			Body:    `{"error":{"code":"ParentResourceNotFound","message":"Can not perform requested operation on nested resource. Parent resource 'acctvm' not found."}}`,
+			Removed: true,
+		},
+		{
+			Status:  http.StatusNotFound,
+			Body:    `{"error":{"code":"ResourceGroupNotFound","message":"Resource group 'acctestRG' could not be found."}}`,
+			Removed: true,
+		},
+		// other failures are still errors
+		{
+			Status:  http.StatusForbidden,
+			Body:    `{"error":{"code":"AuthorizationFailed","message":"The client does not have authorization to perform action 'Microsoft.Compute/virtualMachines/extensions/read'."}}`,
+			Removed: false,
+		},
+	}
+
+	for i, tc := range cases {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if strings.Contains(r.URL.Path, "/extensions/") {
+				w.WriteHeader(tc.Status)
+				fmt.Fprint(w, tc.Body)
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"code":"ResourceNotFound","message":"The Resource 'Microsoft.Compute/virtualMachines/acctvm' under resource group 'acctestRG' was not found."}}`)
+		}))
+
+		d := testArmResourceDataRaw(t, resourceArmVirtualMachineExtensions(), map[string]interface{}{})
+		d.SetId("/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/test")
+
+		client := testArmClientWithBaseURI(server.URL)
+		err := resourceArmVirtualMachineExtensionsRead(d, client)
+		server.Close()
+
+		if tc.Removed {
+			if err != nil {
+				t.Fatalf("Case %d: Expected the Extension to be removed from the state, got %s", i, err)
+			}
+			if d.Id() != "" {
+				t.Fatalf("Case %d: Expected the ID to be cleared, got %q", i, d.Id())
+			}
+			continue
+		}
+		if err == nil || d.Id() == "" {
+			t.Fatalf("Case %d: Expected an error and the Extension to be kept, got %v and ID %q", i, err, d.Id())
+		}
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionsRead_etag(t *testing.T) {
+	var extensionRequests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if !strings.Contains(r.URL.Path, "/extensions/") {
+			fmt.Fprint(w, `{"name":"acctvm","properties":{}}`)
+			return
+		}
+
+		atomic.AddInt32(&extensionRequests, 1)
+		if r.Header.Get("If-None-Match") == `W/"1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `W/"1"`)
+		fmt.Fprint(w, `{"name":"test","location":"westus","properties":{"publisher":"Microsoft.Azure.Extensions","type":"CustomScript","typeHandlerVersion":"2.0","settings":{"commandToExecute":"hostname"},"provisioningState":"Succeeded"}}`)
+	}))
+	defer server.Close()
+
+	d := testArmResourceDataRaw(t, resourceArmVirtualMachineExtensions(), map[string]interface{}{})
+	d.SetId("/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/test")
+
+	client := testArmClientWithBaseURI(server.URL)
+	if err := resourceArmVirtualMachineExtensionsRead(d, client); err != nil {
+		t.Fatalf("Error reading the Extension: %s", err)
+	}
+	if actual := d.Get("etag").(string); actual != `W/"1"` {
+		t.Fatalf("Expected the ETag to be stored, got %q", actual)
+	}
+
+	// an unchanged Extension keeps the state as-is
+	d.Set("settings", `{"commandToExecute":"changed"}`)
+	if err := resourceArmVirtualMachineExtensionsRead(d, client); err != nil {
+		t.Fatalf("Error reading the unchanged Extension: %s", err)
+	}
+	if extensionRequests != 2 || d.Id() == "" {
+		t.Fatalf("Expected the Extension to be requested again and kept, got %d requests and ID %q", extensionRequests, d.Id())
+	}
+	if actual := d.Get("settings").(string); actual != `{"commandToExecute":"changed"}` {
+		t.Fatalf("Expected the settings not to be flattened for a 304, got %s", actual)
+	}
+}
+
+func TestSuppressDiffVirtualMachineExtensionSettings_protectedSettingsHash(t *testing.T) {
+	sent := `{"storageAccountKey":"s3cr3t","storageAccountName":"acctsa"}`
+	d := schema.TestResourceDataRaw(t, resourceArmVirtualMachineExtensions().Schema, map[string]interface{}{"protected_settings": sent})
+	hash, err := hashArmVirtualMachineExtensionProtectedSettingsForState(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := hashArmVirtualMachineExtensionProtectedSettingsForState(d); err != nil || again != hash {
+		t.Fatalf("Expected the salt of the resource to be reused, got %q and %q (%v)", hash, again, err)
+	}
+	d.Set("protected_settings_hash", hash)
+	d.Set("protected_settings", "")
+
+	cases := []struct {
+		Old      string
+		New      string
+		Suppress bool
+	}{
+		// only the hash of the protected settings is needed for the comparison
+		{Old: "", New: sent, Suppress: true},
+		{Old: sent, New: "{\n  \"storageAccountName\": \"acctsa\",\n  \"storageAccountKey\": \"s3cr3t\"\n}", Suppress: true},
+		{Old: sent, New: `{"storageAccountKey":"rotated","storageAccountName":"acctsa"}`, Suppress: false},
+		{Old: sent, New: "", Suppress: false},
+	}
+
+	for _, tc := range cases {
+		if actual := suppressDiffVirtualMachineExtensionSettings("protected_settings", tc.Old, tc.New, d); actual != tc.Suppress {
+			t.Fatalf("Expected the diff from %q to %q to be suppressed: %t, got %t", tc.Old, tc.New, tc.Suppress, actual)
+		}
+	}
+}
+
+func TestHashArmVirtualMachineExtensionProtectedSettings(t *testing.T) {
+	empty, err := hashArmVirtualMachineExtensionProtectedSettings("", "salt")
+	if err != nil || empty != "" {
+		t.Fatalf("Expected no hash without protected settings, got %q (%v)", empty, err)
+	}
+
+	compact, err := hashArmVirtualMachineExtensionProtectedSettings(`{"a":"1","b":"2"}`, "salt")
+	if err != nil {
+		t.Fatalf("Error hashing protected settings: %s", err)
+	}
+
+	reformatted, err := hashArmVirtualMachineExtensionProtectedSettings("{\n  \"b\": \"2\",\n  \"a\": \"1\"\n}", "salt")
+	if err != nil {
+		t.Fatalf("Error hashing protected settings: %s", err)
+	}
+	if compact != reformatted {
+		t.Fatalf("Expected reformatted protected settings to hash identically, got %q and %q", compact, reformatted)
+	}
+
+	changed, err := hashArmVirtualMachineExtensionProtectedSettings(`{"a":"1","b":"3"}`, "salt")
+	if err != nil {
+		t.Fatalf("Error hashing protected settings: %s", err)
+	}
+	if compact == changed {
+		t.Fatalf("Expected changed protected settings to hash differently")
+	}
+
+	salted, err := hashArmVirtualMachineExtensionProtectedSettings(`{"a":"1","b":"2"}`, "pepper")
+	if err != nil {
+		t.Fatalf("Error hashing protected settings: %s", err)
+	}
+	if compact == salted {
+		t.Fatalf("Expected protected settings hashed with another salt to hash differently")
+	}
+
+	if _, err := hashArmVirtualMachineExtensionProtectedSettings(`{"a":`, "salt"); err == nil {
+		t.Fatalf("Expected an error hashing invalid JSON")
+	}
+}
+
+func TestFlattenArmVirtualMachineExtensionSettingsForState_pretty(t *testing.T) {
+	config := `{"fileUris":["https://example.com/script.sh"],"commandToExecute":"sh script.sh","port":8080}`
+	settings, err := expandArmVirtualMachineExtensionSettings(config)
+	if err != nil {
+		t.Fatalf("Error expanding settings: %s", err)
+	}
+
+	compact, err := flattenArmVirtualMachineExtensionSettingsForState(settings, false)
+	if err != nil {
+		t.Fatalf("Error flattening settings: %s", err)
+	}
+	if strings.Contains(compact, "\n") {
+		t.Fatalf("Expected compact settings, got %s", compact)
+	}
+
+	pretty, err := flattenArmVirtualMachineExtensionSettingsForState(settings, true)
+	if err != nil {
+		t.Fatalf("Error flattening settings: %s", err)
+	}
+	if !strings.Contains(pretty, "\n  \"commandToExecute\": \"sh script.sh\"") {
+		t.Fatalf("Expected settings indented with 2 spaces, got %s", pretty)
+	}
+
+	// the indented state mustn't cause a diff against the configuration
+	if !suppressDiffVirtualMachineExtensionSettings("settings", pretty, config, nil) {
+		t.Fatalf("Expected no diff between the indented state and the configuration")
+	}
+	if !suppressDiffVirtualMachineExtensionSettings("settings", pretty, compact, nil) {
+		t.Fatalf("Expected no diff between indented and compact settings")
+	}
+}
+
+func TestSuppressDiffVirtualMachineExtensionSettings_caseInsensitiveKeys(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceArmVirtualMachineExtensions().Schema, map[string]interface{}{
+		"case_insensitive_settings_keys": []interface{}{"commandToExecute", "fileUris"},
+	})
+
+	config := `{"commandToExecute":"hostname","fileUris":["https://example.com/a.sh"],"nested":{"CommandToExecute":"x"}}`
+
+	cases := []struct {
+		Returned string
+		Suppress bool
+	}{
+		{Returned: `{"commandtoexecute":"hostname","FILEURIS":["https://example.com/a.sh"],"nested":{"commandToExecute":"x"}}`, Suppress: true},
+		{Returned: `{"CommandToExecute":"hostname","fileUris":["https://example.com/a.sh"],"nested":{"COMMANDTOEXECUTE":"x"}}`, Suppress: true},
+		// the values are still compared case-sensitively
+		{Returned: `{"commandtoexecute":"HOSTNAME","fileUris":["https://example.com/a.sh"],"nested":{"CommandToExecute":"x"}}`, Suppress: false},
+		// keys which aren't listed are still compared case-sensitively
+		{Returned: `{"commandToExecute":"hostname","fileUris":["https://example.com/a.sh"],"Nested":{"CommandToExecute":"x"}}`, Suppress: false},
+	}
+
+	for i, tc := range cases {
+		if actual := suppressDiffVirtualMachineExtensionSettings("settings", tc.Returned, config, d); actual != tc.Suppress {
+			t.Fatalf("Case %d: Expected suppress to be %t, got %t", i, tc.Suppress, actual)
+		}
+	}
+
+	// without the option, differently cased keys are a diff
+	empty := schema.TestResourceDataRaw(t, resourceArmVirtualMachineExtensions().Schema, map[string]interface{}{})
+	if suppressDiffVirtualMachineExtensionSettings("settings", cases[0].Returned, config, empty) {
+		t.Fatalf("Expected differently cased keys to be a diff without case_insensitive_settings_keys")
+	}
+}
+
+func TestSuppressDiffVirtualMachineExtensionSettings_ignoreKeys(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceArmVirtualMachineExtensions().Schema, map[string]interface{}{
+		"settings_ignore_keys": []interface{}{"authentication", "workspace.region"},
+	})
+
+	config := `{"workspaceId":"abc","workspace":{"name":"ws"}}`
+
+	cases := []struct {
+		Returned string
+		Suppress bool
+	}{
+		// the configured settings are a subset of those returned
+		{Returned: `{"workspaceId":"abc","workspace":{"name":"ws","region":"westus"},"authentication":{"managedIdentity":{}}}`, Suppress: true},
+		{Returned: `{"workspaceId":"abc","workspace":{"name":"ws"},"authentication":"none"}`, Suppress: true},
+		// a configured key which changed is still a diff
+		{Returned: `{"workspaceId":"def","workspace":{"name":"ws","region":"westus"},"authentication":{}}`, Suppress: false},
+		{Returned: `{"workspaceId":"abc","workspace":{"name":"other","region":"westus"}}`, Suppress: false},
+		// keys which aren't listed are still compared
+		{Returned: `{"workspaceId":"abc","workspace":{"name":"ws"},"stopOnMultipleConnections":true}`, Suppress: false},
+	}
+
+	for i, tc := range cases {
+		if actual := suppressDiffVirtualMachineExtensionSettings("settings", tc.Returned, config, d); actual != tc.Suppress {
+			t.Fatalf("Case %d: Expected suppress to be %t, got %t", i, tc.Suppress, actual)
+		}
+	}
+
+	// an ignored key which is configured is compared
+	configured := `{"workspaceId":"abc","workspace":{"name":"ws","region":"eastus"}}`
+	if suppressDiffVirtualMachineExtensionSettings("settings", cases[0].Returned, configured, d) {
+		t.Fatalf("Expected a configured ignored key which changed to be a diff")
+	}
+
+	// without the option, the keys added by the handler are a diff
+	empty := schema.TestResourceDataRaw(t, resourceArmVirtualMachineExtensions().Schema, map[string]interface{}{})
+	if suppressDiffVirtualMachineExtensionSettings("settings", cases[0].Returned, config, empty) {
+		t.Fatalf("Expected the added keys to be a diff without settings_ignore_keys")
+	}
+}
+
+func TestSuppressDiffVirtualMachineExtensionSettings_normalizeStringWhitespace(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceArmVirtualMachineExtensions().Schema, map[string]interface{}{
+		"normalize_string_whitespace": true,
+	})
+
+	config := `{"commandToExecute":"sh install.sh --x","fileUris":["a b.sh"]}`
+
+	cases := []struct {
+		Returned string
+		Suppress bool
+	}{
+		{Returned: `{"commandToExecute":"sh  install.sh   --x","fileUris":["a b.sh"]}`, Suppress: true},
+		{Returned: `{"commandToExecute":"sh\tinstall.sh \n --x","fileUris":["a  b.sh"]}`, Suppress: true},
+		// whitespace is collapsed, not removed
+		{Returned: `{"commandToExecute":"shinstall.sh --x","fileUris":["a b.sh"]}`, Suppress: false},
+		// the keys aren't normalized
+		{Returned: `{"commandToExecute ":"sh install.sh --x","fileUris":["a b.sh"]}`, Suppress: false},
+	}
+
+	for i, tc := range cases {
+		if actual := suppressDiffVirtualMachineExtensionSettings("settings", tc.Returned, config, d); actual != tc.Suppress {
+			t.Fatalf("Case %d: Expected suppress to be %t, got %t", i, tc.Suppress, actual)
+		}
+	}
+
+	// without the option, the whitespace is significant
+	empty := schema.TestResourceDataRaw(t, resourceArmVirtualMachineExtensions().Schema, map[string]interface{}{})
+	if suppressDiffVirtualMachineExtensionSettings("settings", cases[0].Returned, config, empty) {
+		t.Fatalf("Expected differing whitespace to be a diff without normalize_string_whitespace")
+	}
+}
+
+func TestSuppressDiffVirtualMachineExtensionSettings_unorderedArrays(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceArmVirtualMachineExtensions().Schema, map[string]interface{}{
+		"unordered_settings_array_keys": []interface{}{
+			map[string]interface{}{"key": "sinks", "sort_by": "name"},
+			map[string]interface{}{"key": "fileUris"},
+		},
+	})
+
+	config := `{"sinks":[{"name":"b","type":"blob"},{"name":"a","type":"table"}],"fileUris":["z.sh","a.sh"],"ordered":[2,1]}`
+
+	cases := []struct {
+		Returned string
+		Suppress bool
+	}{
+		// Azure returns the arrays sorted
+		{Returned: `{"sinks":[{"name":"a","type":"table"},{"name":"b","type":"blob"}],"fileUris":["a.sh","z.sh"],"ordered":[2,1]}`, Suppress: true},
+		{Returned: config, Suppress: true},
+		// arrays which aren't listed are still order-sensitive
+		{Returned: `{"sinks":[{"name":"a","type":"table"},{"name":"b","type":"blob"}],"fileUris":["a.sh","z.sh"],"ordered":[1,2]}`, Suppress: false},
+		// the elements are still compared
+		{Returned: `{"sinks":[{"name":"a","type":"blob"},{"name":"b","type":"blob"}],"fileUris":["a.sh","z.sh"],"ordered":[2,1]}`, Suppress: false},
+		{Returned: `{"sinks":[{"name":"a","type":"table"}],"fileUris":["a.sh","z.sh"],"ordered":[2,1]}`, Suppress: false},
+	}
+
+	for i, tc := range cases {
+		if actual := suppressDiffVirtualMachineExtensionSettings("settings", tc.Returned, config, d); actual != tc.Suppress {
+			t.Fatalf("Case %d: Expected suppress to be %t, got %t", i, tc.Suppress, actual)
+		}
+	}
+}
+
+func TestSuppressDiffVirtualMachineExtensionSettings_defaultUnorderedArrays(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceArmVirtualMachineExtensions().Schema, map[string]interface{}{
+		"publisher": "Microsoft.Azure.Extensions",
+		"type":      "CustomScript",
+	})
+
+	config := `{"commandToExecute":"sh b.sh && sh a.sh","fileUris":["https://example.com/b.sh","https://example.com/a.sh"]}`
+
+	cases := []struct {
+		Returned string
+		Suppress bool
+	}{
+		{Returned: `{"commandToExecute":"sh b.sh && sh a.sh","fileUris":["https://example.com/a.sh","https://example.com/b.sh"]}`, Suppress: true},
+		// the command is still compared as-is
+		{Returned: `{"commandToExecute":"sh a.sh && sh b.sh","fileUris":["https://example.com/a.sh","https://example.com/b.sh"]}`, Suppress: false},
+		{Returned: `{"commandToExecute":"sh b.sh && sh a.sh","fileUris":["https://example.com/a.sh"]}`, Suppress: false},
+	}
+
+	for i, tc := range cases {
+		if actual := suppressDiffVirtualMachineExtensionSettings("settings", tc.Returned, config, d); actual != tc.Suppress {
+			t.Fatalf("Case %d: Expected suppress to be %t, got %t", i, tc.Suppress, actual)
+		}
+	}
+
+	// other extension types keep the order of `fileUris`
+	other := schema.TestResourceDataRaw(t, resourceArmVirtualMachineExtensions().Schema, map[string]interface{}{
+		"publisher": "Contoso",
+		"type":      "Deployer",
+	})
+	if suppressDiffVirtualMachineExtensionSettings("settings", cases[0].Returned, config, other) {
+		t.Fatalf("Expected reordered fileUris to be a diff for other extension types")
+	}
+}
+
+func TestHashArmVirtualMachineExtensionSettings(t *testing.T) {
+	applied, err := hashArmVirtualMachineExtensionSettings(&map[string]interface{}{"port": float64(8080), "a": "b"})
+	if err != nil {
+		t.Fatalf("Error hashing settings: %s", err)
+	}
+
+	// the number representation doesn't matter
+	same, err := hashArmVirtualMachineExtensionSettings(&map[string]interface{}{"a": "b", "port": json.Number("8080")})
+	if err != nil {
+		t.Fatalf("Error hashing settings: %s", err)
+	}
+	if applied != same {
+		t.Fatalf("Expected semantically equal settings to hash identically")
+	}
+
+	drifted, err := hashArmVirtualMachineExtensionSettings(&map[string]interface{}{"port": float64(8081), "a": "b"})
+	if err != nil {
+		t.Fatalf("Error hashing settings: %s", err)
+	}
+	if applied == drifted {
+		t.Fatalf("Expected changed settings to hash differently")
+	}
+
+	none, err := hashArmVirtualMachineExtensionSettings(nil)
+	if err != nil || none == "" || none == applied {
+		t.Fatalf("Expected a distinct hash without settings, got %q (%v)", none, err)
+	}
+}
+
+func TestArmVirtualMachineExtensionSettingsForState_canonicalOrder(t *testing.T) {
+	// the state holds the keys in the order they were configured, Azure
+	// returns the same settings with the keys in another order
+	current := `{"fileUris":["https://example.com/a.sh"],"commandToExecute":"sh a.sh","port":8080}`
+	returned := map[string]interface{}{
+		"port":             float64(8080),
+		"commandToExecute": "sh a.sh",
+		"fileUris":         []interface{}{"https://example.com/a.sh"},
+	}
+	canonical := `{"commandToExecute":"sh a.sh","fileUris":["https://example.com/a.sh"],"port":8080}`
+
+	state := current
+	for i := 0; i < 2; i++ {
+		var err error
+		state, err = armVirtualMachineExtensionSettingsForState(state, returned, false, false, nil)
+		if err != nil {
+			t.Fatalf("Error flattening settings: %s", err)
+		}
+		if state != canonical {
+			t.Fatalf("Refresh %d: Expected the state to converge to %s, got %s", i+1, canonical, state)
+		}
+	}
+
+	if !suppressDiffVirtualMachineExtensionSettings("settings", state, current, nil) {
+		t.Fatalf("Expected no diff between the canonical state and the configuration")
+	}
+}
+
+func TestArmVirtualMachineExtensionSettingsForState_envTemplate(t *testing.T) {
+	os.Setenv("ARM_TEST_SETTINGS_COMMAND", "hostname")
+	defer os.Unsetenv("ARM_TEST_SETTINGS_COMMAND")
+
+	template := `{"z":1,"commandToExecute":"${env:ARM_TEST_SETTINGS_COMMAND}"}`
+	returned := map[string]interface{}{"commandToExecute": "hostname", "z": float64(1)}
+
+	state, err := armVirtualMachineExtensionSettingsForState(template, returned, false, true, nil)
+	if err != nil {
+		t.Fatalf("Error flattening settings: %s", err)
+	}
+	if expected := `{"commandToExecute":"${env:ARM_TEST_SETTINGS_COMMAND}","z":1}`; state != expected {
+		t.Fatalf("Expected the canonical template %s, got %s", expected, state)
+	}
+
+	returned["commandToExecute"] = "uptime"
+	state, err = armVirtualMachineExtensionSettingsForState(template, returned, false, true, nil)
+	if err != nil {
+		t.Fatalf("Error flattening settings: %s", err)
+	}
+	if expected := `{"commandToExecute":"uptime","z":1}`; state != expected {
+		t.Fatalf("Expected the returned settings once they drift, got %s", state)
+	}
+}
+
 func TestAccAzureRMVirtualMachineExtension_basic(t *testing.T) {
 	ri := acctest.RandInt()
 	preConfig := fmt.Sprintf(testAccAzureRMVirtualMachineExtension_basic, ri, ri, ri, ri, ri, ri, ri, ri)
@@ -81,6 +1844,198 @@ func TestAccAzureRMVirtualMachineExtension_linuxDiagnostics(t *testing.T) {
 	})
 }
 
+func TestExpandArmVirtualMachineExtensionPatchSettings(t *testing.T) {
+	raw := map[string]interface{}{
+		"patch_settings": []interface{}{
+			map[string]interface{}{
+				"patch_mode":      "AutomaticByPlatform",
+				"assessment_mode": "ImageDefault",
+			},
+		},
+	}
+	d := schema.TestResourceDataRaw(t, resourceArmVirtualMachineExtensions().Schema, raw)
+
+	expected := map[string]interface{}{
+		"patchMode":      "AutomaticByPlatform",
+		"assessmentMode": "ImageDefault",
+	}
+	actual := expandArmVirtualMachineExtensionPatchSettings(d)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, actual)
+	}
+}
+
+func TestFlattenArmVirtualMachineExtensionPatchSettings(t *testing.T) {
+	settings := map[string]interface{}{
+		"patchMode":     "Manual",
+		"rebootSetting": "Never",
+		"somethingElse": true,
+	}
+
+	expected := []interface{}{
+		map[string]interface{}{
+			"patch_mode":     "Manual",
+			"reboot_setting": "Never",
+		},
+	}
+	actual := flattenArmVirtualMachineExtensionPatchSettings(&settings)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, actual)
+	}
+}
+
+func TestArmVirtualMachineExtensionCustomScriptSettings(t *testing.T) {
+	raw := map[string]interface{}{
+		"custom_script_settings": []interface{}{
+			map[string]interface{}{
+				"command_to_execute":   "sh install.sh",
+				"file_uris":            []interface{}{"https://example.blob.core.windows.net/scripts/install.sh"},
+				"storage_account_name": "example",
+			},
+		},
+	}
+	d := schema.TestResourceDataRaw(t, resourceArmVirtualMachineExtensions().Schema, raw)
+
+	expected := map[string]interface{}{
+		"commandToExecute":   "sh install.sh",
+		"fileUris":           []interface{}{"https://example.blob.core.windows.net/scripts/install.sh"},
+		"storageAccountName": "example",
+	}
+	actual := expandArmVirtualMachineExtensionCustomScriptSettings(d)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, actual)
+	}
+
+	if flattened := flattenArmVirtualMachineExtensionCustomScriptSettings(&actual); !reflect.DeepEqual(flattened, raw["custom_script_settings"]) {
+		t.Fatalf("Expected %+v, got %+v", raw["custom_script_settings"], flattened)
+	}
+
+	if !isArmCustomScriptExtension("Microsoft.OSTCExtensions", "CustomScriptForLinux") || isArmCustomScriptExtension("Microsoft.Compute", "BGInfo") {
+		t.Fatalf("Expected only the Custom Script extensions to accept `custom_script_settings`")
+	}
+}
+
+func TestArmVirtualMachineExtensionSettings_largeNumbers(t *testing.T) {
+	cases := []string{
+		`{"timestamp":10000000000123456789}`,
+		`{"nested":{"id":9007199254740993},"values":[1,2.5,10000000000]}`,
+	}
+
+	for _, input := range cases {
+		settings, err := expandArmVirtualMachineExtensionSettings(input)
+		if err != nil {
+			t.Fatalf("Unexpected error expanding %q: %s", input, err)
+		}
+
+		output, err := flattenArmVirtualMachineExtensionSettings(settings)
+		if err != nil {
+			t.Fatalf("Unexpected error flattening %q: %s", input, err)
+		}
+
+		if output != input {
+			t.Fatalf("Expected %q to round-trip exactly, got %q", input, output)
+		}
+	}
+}
+
+func TestExpandArmVirtualMachineExtensionSettings_invalid(t *testing.T) {
+	cases := []string{
+		``,
+		`{"a":1`,
+		`{"a":1} {"b":2}`,
+		`[1,2]`,
+	}
+
+	for _, input := range cases {
+		if _, err := expandArmVirtualMachineExtensionSettings(input); err == nil {
+			t.Fatalf("Expected %q to fail to expand", input)
+		}
+	}
+}
+
+func TestSuppressDiffVirtualMachineExtensionSettings_numbers(t *testing.T) {
+	cases := []struct {
+		Old      string
+		New      string
+		Suppress bool
+	}{
+		{
+			Old:      `{"port":8080}`,
+			New:      `{"port": 8080.0}`,
+			Suppress: true,
+		},
+		{
+			Old:      `{"limit":10000000000}`,
+			New:      `{"limit":1e+10}`,
+			Suppress: true,
+		},
+		{
+			Old:      `{"port":8080}`,
+			New:      `{"port":8081}`,
+			Suppress: false,
+		},
+		{
+			Old:      `{"ratio":0.1,"offset":0}`,
+			New:      `{"offset": -0, "ratio": 1e-1}`,
+			Suppress: true,
+		},
+		{
+			Old:      `{"ratio":0.1}`,
+			New:      `{"ratio":0.10000001}`,
+			Suppress: false,
+		},
+		// integers beyond the precision of a float64 are compared exactly
+		{
+			Old:      `{"id":9007199254740993}`,
+			New:      `{"id":9007199254740992}`,
+			Suppress: false,
+		},
+		{
+			Old:      `{"id":9007199254740993}`,
+			New:      `{"id": 9007199254740993.0}`,
+			Suppress: true,
+		},
+		{
+			Old:      `{"ids":[12345678901234567890123]}`,
+			New:      `{"ids":[1.2345678901234567890123e22]}`,
+			Suppress: true,
+		},
+		{
+			Old:      `{"sinks":{"azureMonitor":{"enabled":true,"retention":30,"weights":[1,2.5]}}}`,
+			New:      "{\n  \"sinks\": {\n    \"azureMonitor\": {\"weights\": [1.0, 2.50], \"enabled\": true, \"retention\": 30.0}\n  }\n}",
+			Suppress: true,
+		},
+		{
+			Old:      `{"sinks":{"azureMonitor":{"weights":[1,2.5]}}}`,
+			New:      `{"sinks":{"azureMonitor":{"weights":[2.5,1]}}}`,
+			Suppress: false,
+		},
+		{
+			Old:      `{"enabled":false}`,
+			New:      `{"enabled":true}`,
+			Suppress: false,
+		},
+		// a string is a different value to the extension than a boolean or
+		// number, so these aren't coerced
+		{
+			Old:      `{"enabled":true,"port":8080}`,
+			New:      `{"enabled":"true","port":8080}`,
+			Suppress: false,
+		},
+		{
+			Old:      `{"port":8080}`,
+			New:      `{"port":"8080"}`,
+			Suppress: false,
+		},
+	}
+
+	for _, tc := range cases {
+		if actual := suppressDiffVirtualMachineExtensionSettings("settings", tc.Old, tc.New, nil); actual != tc.Suppress {
+			t.Fatalf("Expected suppressing %q vs %q to be %t, got %t", tc.Old, tc.New, tc.Suppress, actual)
+		}
+	}
+}
+
 func testCheckAzureRMVirtualMachineExtensionExists(name string) resource.TestCheckFunc {
 	return func(s *terraform.State) error {
 		// Ensure we have enough information in state to look up in API
@@ -559,3 +2514,203 @@ SETTINGS
 	}
 }
 `
+
+func TestResourceArmVirtualMachineExtensions_virtualMachineID(t *testing.T) {
+	var put string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "PUT" && strings.Contains(r.URL.Path, "/extensions/"):
+			put = r.URL.Path
+			fmt.Fprint(w, `{"name":"hostname","properties":{"provisioningState":"Succeeded"}}`)
+		case strings.Contains(r.URL.Path, "/extensions/"):
+			fmt.Fprint(w, `{"id":"/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/hostname","name":"hostname","location":"westus","properties":{"publisher":"Microsoft.OSTCExtensions","type":"CustomScriptForLinux","typeHandlerVersion":"1.2","settings":{"commandToExecute":"hostname"},"provisioningState":"Succeeded"}}`)
+		default:
+			fmt.Fprint(w, `{"name":"acctvm","properties":{}}`)
+		}
+	}))
+	defer server.Close()
+
+	vmID := "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm"
+	raw, err := config.NewRawConfig(map[string]interface{}{
+		"name":                 "hostname",
+		"location":             "westus",
+		"virtual_machine_id":   vmID,
+		"publisher":            "Microsoft.OSTCExtensions",
+		"type":                 "CustomScriptForLinux",
+		"type_handler_version": "1.2",
+		"settings":             `{"commandToExecute": "hostname"}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resource := resourceArmVirtualMachineExtensions()
+	diff, err := resource.Diff(nil, terraform.NewResourceConfig(raw))
+	if err != nil {
+		t.Fatalf("Error planning the Extension: %s", err)
+	}
+	state, err := resource.Apply(nil, diff, testArmClientWithBaseURI(server.URL))
+	if err != nil {
+		t.Fatalf("Error applying the Extension: %s", err)
+	}
+
+	if !strings.HasSuffix(put, "/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/hostname") {
+		t.Fatalf("Expected the Extension to be created on the Virtual Machine of `virtual_machine_id`, got %s", put)
+	}
+	if state.Attributes["resource_group_name"] != "acctestRG" || state.Attributes["virtual_machine_name"] != "acctvm" || state.Attributes["virtual_machine_id"] != vmID {
+		t.Fatalf("Expected the Virtual Machine to be read back, got %+v", state.Attributes)
+	}
+
+	// moving to the separate fields for the same Virtual Machine isn't a change
+	raw, err = config.NewRawConfig(map[string]interface{}{
+		"name":                 "hostname",
+		"location":             "westus",
+		"resource_group_name":  "acctestRG",
+		"virtual_machine_name": "acctvm",
+		"publisher":            "Microsoft.OSTCExtensions",
+		"type":                 "CustomScriptForLinux",
+		"type_handler_version": "1.2",
+		"settings":             `{"commandToExecute": "hostname"}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff, err = resource.Diff(state, terraform.NewResourceConfig(raw))
+	if err != nil {
+		t.Fatalf("Error planning the Extension: %s", err)
+	}
+	if diff != nil && !diff.Empty() {
+		t.Fatalf("Expected no diff, got %+v", diff.Attributes)
+	}
+}
+
+func TestResourceArmVirtualMachineExtensions_virtualMachineIDConflicts(t *testing.T) {
+	raw, err := config.NewRawConfig(map[string]interface{}{
+		"name":                 "hostname",
+		"location":             "westus",
+		"resource_group_name":  "acctestRG",
+		"virtual_machine_id":   "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm",
+		"publisher":            "Microsoft.OSTCExtensions",
+		"type":                 "CustomScriptForLinux",
+		"type_handler_version": "1.2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, errors := resourceArmVirtualMachineExtensions().Validate(terraform.NewResourceConfig(raw)); len(errors) == 0 {
+		t.Fatal("Expected `virtual_machine_id` to conflict with `resource_group_name`")
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionsCreate_readFailureKeepsID(t *testing.T) {
+	var created bool
+	var gets int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "PUT" && strings.Contains(r.URL.Path, "/extensions/"):
+			created = true
+			fmt.Fprint(w, `{"name":"hostname","properties":{"provisioningState":"Succeeded"}}`)
+		case strings.Contains(r.URL.Path, "/extensions/") && !created:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"code":"NotFound","message":"The Resource was not found."}}`)
+		case strings.Contains(r.URL.Path, "/extensions/"):
+			// the provisioning state is read once the Extension is created,
+			// after which Azure stops responding
+			if atomic.AddInt32(&gets, 1) > 1 {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error":{"code":"BadRequest","message":"The request failed."}}`)
+				return
+			}
+			fmt.Fprint(w, `{"name":"hostname","properties":{"provisioningState":"Succeeded"}}`)
+		default:
+			fmt.Fprint(w, `{"name":"acctvm","properties":{}}`)
+		}
+	}))
+	defer server.Close()
+
+	d := testArmResourceDataRaw(t, resourceArmVirtualMachineExtensions(), map[string]interface{}{
+		"name":                 "hostname",
+		"location":             "West US",
+		"resource_group_name":  "acctestRG",
+		"virtual_machine_name": "acctvm",
+		"publisher":            "Microsoft.OSTCExtensions",
+		"type":                 "CustomScriptForLinux",
+		"type_handler_version": "1.2",
+		"settings":             `{"commandToExecute": "hostname"}`,
+	})
+	d.MarkNewResource()
+
+	client := testArmClientWithBaseURI(server.URL)
+	client.subscriptionId = "00000000-0000-0000-0000-000000000000"
+	err := resourceArmVirtualMachineExtensionsCreate(d, client)
+	if err == nil || !strings.Contains(err.Error(), "reading it back failed") {
+		t.Fatalf("Expected reading the Extension back to fail, got %v", err)
+	}
+
+	expected := "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/hostname"
+	if d.Id() != expected {
+		t.Fatalf("Expected the ID of the created Extension to be kept, got %q", d.Id())
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionsUpdate_autoUpgradeMinorVersionOmitted(t *testing.T) {
+	var sent []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "PUT" && strings.Contains(r.URL.Path, "/extensions/"):
+			body, _ := ioutil.ReadAll(r.Body)
+			sent = append(sent, string(body))
+			fmt.Fprint(w, `{"name":"hostname","properties":{"provisioningState":"Succeeded"}}`)
+		case strings.Contains(r.URL.Path, "/extensions/"):
+			fmt.Fprint(w, `{"id":"/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/hostname","name":"hostname","location":"westus","properties":{"publisher":"Microsoft.OSTCExtensions","type":"CustomScriptForLinux","typeHandlerVersion":"1.2","autoUpgradeMinorVersion":true,"settings":{"commandToExecute":"hostname"},"provisioningState":"Succeeded"}}`)
+		default:
+			fmt.Fprint(w, `{"name":"acctvm","properties":{}}`)
+		}
+	}))
+	defer server.Close()
+
+	// as imported, from an Extension Azure has with the minor version upgrades enabled
+	client := testArmClientWithBaseURI(server.URL)
+	resource := resourceArmVirtualMachineExtensions()
+	state, err := resource.Refresh(&terraform.InstanceState{
+		ID: "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/hostname",
+	}, client)
+	if err != nil {
+		t.Fatalf("Error refreshing the Extension: %s", err)
+	}
+
+	raw, err := config.NewRawConfig(map[string]interface{}{
+		"name":                 "hostname",
+		"location":             "westus",
+		"resource_group_name":  "acctestRG",
+		"virtual_machine_name": "acctvm",
+		"publisher":            "Microsoft.OSTCExtensions",
+		"type":                 "CustomScriptForLinux",
+		"type_handler_version": "1.2",
+		"settings":             `{"commandToExecute": "uptime"}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff, err := resource.Diff(state, terraform.NewResourceConfig(raw))
+	if err != nil {
+		t.Fatalf("Error planning the Extension: %s", err)
+	}
+	if attr, ok := diff.Attributes["auto_upgrade_minor_version"]; ok {
+		t.Fatalf("Expected no diff of `auto_upgrade_minor_version`, got %+v", attr)
+	}
+	if _, err := resource.Apply(state, diff, client); err != nil {
+		t.Fatalf("Error applying the Extension: %s", err)
+	}
+
+	if len(sent) != 1 || !strings.Contains(sent[0], `"autoUpgradeMinorVersion":true`) {
+		t.Fatalf("Expected the update to keep `autoUpgradeMinorVersion` enabled, got %v", sent)
+	}
+}
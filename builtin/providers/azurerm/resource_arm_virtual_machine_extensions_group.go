@@ -0,0 +1,298 @@
+package azurerm
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/hashicorp/terraform/helper/resource"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// resourceArmVirtualMachineExtensionsGroup manages several Virtual Machine
+// Extensions on a Virtual Machine as a unit, creating or updating them one at
+// a time (in the order configured) since Azure rejects concurrent operations
+// on the extensions of a Virtual Machine.
+func resourceArmVirtualMachineExtensionsGroup() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceArmVirtualMachineExtensionsGroupCreateUpdate,
+		Read:   resourceArmVirtualMachineExtensionsGroupRead,
+		Update: resourceArmVirtualMachineExtensionsGroupCreateUpdate,
+		Delete: resourceArmVirtualMachineExtensionsGroupDelete,
+
+		Timeouts: &schema.ResourceTimeout{
+			Create: schema.DefaultTimeout(60 * time.Minute),
+			Update: schema.DefaultTimeout(60 * time.Minute),
+		},
+
+		Schema: map[string]*schema.Schema{
+			"location": locationSchema(),
+
+			"resource_group_name": {
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+
+			"virtual_machine_name": {
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+
+			"extension": {
+				Type:     schema.TypeList,
+				Required: true,
+				MinItems: 1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"name": {
+							Type:         schema.TypeString,
+							Required:     true,
+							ValidateFunc: validateArmVirtualMachineExtensionName,
+						},
+
+						"publisher": {
+							Type:     schema.TypeString,
+							Required: true,
+						},
+
+						"type": {
+							Type:     schema.TypeString,
+							Required: true,
+						},
+
+						"type_handler_version": {
+							Type:     schema.TypeString,
+							Required: true,
+						},
+
+						"auto_upgrade_minor_version": {
+							Type:     schema.TypeBool,
+							Optional: true,
+						},
+
+						"settings": {
+							Type:             schema.TypeString,
+							Optional:         true,
+							ValidateFunc:     validateArmVirtualMachineExtensionPlaintextSettings,
+							DiffSuppressFunc: suppressDiffVirtualMachineExtensionSettings,
+						},
+
+						"protected_settings": {
+							Type:             schema.TypeString,
+							Optional:         true,
+							Sensitive:        true,
+							ValidateFunc:     validateArmVirtualMachineExtensionSettingsObject,
+							DiffSuppressFunc: suppressDiffVirtualMachineExtensionSettings,
+						},
+					},
+				},
+			},
+
+			// the provisioning state of each Extension, keyed by name
+			"results": {
+				Type:     schema.TypeMap,
+				Computed: true,
+			},
+		},
+	}
+}
+
+func resourceArmVirtualMachineExtensionsGroupCreateUpdate(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*ArmClient)
+
+	location := d.Get("location").(string)
+	resGroup := d.Get("resource_group_name").(string)
+	vmName := d.Get("virtual_machine_name").(string)
+
+	timeout := d.Timeout(schema.TimeoutCreate)
+	if !d.IsNewResource() {
+		timeout = d.Timeout(schema.TimeoutUpdate)
+	}
+	deadline := time.Now().Add(timeout)
+
+	// all of the Extensions are expanded first, so that invalid settings fail
+	// before anything is sent
+	oldExtensions, newExtensions := d.GetChange("extension")
+	previous := armVirtualMachineExtensionsGroupByName(oldExtensions.([]interface{}))
+	extensions := make([]compute.VirtualMachineExtension, 0)
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, v := range newExtensions.([]interface{}) {
+		raw := v.(map[string]interface{})
+		name := raw["name"].(string)
+		if seen[name] {
+			return fmt.Errorf("The Extension %q is specified more than once", name)
+		}
+		seen[name] = true
+
+		extension, err := expandArmVirtualMachineExtensionsGroupExtension(location, raw)
+		if err != nil {
+			return fmt.Errorf("Extension %q: %s", name, err)
+		}
+		extensions = append(extensions, extension)
+		names = append(names, name)
+	}
+
+	// the Extensions created so far are removed when the resource is
+	// destroyed, even when the create fails
+	if d.IsNewResource() {
+		d.SetId(resource.UniqueId())
+	}
+
+	// Extensions which are unchanged aren't sent again, which would run their
+	// extension handler again
+	for i, extension := range extensions {
+		name := names[i]
+		if old, ok := previous[name]; ok && reflect.DeepEqual(old, newExtensions.([]interface{})[i]) {
+			log.Printf("[DEBUG] Virtual Machine Extension %q on %q is unchanged", name, vmName)
+			continue
+		}
+
+		log.Printf("[DEBUG] Creating or updating Virtual Machine Extension %q (%d of %d) on %q", name, i+1, len(extensions), vmName)
+		cancel := make(chan struct{})
+		timer := time.AfterFunc(time.Until(deadline), func() { close(cancel) })
+		err := createArmVirtualMachineExtension(client, resGroup, vmName, name, extension, nil, false, guestAgentReadyTimeout, deadline, cancel)
+		timer.Stop()
+		if err == nil {
+			err = waitForArmVirtualMachineExtensionProvisioned(client, resGroup, vmName, name, time.Until(deadline), cancel)
+		}
+		if err != nil {
+			// the state keeps the previous Extensions, so that those which
+			// weren't applied aren't considered unchanged next time
+			if !d.IsNewResource() {
+				d.Partial(true)
+			}
+			return fmt.Errorf("Error creating or updating Virtual Machine Extension %q (%d of %d) on %q, the remaining Extensions weren't applied: %s", name, i+1, len(extensions), vmName, err)
+		}
+	}
+
+	// Extensions removed from the group are deleted once the others are applied
+	removed := make([]string, 0)
+	for name := range previous {
+		if !seen[name] {
+			removed = append(removed, name)
+		}
+	}
+	if len(removed) > 0 {
+		sort.Strings(removed)
+		if err := deleteArmVirtualMachineExtensionsGroupExtensions(client, resGroup, vmName, removed); err != nil {
+			return err
+		}
+	}
+
+	return resourceArmVirtualMachineExtensionsGroupRead(d, meta)
+}
+
+func resourceArmVirtualMachineExtensionsGroupRead(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*ArmClient).vmExtensionClient
+	resGroup := d.Get("resource_group_name").(string)
+	vmName := d.Get("virtual_machine_name").(string)
+
+	// the Extensions which no longer exist are dropped from the state, so
+	// that the next plan recreates them
+	found := make([]interface{}, 0)
+	results := make(map[string]interface{})
+	for _, v := range d.Get("extension").([]interface{}) {
+		name := v.(map[string]interface{})["name"].(string)
+		resp, err := client.Get(resGroup, vmName, name, "")
+		if err != nil {
+			if resp.StatusCode == http.StatusNotFound {
+				log.Printf("[DEBUG] Virtual Machine Extension %q of the group on %q no longer exists - removing it from state", name, vmName)
+				results[name] = "NotFound"
+				continue
+			}
+			return fmt.Errorf("Error making Read request on Virtual Machine Extension %s: %s", name, err)
+		}
+
+		found = append(found, v)
+		state := "Unknown"
+		if props := resp.VirtualMachineExtensionProperties; props != nil && props.ProvisioningState != nil {
+			state = *props.ProvisioningState
+		}
+		results[name] = state
+	}
+
+	if len(found) == 0 {
+		log.Printf("[DEBUG] None of the Virtual Machine Extensions of the group on %q exist - removing from state", vmName)
+		d.SetId("")
+		return nil
+	}
+
+	if err := d.Set("extension", found); err != nil {
+		return fmt.Errorf("Error setting `extension`: %+v", err)
+	}
+	d.Set("results", results)
+
+	return nil
+}
+
+func resourceArmVirtualMachineExtensionsGroupDelete(d *schema.ResourceData, meta interface{}) error {
+	names := make([]string, 0)
+	for _, v := range d.Get("extension").([]interface{}) {
+		names = append(names, v.(map[string]interface{})["name"].(string))
+	}
+
+	return deleteArmVirtualMachineExtensionsGroupExtensions(meta.(*ArmClient), d.Get("resource_group_name").(string), d.Get("virtual_machine_name").(string), names)
+}
+
+// armVirtualMachineExtensionsGroupByName returns the `extension` blocks keyed
+// by their name.
+func armVirtualMachineExtensionsGroupByName(extensions []interface{}) map[string]interface{} {
+	byName := make(map[string]interface{}, len(extensions))
+	for _, v := range extensions {
+		byName[v.(map[string]interface{})["name"].(string)] = v
+	}
+	return byName
+}
+
+func expandArmVirtualMachineExtensionsGroupExtension(location string, raw map[string]interface{}) (compute.VirtualMachineExtension, error) {
+	publisher := raw["publisher"].(string)
+	extensionType := raw["type"].(string)
+	typeHandlerVersion := raw["type_handler_version"].(string)
+	autoUpgradeMinor := raw["auto_upgrade_minor_version"].(bool)
+
+	extension := compute.VirtualMachineExtension{
+		Location: &location,
+		VirtualMachineExtensionProperties: &compute.VirtualMachineExtensionProperties{
+			Publisher:               &publisher,
+			Type:                    &extensionType,
+			TypeHandlerVersion:      &typeHandlerVersion,
+			AutoUpgradeMinorVersion: &autoUpgradeMinor,
+		},
+	}
+
+	if settingsString := raw["settings"].(string); settingsString != "" {
+		settings, err := expandArmVirtualMachineExtensionSettings(settingsString)
+		if err != nil {
+			return extension, fmt.Errorf("unable to parse settings: %s", err)
+		}
+		extension.VirtualMachineExtensionProperties.Settings = &settings
+	}
+
+	if protectedSettingsString := raw["protected_settings"].(string); protectedSettingsString != "" {
+		protectedSettings, err := expandArmVirtualMachineExtensionSettings(protectedSettingsString)
+		if err != nil {
+			return extension, fmt.Errorf("unable to parse protected_settings: %s", err)
+		}
+		extension.VirtualMachineExtensionProperties.ProtectedSettings = &protectedSettings
+	}
+
+	return extension, nil
+}
+
+// deleteArmVirtualMachineExtensionsGroupExtensions deletes the extensions one
+// at a time, holding the Virtual Machine's lock so that they don't conflict
+// with other extension operations on it.
+func deleteArmVirtualMachineExtensionsGroupExtensions(client *ArmClient, resGroup, vmName string, names []string) error {
+	lockKey := armVirtualMachineExtensionsLockKey(resGroup, vmName)
+	armMutexKV.Lock(lockKey)
+	defer armMutexKV.Unlock(lockKey)
+
+	return deleteArmVirtualMachineExtensionSetExtensions(client, resGroup, vmName, names)
+}
@@ -0,0 +1,129 @@
+package azurerm
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/terraform/config"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestResourceArmVirtualMachineExtensionsGroup(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	existing := make(map[string]bool)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		name := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		switch r.Method {
+		case "PUT":
+			requests = append(requests, "PUT "+name)
+			existing[name] = true
+			fmt.Fprintf(w, `{"name":%q,"properties":{"provisioningState":"Succeeded"}}`, name)
+		case "DELETE":
+			requests = append(requests, "DELETE "+name)
+			delete(existing, name)
+			w.WriteHeader(http.StatusOK)
+		default:
+			if !existing[name] {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"error":{"code":"NotFound","message":"The Resource was not found."}}`)
+				return
+			}
+			fmt.Fprintf(w, `{"name":%q,"properties":{"provisioningState":"Succeeded"}}`, name)
+		}
+	}))
+	defer server.Close()
+
+	client := testArmClientWithBaseURI(server.URL)
+	resource := resourceArmVirtualMachineExtensionsGroup()
+
+	extension := func(name, command string) map[string]interface{} {
+		return map[string]interface{}{
+			"name":                 name,
+			"publisher":            "Microsoft.Azure.Extensions",
+			"type":                 "CustomScript",
+			"type_handler_version": "2.0",
+			"settings":             fmt.Sprintf(`{"commandToExecute": %q}`, command),
+		}
+	}
+	apply := func(state *terraform.InstanceState, extensions ...map[string]interface{}) *terraform.InstanceState {
+		blocks := make([]interface{}, 0)
+		for _, e := range extensions {
+			blocks = append(blocks, e)
+		}
+		raw, err := config.NewRawConfig(map[string]interface{}{
+			"location":             "westus",
+			"resource_group_name":  "acctestRG",
+			"virtual_machine_name": "acctvm",
+			"extension":            blocks,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		diff, err := resource.Diff(state, terraform.NewResourceConfig(raw))
+		if err != nil {
+			t.Fatalf("Error planning the group: %s", err)
+		}
+		requests = nil
+		state, err = resource.Apply(state, diff, client)
+		if err != nil {
+			t.Fatalf("Error applying the group: %s", err)
+		}
+		return state
+	}
+
+	state := apply(nil, extension("first", "hostname"), extension("second", "uptime"))
+	if expected := []string{"PUT first", "PUT second"}; !reflect.DeepEqual(requests, expected) {
+		t.Fatalf("Expected %v, got %v", expected, requests)
+	}
+	if state.Attributes["results.first"] != "Succeeded" || state.Attributes["results.second"] != "Succeeded" {
+		t.Fatalf("Expected the results to be read back, got %+v", state.Attributes)
+	}
+
+	// only the changed Extension is sent again
+	state = apply(state, extension("first", "hostname"), extension("second", "whoami"))
+	if expected := []string{"PUT second"}; !reflect.DeepEqual(requests, expected) {
+		t.Fatalf("Expected %v, got %v", expected, requests)
+	}
+
+	// an Extension deleted outside of Terraform is recreated
+	mu.Lock()
+	delete(existing, "first")
+	mu.Unlock()
+	state, err := resource.Refresh(state, client)
+	if err != nil {
+		t.Fatalf("Error refreshing the group: %s", err)
+	}
+	if state.Attributes["extension.#"] != "1" || state.Attributes["results.first"] != "NotFound" {
+		t.Fatalf("Expected the deleted Extension to be removed from the state, got %+v", state.Attributes)
+	}
+	state = apply(state, extension("first", "hostname"), extension("second", "whoami"))
+	if expected := []string{"PUT first"}; !reflect.DeepEqual(requests, expected) {
+		t.Fatalf("Expected %v, got %v", expected, requests)
+	}
+
+	// the Extensions are matched by name rather than position
+	state = apply(state, extension("second", "whoami"))
+	if expected := []string{"DELETE first"}; !reflect.DeepEqual(requests, expected) {
+		t.Fatalf("Expected %v, got %v", expected, requests)
+	}
+
+	requests = nil
+	if _, err := resource.Apply(state, &terraform.InstanceDiff{Destroy: true}, client); err != nil {
+		t.Fatalf("Error destroying the group: %s", err)
+	}
+	if expected := []string{"DELETE second"}; !reflect.DeepEqual(requests, expected) {
+		t.Fatalf("Expected %v, got %v", expected, requests)
+	}
+}
@@ -341,9 +341,12 @@ func resourceArmVirtualMachineScaleSet() *schema.Resource {
 				Set: resourceArmVirtualMachineScaleSetStorageProfileImageReferenceHash,
 			},
 
+			// computed, so that a Scale Set without extension blocks doesn't
+			// remove the Extensions of azurerm_virtual_machine_scale_set_extension
 			"extension": {
 				Type:     schema.TypeSet,
 				Optional: true,
+				Computed: true,
 				Elem: &schema.Resource{
 					Schema: map[string]*schema.Schema{
 						"name": {
@@ -457,6 +460,12 @@ func resourceArmVirtualMachineScaleSetCreate(d *schema.ResourceData, meta interf
 		Sku:      sku,
 		VirtualMachineScaleSetProperties: &scaleSetProps,
 	}
+
+	// taken by azurerm_virtual_machine_scale_set_extension too
+	lockKey := armVirtualMachineScaleSetLockKey(resGroup, name)
+	armMutexKV.Lock(lockKey)
+	defer armMutexKV.Unlock(lockKey)
+
 	_, vmErr := vmScaleSetClient.CreateOrUpdate(resGroup, name, scaleSetParams, make(chan struct{}))
 	if vmErr != nil {
 		return vmErr
@@ -566,6 +575,10 @@ func resourceArmVirtualMachineScaleSetDelete(d *schema.ResourceData, meta interf
 	resGroup := id.ResourceGroup
 	name := id.Path["virtualMachineScaleSets"]
 
+	lockKey := armVirtualMachineScaleSetLockKey(resGroup, name)
+	armMutexKV.Lock(lockKey)
+	defer armMutexKV.Unlock(lockKey)
+
 	_, err = vmScaleSetClient.Delete(resGroup, name, make(chan struct{}))
 
 	return err
@@ -0,0 +1,368 @@
+package azurerm
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// armVirtualMachineScaleSetExtensionAPIVersion is the API version the
+// Extensions of a Scale Set are changed with. The vendored SDK's API version
+// only allows changing them within the Scale Set's model, which would send
+// the other Extensions without their protected settings.
+const armVirtualMachineScaleSetExtensionAPIVersion = "2017-12-01"
+
+func resourceArmVirtualMachineScaleSetExtension() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceArmVirtualMachineScaleSetExtensionCreate,
+		Read:   resourceArmVirtualMachineScaleSetExtensionRead,
+		Update: resourceArmVirtualMachineScaleSetExtensionCreate,
+		Delete: resourceArmVirtualMachineScaleSetExtensionDelete,
+		Importer: &schema.ResourceImporter{
+			State: schema.ImportStatePassthrough,
+		},
+
+		Timeouts: &schema.ResourceTimeout{
+			Create: schema.DefaultTimeout(60 * time.Minute),
+			Update: schema.DefaultTimeout(60 * time.Minute),
+			Delete: schema.DefaultTimeout(30 * time.Minute),
+		},
+
+		Schema: map[string]*schema.Schema{
+			"name": {
+				Type:         schema.TypeString,
+				Required:     true,
+				ForceNew:     true,
+				ValidateFunc: validateArmVirtualMachineExtensionName,
+			},
+
+			"resource_group_name": {
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+
+			"virtual_machine_scale_set_name": {
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+
+			"publisher": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+
+			"type": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+
+			"type_handler_version": {
+				Type:         schema.TypeString,
+				Required:     true,
+				ValidateFunc: validateArmVirtualMachineExtensionTypeHandlerVersion,
+			},
+
+			"auto_upgrade_minor_version": {
+				Type:     schema.TypeBool,
+				Optional: true,
+			},
+
+			"settings": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				ValidateFunc:     validateArmVirtualMachineExtensionSettingsObject,
+				DiffSuppressFunc: suppressDiffVirtualMachineExtensionSettings,
+			},
+
+			// due to the sensitive nature, these are not returned by the API
+			"protected_settings": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				Sensitive:        true,
+				ValidateFunc:     validateArmVirtualMachineExtensionSettingsObject,
+				DiffSuppressFunc: suppressDiffVirtualMachineExtensionSettings,
+			},
+
+			"provisioning_state": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+		},
+	}
+}
+
+func resourceArmVirtualMachineScaleSetExtensionCreate(d *schema.ResourceData, meta interface{}) error {
+	vmScaleSetClient := meta.(*ArmClient).vmScaleSetClient
+
+	name := d.Get("name").(string)
+	resGroup := d.Get("resource_group_name").(string)
+	vmScaleSetName := d.Get("virtual_machine_scale_set_name").(string)
+
+	extension, err := expandArmVirtualMachineScaleSetExtension(d)
+	if err != nil {
+		return err
+	}
+
+	timeout := d.Timeout(schema.TimeoutCreate)
+	if !d.IsNewResource() {
+		timeout = d.Timeout(schema.TimeoutUpdate)
+	}
+	cancel := make(chan struct{})
+	timer := time.AfterFunc(timeout, func() { close(cancel) })
+	defer timer.Stop()
+
+	lockKey := armVirtualMachineScaleSetLockKey(resGroup, vmScaleSetName)
+	armMutexKV.Lock(lockKey)
+	defer armMutexKV.Unlock(lockKey)
+
+	scaleSet, err := vmScaleSetClient.Get(resGroup, vmScaleSetName)
+	if err != nil {
+		return fmt.Errorf("Error making Read request on Virtual Machine Scale Set %q (resource group %q): %s", vmScaleSetName, resGroup, err)
+	}
+	if scaleSet.ID == nil {
+		return fmt.Errorf("Cannot read Virtual Machine Scale Set %q (resource group %q) ID", vmScaleSetName, resGroup)
+	}
+
+	// sent to the Extension itself rather than within the Scale Set's model, so
+	// that the other Extensions (whose protected settings aren't returned by
+	// the API) are left alone
+	log.Printf("[DEBUG] Creating Extension %q on Virtual Machine Scale Set %q", name, vmScaleSetName)
+	if err := createArmVirtualMachineScaleSetExtension(vmScaleSetClient, resGroup, vmScaleSetName, name, *extension, cancel); err != nil {
+		return fmt.Errorf("Error creating Extension %q on Virtual Machine Scale Set %q: %s", name, vmScaleSetName, err)
+	}
+
+	d.SetId(fmt.Sprintf("%s/extensions/%s", *scaleSet.ID, name))
+
+	return resourceArmVirtualMachineScaleSetExtensionRead(d, meta)
+}
+
+func resourceArmVirtualMachineScaleSetExtensionRead(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*ArmClient)
+
+	id, err := parseAzureResourceID(d.Id())
+	if err != nil {
+		return err
+	}
+	resGroup := id.ResourceGroup
+	vmScaleSetName := id.Path["virtualMachineScaleSets"]
+	name := id.Path["extensions"]
+
+	scaleSet, err := client.vmScaleSetClient.Get(resGroup, vmScaleSetName)
+	if err != nil {
+		if scaleSet.StatusCode == http.StatusNotFound {
+			log.Printf("[INFO] Virtual Machine Scale Set %q not found. Removing Extension %q from state", vmScaleSetName, name)
+			d.SetId("")
+			return nil
+		}
+		return fmt.Errorf("Error making Read request on Virtual Machine Scale Set %q (resource group %q): %s", vmScaleSetName, resGroup, err)
+	}
+
+	extension, _, exists := findArmVirtualMachineScaleSetExtensionByName(&scaleSet, name)
+	if !exists {
+		log.Printf("[INFO] Virtual Machine Scale Set Extension %q not found. Removing from state", name)
+		d.SetId("")
+		return nil
+	}
+
+	d.Set("name", extension.Name)
+	d.Set("resource_group_name", resGroup)
+	d.Set("virtual_machine_scale_set_name", vmScaleSetName)
+
+	props := extension.VirtualMachineScaleSetExtensionProperties
+	if props == nil {
+		return nil
+	}
+
+	d.Set("publisher", props.Publisher)
+	d.Set("type", props.Type)
+	d.Set("type_handler_version", props.TypeHandlerVersion)
+	d.Set("auto_upgrade_minor_version", props.AutoUpgradeMinorVersion)
+	d.Set("provisioning_state", props.ProvisioningState)
+
+	if props.Settings != nil {
+		settings, err := flattenArmVirtualMachineExtensionSettingsForState(*props.Settings, client.prettyPrintSettings)
+		if err != nil {
+			return fmt.Errorf("unable to parse settings from response: %s", err)
+		}
+		d.Set("settings", settings)
+	}
+
+	return nil
+}
+
+func resourceArmVirtualMachineScaleSetExtensionDelete(d *schema.ResourceData, meta interface{}) error {
+	vmScaleSetClient := meta.(*ArmClient).vmScaleSetClient
+
+	id, err := parseAzureResourceID(d.Id())
+	if err != nil {
+		return err
+	}
+	resGroup := id.ResourceGroup
+	vmScaleSetName := id.Path["virtualMachineScaleSets"]
+	name := id.Path["extensions"]
+
+	cancel := make(chan struct{})
+	timer := time.AfterFunc(d.Timeout(schema.TimeoutDelete), func() { close(cancel) })
+	defer timer.Stop()
+
+	lockKey := armVirtualMachineScaleSetLockKey(resGroup, vmScaleSetName)
+	armMutexKV.Lock(lockKey)
+	defer armMutexKV.Unlock(lockKey)
+
+	log.Printf("[DEBUG] Removing Extension %q from Virtual Machine Scale Set %q", name, vmScaleSetName)
+	if err := deleteArmVirtualMachineScaleSetExtension(vmScaleSetClient, resGroup, vmScaleSetName, name, cancel); err != nil {
+		return fmt.Errorf("Error removing Extension %q from Virtual Machine Scale Set %q: %s", name, vmScaleSetName, err)
+	}
+
+	return nil
+}
+
+// armVirtualMachineScaleSetLockKey returns the armMutexKV key serializing the
+// changes to a Scale Set and to its Extensions, which Azure otherwise rejects
+// with a conflict when they're sent concurrently.
+func armVirtualMachineScaleSetLockKey(resGroup, vmScaleSetName string) string {
+	return fmt.Sprintf("%s/virtualMachineScaleSets/%s", resGroup, vmScaleSetName)
+}
+
+// createArmVirtualMachineScaleSetExtension creates (or updates) the Extension
+// through its own endpoint, which the vendored SDK doesn't provide, and waits
+// for the operation to terminate.
+func createArmVirtualMachineScaleSetExtension(client compute.VirtualMachineScaleSetsClient, resGroup, vmScaleSetName, name string, extension compute.VirtualMachineScaleSetExtension, cancel <-chan struct{}) error {
+	// the name is part of the path, and isn't accepted within the properties
+	extension.Name = nil
+
+	req, err := prepareArmVirtualMachineScaleSetExtensionRequest(client, resGroup, vmScaleSetName, name, cancel,
+		autorest.AsJSON(),
+		autorest.AsPut(),
+		autorest.WithJSON(extension))
+	if err != nil {
+		return autorest.NewErrorWithError(err, "compute.VirtualMachineScaleSetExtensionsClient", "CreateOrUpdate", nil, "Failure preparing request")
+	}
+
+	resp, err := autorest.SendWithSender(client, req)
+	if err != nil {
+		return autorest.NewErrorWithError(err, "compute.VirtualMachineScaleSetExtensionsClient", "CreateOrUpdate", resp, "Failure sending request")
+	}
+	if !autorest.ResponseHasStatusCode(resp, http.StatusOK, http.StatusCreated) {
+		err = autorest.Respond(resp,
+			client.ByInspecting(),
+			azure.WithErrorUnlessStatusCode(http.StatusOK, http.StatusCreated),
+			autorest.ByClosing())
+		return autorest.NewErrorWithError(err, "compute.VirtualMachineScaleSetExtensionsClient", "CreateOrUpdate", resp, "Failure responding to request")
+	}
+
+	return pollArmVirtualMachineExtensionOperation(client, resp, client.PollingDelay, cancel)
+}
+
+// deleteArmVirtualMachineScaleSetExtension deletes the Extension through its
+// own endpoint and waits for the operation to terminate. An Extension which
+// (or whose Scale Set) doesn't exist is considered deleted.
+func deleteArmVirtualMachineScaleSetExtension(client compute.VirtualMachineScaleSetsClient, resGroup, vmScaleSetName, name string, cancel <-chan struct{}) error {
+	req, err := prepareArmVirtualMachineScaleSetExtensionRequest(client, resGroup, vmScaleSetName, name, cancel,
+		autorest.AsDelete())
+	if err != nil {
+		return autorest.NewErrorWithError(err, "compute.VirtualMachineScaleSetExtensionsClient", "Delete", nil, "Failure preparing request")
+	}
+
+	resp, err := autorest.SendWithSender(client, req)
+	if err != nil {
+		return autorest.NewErrorWithError(err, "compute.VirtualMachineScaleSetExtensionsClient", "Delete", resp, "Failure sending request")
+	}
+	switch {
+	case autorest.ResponseHasStatusCode(resp, http.StatusNoContent, http.StatusNotFound):
+		resp.Body.Close()
+		return nil
+	case !autorest.ResponseHasStatusCode(resp, http.StatusOK, http.StatusAccepted):
+		err = autorest.Respond(resp,
+			client.ByInspecting(),
+			azure.WithErrorUnlessStatusCode(http.StatusOK, http.StatusAccepted, http.StatusNoContent),
+			autorest.ByClosing())
+		return autorest.NewErrorWithError(err, "compute.VirtualMachineScaleSetExtensionsClient", "Delete", resp, "Failure responding to request")
+	}
+
+	// polling the Extension itself would end with a 404 once it's deleted
+	if resp.Header.Get("Azure-AsyncOperation") == "" && autorest.GetLocation(resp) == "" {
+		resp.Body.Close()
+		return nil
+	}
+	return pollArmVirtualMachineExtensionOperation(client, resp, client.PollingDelay, cancel)
+}
+
+func prepareArmVirtualMachineScaleSetExtensionRequest(client compute.VirtualMachineScaleSetsClient, resGroup, vmScaleSetName, name string, cancel <-chan struct{}, decorators ...autorest.PrepareDecorator) (*http.Request, error) {
+	pathParameters := map[string]interface{}{
+		"resourceGroupName": autorest.Encode("path", resGroup),
+		"subscriptionId":    autorest.Encode("path", client.SubscriptionID),
+		"vmScaleSetName":    autorest.Encode("path", vmScaleSetName),
+		"vmssExtensionName": autorest.Encode("path", name),
+	}
+
+	queryParameters := map[string]interface{}{
+		"api-version": armVirtualMachineScaleSetExtensionAPIVersion,
+	}
+
+	decorators = append(decorators,
+		autorest.WithBaseURL(client.BaseURI),
+		autorest.WithPathParameters("/subscriptions/{subscriptionId}/resourceGroups/{resourceGroupName}/providers/Microsoft.Compute/virtualMachineScaleSets/{vmScaleSetName}/extensions/{vmssExtensionName}", pathParameters),
+		autorest.WithQueryParameters(queryParameters))
+	return autorest.Prepare(&http.Request{Cancel: cancel}, decorators...)
+}
+
+func expandArmVirtualMachineScaleSetExtension(d *schema.ResourceData) (*compute.VirtualMachineScaleSetExtension, error) {
+	name := d.Get("name").(string)
+	publisher := d.Get("publisher").(string)
+	extensionType := d.Get("type").(string)
+	version := d.Get("type_handler_version").(string)
+	autoUpgrade := d.Get("auto_upgrade_minor_version").(bool)
+
+	extension := compute.VirtualMachineScaleSetExtension{
+		Name: &name,
+		VirtualMachineScaleSetExtensionProperties: &compute.VirtualMachineScaleSetExtensionProperties{
+			Publisher:               &publisher,
+			Type:                    &extensionType,
+			TypeHandlerVersion:      &version,
+			AutoUpgradeMinorVersion: &autoUpgrade,
+		},
+	}
+
+	if s := d.Get("settings").(string); s != "" {
+		settings, err := expandArmVirtualMachineExtensionSettings(s)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse settings: %s", err)
+		}
+		extension.VirtualMachineScaleSetExtensionProperties.Settings = &settings
+	}
+
+	if s := d.Get("protected_settings").(string); s != "" {
+		protectedSettings, err := expandArmVirtualMachineExtensionSettings(s)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse protected_settings: %s", err)
+		}
+		extension.VirtualMachineScaleSetExtensionProperties.ProtectedSettings = &protectedSettings
+	}
+
+	return &extension, nil
+}
+
+func findArmVirtualMachineScaleSetExtensionByName(scaleSet *compute.VirtualMachineScaleSet, name string) (*compute.VirtualMachineScaleSetExtension, int, bool) {
+	if scaleSet == nil || scaleSet.VirtualMachineScaleSetProperties == nil || scaleSet.VirtualMachineProfile == nil ||
+		scaleSet.VirtualMachineProfile.ExtensionProfile == nil || scaleSet.VirtualMachineProfile.ExtensionProfile.Extensions == nil {
+		return nil, -1, false
+	}
+
+	for i, extension := range *scaleSet.VirtualMachineProfile.ExtensionProfile.Extensions {
+		if extension.Name != nil && strings.EqualFold(*extension.Name, name) {
+			return &extension, i, true
+		}
+	}
+
+	return nil, -1, false
+}
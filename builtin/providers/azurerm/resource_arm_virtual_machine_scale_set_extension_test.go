@@ -0,0 +1,147 @@
+package azurerm
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/hashicorp/terraform/config"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestResourceArmVirtualMachineScaleSetExtension_createAndDelete(t *testing.T) {
+	var mu sync.Mutex
+	scaleSet := compute.VirtualMachineScaleSet{}
+	if err := json.Unmarshal([]byte(`{"id":"/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachineScaleSets/acctvmss","name":"acctvmss","location":"westus","properties":{"virtualMachineProfile":{"extensionProfile":{"extensions":[{"name":"existing","properties":{"publisher":"Microsoft.Azure.Diagnostics","type":"LinuxDiagnostic","typeHandlerVersion":"2.3"}}]}}}}`), &scaleSet); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		extensions := scaleSet.VirtualMachineProfile.ExtensionProfile.Extensions
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/virtualMachineScaleSets/acctvmss"):
+			json.NewEncoder(w).Encode(scaleSet)
+		case r.Method == "PUT" && strings.HasSuffix(r.URL.Path, "/virtualMachineScaleSets/acctvmss/extensions/hostname"):
+			if apiVersion := r.URL.Query().Get("api-version"); apiVersion != armVirtualMachineScaleSetExtensionAPIVersion {
+				t.Errorf("Expected the Extension to be created with the API version %q, got %q", armVirtualMachineScaleSetExtensionAPIVersion, apiVersion)
+			}
+			var extension compute.VirtualMachineScaleSetExtension
+			if err := json.NewDecoder(r.Body).Decode(&extension); err != nil {
+				t.Errorf("Error decoding the Extension: %s", err)
+			}
+			name := "hostname"
+			extension.Name = &name
+			*extensions = append(*extensions, extension)
+			json.NewEncoder(w).Encode(extension)
+		case r.Method == "DELETE" && strings.HasSuffix(r.URL.Path, "/virtualMachineScaleSets/acctvmss/extensions/hostname"):
+			kept := []compute.VirtualMachineScaleSetExtension{}
+			for _, extension := range *extensions {
+				if *extension.Name != "hostname" {
+					kept = append(kept, extension)
+				}
+			}
+			*extensions = kept
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := testArmClientWithBaseURI(server.URL)
+	d := testArmResourceDataRaw(t, resourceArmVirtualMachineScaleSetExtension(), map[string]interface{}{
+		"name":                           "hostname",
+		"resource_group_name":            "acctestRG",
+		"virtual_machine_scale_set_name": "acctvmss",
+		"publisher":                      "Microsoft.OSTCExtensions",
+		"type":                           "CustomScriptForLinux",
+		"type_handler_version":           "1.2",
+		"settings":                       `{"commandToExecute":"hostname"}`,
+		"protected_settings":             `{"storageAccountKey":"secret"}`,
+	})
+
+	if err := resourceArmVirtualMachineScaleSetExtensionCreate(d, client); err != nil {
+		t.Fatalf("Error creating the Scale Set Extension: %s", err)
+	}
+
+	if expected := "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachineScaleSets/acctvmss/extensions/hostname"; d.Id() != expected {
+		t.Fatalf("Expected the ID %q, got %q", expected, d.Id())
+	}
+
+	extensions := *scaleSet.VirtualMachineProfile.ExtensionProfile.Extensions
+	if len(extensions) != 2 || *extensions[0].Name != "existing" || *extensions[1].Name != "hostname" {
+		t.Fatalf("Expected the Extension to be added next to the existing one, got %+v", extensions)
+	}
+	if props := extensions[1].VirtualMachineScaleSetExtensionProperties; props.ProtectedSettings == nil || (*props.ProtectedSettings)["storageAccountKey"] != "secret" {
+		t.Fatalf("Expected the protected settings to be sent, got %+v", props)
+	}
+	if props := extensions[0].VirtualMachineScaleSetExtensionProperties; props.ProtectedSettings != nil {
+		t.Fatalf("Expected the existing Extension to be left alone, got %+v", props)
+	}
+	if settings := d.Get("settings").(string); settings != `{"commandToExecute":"hostname"}` {
+		t.Fatalf("Expected the settings to be read back, got %q", settings)
+	}
+
+	if err := resourceArmVirtualMachineScaleSetExtensionDelete(d, client); err != nil {
+		t.Fatalf("Error deleting the Scale Set Extension: %s", err)
+	}
+
+	extensions = *scaleSet.VirtualMachineProfile.ExtensionProfile.Extensions
+	if len(extensions) != 1 || *extensions[0].Name != "existing" {
+		t.Fatalf("Expected only the existing Extension to be kept, got %+v", extensions)
+	}
+
+	if err := resourceArmVirtualMachineScaleSetExtensionRead(d, client); err != nil {
+		t.Fatalf("Error reading the Scale Set Extension: %s", err)
+	}
+	if d.Id() != "" {
+		t.Fatalf("Expected the deleted Extension to be removed from the state, got %q", d.Id())
+	}
+}
+
+func TestResourceArmVirtualMachineScaleSet_unmanagedExtensions(t *testing.T) {
+	// an Extension added by azurerm_virtual_machine_scale_set_extension is read
+	// into the state of a Scale Set without any extension blocks
+	extension := map[string]interface{}{
+		"name":                 "hostname",
+		"publisher":            "Microsoft.Azure.Extensions",
+		"type":                 "CustomScript",
+		"type_handler_version": "2.0",
+	}
+	hash := strconv.Itoa(resourceArmVirtualMachineScaleSetExtensionHash(extension))
+	state := &terraform.InstanceState{
+		ID: "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachineScaleSets/acctvmss",
+		Attributes: map[string]string{
+			"extension.#":                                 "1",
+			"extension." + hash + ".name":                 "hostname",
+			"extension." + hash + ".publisher":            "Microsoft.Azure.Extensions",
+			"extension." + hash + ".type":                 "CustomScript",
+			"extension." + hash + ".type_handler_version": "2.0",
+		},
+	}
+
+	raw, err := config.NewRawConfig(map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff, err := resourceArmVirtualMachineScaleSet().Diff(state, terraform.NewResourceConfig(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff != nil {
+		for k := range diff.Attributes {
+			if strings.HasPrefix(k, "extension.") {
+				t.Fatalf("Expected the Extension to be left alone, got a diff for %q", k)
+			}
+		}
+	}
+}
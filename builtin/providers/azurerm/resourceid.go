@@ -17,6 +17,18 @@ type ResourceID struct {
 	Path           map[string]string
 }
 
+// canonicalResourceIDKeys maps the lowercased keys of the Microsoft.Compute
+// path segments to the casing they're looked up with, since IDs typed by
+// users (e.g. when importing) don't always match the casing Azure returns.
+// Other keys are kept as-is, as resources look up some of them with
+// different casings.
+var canonicalResourceIDKeys = map[string]string{
+	"availabilitysets":        "availabilitySets",
+	"extensions":              "extensions",
+	"virtualmachines":         "virtualMachines",
+	"virtualmachinescalesets": "virtualMachineScaleSets",
+}
+
 // parseAzureResourceID converts a long-form Azure Resource Manager ID
 // into a ResourceID. We make assumptions about the structure of URLs,
 // which is obviously not good, but the best thing available given the
@@ -52,6 +64,9 @@ func parseAzureResourceID(id string) (*ResourceID, error) {
 	for current := 0; current < len(components); current += 2 {
 		key := components[current]
 		value := components[current+1]
+		if canonical, ok := canonicalResourceIDKeys[strings.ToLower(key)]; ok {
+			key = canonical
+		}
 
 		// Catch the subscriptionID before it can be overwritten by another "subscriptions"
 		// value in the ID which is the case for the Service Bus subscription resource
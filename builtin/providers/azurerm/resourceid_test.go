@@ -115,6 +115,19 @@ func TestParseAzureResourceID(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"/subscriptions/34ca515c-4629-458e-bf7c-738d77e0d0ea/resourcegroups/testGroup1/providers/Microsoft.Compute/virtualmachines/testVM1/EXTENSIONS/testExtension1",
+			&ResourceID{
+				SubscriptionID: "34ca515c-4629-458e-bf7c-738d77e0d0ea",
+				ResourceGroup:  "testGroup1",
+				Provider:       "Microsoft.Compute",
+				Path: map[string]string{
+					"virtualMachines": "testVM1",
+					"extensions":      "testExtension1",
+				},
+			},
+			false,
+		},
 	}
 
 	for _, test := range testCases {
@@ -0,0 +1,335 @@
+package azurerm
+
+import (
+	"encoding/json"
+	"math/big"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/golang-lru"
+)
+
+// settingsCacheSize is the number of distinct settings strings we keep the
+// canonical form of. Plans with thousands of extensions tend to share a small
+// number of distinct settings documents, so this comfortably covers them.
+const settingsCacheSize = 1024
+
+// settingsNormalizationCache memoizes the canonical form of extension
+// settings JSON so that the DiffSuppressFunc doesn't have to re-parse
+// identical documents across resource instances. The underlying LRU is
+// safe for concurrent use.
+var settingsNormalizationCache = mustNewSettingsCache(settingsCacheSize)
+
+type canonicalSettings struct {
+	value string
+	err   error
+}
+
+func mustNewSettingsCache(size int) *lru.Cache {
+	cache, err := lru.New(size)
+	if err != nil {
+		panic(err)
+	}
+	return cache
+}
+
+// canonicalizeArmVirtualMachineExtensionSettings parses the given JSON object
+// and re-encodes it, which sorts the keys and strips insignificant whitespace.
+// Two settings documents are semantically equal when their canonical forms
+// match.
+func canonicalizeArmVirtualMachineExtensionSettings(jsonString string) (string, error) {
+	if cached, ok := settingsNormalizationCache.Get(jsonString); ok {
+		c := cached.(canonicalSettings)
+		return c.value, c.err
+	}
+
+	value, err := normalizeArmVirtualMachineExtensionSettings(jsonString)
+	settingsNormalizationCache.Add(jsonString, canonicalSettings{value: value, err: err})
+
+	return value, err
+}
+
+func normalizeArmVirtualMachineExtensionSettings(jsonString string) (string, error) {
+	settings, err := expandArmVirtualMachineExtensionSettings(jsonString)
+	if err != nil {
+		return "", err
+	}
+
+	canonical := canonicalizeArmVirtualMachineExtensionSettingsNumbers(settings)
+
+	result, err := json.Marshal(canonical)
+	if err != nil {
+		return "", err
+	}
+
+	return string(result), nil
+}
+
+// canonicalizeArmVirtualMachineExtensionSettingsNumbers rewrites the numbers
+// in the settings (the json.Number values produced by
+// expandArmVirtualMachineExtensionSettings, or the float64 values of those
+// returned by the API) in a canonical exact decimal form, so that e.g. `8080`,
+// `8080.0` and `8.08e3` compare equal while integers beyond the precision of a
+// float64 still compare as written.
+func canonicalizeArmVirtualMachineExtensionSettingsNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		return canonicalizeArmVirtualMachineExtensionSettingsNumber(v.String())
+	case float64:
+		return canonicalizeArmVirtualMachineExtensionSettingsNumber(strconv.FormatFloat(v, 'g', -1, 64))
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, inner := range v {
+			result[key] = canonicalizeArmVirtualMachineExtensionSettingsNumbers(inner)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, inner := range v {
+			result[i] = canonicalizeArmVirtualMachineExtensionSettingsNumbers(inner)
+		}
+		return result
+	default:
+		return v
+	}
+}
+
+// armVirtualMachineExtensionSettingsMaxExponent bounds the exponents which are
+// expanded into a decimal, since e.g. `1e1000000000` would take gigabytes.
+const armVirtualMachineExtensionSettingsMaxExponent = 1000
+
+// canonicalizeArmVirtualMachineExtensionSettingsNumber returns the number as an
+// exact decimal without an exponent or trailing zeros (and `-0` as `0`), or
+// as-is when it can't be parsed or its exponent is out of range.
+func canonicalizeArmVirtualMachineExtensionSettingsNumber(number string) json.Number {
+	if i := strings.IndexAny(number, "eE"); i >= 0 {
+		exponent, err := strconv.Atoi(strings.TrimPrefix(number[i+1:], "+"))
+		if err != nil || exponent > armVirtualMachineExtensionSettingsMaxExponent || exponent < -armVirtualMachineExtensionSettingsMaxExponent {
+			return json.Number(number)
+		}
+	}
+
+	r, ok := new(big.Rat).SetString(number)
+	if !ok {
+		return json.Number(number)
+	}
+	if r.IsInt() {
+		return json.Number(r.Num().String())
+	}
+
+	// the denominator of a decimal is a product of 2s and 5s, so it has an
+	// exact decimal form with as many places as the larger count of those
+	places := int(r.Denom().TrailingZeroBits())
+	fives, d, five := 0, new(big.Int).Set(r.Denom()), big.NewInt(5)
+	for {
+		q, m := new(big.Int).QuoRem(d, five, new(big.Int))
+		if m.Sign() != 0 {
+			break
+		}
+		d = q
+		fives++
+	}
+	if fives > places {
+		places = fives
+	}
+
+	return json.Number(r.FloatString(places))
+}
+
+// decodeArmVirtualMachineExtensionSettingsJSON decodes canonical settings,
+// keeping their numbers exact.
+func decodeArmVirtualMachineExtensionSettingsJSON(canonicalJSON string, value *interface{}) error {
+	decoder := json.NewDecoder(strings.NewReader(canonicalJSON))
+	decoder.UseNumber()
+	return decoder.Decode(value)
+}
+
+// normalizeArmVirtualMachineExtensionSettingsForComparison applies the
+// comparison options of the extension to its canonical settings: keys matching
+// one of caseInsensitiveKeys (in any casing) are rewritten to the casing given,
+// the arrays held by unorderedArrayKeys are sorted by the mapped sub-key (or by
+// their elements, if none is given), and with normalizeWhitespace, runs of
+// whitespace within string values are collapsed to a single space.
+func normalizeArmVirtualMachineExtensionSettingsForComparison(canonicalJSON string, caseInsensitiveKeys []string, unorderedArrayKeys map[string]string, normalizeWhitespace bool) (string, error) {
+	var settings interface{}
+	if err := decodeArmVirtualMachineExtensionSettingsJSON(canonicalJSON, &settings); err != nil {
+		return "", err
+	}
+
+	if len(caseInsensitiveKeys) > 0 {
+		lookup := make(map[string]string, len(caseInsensitiveKeys))
+		for _, key := range caseInsensitiveKeys {
+			lookup[strings.ToLower(key)] = key
+		}
+		settings = foldArmVirtualMachineExtensionSettingsValueKeys(settings, lookup)
+	}
+
+	if len(unorderedArrayKeys) > 0 {
+		settings = sortArmVirtualMachineExtensionSettingsArrays(settings, unorderedArrayKeys)
+	}
+
+	if normalizeWhitespace {
+		settings = collapseArmVirtualMachineExtensionSettingsWhitespace(settings)
+	}
+
+	result, err := json.Marshal(settings)
+	if err != nil {
+		return "", err
+	}
+
+	return string(result), nil
+}
+
+// removeArmVirtualMachineExtensionSettingsIgnoredKeys removes the ignored keys
+// (dot-separated paths into nested objects, such as `workspace.region`) from
+// the returned settings where the configured settings don't have them, so
+// that configured settings which are a subset of those returned compare equal.
+func removeArmVirtualMachineExtensionSettingsIgnoredKeys(returnedCanonicalJSON, configuredCanonicalJSON string, ignoreKeys []string) (string, error) {
+	var returned, configured interface{}
+	if err := decodeArmVirtualMachineExtensionSettingsJSON(returnedCanonicalJSON, &returned); err != nil {
+		return "", err
+	}
+	if err := decodeArmVirtualMachineExtensionSettingsJSON(configuredCanonicalJSON, &configured); err != nil {
+		return "", err
+	}
+
+	for _, key := range ignoreKeys {
+		removeArmVirtualMachineExtensionSettingsIgnoredKey(returned, configured, strings.Split(key, "."))
+	}
+
+	result, err := json.Marshal(returned)
+	if err != nil {
+		return "", err
+	}
+
+	return string(result), nil
+}
+
+func removeArmVirtualMachineExtensionSettingsIgnoredKey(returned, configured interface{}, path []string) {
+	returnedObject, ok := returned.(map[string]interface{})
+	if !ok {
+		return
+	}
+	configuredObject, _ := configured.(map[string]interface{})
+	configuredValue, configuredOk := configuredObject[path[0]]
+
+	if len(path) == 1 {
+		if !configuredOk {
+			delete(returnedObject, path[0])
+		}
+		return
+	}
+
+	removeArmVirtualMachineExtensionSettingsIgnoredKey(returnedObject[path[0]], configuredValue, path[1:])
+}
+
+func foldArmVirtualMachineExtensionSettingsValueKeys(value interface{}, lookup map[string]string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, inner := range v {
+			if folded, ok := lookup[strings.ToLower(key)]; ok {
+				key = folded
+			}
+			result[key] = foldArmVirtualMachineExtensionSettingsValueKeys(inner, lookup)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, inner := range v {
+			result[i] = foldArmVirtualMachineExtensionSettingsValueKeys(inner, lookup)
+		}
+		return result
+	default:
+		return v
+	}
+}
+
+var armVirtualMachineExtensionSettingsWhitespace = regexp.MustCompile(`\s+`)
+
+// collapseArmVirtualMachineExtensionSettingsWhitespace collapses the
+// whitespace within the string values only; keys are left as-is.
+func collapseArmVirtualMachineExtensionSettingsWhitespace(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, inner := range v {
+			result[key] = collapseArmVirtualMachineExtensionSettingsWhitespace(inner)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, inner := range v {
+			result[i] = collapseArmVirtualMachineExtensionSettingsWhitespace(inner)
+		}
+		return result
+	case string:
+		return armVirtualMachineExtensionSettingsWhitespace.ReplaceAllString(v, " ")
+	default:
+		return v
+	}
+}
+
+func sortArmVirtualMachineExtensionSettingsArrays(value interface{}, unorderedArrayKeys map[string]string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, inner := range v {
+			inner = sortArmVirtualMachineExtensionSettingsArrays(inner, unorderedArrayKeys)
+			if sortBy, ok := unorderedArrayKeys[key]; ok {
+				if array, isArray := inner.([]interface{}); isArray {
+					inner = sortArmVirtualMachineExtensionSettingsArray(array, sortBy)
+				}
+			}
+			result[key] = inner
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, inner := range v {
+			result[i] = sortArmVirtualMachineExtensionSettingsArrays(inner, unorderedArrayKeys)
+		}
+		return result
+	default:
+		return v
+	}
+}
+
+// sortArmVirtualMachineExtensionSettingsArray sorts the elements by the JSON
+// encoding of their sortBy sub-key, falling back to (and breaking ties with)
+// the encoding of the whole element.
+func sortArmVirtualMachineExtensionSettingsArray(array []interface{}, sortBy string) []interface{} {
+	type sortable struct {
+		key     string
+		encoded string
+		value   interface{}
+	}
+
+	elements := make([]sortable, 0, len(array))
+	for _, element := range array {
+		encoded, _ := json.Marshal(element)
+		key := string(encoded)
+		if object, ok := element.(map[string]interface{}); ok && sortBy != "" {
+			if subKey, ok := object[sortBy]; ok {
+				encodedSubKey, _ := json.Marshal(subKey)
+				key = string(encodedSubKey)
+			}
+		}
+		elements = append(elements, sortable{key: key, encoded: string(encoded), value: element})
+	}
+
+	sort.SliceStable(elements, func(i, j int) bool {
+		if elements[i].key != elements[j].key {
+			return elements[i].key < elements[j].key
+		}
+		return elements[i].encoded < elements[j].encoded
+	})
+
+	result := make([]interface{}, 0, len(elements))
+	for _, element := range elements {
+		result = append(result, element.value)
+	}
+	return result
+}
@@ -0,0 +1,113 @@
+package azurerm
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCanonicalizeArmVirtualMachineExtensionSettings(t *testing.T) {
+	cases := []struct {
+		Value       string
+		Expected    string
+		ExpectError bool
+	}{
+		{
+			Value:    `{"b": 1, "a": "x"}`,
+			Expected: `{"a":"x","b":1}`,
+		},
+		{
+			Value:    "{\n\t\"commandToExecute\": \"hostname\"\n}",
+			Expected: `{"commandToExecute":"hostname"}`,
+		},
+		// numbers are written as exact decimals
+		{
+			Value:    `{"zero": -0.0, "ratio": 1.50, "small": 2.5e-3, "big": 9007199254740993, "exp": 1E+3}`,
+			Expected: `{"big":9007199254740993,"exp":1000,"ratio":1.5,"small":0.0025,"zero":0}`,
+		},
+		// except those with an exponent too large to expand
+		{
+			Value:    `{"huge": 1e100000}`,
+			Expected: `{"huge":1e100000}`,
+		},
+		{
+			Value:       `{"a":`,
+			ExpectError: true,
+		},
+		{
+			Value:       ``,
+			ExpectError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		// run each case twice so the second lookup is served from the cache
+		for i := 0; i < 2; i++ {
+			actual, err := canonicalizeArmVirtualMachineExtensionSettings(tc.Value)
+			if tc.ExpectError {
+				if err == nil {
+					t.Fatalf("Expected %q to return an error", tc.Value)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error for %q: %s", tc.Value, err)
+			}
+			if actual != tc.Expected {
+				t.Fatalf("Expected %q to canonicalize to %q, got %q", tc.Value, tc.Expected, actual)
+			}
+		}
+	}
+}
+
+func TestCanonicalizeArmVirtualMachineExtensionSettings_concurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			input := fmt.Sprintf(`{"commandToExecute": "echo %d"}`, i%5)
+			expected := fmt.Sprintf(`{"commandToExecute":"echo %d"}`, i%5)
+			actual, err := canonicalizeArmVirtualMachineExtensionSettings(input)
+			if err != nil {
+				t.Errorf("Unexpected error: %s", err)
+				return
+			}
+			if actual != expected {
+				t.Errorf("Expected %q, got %q", expected, actual)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func benchmarkSettings() string {
+	uris := make([]string, 0, 50)
+	for i := 0; i < 50; i++ {
+		uris = append(uris, fmt.Sprintf(`"https://example.blob.core.windows.net/scripts/script%d.sh"`, i))
+	}
+	return fmt.Sprintf(`{"commandToExecute": "sh bootstrap.sh", "fileUris": [%s]}`, strings.Join(uris, ", "))
+}
+
+func BenchmarkSuppressDiffVirtualMachineExtensionSettings_uncached(b *testing.B) {
+	settings := benchmarkSettings()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		old, _ := normalizeArmVirtualMachineExtensionSettings(settings)
+		new, _ := normalizeArmVirtualMachineExtensionSettings(settings)
+		if old != new {
+			b.Fatal("Expected settings to be equal")
+		}
+	}
+}
+
+func BenchmarkSuppressDiffVirtualMachineExtensionSettings_cached(b *testing.B) {
+	settings := benchmarkSettings()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !suppressDiffVirtualMachineExtensionSettings("settings", settings, settings, nil) {
+			b.Fatal("Expected settings to be equal")
+		}
+	}
+}
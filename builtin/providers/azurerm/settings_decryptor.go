@@ -0,0 +1,111 @@
+package azurerm
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// SettingsDecryptor decrypts values in Virtual Machine Extension settings
+// which are encrypted (e.g. by an organisation's KMS) before being written in
+// the configuration, and so are stored verbatim by Azure. It's consulted when
+// comparing the stored settings to the configuration, so that a plaintext
+// value in the configuration matches its encrypted counterpart in Azure.
+type SettingsDecryptor interface {
+	// Decrypt returns the plaintext of the value held by the given settings
+	// key, and whether the key is one the decryptor handles.
+	Decrypt(key, value string) (plaintext string, handled bool, err error)
+}
+
+type noopSettingsDecryptor struct{}
+
+func (noopSettingsDecryptor) Decrypt(key, value string) (string, bool, error) {
+	return value, false, nil
+}
+
+var (
+	settingsDecryptorLock sync.RWMutex
+	settingsDecryptor     SettingsDecryptor = noopSettingsDecryptor{}
+)
+
+// RegisterSettingsDecryptor sets the decryptor used when comparing Virtual
+// Machine Extension settings. Passing nil restores the default, which leaves
+// all values untouched.
+func RegisterSettingsDecryptor(decryptor SettingsDecryptor) {
+	if decryptor == nil {
+		decryptor = noopSettingsDecryptor{}
+	}
+
+	settingsDecryptorLock.Lock()
+	defer settingsDecryptorLock.Unlock()
+	settingsDecryptor = decryptor
+}
+
+func registeredSettingsDecryptor() SettingsDecryptor {
+	settingsDecryptorLock.RLock()
+	defer settingsDecryptorLock.RUnlock()
+	return settingsDecryptor
+}
+
+// decryptArmVirtualMachineExtensionSettings returns the canonical form of the
+// settings with any values handled by the registered decryptor decrypted, and
+// whether anything was decrypted at all.
+func decryptArmVirtualMachineExtensionSettings(jsonString string) (string, bool, error) {
+	decryptor := registeredSettingsDecryptor()
+	if _, ok := decryptor.(noopSettingsDecryptor); ok {
+		return "", false, nil
+	}
+
+	settings, err := expandArmVirtualMachineExtensionSettings(jsonString)
+	if err != nil {
+		return "", false, err
+	}
+
+	decrypted, changed, err := decryptArmVirtualMachineExtensionSettingsValue(decryptor, "", settings)
+	if err != nil || !changed {
+		return "", false, err
+	}
+
+	result, err := json.Marshal(canonicalizeArmVirtualMachineExtensionSettingsNumbers(decrypted))
+	if err != nil {
+		return "", false, err
+	}
+
+	return string(result), true, nil
+}
+
+func decryptArmVirtualMachineExtensionSettingsValue(decryptor SettingsDecryptor, key string, value interface{}) (interface{}, bool, error) {
+	switch v := value.(type) {
+	case string:
+		plaintext, handled, err := decryptor.Decrypt(key, v)
+		if err != nil || !handled {
+			return v, false, err
+		}
+		return plaintext, true, nil
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		changed := false
+		for k, inner := range v {
+			decrypted, c, err := decryptArmVirtualMachineExtensionSettingsValue(decryptor, k, inner)
+			if err != nil {
+				return nil, false, err
+			}
+			result[k] = decrypted
+			changed = changed || c
+		}
+		return result, changed, nil
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		changed := false
+		for i, inner := range v {
+			decrypted, c, err := decryptArmVirtualMachineExtensionSettingsValue(decryptor, key, inner)
+			if err != nil {
+				return nil, false, err
+			}
+			result[i] = decrypted
+			changed = changed || c
+		}
+		return result, changed, nil
+	default:
+		return v, false, nil
+	}
+}
@@ -0,0 +1,65 @@
+package azurerm
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testSettingsDecryptor "decrypts" values of the `storageKey` key prefixed
+// with `enc:` by reversing them.
+type testSettingsDecryptor struct{}
+
+func (testSettingsDecryptor) Decrypt(key, value string) (string, bool, error) {
+	if key != "storageKey" {
+		return value, false, nil
+	}
+	if !strings.HasPrefix(value, "enc:") {
+		return "", false, fmt.Errorf("value isn't encrypted")
+	}
+
+	runes := []rune(strings.TrimPrefix(value, "enc:"))
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes), true, nil
+}
+
+func TestSuppressDiffVirtualMachineExtensionSettings_decryptor(t *testing.T) {
+	stored := `{"storageKey":"enc:terces","nested":{"storageKey":"enc:cba"},"port":8080}`
+	config := `{"storageKey":"secret","nested":{"storageKey":"abc"},"port":8080}`
+
+	if suppressDiffVirtualMachineExtensionSettings("settings", stored, config, nil) {
+		t.Fatalf("Expected a diff without a registered decryptor")
+	}
+
+	RegisterSettingsDecryptor(testSettingsDecryptor{})
+	defer RegisterSettingsDecryptor(nil)
+
+	if !suppressDiffVirtualMachineExtensionSettings("settings", stored, config, nil) {
+		t.Fatalf("Expected no diff once the stored values are decrypted")
+	}
+
+	changed := `{"storageKey":"different","nested":{"storageKey":"abc"},"port":8080}`
+	if suppressDiffVirtualMachineExtensionSettings("settings", stored, changed, nil) {
+		t.Fatalf("Expected a diff when the decrypted value differs from the configuration")
+	}
+
+	if suppressDiffVirtualMachineExtensionSettings("settings", `{"storageKey":"plain"}`, `{"storageKey":"plain2"}`, nil) {
+		t.Fatalf("Expected a diff when the decryptor fails")
+	}
+}
+
+func TestRegisterSettingsDecryptor_nilRestoresDefault(t *testing.T) {
+	RegisterSettingsDecryptor(testSettingsDecryptor{})
+	RegisterSettingsDecryptor(nil)
+
+	if _, ok := registeredSettingsDecryptor().(noopSettingsDecryptor); !ok {
+		t.Fatalf("Expected registering nil to restore the no-op decryptor")
+	}
+
+	_, decrypted, err := decryptArmVirtualMachineExtensionSettings(`{"storageKey":"enc:terces"}`)
+	if err != nil || decrypted {
+		t.Fatalf("Expected the no-op decryptor to leave the settings untouched, got %t (%v)", decrypted, err)
+	}
+}
@@ -0,0 +1,160 @@
+package azurerm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// settingsValidationWebhookMaxReason is the length the rejection reason
+// returned by the webhook is truncated to, in case it's e.g. an HTML page.
+const settingsValidationWebhookMaxReason = 1024
+
+// settingsValidationWebhook sends the settings of the Virtual Machine
+// Extensions to the provider's `settings_validation_webhook_url`, so that a
+// central policy service can reject them.
+type settingsValidationWebhook struct {
+	url    string
+	client *http.Client
+
+	// whether the Extension is applied regardless when the webhook can't be
+	// reached, rather than failing
+	warnOnFailure bool
+}
+
+// settingsValidationRequest is the body POSTed to the webhook. The values of
+// the protected settings are redacted, keeping the keys.
+type settingsValidationRequest struct {
+	ResourceID         string                 `json:"resource_id"`
+	Name               string                 `json:"name"`
+	ResourceGroupName  string                 `json:"resource_group_name"`
+	VirtualMachineName string                 `json:"virtual_machine_name"`
+	Location           string                 `json:"location"`
+	Publisher          string                 `json:"publisher"`
+	Type               string                 `json:"type"`
+	TypeHandlerVersion string                 `json:"type_handler_version"`
+	Settings           map[string]interface{} `json:"settings"`
+	ProtectedSettings  map[string]interface{} `json:"protected_settings"`
+}
+
+// settingsValidationResponse is the body the webhook may reject the settings
+// with.
+type settingsValidationResponse struct {
+	Reason string `json:"reason"`
+}
+
+// newSettingsValidationWebhook returns nil without a webhook URL, which
+// validate does nothing for.
+func newSettingsValidationWebhook(webhookURL string, timeout time.Duration, failureMode string) *settingsValidationWebhook {
+	if webhookURL == "" {
+		return nil
+	}
+
+	return &settingsValidationWebhook{
+		url:           webhookURL,
+		client:        &http.Client{Timeout: timeout},
+		warnOnFailure: failureMode == "warn",
+	}
+}
+
+// validate returns an error when the webhook rejects the settings, with a
+// non-2xx response giving a reason. A webhook which can't be reached, times
+// out or fails without a reason is an error too, unless the provider's
+// `settings_validation_webhook_failure_mode` is `warn`.
+func (w *settingsValidationWebhook) validate(request settingsValidationRequest) error {
+	if w == nil {
+		return nil
+	}
+
+	reason, err := w.send(request)
+	if err != nil {
+		if w.warnOnFailure {
+			log.Printf("[WARN] Unable to validate the settings of Virtual Machine Extension %q with the settings validation webhook, applying them regardless: %s", request.Name, err)
+			return nil
+		}
+		return fmt.Errorf("Unable to validate the settings of Virtual Machine Extension %q with the settings validation webhook: %s", request.Name, err)
+	}
+	if reason != "" {
+		return fmt.Errorf("The settings validation webhook rejected the settings of Virtual Machine Extension %q: %s", request.Name, reason)
+	}
+
+	return nil
+}
+
+// send returns the reason the settings were rejected for, which is empty when
+// they were accepted.
+func (w *settingsValidationWebhook) send(request settingsValidationRequest) (string, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// the URL may contain credentials, so isn't part of the error
+		if urlErr, ok := err.(*url.Error); ok {
+			if urlErr.Timeout() {
+				return "", fmt.Errorf("the webhook didn't respond within %s", w.client.Timeout)
+			}
+			return "", urlErr.Err
+		}
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return "", nil
+	}
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading the response (status %s): %s", resp.Status, err)
+	}
+
+	var rejection settingsValidationResponse
+	if err := json.Unmarshal(contents, &rejection); err != nil {
+		rejection.Reason = string(contents)
+	}
+	reason := strings.TrimSpace(rejection.Reason)
+	if reason == "" {
+		return "", fmt.Errorf("the webhook returned %s without a reason", resp.Status)
+	}
+	if len(reason) > settingsValidationWebhookMaxReason {
+		reason = reason[:settingsValidationWebhookMaxReason] + "..."
+	}
+
+	return reason, nil
+}
+
+// expandSettingsValidationRequestProtectedSettings redacts the values of the
+// protected settings, which never leave the provider.
+func expandSettingsValidationRequestProtectedSettings(protectedSettings *map[string]interface{}) map[string]interface{} {
+	redacted := make(map[string]interface{})
+	if protectedSettings != nil {
+		for k := range *protectedSettings {
+			redacted[k] = redactedValue
+		}
+	}
+	return redacted
+}
+
+// flattenSettingsValidationWebhookURL drops any credentials from the URL,
+// for the effective provider options.
+func flattenSettingsValidationWebhookURL(webhookURL string) string {
+	parsed, err := url.Parse(webhookURL)
+	if err != nil {
+		return redactArmProviderSecret(webhookURL)
+	}
+
+	parsed.User = nil
+	if parsed.RawQuery != "" {
+		parsed.RawQuery = redactedValue
+	}
+	return parsed.String()
+}
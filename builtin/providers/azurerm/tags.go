@@ -62,6 +62,9 @@ func expandTags(tagsMap map[string]interface{}) *map[string]*string {
 	return &output
 }
 
+// flattenAndSetTags always sets a (possibly empty) map, since Azure returns no
+// tags at all for resources without any, so that the state doesn't flip
+// between an empty map and no tags across refreshes.
 func flattenAndSetTags(d *schema.ResourceData, tagsMap *map[string]*string) {
 	if tagsMap == nil {
 		d.Set("tags", make(map[string]interface{}))
@@ -71,6 +74,10 @@ func flattenAndSetTags(d *schema.ResourceData, tagsMap *map[string]*string) {
 	output := make(map[string]interface{}, len(*tagsMap))
 
 	for i, v := range *tagsMap {
+		if v == nil {
+			output[i] = ""
+			continue
+		}
 		output[i] = *v
 	}
 
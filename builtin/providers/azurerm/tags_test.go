@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"strings"
 	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
 )
 
 func TestValidateMaximumNumberOfARMTags(t *testing.T) {
@@ -95,3 +97,27 @@ func TestExpandARMTags(t *testing.T) {
 		}
 	}
 }
+
+func TestFlattenAndSetTags_nil(t *testing.T) {
+	tagsSchema := map[string]*schema.Schema{"tags": tagsSchema()}
+
+	empty := ""
+	cases := []*map[string]*string{
+		nil,
+		&map[string]*string{},
+		&map[string]*string{"empty": nil, "set": &empty},
+	}
+
+	for i, tc := range cases {
+		d := schema.TestResourceDataRaw(t, tagsSchema, map[string]interface{}{})
+		flattenAndSetTags(d, tc)
+
+		tags, ok := d.Get("tags").(map[string]interface{})
+		if !ok {
+			t.Fatalf("Case %d: Expected the tags to be a map, got %#v", i, d.Get("tags"))
+		}
+		if tc != nil && len(tags) != len(*tc) {
+			t.Fatalf("Case %d: Expected %d tags, got %#v", i, len(*tc), tags)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package azurerm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+)
+
+// The retries of the requests sent by withTransientErrorRetry. The delay
+// doubles after each attempt (unless Azure returns a `Retry-After`), and is
+// capped so that a throttled apply can't hang indefinitely.
+var (
+	transientErrorRetryAttempts = 5
+	transientErrorRetryDelay    = 5 * time.Second
+	transientErrorRetryMaxDelay = 2 * time.Minute
+)
+
+// transientErrorStatusCodes are the status codes Azure returns when throttling
+// or during bursts of operations, which succeed when retried.
+var transientErrorStatusCodes = []int{
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// withTransientErrorRetry retries the requests answered with one of the
+// transientErrorStatusCodes, honouring the `Retry-After` returned. Unlike the
+// SDK's own retries, this includes `429 Too Many Requests`. Any other response
+// (including the last transient one) is returned as-is.
+func withTransientErrorRetry() autorest.SendDecorator {
+	return func(s autorest.Sender) autorest.Sender {
+		return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+			var body []byte
+			if r.Body != nil {
+				var err error
+				if body, err = ioutil.ReadAll(r.Body); err != nil {
+					return nil, err
+				}
+				r.Body.Close()
+			}
+
+			delay := transientErrorRetryDelay
+			for attempt := 1; ; attempt++ {
+				if body != nil {
+					r.Body = ioutil.NopCloser(bytes.NewReader(body))
+				}
+
+				resp, err := s.Do(r)
+				if err != nil || attempt >= transientErrorRetryAttempts || !autorest.ResponseHasStatusCode(resp, transientErrorStatusCodes...) {
+					return resp, err
+				}
+
+				wait := autorest.GetRetryAfter(resp, delay)
+				if wait > transientErrorRetryMaxDelay {
+					wait = transientErrorRetryMaxDelay
+				}
+				log.Printf("[DEBUG] AzureRM %s %s returned %s, retrying in %s (attempt %d of %d)", r.Method, r.URL, resp.Status, wait, attempt, transientErrorRetryAttempts)
+
+				select {
+				case <-time.After(wait):
+				case <-r.Cancel:
+					return resp, err
+				}
+				autorest.Respond(resp, autorest.ByClosing())
+
+				if delay *= 2; delay > transientErrorRetryMaxDelay {
+					delay = transientErrorRetryMaxDelay
+				}
+			}
+		})
+	}
+}
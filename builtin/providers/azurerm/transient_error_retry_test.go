@@ -0,0 +1,98 @@
+package azurerm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/go-autorest/autorest"
+)
+
+func testTransientErrorRetryClient(baseURI string) compute.VirtualMachineExtensionsClient {
+	client := compute.NewVirtualMachineExtensionsClientWithBaseURI(baseURI, "00000000-0000-0000-0000-000000000000")
+	client.Sender = autorest.CreateSender(withTransientErrorRetry())
+	// the SDK's own retries wait 30 seconds
+	client.RetryAttempts, client.RetryDuration = 0, 0
+	return client
+}
+
+func TestWithTransientErrorRetry(t *testing.T) {
+	// without honouring the `Retry-After`, the test times out
+	defer func(delay, maxDelay time.Duration) {
+		transientErrorRetryDelay, transientErrorRetryMaxDelay = delay, maxDelay
+	}(transientErrorRetryDelay, transientErrorRetryMaxDelay)
+	transientErrorRetryDelay, transientErrorRetryMaxDelay = time.Hour, time.Hour
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		body, _ := ioutil.ReadAll(r.Body)
+		if len(body) == 0 {
+			t.Errorf("Expected the request body to be sent with every attempt")
+		}
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"error":{"code":"TooManyRequests","message":"The request is being throttled."}}`)
+			return
+		}
+		fmt.Fprint(w, `{"name":"hostname","properties":{"provisioningState":"Succeeded"}}`)
+	}))
+	defer server.Close()
+
+	client := testTransientErrorRetryClient(server.URL)
+	if _, err := client.CreateOrUpdate("acctestRG", "acctvm", "hostname", compute.VirtualMachineExtension{}, nil); err != nil {
+		t.Fatalf("Expected the request to succeed once it's no longer throttled, got: %s", err)
+	}
+	if requests != 3 {
+		t.Fatalf("Expected 3 requests, got %d", requests)
+	}
+}
+
+func TestWithTransientErrorRetry_notRetried(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error":{"code":"NotFound","message":"The entity was not found."}}`)
+	}))
+	defer server.Close()
+
+	client := testTransientErrorRetryClient(server.URL)
+	resp, err := client.Get("acctestRG", "acctvm", "hostname", "")
+	if err == nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected the 404 to be returned, got %d: %v", resp.StatusCode, err)
+	}
+	if requests != 1 {
+		t.Fatalf("Expected the 404 not to be retried, got %d requests", requests)
+	}
+}
+
+func TestWithTransientErrorRetry_budget(t *testing.T) {
+	defer func(attempts int) { transientErrorRetryAttempts = attempts }(transientErrorRetryAttempts)
+	transientErrorRetryAttempts = 3
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, `{"error":{"code":"ServiceUnavailable","message":"The service is unavailable."}}`)
+	}))
+	defer server.Close()
+
+	client := testTransientErrorRetryClient(server.URL)
+	if _, err := client.Delete("acctestRG", "acctvm", "hostname", nil); err == nil {
+		t.Fatalf("Expected an error once the retries are exhausted")
+	}
+	if requests != 3 {
+		t.Fatalf("Expected 3 attempts, got %d", requests)
+	}
+}
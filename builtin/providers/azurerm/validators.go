@@ -1,21 +1,82 @@
 package azurerm
 
 import (
+	"encoding/json"
 	"fmt"
+	"time"
 
+	"github.com/hashicorp/go-version"
+	"github.com/hashicorp/terraform/helper/schema"
 	"github.com/satori/uuid"
 )
 
 func validateJsonString(v interface{}, k string) (ws []string, errors []error) {
 	if _, err := normalizeJsonString(v); err != nil {
-		errors = append(errors, fmt.Errorf("%q contains an invalid JSON: %s", k, err))
+		errors = append(errors, fmt.Errorf("%q contains an invalid JSON: %s", k, describeJsonError(v.(string), err)))
 	}
 	return
 }
 
+// describeJsonError adds the line and column of the error to its message,
+// since encoding/json only records the byte offset, which is hard to find in
+// a large heredoc.
+func describeJsonError(jsonString string, err error) string {
+	var offset int64
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+	default:
+		return err.Error()
+	}
+
+	// the offset is that of the byte after the one in error
+	if offset > int64(len(jsonString)) {
+		offset = int64(len(jsonString))
+	}
+	line, column := 1, 1
+	for _, c := range jsonString[:offset-1] {
+		if c == '\n' {
+			line, column = line+1, 1
+		} else {
+			column++
+		}
+	}
+
+	return fmt.Sprintf("%s (at line %d, column %d)", err, line, column)
+}
+
 func validateUUID(v interface{}, k string) (ws []string, errors []error) {
 	if _, err := uuid.FromString(v.(string)); err != nil {
 		errors = append(errors, fmt.Errorf("%q is an invalid UUUID: %s", k, err))
 	}
 	return
 }
+
+func validateDuration(v interface{}, k string) (ws []string, errors []error) {
+	return validateDurationAtMost(0)(v, k)
+}
+
+// validateDurationAtMost validates a non-negative duration such as `30s`. A
+// max of zero means the duration is unbounded.
+func validateDurationAtMost(max time.Duration) schema.SchemaValidateFunc {
+	return func(v interface{}, k string) (ws []string, errors []error) {
+		duration, err := time.ParseDuration(v.(string))
+		if err != nil {
+			errors = append(errors, fmt.Errorf("%q is an invalid duration: %s", k, err))
+		} else if duration < 0 {
+			errors = append(errors, fmt.Errorf("%q cannot be negative", k))
+		} else if max > 0 && duration > max {
+			errors = append(errors, fmt.Errorf("%q cannot be longer than %s", k, max))
+		}
+		return
+	}
+}
+
+func validateVersion(v interface{}, k string) (ws []string, errors []error) {
+	if _, err := version.NewVersion(v.(string)); err != nil {
+		errors = append(errors, fmt.Errorf("%q is an invalid version: %s", k, err))
+	}
+	return
+}
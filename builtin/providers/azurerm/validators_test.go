@@ -1,6 +1,10 @@
 package azurerm
 
-import "testing"
+import (
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestValidateJsonString(t *testing.T) {
 	type testCases struct {
@@ -56,3 +60,81 @@ func TestValidateJsonString(t *testing.T) {
 		}
 	}
 }
+
+func TestValidateJsonString_position(t *testing.T) {
+	cases := []struct {
+		Value    string
+		Position string
+	}{
+		{Value: `{"def":}`, Position: "line 1, column 8"},
+		{Value: "{\n  \"a\": 1,\n  \"b\": tru\n}", Position: "line 3, column 11"},
+		{Value: `{"abc":`, Position: "line 1, column 7"},
+	}
+
+	for _, tc := range cases {
+		_, errors := validateJsonString(tc.Value, "json")
+		if len(errors) != 1 || !strings.Contains(errors[0].Error(), tc.Position) {
+			t.Fatalf("Expected the error for %q to point at %s, got %v", tc.Value, tc.Position, errors)
+		}
+	}
+}
+
+func TestValidateDuration(t *testing.T) {
+	cases := []struct {
+		Value    string
+		ErrCount int
+	}{
+		{Value: "1h", ErrCount: 0},
+		{Value: "90m", ErrCount: 0},
+		{Value: "0", ErrCount: 0},
+		{Value: "-1h", ErrCount: 1},
+		{Value: "an hour", ErrCount: 1},
+	}
+
+	for _, tc := range cases {
+		_, errors := validateDuration(tc.Value, "extension_image_cache_ttl")
+		if len(errors) != tc.ErrCount {
+			t.Fatalf("Expected validateDuration to trigger %d error(s) for %q, got %d", tc.ErrCount, tc.Value, len(errors))
+		}
+	}
+}
+
+func TestValidateDurationAtMost(t *testing.T) {
+	cases := []struct {
+		Value    string
+		ErrCount int
+	}{
+		{Value: "0s", ErrCount: 0},
+		{Value: "30m", ErrCount: 0},
+		{Value: "31m", ErrCount: 1},
+		{Value: "-1s", ErrCount: 1},
+		{Value: "soon", ErrCount: 1},
+	}
+
+	for _, tc := range cases {
+		_, errors := validateDurationAtMost(30*time.Minute)(tc.Value, "create_delay")
+		if len(errors) != tc.ErrCount {
+			t.Fatalf("Expected validateDurationAtMost to trigger %d error(s) for %q, got %d", tc.ErrCount, tc.Value, len(errors))
+		}
+	}
+}
+
+func TestValidateVersion(t *testing.T) {
+	cases := []struct {
+		Value    string
+		ErrCount int
+	}{
+		{Value: "2.0", ErrCount: 0},
+		{Value: "1.10.3", ErrCount: 0},
+		{Value: "2", ErrCount: 0},
+		{Value: "latest", ErrCount: 1},
+		{Value: "", ErrCount: 1},
+	}
+
+	for _, tc := range cases {
+		_, errors := validateVersion(tc.Value, "minimum_version_floor")
+		if len(errors) != tc.ErrCount {
+			t.Fatalf("Expected validateVersion to trigger %d error(s) for %q, got %d", tc.ErrCount, tc.Value, len(errors))
+		}
+	}
+}
@@ -0,0 +1,1163 @@
+package azurerm
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/hashicorp/terraform/helper/resource"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// guestAgentReadyTimeout bounds how long we wait for the VM Agent to report
+// ready before retrying an extension which failed because it wasn't.
+const guestAgentReadyTimeout = 10 * time.Minute
+
+// guestAgentReadyPollInterval is how often the VM instance view is polled
+// while waiting for the VM Agent, overridden in tests.
+var guestAgentReadyPollInterval = 15 * time.Second
+
+// extensionProvisioningTimeout bounds how long we wait for an extension to
+// leave the Creating/Updating provisioning states once Azure accepted it.
+const extensionProvisioningTimeout = 30 * time.Minute
+
+// extensionProvisioningPollInterval is how often the extension is polled
+// while it's provisioning, overridden in tests.
+var extensionProvisioningPollInterval = 15 * time.Second
+
+// redactedValue replaces secrets in the `resource_json` attribute.
+const redactedValue = "REDACTED"
+
+// defaultForbiddenSecretPatterns are matched against the keys and string
+// values of the plaintext `settings` when `forbid_secrets_in_settings` is
+// enabled without an explicit `forbid_secret_patterns` list.
+var defaultForbiddenSecretPatterns = []string{
+	`(?i)password`,
+	`(?i)secret`,
+	`(?i)(access|account|storage)_?key`,
+	`(?i)AccountKey=`,
+	`(?i)SharedAccessSignature|[?&]sig=`,
+	`-----BEGIN [A-Z ]*PRIVATE KEY-----`,
+}
+
+// defaultMutuallyExclusiveSettingsKeys are the groups of settings keys, keyed
+// by `publisher/type` (lowercased), of which extensions accept only one.
+var defaultMutuallyExclusiveSettingsKeys = map[string][][]string{
+	"microsoft.azure.extensions/customscript": {
+		{"commandToExecute", "script"},
+	},
+}
+
+// defaultUnorderedSettingsArrayKeys are the arrays of settings, keyed by
+// `publisher/type` (lowercased), whose order is insignificant to the
+// extension, in the form of `unordered_settings_array_keys`. Keys such as
+// `commandToExecute` stay order-sensitive.
+var defaultUnorderedSettingsArrayKeys = map[string]map[string]string{
+	"microsoft.azure.extensions/customscript":       {"fileUris": ""},
+	"microsoft.compute/customscriptextension":       {"fileUris": ""},
+	"microsoft.ostcextensions/customscriptforlinux": {"fileUris": ""},
+}
+
+// osSpecificSettingsKeys are the top-level settings keys, keyed by
+// `publisher/type` (lowercased), which are only valid on VMs of the given OS.
+var osSpecificSettingsKeys = map[string]map[string]compute.OperatingSystemTypes{
+	"microsoft.azure.extensions/customscript": {
+		"script":       compute.Linux,
+		"skipDos2Unix": compute.Linux,
+	},
+}
+
+// settingsNotReturnedExtensionTypes are the extension types, keyed by
+// `publisher/type` (lowercased), which accept settings but never return them
+// from the API - like the protected settings of every extension. For these the
+// settings last applied are kept in the state.
+var settingsNotReturnedExtensionTypes = map[string]bool{
+	"microsoft.azure.networkwatcher/networkwatcheragentlinux":   true,
+	"microsoft.azure.networkwatcher/networkwatcheragentwindows": true,
+	"microsoft.compute/bginfo":                                  true,
+}
+
+// isArmVirtualMachineExtensionSettingsReturned returns whether the settings
+// in the response can be stored in the state, i.e. they were returned or the
+// extension type is expected to return them.
+func isArmVirtualMachineExtensionSettingsReturned(extension compute.VirtualMachineExtension) bool {
+	props := extension.VirtualMachineExtensionProperties
+	if props == nil || props.Settings == nil {
+		return false
+	}
+	if len(*props.Settings) > 0 || props.Publisher == nil || props.Type == nil {
+		return true
+	}
+
+	return !settingsNotReturnedExtensionTypes[strings.ToLower(fmt.Sprintf("%s/%s", *props.Publisher, *props.Type))]
+}
+
+// The tags added to extensions with the provider's `auto_tag_extension_metadata`.
+const (
+	extensionPublisherTag = "tf-extension-publisher"
+	extensionTypeTag      = "tf-extension-type"
+	extensionVersionTag   = "tf-extension-version"
+)
+
+// expandArmVirtualMachineExtensionMetadataTags adds the metadata tags to the
+// tags of the extension, without overwriting any tags of the same name.
+func expandArmVirtualMachineExtensionMetadataTags(tags *map[string]*string, publisher, extensionType, typeHandlerVersion string) {
+	metadata := map[string]string{
+		extensionPublisherTag: publisher,
+		extensionTypeTag:      extensionType,
+		extensionVersionTag:   typeHandlerVersion,
+	}
+
+	for k, v := range metadata {
+		if _, ok := (*tags)[k]; !ok {
+			value := v
+			(*tags)[k] = &value
+		}
+	}
+}
+
+// flattenArmVirtualMachineExtensionMetadataTags removes the metadata tags
+// which aren't configured from the returned tags, so that they're never a diff.
+func flattenArmVirtualMachineExtensionMetadataTags(tags *map[string]*string, configured map[string]interface{}) *map[string]*string {
+	if tags == nil {
+		return nil
+	}
+
+	output := make(map[string]*string, len(*tags))
+	for k, v := range *tags {
+		switch k {
+		case extensionPublisherTag, extensionTypeTag, extensionVersionTag:
+			if _, ok := configured[k]; !ok {
+				continue
+			}
+		}
+		output[k] = v
+	}
+
+	return &output
+}
+
+// defaultReservedExtensionNames are the names of extensions which Azure
+// services (such as Security Center) install on VMs themselves, and so which
+// conflict with extensions created under the same name. These can be
+// overridden with a comma-separated list in reservedExtensionNamesEnvVar.
+var defaultReservedExtensionNames = []string{
+	"AzureMonitorLinuxAgent",
+	"AzureMonitorWindowsAgent",
+	"AzureNetworkWatcherExtension",
+	"AzurePolicyforLinux",
+	"AzurePolicyforWindows",
+	"AzureSecurityLinuxAgent",
+	"AzureSecurityWindowsAgent",
+	"DependencyAgentLinux",
+	"DependencyAgentWindows",
+	"IaaSAntimalware",
+	"MDE.Linux",
+	"MDE.Windows",
+	"MicrosoftMonitoringAgent",
+	"OmsAgentForLinux",
+}
+
+const reservedExtensionNamesEnvVar = "ARM_RESERVED_EXTENSION_NAMES"
+
+func reservedArmVirtualMachineExtensionNames() []string {
+	v, ok := os.LookupEnv(reservedExtensionNamesEnvVar)
+	if !ok {
+		return defaultReservedExtensionNames
+	}
+
+	names := make([]string, 0)
+	for _, name := range strings.Split(v, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// validateArmVirtualMachineExtensionName warns (rather than fails, since the
+// conflict depends on which Azure services are enabled) when the name is one
+// used by an Azure-managed extension.
+func validateArmVirtualMachineExtensionName(v interface{}, k string) (ws []string, errors []error) {
+	name := v.(string)
+	for _, reserved := range reservedArmVirtualMachineExtensionNames() {
+		if strings.EqualFold(name, reserved) {
+			ws = append(ws, fmt.Sprintf("%q: %q is the name of an extension managed by Azure, which may replace (or conflict with) this one - consider using a different name", k, name))
+			return
+		}
+	}
+	return
+}
+
+// typeHandlerVersionRegexp matches the `major.minor` (optionally `.build`)
+// versions Azure accepts, where some publishers also accept a wildcard for
+// the last part, such as `2.*`.
+var typeHandlerVersionRegexp = regexp.MustCompile(`^[0-9]+\.(\*|[0-9]+(\.(\*|[0-9]+))?)$`)
+
+func validateArmVirtualMachineExtensionTypeHandlerVersion(v interface{}, k string) (ws []string, errors []error) {
+	value := v.(string)
+	if !typeHandlerVersionRegexp.MatchString(value) {
+		errors = append(errors, fmt.Errorf("%q must be a version of the form `major.minor` (such as `2.0`, or `2.*`), got %q", k, value))
+	}
+	return
+}
+
+// isArmVirtualMachineExtensionVersionBuildPinned returns whether the version
+// pins a build (such as `2.0.1`), which can't be combined with automatic minor
+// version upgrades.
+func isArmVirtualMachineExtensionVersionBuildPinned(typeHandlerVersion string) bool {
+	parts := strings.Split(typeHandlerVersion, ".")
+	return len(parts) == 3 && parts[2] != "*"
+}
+
+// validateArmVirtualMachineExtensionMutuallyExclusiveKeys checks that at most
+// one key of each group is present across the top level of the given settings
+// (i.e. a key can't be in `settings` while another is in `protected_settings`).
+func validateArmVirtualMachineExtensionMutuallyExclusiveKeys(groups [][]string, settings ...*map[string]interface{}) error {
+	for _, group := range groups {
+		present := make([]string, 0)
+		for _, key := range group {
+			for _, s := range settings {
+				if s == nil {
+					continue
+				}
+				if _, ok := (*s)[key]; ok {
+					present = append(present, key)
+					break
+				}
+			}
+		}
+
+		if len(present) > 1 {
+			return fmt.Errorf("Only one of the settings keys %q can be specified, but found %q", group, present)
+		}
+	}
+
+	return nil
+}
+
+// validateArmVirtualMachineExtensionOSSpecificKeys checks that none of the
+// top-level keys of the given settings are only valid on another OS than the
+// VM's osType. Nothing is checked when the OS type isn't known.
+func validateArmVirtualMachineExtensionOSSpecificKeys(keys map[string]compute.OperatingSystemTypes, osType string, settings ...*map[string]interface{}) error {
+	if osType == "" {
+		return nil
+	}
+
+	for _, s := range settings {
+		if s == nil {
+			continue
+		}
+		for key := range *s {
+			if keyOSType, ok := keys[key]; ok && !strings.EqualFold(string(keyOSType), osType) {
+				return fmt.Errorf("The settings key %q is only valid on %s Virtual Machines, but the Virtual Machine is %s", key, keyOSType, osType)
+			}
+		}
+	}
+
+	return nil
+}
+
+// settingsEnvToken matches the `${env:VAR}` tokens substituted in settings
+// when `settings_env_substitution` is enabled.
+var settingsEnvToken = regexp.MustCompile(`\$\{env:([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// defaultExtensionSettingsSizeLimit is the size (in bytes) of the serialized
+// settings, and separately the protected settings, Azure accepts.
+const defaultExtensionSettingsSizeLimit = 65536
+
+// validateArmVirtualMachineExtensionSettingsSize returns an error when the
+// serialized settings exceed limit bytes, which Azure otherwise rejects with
+// an error that doesn't mention the size.
+func validateArmVirtualMachineExtensionSettingsSize(key string, settings *map[string]interface{}, limit int) error {
+	if settings == nil {
+		return nil
+	}
+
+	serialized, err := json.Marshal(*settings)
+	if err != nil {
+		return fmt.Errorf("Error serializing `%s`: %s", key, err)
+	}
+	if len(serialized) <= limit {
+		return nil
+	}
+
+	return fmt.Errorf("The serialized `%s` are %d bytes, which exceeds the limit of %d bytes for Virtual Machine Extensions. Rather than passing large content inline, store it in a storage account and download it with `fileUris`. The limit can be changed with the provider's `extension_settings_size_limit`.", key, len(serialized), limit)
+}
+
+// substituteArmVirtualMachineExtensionSettingsEnv replaces the `${env:VAR}`
+// tokens in the string values of the settings with the value of the
+// environment variable. Since only string values are substituted (after the
+// settings have been parsed) the result is always valid JSON, whatever the
+// value contains. It's an error for a referenced variable to be unset.
+func substituteArmVirtualMachineExtensionSettingsEnv(settings map[string]interface{}) (map[string]interface{}, error) {
+	missing := make(map[string]bool)
+	result := substituteArmVirtualMachineExtensionSettingsTokens(settings, settingsEnvToken, os.LookupEnv, missing)
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("the environment variable(s) %s are not set", joinSortedArmVirtualMachineExtensionTokenNames(missing))
+	}
+
+	return result.(map[string]interface{}), nil
+}
+
+// substituteArmVirtualMachineExtensionSettingsTokens replaces the tokens
+// matched by token (whose first group is the name looked up) in the string
+// values, recording the names lookup doesn't know in missing.
+func substituteArmVirtualMachineExtensionSettingsTokens(value interface{}, token *regexp.Regexp, lookup func(string) (string, bool), missing map[string]bool) interface{} {
+	switch v := value.(type) {
+	case string:
+		return token.ReplaceAllStringFunc(v, func(match string) string {
+			name := token.FindStringSubmatch(match)[1]
+			replacement, ok := lookup(name)
+			if !ok {
+				missing[name] = true
+			}
+			return replacement
+		})
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, inner := range v {
+			result[key] = substituteArmVirtualMachineExtensionSettingsTokens(inner, token, lookup, missing)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, inner := range v {
+			result[i] = substituteArmVirtualMachineExtensionSettingsTokens(inner, token, lookup, missing)
+		}
+		return result
+	default:
+		return v
+	}
+}
+
+func joinSortedArmVirtualMachineExtensionTokenNames(names map[string]bool) string {
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return strings.Join(sorted, ", ")
+}
+
+// armVirtualMachineExtensionSettingsTemplateMatches returns whether the
+// settings template, once substituted (with the environment when envSubstitution
+// is set, and with the resolved vmAttributes), is semantically equal to the
+// applied settings. Any failure (such as a variable no longer being set) is
+// treated as a mismatch.
+func armVirtualMachineExtensionSettingsTemplateMatches(template, applied string, envSubstitution bool, vmAttributes map[string]string) bool {
+	if template == "" {
+		return false
+	}
+
+	substituted, err := expandArmVirtualMachineExtensionSettings(template)
+	if err != nil {
+		return false
+	}
+
+	if envSubstitution {
+		if substituted, err = substituteArmVirtualMachineExtensionSettingsEnv(substituted); err != nil {
+			log.Printf("[DEBUG] Unable to compare the settings template to the applied settings: %s", err)
+			return false
+		}
+	}
+	if len(vmAttributes) > 0 {
+		if substituted, err = substituteArmVirtualMachineExtensionSettingsVMAttributes(substituted, vmAttributes); err != nil {
+			log.Printf("[DEBUG] Unable to compare the settings template to the applied settings: %s", err)
+			return false
+		}
+	}
+
+	expected, err := json.Marshal(canonicalizeArmVirtualMachineExtensionSettingsNumbers(substituted))
+	if err != nil {
+		return false
+	}
+
+	actual, err := canonicalizeArmVirtualMachineExtensionSettings(applied)
+	if err != nil {
+		return false
+	}
+
+	return string(expected) == actual
+}
+
+func validateRegexp(v interface{}, k string) (ws []string, errors []error) {
+	if _, err := regexp.Compile(v.(string)); err != nil {
+		errors = append(errors, fmt.Errorf("%q contains an invalid regular expression: %s", k, err))
+	}
+	return
+}
+
+// findArmVirtualMachineExtensionSettingsSecrets returns the (dotted) paths of
+// the settings whose key or string value matches one of the patterns. The
+// matched values themselves are deliberately not returned so they can't leak
+// into error messages or logs.
+func findArmVirtualMachineExtensionSettingsSecrets(settings map[string]interface{}, patterns []*regexp.Regexp) []string {
+	matches := make([]string, 0)
+	walkArmVirtualMachineExtensionSettings("", "", settings, func(path, key string, value interface{}) {
+		s, isString := value.(string)
+		for _, pattern := range patterns {
+			if pattern.MatchString(key) || (isString && pattern.MatchString(s)) {
+				matches = append(matches, path)
+				return
+			}
+		}
+	})
+
+	sort.Strings(matches)
+	return matches
+}
+
+// secretLookingSettingsKeyRegexp matches the keys of settings which are likely
+// to hold a secret, such as `adminPassword` or `storageAccountKey`.
+var secretLookingSettingsKeyRegexp = regexp.MustCompile(`(?i)password|secret|key|token`)
+
+// validateArmVirtualMachineExtensionPlaintextSettings validates the settings
+// are a JSON object, and warns (without blocking the apply) about keys which
+// look like they hold secrets, which `protected_settings` keeps out of the
+// plan output and logs. Only the paths of the keys are reported, never their
+// values.
+func validateArmVirtualMachineExtensionPlaintextSettings(v interface{}, k string) (ws []string, errors []error) {
+	if ws, errors = validateArmVirtualMachineExtensionSettingsObject(v, k); len(errors) > 0 || v.(string) == "" {
+		return
+	}
+
+	settings, err := expandArmVirtualMachineExtensionSettings(v.(string))
+	if err != nil {
+		return
+	}
+
+	paths := make([]string, 0)
+	walkArmVirtualMachineExtensionSettings("", "", settings, func(path, key string, value interface{}) {
+		if secretLookingSettingsKeyRegexp.MatchString(path) {
+			paths = append(paths, path)
+		}
+	})
+	if len(paths) > 0 {
+		sort.Strings(paths)
+		ws = append(ws, fmt.Sprintf("%q: the key(s) %s look like they hold secrets, which are shown in the plan and stored in plain text - consider moving them to `protected_settings`", k, strings.Join(paths, ", ")))
+	}
+	return
+}
+
+func validateArmVirtualMachineExtensionSettingsSecrets(settings map[string]interface{}, rawPatterns []string) error {
+	patterns := make([]*regexp.Regexp, 0, len(rawPatterns))
+	for _, raw := range rawPatterns {
+		pattern, err := regexp.Compile(raw)
+		if err != nil {
+			return fmt.Errorf("Error compiling secret pattern %q: %s", raw, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+
+	if matches := findArmVirtualMachineExtensionSettingsSecrets(settings, patterns); len(matches) > 0 {
+		return fmt.Errorf("`settings` appears to contain secrets in the key(s) %s - these should be moved to `protected_settings`", strings.Join(matches, ", "))
+	}
+
+	return nil
+}
+
+// mergeArmVirtualMachineExtensionSettings deep-merges the overrides into (a
+// copy of) the base: objects present in both are merged recursively, any other
+// value (including arrays) in the overrides replaces the one in the base.
+func mergeArmVirtualMachineExtensionSettings(base, overrides map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(base)+len(overrides))
+	for k, v := range base {
+		merged[k] = v
+	}
+
+	for k, override := range overrides {
+		baseMap, baseIsMap := merged[k].(map[string]interface{})
+		overrideMap, overrideIsMap := override.(map[string]interface{})
+		if baseIsMap && overrideIsMap {
+			merged[k] = mergeArmVirtualMachineExtensionSettings(baseMap, overrideMap)
+			continue
+		}
+		merged[k] = override
+	}
+
+	return merged
+}
+
+// walkArmVirtualMachineExtensionSettings calls fn for every leaf value in the
+// settings, along with its dotted path and the name of the key holding it.
+// Array elements are addressed by index and inherit the key of the array.
+func walkArmVirtualMachineExtensionSettings(path, key string, value interface{}, fn func(path, key string, value interface{})) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, inner := range v {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			walkArmVirtualMachineExtensionSettings(p, k, inner, fn)
+		}
+	case []interface{}:
+		for i, inner := range v {
+			walkArmVirtualMachineExtensionSettings(fmt.Sprintf("%s.%d", path, i), key, inner, fn)
+		}
+	default:
+		fn(path, key, v)
+	}
+}
+
+// flattenArmVirtualMachineExtensionResourceJSON encodes the extension as
+// returned by the API for the `resource_json` attribute. The values of the
+// protected settings are redacted (keeping the keys, so it's visible what was
+// set), as are the status messages in the instance view, since these commonly
+// contain the output of scripts run by the extension.
+func flattenArmVirtualMachineExtensionResourceJSON(extension compute.VirtualMachineExtension) (string, error) {
+	if props := extension.VirtualMachineExtensionProperties; props != nil {
+		redacted := *props
+
+		if props.ProtectedSettings != nil {
+			protectedSettings := make(map[string]interface{}, len(*props.ProtectedSettings))
+			for k := range *props.ProtectedSettings {
+				protectedSettings[k] = redactedValue
+			}
+			redacted.ProtectedSettings = &protectedSettings
+		}
+
+		if props.InstanceView != nil {
+			instanceView := *props.InstanceView
+			instanceView.Statuses = redactArmInstanceViewStatusMessages(props.InstanceView.Statuses)
+			instanceView.Substatuses = redactArmInstanceViewStatusMessages(props.InstanceView.Substatuses)
+			redacted.InstanceView = &instanceView
+		}
+
+		extension.VirtualMachineExtensionProperties = &redacted
+	}
+
+	result, err := json.Marshal(extension)
+	if err != nil {
+		return "", err
+	}
+
+	return string(result), nil
+}
+
+func redactArmInstanceViewStatusMessages(statuses *[]compute.InstanceViewStatus) *[]compute.InstanceViewStatus {
+	if statuses == nil {
+		return nil
+	}
+
+	redacted := make([]compute.InstanceViewStatus, 0, len(*statuses))
+	for _, status := range *statuses {
+		if status.Message != nil {
+			message := redactedValue
+			status.Message = &message
+		}
+		redacted = append(redacted, status)
+	}
+
+	return &redacted
+}
+
+// createArmVirtualMachineExtension creates (or updates) the extension. When
+// retryAfterGuestAgentReady is set and Azure rejects the extension because the
+// VM Agent isn't ready yet, this waits (up to timeout, or until the deadline
+// when sooner) for the agent to report ready and retries the request once. With the provider's
+// `fail_fast_on_extension_error` set, the first failure cancels any other
+// extension operations in progress and fails those not yet started. Errors
+// with one of the provider's `non_fatal_error_codes` are ignored once the
+// extension provisions, which is waited for until the deadline (when set). It
+// holds one of the provider's
+// `max_concurrent_extension_operations` until done, after waiting for any
+// other extension operation on the same Virtual Machine. Closing cancel
+// (which can be nil) stops waiting for the operation, e.g. once the
+// resource's timeout is exceeded.
+func createArmVirtualMachineExtension(client *ArmClient, resGroup, vmName, name string, extension compute.VirtualMachineExtension, orderedSettings json.RawMessage, retryAfterGuestAgentReady bool, timeout time.Duration, deadline time.Time, cancel <-chan struct{}) error {
+	if err := client.extensionFailFast.err(); err != nil {
+		return err
+	}
+
+	// locked first, so that an operation waiting for the VM doesn't hold one
+	// of the operations other VMs could use
+	lockKey := armVirtualMachineExtensionsLockKey(resGroup, vmName)
+	armMutexKV.Lock(lockKey)
+	defer armMutexKV.Unlock(lockKey)
+
+	client.extensionOperations.acquire()
+	defer client.extensionOperations.release()
+
+	cancel, stop := mergeArmCancelChannels(cancel, client.extensionFailFast.cancel())
+	defer stop()
+
+	if !deadline.IsZero() && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	err := createArmVirtualMachineExtensionWithRetry(client, resGroup, vmName, name, extension, orderedSettings, retryAfterGuestAgentReady, timeout, cancel)
+	if err != nil {
+		err = ignoreArmNonFatalVirtualMachineExtensionError(client, resGroup, vmName, name, err, deadline, cancel)
+	}
+	if err != nil {
+		client.extensionFailFast.fail(fmt.Errorf("Virtual Machine Extension %q on Virtual Machine %q failed: %s", name, vmName, err))
+	}
+
+	return err
+}
+
+// validateArmVirtualMachineID checks `virtual_machine_id` is the ID of a
+// Virtual Machine, rather than that of e.g. one of its extensions.
+func validateArmVirtualMachineID(v interface{}, k string) (ws []string, errors []error) {
+	id, err := parseAzureResourceID(v.(string))
+	if err != nil {
+		errors = append(errors, fmt.Errorf("%q must be the ID of a Virtual Machine: %s", k, err))
+		return
+	}
+	if !strings.EqualFold(id.Provider, "Microsoft.Compute") || id.Path["virtualMachines"] == "" || len(id.Path) != 1 {
+		errors = append(errors, fmt.Errorf("%q must be the ID of a Virtual Machine, such as /subscriptions/<subscription>/resourceGroups/<group>/providers/Microsoft.Compute/virtualMachines/<name>, got %q", k, v.(string)))
+	}
+	return
+}
+
+// armVirtualMachineID returns the ID of the Virtual Machine vmName.
+func armVirtualMachineID(subscriptionID, resGroup, vmName string) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachines/%s", subscriptionID, resGroup, vmName)
+}
+
+// armVirtualMachineExtensionVirtualMachine returns the resource group and name
+// of the Virtual Machine the Extension is on, from either `virtual_machine_id`
+// or `resource_group_name` and `virtual_machine_name`.
+func armVirtualMachineExtensionVirtualMachine(d *schema.ResourceData) (string, string, error) {
+	if v := d.Get("virtual_machine_id").(string); v != "" {
+		id, err := parseAzureResourceID(v)
+		if err != nil {
+			return "", "", fmt.Errorf("Error parsing `virtual_machine_id`: %s", err)
+		}
+		return id.ResourceGroup, id.Path["virtualMachines"], nil
+	}
+
+	resGroup := d.Get("resource_group_name").(string)
+	vmName := d.Get("virtual_machine_name").(string)
+	if resGroup == "" || vmName == "" {
+		return "", "", fmt.Errorf("Either `virtual_machine_id` or both `resource_group_name` and `virtual_machine_name` must be set")
+	}
+	return resGroup, vmName, nil
+}
+
+// setArmVirtualMachineExtensionVirtualMachine sets the attributes identifying
+// the Virtual Machine, whichever of them was configured.
+func setArmVirtualMachineExtensionVirtualMachine(d *schema.ResourceData, subscriptionID, resGroup, vmName string) {
+	d.Set("resource_group_name", resGroup)
+	d.Set("virtual_machine_name", vmName)
+	d.Set("virtual_machine_id", armVirtualMachineID(subscriptionID, resGroup, vmName))
+}
+
+// armVirtualMachineExtensionsLockKey returns the armMutexKV key serializing
+// the extension operations on a Virtual Machine, which Azure otherwise
+// rejects with a conflict when they're sent concurrently.
+func armVirtualMachineExtensionsLockKey(resGroup, vmName string) string {
+	return fmt.Sprintf("%s/virtualMachines/%s", resGroup, vmName)
+}
+
+// mergeArmCancelChannels returns a channel closed once either a or b is,
+// until stop is called. Nil channels are never closed.
+func mergeArmCancelChannels(a, b <-chan struct{}) (<-chan struct{}, func()) {
+	merged, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		select {
+		case <-a:
+			close(merged)
+		case <-b:
+			close(merged)
+		case <-stopped:
+		}
+	}()
+
+	var once sync.Once
+	return merged, func() { once.Do(func() { close(stopped) }) }
+}
+
+// ignoreArmNonFatalVirtualMachineExtensionError returns nil when the code of
+// err is one of the provider's `non_fatal_error_codes` and the extension went
+// on to provision successfully regardless, or err otherwise. It waits until
+// the deadline (or, when that's zero, for extensionProvisioningTimeout), or
+// until cancel is closed.
+func ignoreArmNonFatalVirtualMachineExtensionError(client *ArmClient, resGroup, vmName, name string, err error, deadline time.Time, cancel <-chan struct{}) error {
+	code, _ := flattenArmVirtualMachineExtensionError(err, nil)
+	if !isArmNonFatalErrorCode(client.nonFatalErrorCodes, code) {
+		return err
+	}
+
+	log.Printf("[WARN] Virtual Machine Extension %q on Virtual Machine %q returned the non-fatal error code %q, waiting for it to provision: %s", name, vmName, code, err)
+	timeout := extensionProvisioningTimeout
+	if !deadline.IsZero() {
+		timeout = time.Until(deadline)
+	}
+	if waitErr := waitForArmVirtualMachineExtensionProvisioned(client, resGroup, vmName, name, timeout, cancel); waitErr != nil {
+		return fmt.Errorf("%s\n\nThe error code %q is in the provider's `non_fatal_error_codes`, but the Extension wasn't provisioned: %s", err, code, waitErr)
+	}
+
+	return nil
+}
+
+// isArmNonFatalErrorCode returns whether code is one of codes, ignoring case.
+func isArmNonFatalErrorCode(codes []string, code string) bool {
+	if code == "" {
+		return false
+	}
+	for _, c := range codes {
+		if strings.EqualFold(c, code) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func createArmVirtualMachineExtensionWithRetry(client *ArmClient, resGroup, vmName, name string, extension compute.VirtualMachineExtension, orderedSettings json.RawMessage, retryAfterGuestAgentReady bool, timeout time.Duration, cancel <-chan struct{}) error {
+	err := createOrUpdateArmVirtualMachineExtension(client, resGroup, vmName, name, extension, orderedSettings, cancel)
+	if err != nil && isArmSoftDeletedNameInUseError(err) {
+		return fmt.Errorf("The name %q can't be used for an Extension on Virtual Machine %q yet: an Extension with this name was recently deleted and is retained (soft-deleted) by a policy on the subscription. Either wait for it to be purged, purge it manually, or use a different `name`.\n\n%s", name, vmName, err)
+	}
+	if err == nil || !retryAfterGuestAgentReady || !isArmGuestAgentNotReadyError(err) {
+		return err
+	}
+
+	log.Printf("[DEBUG] Waiting for the VM Agent on Virtual Machine %q (resource group %q) to become ready before retrying Extension %q", vmName, resGroup, name)
+	if waitErr := waitForArmGuestAgentReady(client, resGroup, vmName, timeout, cancel); waitErr != nil {
+		return fmt.Errorf("Error waiting for the VM Agent on Virtual Machine %q to become ready (%s) after creating Extension %q failed: %s", vmName, waitErr, name, err)
+	}
+
+	err = createOrUpdateArmVirtualMachineExtension(client, resGroup, vmName, name, extension, orderedSettings, cancel)
+	return err
+}
+
+// getArmVirtualMachineExtensionIfChanged retrieves the extension (with its
+// instance view). When etag is set it's sent as `If-None-Match`, and a 304
+// response returns notModified instead, so the caller can keep the state.
+// Closing cancel aborts the request.
+func getArmVirtualMachineExtensionIfChanged(client compute.VirtualMachineExtensionsClient, resGroup, vmName, name, etag string, cancel <-chan struct{}) (result compute.VirtualMachineExtension, notModified bool, err error) {
+	req, err := client.GetPreparer(resGroup, vmName, name, "instanceView")
+	if err != nil {
+		return result, false, autorest.NewErrorWithError(err, "compute.VirtualMachineExtensionsClient", "Get", nil, "Failure preparing request")
+	}
+	req.Cancel = cancel
+	if etag != "" {
+		if req, err = autorest.Prepare(req, autorest.WithHeader("If-None-Match", etag)); err != nil {
+			return result, false, autorest.NewErrorWithError(err, "compute.VirtualMachineExtensionsClient", "Get", nil, "Failure preparing request")
+		}
+	}
+
+	resp, err := client.GetSender(req)
+	if err != nil {
+		result.Response = autorest.Response{Response: resp}
+		return result, false, autorest.NewErrorWithError(err, "compute.VirtualMachineExtensionsClient", "Get", resp, "Failure sending request")
+	}
+
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		return result, true, nil
+	}
+
+	result, err = client.GetResponder(resp)
+	if err != nil {
+		err = autorest.NewErrorWithError(err, "compute.VirtualMachineExtensionsClient", "Get", resp, "Failure responding to request")
+	}
+
+	return result, false, err
+}
+
+// getArmVirtualMachine retrieves the Virtual Machine (with its instance view,
+// when expanded). Closing cancel aborts the request.
+func getArmVirtualMachine(client compute.VirtualMachinesClient, resGroup, vmName string, expand compute.InstanceViewTypes, cancel <-chan struct{}) (result compute.VirtualMachine, err error) {
+	req, err := client.GetPreparer(resGroup, vmName, expand)
+	if err != nil {
+		return result, autorest.NewErrorWithError(err, "compute.VirtualMachinesClient", "Get", nil, "Failure preparing request")
+	}
+	req.Cancel = cancel
+
+	resp, err := client.GetSender(req)
+	if err != nil {
+		result.Response = autorest.Response{Response: resp}
+		return result, autorest.NewErrorWithError(err, "compute.VirtualMachinesClient", "Get", resp, "Failure sending request")
+	}
+
+	result, err = client.GetResponder(resp)
+	if err != nil {
+		err = autorest.NewErrorWithError(err, "compute.VirtualMachinesClient", "Get", resp, "Failure responding to request")
+	}
+
+	return result, err
+}
+
+// extensionFailFast is shared by all extension operations in a provider
+// instance. Once enabled and failed, its cancel channel is closed, which
+// aborts the polling of in-flight operations, and err returns the failure
+// which caused it. A nil (or disabled) extensionFailFast never cancels.
+type extensionFailFast struct {
+	enabled bool
+
+	once    sync.Once
+	done    chan struct{}
+	lock    sync.RWMutex
+	failure error
+}
+
+func newExtensionFailFast(enabled bool) *extensionFailFast {
+	return &extensionFailFast{
+		enabled: enabled,
+		done:    make(chan struct{}),
+	}
+}
+
+func (f *extensionFailFast) cancel() <-chan struct{} {
+	if f == nil || !f.enabled {
+		return make(chan struct{})
+	}
+	return f.done
+}
+
+func (f *extensionFailFast) fail(err error) {
+	if f == nil || !f.enabled {
+		return
+	}
+
+	f.once.Do(func() {
+		f.lock.Lock()
+		f.failure = err
+		f.lock.Unlock()
+
+		log.Printf("[WARN] Cancelling in-flight Virtual Machine Extension operations since `fail_fast_on_extension_error` is set: %s", err)
+		close(f.done)
+	})
+}
+
+func (f *extensionFailFast) err() error {
+	if f == nil || !f.enabled {
+		return nil
+	}
+
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	if f.failure == nil {
+		return nil
+	}
+	return fmt.Errorf("Not deploying, since another Virtual Machine Extension failed and `fail_fast_on_extension_error` is set: %s", f.failure)
+}
+
+// extensionOperationLimiter is a semaphore shared by all extension operations
+// in a provider instance, bounding how many run at once independently of
+// Terraform's parallelism. A nil extensionOperationLimiter doesn't limit.
+type extensionOperationLimiter chan struct{}
+
+func newExtensionOperationLimiter(max int) extensionOperationLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return make(extensionOperationLimiter, max)
+}
+
+func (l extensionOperationLimiter) acquire() {
+	if l != nil {
+		l <- struct{}{}
+	}
+}
+
+func (l extensionOperationLimiter) release() {
+	if l != nil {
+		<-l
+	}
+}
+
+// armServiceErrorRegexp matches the code and message of a service error,
+// which is all that's left of it once e.g. a long running operation failed.
+var armServiceErrorRegexp = regexp.MustCompile(`Code="((?:[^"\\]|\\.)*)" Message="((?:[^"\\]|\\.)*)"`)
+
+// flattenArmVirtualMachineExtensionError returns the code and message of the
+// ARM error which caused the extension to fail, for the `last_error_code` and
+// `last_error_message` attributes. Errors which don't come from ARM have no
+// code and their message is used as is. The values of the protected settings
+// are redacted from the message, since extensions commonly echo them.
+func flattenArmVirtualMachineExtensionError(err error, protectedSettings *map[string]interface{}) (string, string) {
+	code, message := "", err.Error()
+
+	original := err
+	if detailed, ok := err.(autorest.DetailedError); ok && detailed.Original != nil {
+		original = detailed.Original
+	}
+
+	var serviceError *azure.ServiceError
+	switch e := original.(type) {
+	case azure.RequestError:
+		serviceError = e.ServiceError
+	case *azure.RequestError:
+		serviceError = e.ServiceError
+	}
+
+	if serviceError != nil {
+		code, message = serviceError.Code, serviceError.Message
+	} else if m := armServiceErrorRegexp.FindStringSubmatch(message); m != nil {
+		code = unquoteArmServiceErrorField(m[1])
+		message = unquoteArmServiceErrorField(m[2])
+	}
+
+	return code, redactArmVirtualMachineExtensionProtectedValues(message, protectedSettings)
+}
+
+// redactArmVirtualMachineExtensionProtectedValues replaces the (string) values
+// of the protected settings in message, since extensions commonly echo them.
+func redactArmVirtualMachineExtensionProtectedValues(message string, protectedSettings *map[string]interface{}) string {
+	if protectedSettings != nil {
+		walkArmVirtualMachineExtensionSettings("", "", *protectedSettings, func(path, key string, value interface{}) {
+			if s, ok := value.(string); ok && s != "" {
+				message = strings.Replace(message, s, redactedValue, -1)
+			}
+		})
+	}
+
+	return message
+}
+
+// extensionScriptOutputSizeLimit is the size (in bytes) `output` and
+// `error_output` are capped to, so that a chatty script doesn't bloat the
+// state.
+const extensionScriptOutputSizeLimit = 4096
+
+// flattenArmVirtualMachineExtensionScriptOutput returns the message of the
+// instance view substatus with the given code, in which the Custom Script
+// extensions report the stdout (or stderr) of the script. Only the end of
+// longer output is kept, since that's where a failure shows.
+func flattenArmVirtualMachineExtensionScriptOutput(instanceView *compute.VirtualMachineExtensionInstanceView, code string, protectedSettings *map[string]interface{}) string {
+	if instanceView == nil || instanceView.Substatuses == nil {
+		return ""
+	}
+
+	for _, status := range *instanceView.Substatuses {
+		if status.Code == nil || !strings.EqualFold(*status.Code, code) || status.Message == nil {
+			continue
+		}
+
+		output := redactArmVirtualMachineExtensionProtectedValues(*status.Message, protectedSettings)
+		if len(output) <= extensionScriptOutputSizeLimit {
+			return output
+		}
+
+		start := len(output) - extensionScriptOutputSizeLimit
+		for start < len(output) && !utf8.RuneStart(output[start]) {
+			start++
+		}
+		return fmt.Sprintf("(truncated to the last %d bytes)\n%s", extensionScriptOutputSizeLimit, output[start:])
+	}
+
+	return ""
+}
+
+func unquoteArmServiceErrorField(quoted string) string {
+	if unquoted, err := strconv.Unquote(`"` + quoted + `"`); err == nil {
+		return unquoted
+	}
+	return quoted
+}
+
+// flattenArmCaseInsensitiveString returns current when it only differs from
+// the returned value by case, so that the casing in the state is the one
+// configured.
+func flattenArmCaseInsensitiveString(current string, returned *string) *string {
+	if returned != nil && strings.EqualFold(current, *returned) {
+		return &current
+	}
+	return returned
+}
+
+// armResourceNotFoundErrorCodes are the codes ARM fails a request with when
+// the resource, or its parent, doesn't exist.
+var armResourceNotFoundErrorCodes = []string{"NotFound", "ParentResourceNotFound", "ResourceGroupNotFound", "ResourceNotFound"}
+
+// isArmResourceNotFoundError returns whether the request failed since the
+// resource, or its parent, doesn't exist.
+func isArmResourceNotFoundError(err error) bool {
+	if detailed, ok := err.(autorest.DetailedError); ok && detailed.StatusCode == http.StatusNotFound {
+		return true
+	}
+
+	code, _ := flattenArmVirtualMachineExtensionError(err, nil)
+	for _, notFound := range armResourceNotFoundErrorCodes {
+		if code == notFound {
+			return true
+		}
+	}
+	return false
+}
+
+// isArmGuestAgentNotReadyError returns whether the extension failed because
+// the VM Agent hadn't (yet) reported its status.
+func isArmGuestAgentNotReadyError(err error) bool {
+	message := err.Error()
+	return strings.Contains(message, "VMAgentStatusCommunicationError") ||
+		strings.Contains(strings.ToLower(message), "vm agent is not ready") ||
+		strings.Contains(strings.ToLower(message), "vmagent not ready")
+}
+
+// isArmSoftDeletedNameInUseError returns whether the extension couldn't be
+// created because a deleted extension with the same name is still retained.
+func isArmSoftDeletedNameInUseError(err error) bool {
+	message := strings.ToLower(err.Error())
+	return strings.Contains(message, "softdeleted") ||
+		strings.Contains(message, "soft-deleted") ||
+		strings.Contains(message, "soft deleted")
+}
+
+// flattenArmVirtualMachinePowerState returns the power state of the VM from
+// its instance view (e.g. `running` or `deallocated`), or an empty string when
+// it isn't reported.
+func flattenArmVirtualMachinePowerState(vm compute.VirtualMachine) string {
+	props := vm.VirtualMachineProperties
+	if props == nil || props.InstanceView == nil || props.InstanceView.Statuses == nil {
+		return ""
+	}
+
+	for _, status := range *props.InstanceView.Statuses {
+		if status.Code != nil && strings.HasPrefix(*status.Code, "PowerState/") {
+			return strings.ToLower(strings.TrimPrefix(*status.Code, "PowerState/"))
+		}
+	}
+
+	return ""
+}
+
+// waitForArmVirtualMachineExtensionProvisioned waits for the extension to
+// reach a terminal provisioning state, since Azure can accept the extension
+// (ending the long running operation) before the handler has run. When it
+// didn't succeed, the error includes the statuses of the extension's instance
+// view, formatted like an ARM error so flattenArmVirtualMachineExtensionError
+// reads the code and message. Closing cancel (which can be nil) stops waiting.
+func waitForArmVirtualMachineExtensionProvisioned(client *ArmClient, resGroup, vmName, name string, timeout time.Duration, cancel <-chan struct{}) error {
+	stateConf := &resource.StateChangeConf{
+		Pending:      []string{"Creating", "Updating"},
+		Target:       []string{"Succeeded", "Failed", "Canceled"},
+		Refresh:      extensionProvisioningStateRefreshFunc(client, resGroup, vmName, name, cancel),
+		Timeout:      timeout,
+		PollInterval: extensionProvisioningPollInterval,
+	}
+	result, err := stateConf.WaitForState()
+	if err != nil {
+		return fmt.Errorf("Error waiting for Virtual Machine Extension %q on Virtual Machine %q to be provisioned: %s", name, vmName, err)
+	}
+
+	extension := result.(compute.VirtualMachineExtension)
+	props := extension.VirtualMachineExtensionProperties
+	if *props.ProvisioningState == "Succeeded" {
+		return nil
+	}
+
+	code, messages := "", make([]string, 0)
+	if props.InstanceView != nil && props.InstanceView.Statuses != nil {
+		for _, status := range *props.InstanceView.Statuses {
+			if code == "" && status.Level == compute.Error && status.Code != nil {
+				code = *status.Code
+			}
+			if status.Message != nil && *status.Message != "" {
+				messages = append(messages, *status.Message)
+			}
+		}
+	}
+	if code == "" {
+		code = fmt.Sprintf("ProvisioningState/%s", strings.ToLower(*props.ProvisioningState))
+	}
+
+	if *props.ProvisioningState == "Canceled" {
+		return fmt.Errorf("Virtual Machine Extension %q on Virtual Machine %q was canceled with provisioning state %q: Code=%q Message=%q\n\n%s", name, vmName, *props.ProvisioningState, code, strings.Join(messages, "\n"), armVirtualMachineExtensionCanceledHint)
+	}
+	return fmt.Errorf("Virtual Machine Extension %q on Virtual Machine %q finished with provisioning state %q: Code=%q Message=%q", name, vmName, *props.ProvisioningState, code, strings.Join(messages, "\n"))
+}
+
+// armVirtualMachineExtensionCanceledHint explains an extension operation
+// which was canceled rather than failed, since fixing it differs.
+const armVirtualMachineExtensionCanceledHint = "Azure usually cancels an Extension operation since another operation it depends on (such as one on the Virtual Machine, or on another of its Extensions) failed. Fix that operation, then apply again."
+
+func extensionProvisioningStateRefreshFunc(client *ArmClient, resGroup, vmName, name string, cancel <-chan struct{}) resource.StateRefreshFunc {
+	return func() (interface{}, string, error) {
+		select {
+		case <-cancel:
+			return nil, "", fmt.Errorf("Stopped waiting for Virtual Machine Extension %q (Virtual Machine %q / resource group %q) to be provisioned", name, vmName, resGroup)
+		default:
+		}
+
+		extension, _, err := getArmVirtualMachineExtensionIfChanged(client.vmExtensionClient, resGroup, vmName, name, "", cancel)
+		if err != nil {
+			return nil, "", fmt.Errorf("Error retrieving Virtual Machine Extension %q (Virtual Machine %q / resource group %q): %s", name, vmName, resGroup, err)
+		}
+
+		if props := extension.VirtualMachineExtensionProperties; props != nil && props.ProvisioningState != nil {
+			return extension, *props.ProvisioningState, nil
+		}
+
+		// Azure only omits the state of extensions which were provisioned
+		// before it was introduced
+		succeeded := "Succeeded"
+		if extension.VirtualMachineExtensionProperties == nil {
+			extension.VirtualMachineExtensionProperties = &compute.VirtualMachineExtensionProperties{}
+		}
+		extension.VirtualMachineExtensionProperties.ProvisioningState = &succeeded
+		return extension, succeeded, nil
+	}
+}
+
+// waitForArmGuestAgentReady waits (up to timeout) for the VM Agent to report
+// ready, returning as soon as cancel is closed.
+func waitForArmGuestAgentReady(client *ArmClient, resGroup, vmName string, timeout time.Duration, cancel <-chan struct{}) error {
+	stateConf := &resource.StateChangeConf{
+		Pending:    []string{"NotReady"},
+		Target:     []string{"Ready"},
+		Refresh:    guestAgentStateRefreshFunc(client, resGroup, vmName, cancel),
+		Timeout:    timeout,
+		MinTimeout: guestAgentReadyPollInterval,
+	}
+
+	// the refresh func stops the wait once cancel is closed, which may only
+	// happen after the poll interval
+	done := make(chan error, 1)
+	go func() {
+		_, err := stateConf.WaitForState()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-cancel:
+		return fmt.Errorf("Stopped waiting for the VM Agent on Virtual Machine %q (resource group %q) to become ready", vmName, resGroup)
+	}
+}
+
+func guestAgentStateRefreshFunc(client *ArmClient, resGroup, vmName string, cancel <-chan struct{}) resource.StateRefreshFunc {
+	return func() (interface{}, string, error) {
+		select {
+		case <-cancel:
+			return nil, "", fmt.Errorf("Stopped waiting for the VM Agent on Virtual Machine %q (resource group %q) to become ready", vmName, resGroup)
+		default:
+		}
+
+		vm, err := getArmVirtualMachine(client.vmClient, resGroup, vmName, compute.InstanceView, cancel)
+		if err != nil {
+			return nil, "", fmt.Errorf("Error retrieving the instance view of Virtual Machine %q (resource group %q): %s", vmName, resGroup, err)
+		}
+
+		if props := vm.VirtualMachineProperties; props != nil && props.InstanceView != nil && props.InstanceView.VMAgent != nil {
+			if statuses := props.InstanceView.VMAgent.Statuses; statuses != nil {
+				for _, status := range *statuses {
+					if status.DisplayStatus != nil && strings.EqualFold(*status.DisplayStatus, "Ready") {
+						return vm, "Ready", nil
+					}
+				}
+			}
+		}
+
+		return vm, "NotReady", nil
+	}
+}
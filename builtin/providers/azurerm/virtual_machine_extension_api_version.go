@@ -0,0 +1,50 @@
+package azurerm
+
+import (
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// armVirtualMachineExtensionAPIVersions are the Compute API versions an
+// Extension can be managed with: the vendored SDK's (the default), and the
+// later ones whose Virtual Machine Extension model it's compatible with.
+var armVirtualMachineExtensionAPIVersions = []string{
+	compute.APIVersion,
+	"2017-03-30",
+	"2017-12-01",
+	"2018-04-01",
+	"2018-06-01",
+	"2018-10-01",
+	"2019-03-01",
+	"2019-07-01",
+}
+
+// armClientWithVirtualMachineExtensionAPIVersion returns the provider's client
+// with its Virtual Machine Extensions client using the Extension's
+// `api_version`, or the provider's client as-is when that isn't set.
+func armClientWithVirtualMachineExtensionAPIVersion(d *schema.ResourceData, meta interface{}) interface{} {
+	apiVersion, _ := d.Get("api_version").(string)
+	if apiVersion == "" || apiVersion == meta.(*ArmClient).vmExtensionClient.APIVersion {
+		return meta
+	}
+
+	client := *meta.(*ArmClient)
+	client.vmExtensionClient.APIVersion = apiVersion
+	return &client
+}
+
+// isArmVirtualMachineExtensionAPIVersionOnlyChange returns whether
+// `api_version` is the only attribute of the Extension which changed, which
+// doesn't need it to be sent (and the extension handler run) again.
+func isArmVirtualMachineExtensionAPIVersionOnlyChange(d *schema.ResourceData) bool {
+	if !d.HasChange("api_version") {
+		return false
+	}
+
+	for k := range resourceArmVirtualMachineExtensions().Schema {
+		if k != "api_version" && d.HasChange(k) {
+			return false
+		}
+	}
+	return true
+}
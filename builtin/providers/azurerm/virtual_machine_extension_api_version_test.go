@@ -0,0 +1,145 @@
+package azurerm
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/hashicorp/terraform/config"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestResourceArmVirtualMachineExtensions_apiVersion(t *testing.T) {
+	cases := []struct {
+		APIVersion string
+		Expected   string
+	}{
+		{APIVersion: "", Expected: compute.APIVersion},
+		{APIVersion: "2018-06-01", Expected: "2018-06-01"},
+	}
+
+	for i, tc := range cases {
+		var lock sync.Mutex
+		apiVersions := make(map[string]bool)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if !strings.Contains(r.URL.Path, "/extensions/") {
+				fmt.Fprint(w, `{"name":"acctvm","properties":{}}`)
+				return
+			}
+
+			lock.Lock()
+			apiVersions[r.Method+" "+r.URL.Query().Get("api-version")] = true
+			lock.Unlock()
+			if r.Method == "DELETE" {
+				return
+			}
+			fmt.Fprint(w, `{"id":"/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/test","name":"test","location":"westus","properties":{"publisher":"Microsoft.Azure.Extensions","type":"CustomScript","typeHandlerVersion":"2.0","provisioningState":"Succeeded"}}`)
+		}))
+
+		d := testArmResourceDataRaw(t, resourceArmVirtualMachineExtensions(), map[string]interface{}{
+			"name":                 "test",
+			"location":             "West US",
+			"resource_group_name":  "acctestRG",
+			"virtual_machine_name": "acctvm",
+			"publisher":            "Microsoft.Azure.Extensions",
+			"type":                 "CustomScript",
+			"type_handler_version": "2.0",
+			"api_version":          tc.APIVersion,
+			"skip_delete_wait":     true,
+		})
+		d.MarkNewResource()
+
+		client := testArmClientWithBaseURI(server.URL)
+		if err := resourceArmVirtualMachineExtensionsCreate(d, client); err != nil {
+			t.Fatalf("Case %d: Error creating the Extension: %s", i, err)
+		}
+		if err := resourceArmVirtualMachineExtensionsDelete(d, client); err != nil {
+			t.Fatalf("Case %d: Error deleting the Extension: %s", i, err)
+		}
+		server.Close()
+
+		for _, method := range []string{"PUT", "GET", "DELETE"} {
+			if !apiVersions[method+" "+tc.Expected] || len(apiVersions) != 3 {
+				t.Fatalf("Case %d: Expected the Extension to be managed with api-version %q, got %v", i, tc.Expected, apiVersions)
+			}
+		}
+
+		// the provider's client isn't changed
+		if client.vmExtensionClient.APIVersion != compute.APIVersion {
+			t.Fatalf("Case %d: Expected the provider's api-version to be kept, got %q", i, client.vmExtensionClient.APIVersion)
+		}
+	}
+}
+
+func TestResourceArmVirtualMachineExtensions_apiVersionValidation(t *testing.T) {
+	validate := resourceArmVirtualMachineExtensions().Schema["api_version"].ValidateFunc
+	if _, errors := validate("2018-06-01", "api_version"); len(errors) != 0 {
+		t.Fatalf("Expected a known API version to be valid, got %v", errors)
+	}
+	if _, errors := validate("2099-01-01", "api_version"); len(errors) == 0 {
+		t.Fatalf("Expected an unknown API version to be invalid")
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionsUpdate_apiVersionOnly(t *testing.T) {
+	var puts int
+	var apiVersion string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "PUT" && strings.Contains(r.URL.Path, "/extensions/"):
+			puts++
+			fmt.Fprint(w, `{"name":"hostname","properties":{"provisioningState":"Succeeded"}}`)
+		case strings.Contains(r.URL.Path, "/extensions/"):
+			apiVersion = r.URL.Query().Get("api-version")
+			fmt.Fprint(w, `{"id":"/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/hostname","name":"hostname","location":"westus","properties":{"publisher":"Microsoft.OSTCExtensions","type":"CustomScriptForLinux","typeHandlerVersion":"1.2","provisioningState":"Succeeded"}}`)
+		default:
+			fmt.Fprint(w, `{"name":"acctvm","properties":{}}`)
+		}
+	}))
+	defer server.Close()
+
+	client := testArmClientWithBaseURI(server.URL)
+	resource := resourceArmVirtualMachineExtensions()
+
+	apply := func(state *terraform.InstanceState, apiVersion string) *terraform.InstanceState {
+		raw, err := config.NewRawConfig(map[string]interface{}{
+			"name":                 "hostname",
+			"location":             "westus",
+			"resource_group_name":  "acctestRG",
+			"virtual_machine_name": "acctvm",
+			"publisher":            "Microsoft.OSTCExtensions",
+			"type":                 "CustomScriptForLinux",
+			"type_handler_version": "1.2",
+			"api_version":          apiVersion,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		diff, err := resource.Diff(state, terraform.NewResourceConfig(raw))
+		if err != nil {
+			t.Fatalf("Error planning the Extension: %s", err)
+		}
+		state, err = resource.Apply(state, diff, client)
+		if err != nil {
+			t.Fatalf("Error applying the Extension: %s", err)
+		}
+		return state
+	}
+
+	state := apply(nil, compute.APIVersion)
+	apply(state, "2018-06-01")
+	if puts != 1 {
+		t.Fatalf("Expected a change of the api_version alone not to send the Extension again, got %d requests", puts)
+	}
+	if apiVersion != "2018-06-01" {
+		t.Fatalf("Expected the Extension to be read with the new api_version, got %q", apiVersion)
+	}
+}
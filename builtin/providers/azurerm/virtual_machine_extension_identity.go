@@ -0,0 +1,89 @@
+package azurerm
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+// armVirtualMachineIdentityAPIVersion is the API version the identity of a
+// Virtual Machine is read with. The vendored SDK's API version predates
+// managed identities, which Virtual Machines return since 2017-12-01.
+const armVirtualMachineIdentityAPIVersion = "2017-12-01"
+
+type armVirtualMachineIdentity struct {
+	Identity *struct {
+		Type string `json:"type"`
+	} `json:"identity"`
+}
+
+// getArmVirtualMachineIdentityType returns the type of the managed identity
+// assigned to the Virtual Machine (such as `SystemAssigned`), which is empty
+// when it has none.
+func getArmVirtualMachineIdentityType(client *ArmClient, resGroup, vmName string) (string, error) {
+	vmClient := client.vmClient
+
+	pathParameters := map[string]interface{}{
+		"resourceGroupName": autorest.Encode("path", resGroup),
+		"subscriptionId":    autorest.Encode("path", vmClient.SubscriptionID),
+		"vmName":            autorest.Encode("path", vmName),
+	}
+	queryParameters := map[string]interface{}{
+		"api-version": armVirtualMachineIdentityAPIVersion,
+	}
+
+	req, err := autorest.Prepare(&http.Request{},
+		autorest.AsGet(),
+		autorest.WithBaseURL(vmClient.BaseURI),
+		autorest.WithPathParameters("/subscriptions/{subscriptionId}/resourceGroups/{resourceGroupName}/providers/Microsoft.Compute/virtualMachines/{vmName}", pathParameters),
+		autorest.WithQueryParameters(queryParameters))
+	if err != nil {
+		return "", autorest.NewErrorWithError(err, "compute.VirtualMachinesClient", "Get", nil, "Failure preparing request")
+	}
+
+	resp, err := autorest.SendWithSender(vmClient, req)
+	if err != nil {
+		return "", autorest.NewErrorWithError(err, "compute.VirtualMachinesClient", "Get", resp, "Failure sending request")
+	}
+
+	var result armVirtualMachineIdentity
+	err = autorest.Respond(resp,
+		vmClient.ByInspecting(),
+		azure.WithErrorUnlessStatusCode(http.StatusOK),
+		autorest.ByUnmarshallingJSON(&result),
+		autorest.ByClosing())
+	if err != nil {
+		return "", autorest.NewErrorWithError(err, "compute.VirtualMachinesClient", "Get", resp, "Failure responding to request")
+	}
+
+	if result.Identity == nil || strings.EqualFold(result.Identity.Type, "None") {
+		return "", nil
+	}
+	return result.Identity.Type, nil
+}
+
+// validateArmVirtualMachineExtensionManagedIdentity returns an error when the
+// Virtual Machine has no system-assigned identity, which an extension fetching
+// secrets from Key Vault authenticates with.
+func validateArmVirtualMachineExtensionManagedIdentity(client *ArmClient, resGroup, vmName, name string) error {
+	identityType, err := getArmVirtualMachineIdentityType(client, resGroup, vmName)
+	if err != nil {
+		if isArmResourceNotFoundError(err) {
+			return armVirtualMachineExtensionParentNotFoundError(resGroup, vmName, name)
+		}
+		return fmt.Errorf("Error reading the identity of Virtual Machine %q (resource group %q): %s", vmName, resGroup, err)
+	}
+
+	if !strings.Contains(strings.ToLower(identityType), "systemassigned") {
+		assigned := "no managed identity"
+		if identityType != "" {
+			assigned = fmt.Sprintf("only a %s identity", identityType)
+		}
+		return fmt.Errorf("Virtual Machine %q (resource group %q) has %s, but Virtual Machine Extension %q requires a system-assigned identity (`requires_managed_identity`) - without one the extension fails at runtime when authenticating to Key Vault. Assign the Virtual Machine an identity of type `SystemAssigned` before attaching the Extension", vmName, resGroup, assigned, name)
+	}
+
+	return nil
+}
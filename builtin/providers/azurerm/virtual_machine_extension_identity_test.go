@@ -0,0 +1,75 @@
+package azurerm
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResourceArmVirtualMachineExtensionsCreate_requiresManagedIdentity(t *testing.T) {
+	cases := []struct {
+		Identity    string
+		ExpectError string
+	}{
+		{Identity: ``, ExpectError: `has no managed identity, but Virtual Machine Extension "test" requires a system-assigned identity`},
+		{Identity: `,"identity":{"type":"None"}`, ExpectError: `has no managed identity`},
+		{Identity: `,"identity":{"type":"UserAssigned"}`, ExpectError: `has only a UserAssigned identity`},
+		{Identity: `,"identity":{"type":"SystemAssigned","principalId":"00000000-0000-0000-0000-000000000001"}`},
+		{Identity: `,"identity":{"type":"SystemAssigned, UserAssigned"}`},
+	}
+
+	for i, tc := range cases {
+		var puts, identityReads int
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch {
+			case r.Method == "PUT" && strings.Contains(r.URL.Path, "/extensions/"):
+				puts++
+				fmt.Fprint(w, `{"name":"test","properties":{"provisioningState":"Succeeded"}}`)
+			case strings.Contains(r.URL.Path, "/extensions/"):
+				fmt.Fprint(w, `{"id":"/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/test","name":"test","location":"westus","properties":{"publisher":"Microsoft.Azure.Extensions","type":"CustomScript","typeHandlerVersion":"2.0","provisioningState":"Succeeded"}}`)
+			default:
+				if r.URL.Query().Get("api-version") == armVirtualMachineIdentityAPIVersion {
+					identityReads++
+				}
+				fmt.Fprintf(w, `{"name":"acctvm","properties":{}%s}`, tc.Identity)
+			}
+		}))
+
+		d := testArmResourceDataRaw(t, resourceArmVirtualMachineExtensions(), map[string]interface{}{
+			"name":                      "test",
+			"location":                  "West US",
+			"resource_group_name":       "acctestRG",
+			"virtual_machine_name":      "acctvm",
+			"publisher":                 "Microsoft.Azure.Extensions",
+			"type":                      "CustomScript",
+			"type_handler_version":      "2.0",
+			"requires_managed_identity": true,
+		})
+		d.MarkNewResource()
+
+		err := resourceArmVirtualMachineExtensionsCreate(d, testArmClientWithBaseURI(server.URL))
+		server.Close()
+
+		if identityReads != 1 {
+			t.Fatalf("Case %d: Expected the identity of the Virtual Machine to be read once, got %d requests", i, identityReads)
+		}
+		if tc.ExpectError != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.ExpectError) {
+				t.Fatalf("Case %d: Expected an error containing %q, got %v", i, tc.ExpectError, err)
+			}
+			if puts != 0 {
+				t.Fatalf("Case %d: Expected the Extension not to be sent, got %d requests", i, puts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Case %d: Error creating the Extension: %s", i, err)
+		}
+		if puts != 1 {
+			t.Fatalf("Case %d: Expected the Extension to be created, got %d requests", i, puts)
+		}
+	}
+}
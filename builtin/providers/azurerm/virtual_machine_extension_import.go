@@ -0,0 +1,33 @@
+package azurerm
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// resourceArmVirtualMachineExtensionsImportState imports an Extension by its
+// ID. Azure never returns the protected settings, so they're marked as
+// imported: until the Extension is next sent to Azure, the configured
+// `protected_settings` aren't diffed against the (empty) value in the state.
+// The attributes only known to Terraform take their defaults.
+func resourceArmVirtualMachineExtensionsImportState(d *schema.ResourceData, meta interface{}) ([]*schema.ResourceData, error) {
+	id, err := parseAzureResourceID(d.Id())
+	if err != nil {
+		return nil, err
+	}
+	if id.Path["virtualMachines"] == "" || id.Path["extensions"] == "" {
+		return nil, fmt.Errorf("%q isn't the ID of a Virtual Machine Extension, which is of the form /subscriptions/{subscriptionId}/resourceGroups/{resourceGroup}/providers/Microsoft.Compute/virtualMachines/{vmName}/extensions/{name}", d.Id())
+	}
+
+	// so that the plan after the import is clean
+	for k, v := range resourceArmVirtualMachineExtensions().Schema {
+		if v.Default != nil {
+			d.Set(k, v.Default)
+		}
+	}
+	d.Set("inherited_tags", map[string]interface{}{})
+	d.Set("vm_attribute_values", map[string]interface{}{})
+	d.Set("protected_settings_imported", true)
+	return []*schema.ResourceData{d}, nil
+}
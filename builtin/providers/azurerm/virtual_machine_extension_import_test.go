@@ -0,0 +1,94 @@
+package azurerm
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform/config"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestResourceArmVirtualMachineExtensions_importProtectedSettings(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != "GET" {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+			return
+		}
+		if strings.Contains(r.URL.Path, "/extensions/") {
+			fmt.Fprint(w, `{"id":"/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/hostname","name":"hostname","location":"westus","properties":{"publisher":"Microsoft.OSTCExtensions","type":"CustomScriptForLinux","typeHandlerVersion":"1.2","settings":{"commandToExecute":"hostname"},"provisioningState":"Succeeded"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"name":"acctvm","properties":{}}`)
+	}))
+	defer server.Close()
+
+	client := testArmClientWithBaseURI(server.URL)
+	resource := resourceArmVirtualMachineExtensions()
+
+	// as `terraform import` does: the importer, then a refresh
+	data := resource.Data(&terraform.InstanceState{
+		ID: "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/hostname",
+	})
+	imported, err := resource.Importer.State(data, client)
+	if err != nil {
+		t.Fatalf("Error importing the Extension: %s", err)
+	}
+	if len(imported) != 1 {
+		t.Fatalf("Expected a single Extension to be imported, got %d", len(imported))
+	}
+	state, err := resource.Refresh(imported[0].State(), client)
+	if err != nil {
+		t.Fatalf("Error refreshing the imported Extension: %s", err)
+	}
+	if state.Attributes["protected_settings_imported"] != "true" {
+		t.Fatalf("Expected the protected settings to be marked as imported, got %+v", state.Attributes)
+	}
+
+	raw, err := config.NewRawConfig(map[string]interface{}{
+		"name":                 "hostname",
+		"location":             "westus",
+		"resource_group_name":  "acctestRG",
+		"virtual_machine_name": "acctvm",
+		"publisher":            "Microsoft.OSTCExtensions",
+		"type":                 "CustomScriptForLinux",
+		"type_handler_version": "1.2",
+		"settings":             `{"commandToExecute": "hostname"}`,
+		"protected_settings":   `{"storageAccountKey": "secret"}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the plan after the import is clean
+	diff, err := resource.Diff(state, terraform.NewResourceConfig(raw))
+	if err != nil {
+		t.Fatalf("Error planning the imported Extension: %s", err)
+	}
+	if diff != nil && len(diff.Attributes) > 0 {
+		t.Fatalf("Expected a clean plan after the import, got %+v", diff.Attributes)
+	}
+
+	// while once the Extension has been sent, a change of them is a diff
+	state.Attributes["protected_settings_imported"] = "false"
+	diff, err = resource.Diff(state, terraform.NewResourceConfig(raw))
+	if err != nil {
+		t.Fatalf("Error planning the Extension: %s", err)
+	}
+	if diff == nil || diff.Attributes["protected_settings"] == nil {
+		t.Fatalf("Expected a diff of `protected_settings`, got %+v", diff)
+	}
+}
+
+func TestResourceArmVirtualMachineExtensions_importInvalidID(t *testing.T) {
+	resource := resourceArmVirtualMachineExtensions()
+	data := resource.Data(&terraform.InstanceState{
+		ID: "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm",
+	})
+	if _, err := resource.Importer.State(data, testArmClientWithBaseURI("http://localhost")); err == nil || !strings.Contains(err.Error(), "isn't the ID of a Virtual Machine Extension") {
+		t.Fatalf("Expected an error for the ID of a Virtual Machine, got %v", err)
+	}
+}
@@ -0,0 +1,54 @@
+package azurerm
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// expandArmVirtualMachineExtensionInheritedTags adds the tags of the Virtual
+// Machine to those of the extension, where the extension's own tags win on a
+// collision, and returns the tags which were inherited.
+func expandArmVirtualMachineExtensionInheritedTags(client *ArmClient, resGroup, vmName, name string, tags *map[string]*string) (map[string]interface{}, error) {
+	vm, err := client.vmClient.Get(resGroup, vmName, "")
+	if err != nil {
+		if vm.StatusCode == http.StatusNotFound {
+			return nil, armVirtualMachineExtensionParentNotFoundError(resGroup, vmName, name)
+		}
+		return nil, fmt.Errorf("Error retrieving the tags of Virtual Machine %q (resource group %q) to inherit: %s", vmName, resGroup, err)
+	}
+
+	inherited := make(map[string]interface{})
+	if vm.Tags == nil {
+		return inherited, nil
+	}
+	for k, v := range *vm.Tags {
+		if _, ok := (*tags)[k]; ok || v == nil {
+			continue
+		}
+		value := *v
+		(*tags)[k] = &value
+		inherited[k] = value
+	}
+	return inherited, nil
+}
+
+// flattenArmVirtualMachineExtensionInheritedTags removes the tags which were
+// inherited from the Virtual Machine (and aren't configured) from the returned
+// tags, so that they're never a diff. A tag whose value has since changed in
+// Azure is kept, as drift.
+func flattenArmVirtualMachineExtensionInheritedTags(tags *map[string]*string, inherited, configured map[string]interface{}) *map[string]*string {
+	if tags == nil || len(inherited) == 0 {
+		return tags
+	}
+
+	output := make(map[string]*string, len(*tags))
+	for k, v := range *tags {
+		if value, ok := inherited[k]; ok && v != nil && *v == value.(string) {
+			if _, ok := configured[k]; !ok {
+				continue
+			}
+		}
+		output[k] = v
+	}
+	return &output
+}
@@ -0,0 +1,99 @@
+package azurerm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform/config"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestResourceArmVirtualMachineExtensions_inheritTagsFromVM(t *testing.T) {
+	var sent map[string]string
+	tags := `{}`
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "PUT" && strings.Contains(r.URL.Path, "/extensions/"):
+			var body struct {
+				Tags json.RawMessage `json:"tags"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			json.Unmarshal(body.Tags, &sent)
+			tags = string(body.Tags)
+			fmt.Fprint(w, `{"name":"hostname","properties":{"provisioningState":"Succeeded"}}`)
+		case strings.Contains(r.URL.Path, "/extensions/"):
+			fmt.Fprintf(w, `{"id":"/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/hostname","name":"hostname","location":"westus","tags":%s,"properties":{"publisher":"Microsoft.OSTCExtensions","type":"CustomScriptForLinux","typeHandlerVersion":"1.2","settings":{"commandToExecute":"hostname"},"provisioningState":"Succeeded"}}`, tags)
+		default:
+			fmt.Fprint(w, `{"name":"acctvm","tags":{"cost-center":"1234","environment":"production"},"properties":{}}`)
+		}
+	}))
+	defer server.Close()
+
+	cases := []struct {
+		Tags      map[string]interface{}
+		Sent      map[string]string
+		Inherited string
+	}{
+		{
+			Tags:      map[string]interface{}{},
+			Sent:      map[string]string{"cost-center": "1234", "environment": "production"},
+			Inherited: "2",
+		},
+		{
+			Tags:      map[string]interface{}{"environment": "staging"},
+			Sent:      map[string]string{"cost-center": "1234", "environment": "staging"},
+			Inherited: "1",
+		},
+	}
+
+	for _, tc := range cases {
+		raw, err := config.NewRawConfig(map[string]interface{}{
+			"name":                 "hostname",
+			"location":             "westus",
+			"resource_group_name":  "acctestRG",
+			"virtual_machine_name": "acctvm",
+			"publisher":            "Microsoft.OSTCExtensions",
+			"type":                 "CustomScriptForLinux",
+			"type_handler_version": "1.2",
+			"settings":             `{"commandToExecute": "hostname"}`,
+			"inherit_tags_from_vm": true,
+			"tags":                 tc.Tags,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resource := resourceArmVirtualMachineExtensions()
+		diff, err := resource.Diff(nil, terraform.NewResourceConfig(raw))
+		if err != nil {
+			t.Fatalf("Error planning the Extension: %s", err)
+		}
+		state, err := resource.Apply(nil, diff, testArmClientWithBaseURI(server.URL))
+		if err != nil {
+			t.Fatalf("Error applying the Extension: %s", err)
+		}
+
+		if !reflect.DeepEqual(sent, tc.Sent) {
+			t.Fatalf("Expected the tags %+v to be sent, got %+v", tc.Sent, sent)
+		}
+		if state.Attributes["tags.%"] != fmt.Sprintf("%d", len(tc.Tags)) || state.Attributes["inherited_tags.%"] != tc.Inherited {
+			t.Fatalf("Expected only the configured tags to be read back, got %+v", state.Attributes)
+		}
+
+		// the inherited tags aren't a diff
+		diff, err = resource.Diff(state, terraform.NewResourceConfig(raw))
+		if err != nil {
+			t.Fatalf("Error planning the Extension: %s", err)
+		}
+		if diff != nil && !diff.Empty() {
+			t.Fatalf("Expected no diff, got %+v", diff.Attributes)
+		}
+	}
+}
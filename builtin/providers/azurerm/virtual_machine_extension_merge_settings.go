@@ -0,0 +1,61 @@
+package azurerm
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// expandArmVirtualMachineExtensionMergedSettings deep-merges the settings over
+// those the Extension currently has in Azure, so that keys added outside of
+// Terraform (e.g. by Azure automation) are sent back rather than removed. The
+// settings are returned as-is when the Extension doesn't exist yet.
+func expandArmVirtualMachineExtensionMergedSettings(client *ArmClient, resGroup, vmName, name string, settings *map[string]interface{}) (*map[string]interface{}, error) {
+	resp, err := client.vmExtensionClient.Get(resGroup, vmName, name, "")
+	if err != nil {
+		if resp.Response.Response != nil && resp.StatusCode == http.StatusNotFound {
+			return settings, nil
+		}
+		return nil, fmt.Errorf("Error reading the current settings of Virtual Machine Extension %q on Virtual Machine %q to merge with: %s", name, vmName, err)
+	}
+
+	props := resp.VirtualMachineExtensionProperties
+	if props == nil || props.Settings == nil {
+		return settings, nil
+	}
+
+	overrides := make(map[string]interface{})
+	if settings != nil {
+		overrides = *settings
+	}
+	merged := mergeArmVirtualMachineExtensionSettings(*props.Settings, overrides)
+	return &merged, nil
+}
+
+// isArmVirtualMachineExtensionSettingsMergedSubset returns whether merging the
+// configured settings over those returned leaves them unchanged, i.e. whether
+// the configured keys all have the values returned.
+func isArmVirtualMachineExtensionSettingsMergedSubset(returned, configured string) bool {
+	returnedSettings, err := expandArmVirtualMachineExtensionSettings(returned)
+	if err != nil {
+		return false
+	}
+	configuredSettings, err := expandArmVirtualMachineExtensionSettings(configured)
+	if err != nil {
+		return false
+	}
+
+	merged, err := flattenArmVirtualMachineExtensionSettings(mergeArmVirtualMachineExtensionSettings(returnedSettings, configuredSettings))
+	if err != nil {
+		return false
+	}
+	mergedCanonical, err := canonicalizeArmVirtualMachineExtensionSettings(merged)
+	if err != nil {
+		return false
+	}
+	returnedCanonical, err := canonicalizeArmVirtualMachineExtensionSettings(returned)
+	if err != nil {
+		return false
+	}
+
+	return mergedCanonical == returnedCanonical
+}
@@ -0,0 +1,146 @@
+package azurerm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func TestResourceArmVirtualMachineExtensionsCreate_mergeSettings(t *testing.T) {
+	var sent map[string]interface{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "PUT" && strings.Contains(r.URL.Path, "/extensions/"):
+			body, _ := ioutil.ReadAll(r.Body)
+			var extension struct {
+				Properties struct {
+					Settings map[string]interface{} `json:"settings"`
+				} `json:"properties"`
+			}
+			if err := json.Unmarshal(body, &extension); err != nil {
+				t.Errorf("Error parsing the request: %s", err)
+			}
+			sent = extension.Properties.Settings
+			fmt.Fprint(w, `{"name":"test","properties":{"provisioningState":"Succeeded"}}`)
+		case strings.Contains(r.URL.Path, "/extensions/"):
+			fmt.Fprint(w, `{"id":"/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/test","name":"test","location":"westus","properties":{"publisher":"Microsoft.Azure.Extensions","type":"CustomScript","typeHandlerVersion":"2.0","settings":{"commandToExecute":"hostname","automation":{"runbook":"patch","schedule":"daily"},"injected":"by-azure"},"provisioningState":"Succeeded"}}`)
+		default:
+			fmt.Fprint(w, `{"name":"acctvm","properties":{}}`)
+		}
+	}))
+	defer server.Close()
+
+	d := testArmResourceDataRaw(t, resourceArmVirtualMachineExtensions(), map[string]interface{}{
+		"name":                 "test",
+		"location":             "West US",
+		"resource_group_name":  "acctestRG",
+		"virtual_machine_name": "acctvm",
+		"publisher":            "Microsoft.Azure.Extensions",
+		"type":                 "CustomScript",
+		"type_handler_version": "2.0",
+		"settings":             `{"commandToExecute":"uptime","automation":{"schedule":"weekly"},"fileUris":["https://example.com/a.sh"]}`,
+		"merge_settings":       true,
+	})
+
+	if err := resourceArmVirtualMachineExtensionsCreate(d, testArmClientWithBaseURI(server.URL)); err != nil {
+		t.Fatalf("Error updating the Extension: %s", err)
+	}
+
+	// the union of the settings, those configured overriding the existing ones
+	expected := map[string]interface{}{
+		"commandToExecute": "uptime",
+		"automation": map[string]interface{}{
+			"runbook":  "patch",
+			"schedule": "weekly",
+		},
+		"fileUris": []interface{}{"https://example.com/a.sh"},
+		"injected": "by-azure",
+	}
+	if !reflect.DeepEqual(sent, expected) {
+		t.Fatalf("Expected the merged settings %+v to be sent, got %+v", expected, sent)
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionsCreate_mergeSettingsNewExtension(t *testing.T) {
+	var sent string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "PUT" && strings.Contains(r.URL.Path, "/extensions/"):
+			body, _ := ioutil.ReadAll(r.Body)
+			sent = string(body)
+			fmt.Fprint(w, `{"name":"test","properties":{"provisioningState":"Succeeded"}}`)
+		case strings.Contains(r.URL.Path, "/extensions/") && sent == "":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"code":"NotFound","message":"The entity was not found in this Azure location."}}`)
+		case strings.Contains(r.URL.Path, "/extensions/"):
+			fmt.Fprint(w, `{"id":"/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/test","name":"test","location":"westus","properties":{"publisher":"Microsoft.Azure.Extensions","type":"CustomScript","typeHandlerVersion":"2.0","settings":{"commandToExecute":"hostname"},"provisioningState":"Succeeded"}}`)
+		default:
+			fmt.Fprint(w, `{"name":"acctvm","properties":{}}`)
+		}
+	}))
+	defer server.Close()
+
+	d := testArmResourceDataRaw(t, resourceArmVirtualMachineExtensions(), map[string]interface{}{
+		"name":                 "test",
+		"location":             "West US",
+		"resource_group_name":  "acctestRG",
+		"virtual_machine_name": "acctvm",
+		"publisher":            "Microsoft.Azure.Extensions",
+		"type":                 "CustomScript",
+		"type_handler_version": "2.0",
+		"settings":             `{"commandToExecute":"hostname"}`,
+		"merge_settings":       true,
+	})
+	d.MarkNewResource()
+
+	if err := resourceArmVirtualMachineExtensionsCreate(d, testArmClientWithBaseURI(server.URL)); err != nil {
+		t.Fatalf("Error creating the Extension: %s", err)
+	}
+	if !strings.Contains(sent, `"settings":{"commandToExecute":"hostname"}`) {
+		t.Fatalf("Expected only the configured settings to be sent, got %s", sent)
+	}
+}
+
+func TestSuppressDiffVirtualMachineExtensionSettings_mergeSettings(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, resourceArmVirtualMachineExtensions().Schema, map[string]interface{}{
+		"merge_settings": true,
+	})
+
+	config := `{"commandToExecute":"uptime","automation":{"schedule":"weekly"}}`
+
+	cases := []struct {
+		Returned string
+		Suppress bool
+	}{
+		// the keys added outside of Terraform are kept
+		{Returned: `{"commandToExecute":"uptime","automation":{"runbook":"patch","schedule":"weekly"},"injected":"by-azure"}`, Suppress: true},
+		// a configured key which changed is still a diff
+		{Returned: `{"commandToExecute":"hostname","automation":{"runbook":"patch","schedule":"weekly"},"injected":"by-azure"}`, Suppress: false},
+		{Returned: `{"commandToExecute":"uptime","automation":{"runbook":"patch","schedule":"daily"}}`, Suppress: false},
+		// as is one which was removed
+		{Returned: `{"automation":{"schedule":"weekly"}}`, Suppress: false},
+	}
+
+	for i, tc := range cases {
+		if actual := suppressDiffVirtualMachineExtensionSettings("settings", tc.Returned, config, d); actual != tc.Suppress {
+			t.Fatalf("Case %d: Expected suppress to be %t, got %t", i, tc.Suppress, actual)
+		}
+	}
+
+	// without the option, the added keys are a diff
+	empty := schema.TestResourceDataRaw(t, resourceArmVirtualMachineExtensions().Schema, map[string]interface{}{})
+	if suppressDiffVirtualMachineExtensionSettings("settings", cases[0].Returned, config, empty) {
+		t.Fatalf("Expected the added keys to be a diff without merge_settings")
+	}
+}
@@ -0,0 +1,154 @@
+package azurerm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// orderedArmVirtualMachineExtensionSettings is a JSON object which, unlike a
+// map, keeps the order of its keys, for the extensions with `ordered_settings`
+// which process the keys of their settings positionally. Nested objects are
+// ordered too.
+type orderedArmVirtualMachineExtensionSettings struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (s *orderedArmVirtualMachineExtensionSettings) UnmarshalJSON(b []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+
+	value, err := decodeOrderedArmVirtualMachineExtensionSettingsValue(decoder)
+	if err != nil {
+		return err
+	}
+	object, ok := value.(*orderedArmVirtualMachineExtensionSettings)
+	if !ok {
+		return fmt.Errorf("settings must be a JSON object, got %T", value)
+	}
+
+	*s = *object
+	return nil
+}
+
+func (s orderedArmVirtualMachineExtensionSettings) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range s.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		encodedKey, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		encodedValue, err := json.Marshal(s.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(encodedKey)
+		buf.WriteByte(':')
+		buf.Write(encodedValue)
+	}
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+func decodeOrderedArmVirtualMachineExtensionSettingsValue(decoder *json.Decoder) (interface{}, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch token {
+	case json.Delim('{'):
+		object := &orderedArmVirtualMachineExtensionSettings{values: make(map[string]interface{})}
+		for decoder.More() {
+			keyToken, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			key := keyToken.(string)
+
+			value, err := decodeOrderedArmVirtualMachineExtensionSettingsValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			// like encoding/json, the last of duplicated keys wins
+			if _, exists := object.values[key]; !exists {
+				object.keys = append(object.keys, key)
+			}
+			object.values[key] = value
+		}
+		// the closing delimiter
+		if _, err := decoder.Token(); err != nil {
+			return nil, err
+		}
+		return object, nil
+	case json.Delim('['):
+		array := make([]interface{}, 0)
+		for decoder.More() {
+			value, err := decodeOrderedArmVirtualMachineExtensionSettingsValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		if _, err := decoder.Token(); err != nil {
+			return nil, err
+		}
+		return array, nil
+	default:
+		return token, nil
+	}
+}
+
+// expandArmVirtualMachineExtensionOrderedSettings returns the settings as
+// they're sent to Azure with `ordered_settings`, in the order configured.
+func expandArmVirtualMachineExtensionOrderedSettings(settingsString string) (json.RawMessage, error) {
+	var settings orderedArmVirtualMachineExtensionSettings
+	if err := json.Unmarshal([]byte(settingsString), &settings); err != nil {
+		return nil, fmt.Errorf("unable to parse settings: %s", err)
+	}
+
+	return json.Marshal(settings)
+}
+
+// setArmVirtualMachineExtensionRequestSettings replaces the settings in the
+// body of the prepared request, which the SDK encodes from a map and so sorts
+// the keys of.
+func setArmVirtualMachineExtensionRequestSettings(req *http.Request, settings json.RawMessage) error {
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	var extension map[string]json.RawMessage
+	if err := json.Unmarshal(body, &extension); err != nil {
+		return err
+	}
+	properties := make(map[string]json.RawMessage)
+	if raw, ok := extension["properties"]; ok {
+		if err := json.Unmarshal(raw, &properties); err != nil {
+			return err
+		}
+	}
+	properties["settings"] = settings
+
+	if extension["properties"], err = json.Marshal(properties); err != nil {
+		return err
+	}
+	if body, err = json.Marshal(extension); err != nil {
+		return err
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	return nil
+}
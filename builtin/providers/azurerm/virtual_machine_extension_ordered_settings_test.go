@@ -0,0 +1,109 @@
+package azurerm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExpandArmVirtualMachineExtensionOrderedSettings(t *testing.T) {
+	cases := []struct {
+		Settings string
+		Expected string
+		Error    bool
+	}{
+		{
+			Settings: `{"zeta": 1, "alpha": {"y": "1", "x": [3, {"b": true, "a": null}]}, "mid": 1.50}`,
+			Expected: `{"zeta":1,"alpha":{"y":"1","x":[3,{"b":true,"a":null}]},"mid":1.50}`,
+		},
+		{
+			// the last of duplicated keys wins, in the position of the first
+			Settings: `{"b": 1, "a": 2, "b": 3}`,
+			Expected: `{"b":3,"a":2}`,
+		},
+		{
+			Settings: `{}`,
+			Expected: `{}`,
+		},
+		{
+			Settings: `["a"]`,
+			Error:    true,
+		},
+		{
+			Settings: `{"a":`,
+			Error:    true,
+		},
+	}
+
+	for _, tc := range cases {
+		actual, err := expandArmVirtualMachineExtensionOrderedSettings(tc.Settings)
+		if tc.Error {
+			if err == nil {
+				t.Fatalf("Expected an error expanding %s", tc.Settings)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Error expanding %s: %s", tc.Settings, err)
+		}
+		if string(actual) != tc.Expected {
+			t.Fatalf("Expected %s, got %s", tc.Expected, actual)
+		}
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionsCreate_orderedSettings(t *testing.T) {
+	for _, fallbackPoller := range []bool{false, true} {
+		var sent string
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch {
+			case r.Method == "PUT" && strings.Contains(r.URL.Path, "/extensions/"):
+				body, _ := ioutil.ReadAll(r.Body)
+				sent = string(body)
+				fmt.Fprint(w, `{"name":"ordered","properties":{"provisioningState":"Succeeded"}}`)
+			case strings.Contains(r.URL.Path, "/extensions/"):
+				fmt.Fprint(w, `{"id":"/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/ordered","name":"ordered","location":"westus","properties":{"publisher":"Contoso","type":"Steps","typeHandlerVersion":"1.0","settings":{"alpha":2,"zeta":1},"provisioningState":"Succeeded"}}`)
+			default:
+				fmt.Fprint(w, `{"name":"acctvm","properties":{}}`)
+			}
+		}))
+
+		d := testArmResourceDataRaw(t, resourceArmVirtualMachineExtensions(), map[string]interface{}{
+			"name":                 "ordered",
+			"location":             "West US",
+			"resource_group_name":  "acctestRG",
+			"virtual_machine_name": "acctvm",
+			"publisher":            "Contoso",
+			"type":                 "Steps",
+			"type_handler_version": "1.0",
+			"settings":             `{"zeta": 1, "alpha": 2}`,
+			"ordered_settings":     true,
+		})
+		d.MarkNewResource()
+
+		client := testArmClientWithBaseURI(server.URL)
+		client.extensionFallbackPoller = fallbackPoller
+		err := resourceArmVirtualMachineExtensionsCreate(d, client)
+		server.Close()
+
+		if err != nil {
+			t.Fatalf("Error creating the Extension (fallback poller %t): %s", fallbackPoller, err)
+		}
+		if !strings.Contains(sent, `"settings":{"zeta":1,"alpha":2}`) {
+			t.Fatalf("Expected the settings to be sent in the order configured (fallback poller %t), got %s", fallbackPoller, sent)
+		}
+		if !strings.Contains(sent, `"publisher":"Contoso"`) {
+			t.Fatalf("Expected the other properties to be kept (fallback poller %t), got %s", fallbackPoller, sent)
+		}
+
+		// Azure returning the keys sorted isn't a diff
+		if !suppressDiffVirtualMachineExtensionSettings("settings", d.Get("settings").(string), `{"zeta": 1, "alpha": 2}`, d) {
+			t.Fatalf("Expected no diff between the settings read back and the configuration")
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package azurerm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+// createOrUpdateArmVirtualMachineExtension sends the request to create (or
+// update) the extension, waiting for it to complete with either the SDK's
+// poller or, with the provider's `use_fallback_extension_poller` set, with
+// pollArmVirtualMachineExtensionOperation. When given, orderedSettings are sent
+// in place of the extension's settings.
+func createOrUpdateArmVirtualMachineExtension(client *ArmClient, resGroup, vmName, name string, extension compute.VirtualMachineExtension, orderedSettings json.RawMessage, cancel <-chan struct{}) error {
+	if !client.extensionFallbackPoller && orderedSettings == nil {
+		_, err := client.vmExtensionClient.CreateOrUpdate(resGroup, vmName, name, extension, cancel)
+		return err
+	}
+
+	extClient := client.vmExtensionClient
+	req, err := extClient.CreateOrUpdatePreparer(resGroup, vmName, name, extension, cancel)
+	if err != nil {
+		return autorest.NewErrorWithError(err, "compute.VirtualMachineExtensionsClient", "CreateOrUpdate", nil, "Failure preparing request")
+	}
+	if orderedSettings != nil {
+		if err := setArmVirtualMachineExtensionRequestSettings(req, orderedSettings); err != nil {
+			return autorest.NewErrorWithError(err, "compute.VirtualMachineExtensionsClient", "CreateOrUpdate", nil, "Failure preparing request")
+		}
+	}
+
+	if !client.extensionFallbackPoller {
+		resp, err := extClient.CreateOrUpdateSender(req)
+		if err != nil {
+			return autorest.NewErrorWithError(err, "compute.VirtualMachineExtensionsClient", "CreateOrUpdate", resp, "Failure sending request")
+		}
+		if _, err := extClient.CreateOrUpdateResponder(resp); err != nil {
+			return autorest.NewErrorWithError(err, "compute.VirtualMachineExtensionsClient", "CreateOrUpdate", resp, "Failure responding to request")
+		}
+		return nil
+	}
+
+	// sent without azure.DoPollForAsynchronous, so that the operation is
+	// polled here instead
+	resp, err := autorest.SendWithSender(extClient, req)
+	if err != nil {
+		return autorest.NewErrorWithError(err, "compute.VirtualMachineExtensionsClient", "CreateOrUpdate", resp, "Failure sending request")
+	}
+
+	if !autorest.ResponseHasStatusCode(resp, http.StatusOK, http.StatusCreated, http.StatusAccepted) {
+		// returns the same errors as the SDK, e.g. for a conflict
+		if _, err := extClient.CreateOrUpdateResponder(resp); err != nil {
+			return autorest.NewErrorWithError(err, "compute.VirtualMachineExtensionsClient", "CreateOrUpdate", resp, "Failure responding to request")
+		}
+		return nil
+	}
+
+	if err := pollArmVirtualMachineExtensionOperation(extClient.Client, resp, extClient.PollingDelay, cancel); err != nil {
+		return autorest.NewErrorWithError(err, "compute.VirtualMachineExtensionsClient", "CreateOrUpdate", nil, "Failure sending request")
+	}
+
+	return nil
+}
+
+// startArmVirtualMachineExtensionDelete sends the request to delete the
+// extension without waiting for Azure to complete it, for `skip_delete_wait`.
+func startArmVirtualMachineExtensionDelete(client *ArmClient, resGroup, vmName, name string, cancel <-chan struct{}) (autorest.Response, error) {
+	extClient := client.vmExtensionClient
+	req, err := extClient.DeletePreparer(resGroup, vmName, name, cancel)
+	if err != nil {
+		return autorest.Response{}, autorest.NewErrorWithError(err, "compute.VirtualMachineExtensionsClient", "Delete", nil, "Failure preparing request")
+	}
+
+	// sent without azure.DoPollForAsynchronous, so that the operation isn't
+	// polled at all
+	resp, err := autorest.SendWithSender(extClient, req)
+	if err != nil {
+		return autorest.Response{Response: resp}, autorest.NewErrorWithError(err, "compute.VirtualMachineExtensionsClient", "Delete", resp, "Failure sending request")
+	}
+	if autorest.ResponseHasStatusCode(resp, http.StatusAccepted) {
+		resp.Body.Close()
+		return autorest.Response{Response: resp}, nil
+	}
+
+	result, err := extClient.DeleteResponder(resp)
+	if err != nil {
+		return result, autorest.NewErrorWithError(err, "compute.VirtualMachineExtensionsClient", "Delete", resp, "Failure responding to request")
+	}
+	return result, nil
+}
+
+// pollArmVirtualMachineExtensionOperation polls the `Azure-AsyncOperation` (or
+// `Location`) URL returned by the initial response until the operation
+// terminates. Unlike autorest's poller, it accepts the status in any of the
+// shapes read by parseArmAsyncOperationStatus, and falls back to polling the
+// resource itself when neither header is returned.
+func pollArmVirtualMachineExtensionOperation(sender autorest.Sender, resp *http.Response, delay time.Duration, cancel <-chan struct{}) error {
+	pollURL := resp.Header.Get("Azure-AsyncOperation")
+	if pollURL == "" {
+		pollURL = autorest.GetLocation(resp)
+	}
+	if pollURL == "" && resp.Request != nil {
+		pollURL = resp.Request.URL.String()
+	}
+
+	for {
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("Error reading the status of the Extension operation: %s", err)
+		}
+
+		status := parseArmAsyncOperationStatus(resp.StatusCode, body)
+		switch {
+		case strings.EqualFold(status.State, "Succeeded"):
+			return nil
+		case strings.EqualFold(status.State, "Canceled"):
+			return fmt.Errorf("Long running operation was canceled with status '%s': Code=%q Message=%q\n\n%s", status.State, status.Code, status.Message, armVirtualMachineExtensionCanceledHint)
+		case strings.EqualFold(status.State, "Failed"):
+			// formatted like autorest's errors, which flattenArmVirtualMachineExtensionError reads
+			return fmt.Errorf("Long running operation terminated with status '%s': Code=%q Message=%q", status.State, status.Code, status.Message)
+		}
+
+		if pollURL == "" {
+			return fmt.Errorf("Unable to obtain the URL to poll the Extension operation (status %q)", status.State)
+		}
+
+		log.Printf("[DEBUG] Extension operation is %q, polling %s", status.State, pollURL)
+		select {
+		case <-time.After(autorest.GetRetryAfter(resp, delay)):
+		case <-cancel:
+			return fmt.Errorf("Polling of the Extension operation was canceled")
+		}
+
+		req, err := autorest.Prepare(&http.Request{Cancel: cancel}, autorest.AsGet(), autorest.WithBaseURL(pollURL))
+		if err != nil {
+			return fmt.Errorf("Error creating the request to poll %s: %s", pollURL, err)
+		}
+		resp, err = autorest.SendWithSender(sender, req)
+		if err != nil {
+			return fmt.Errorf("Error polling %s: %s", pollURL, err)
+		}
+		if resp.StatusCode >= http.StatusBadRequest {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			return fmt.Errorf("Error polling %s: unexpected status %d: %s", pollURL, resp.StatusCode, bytes.TrimSpace(body))
+		}
+	}
+}
+
+type armAsyncOperationStatus struct {
+	State   string
+	Code    string
+	Message string
+}
+
+// parseArmAsyncOperationStatus reads the state of an operation from a polling
+// response. Besides the documented `{"status": "..."}` operation resource,
+// some clouds return the state as `{"status": {"state": "..."}}`, as a
+// `provisioningState` (optionally within `properties`) or only through the
+// status code (202 while in progress). States are returned as-is, so callers
+// compare them case-insensitively.
+func parseArmAsyncOperationStatus(statusCode int, body []byte) armAsyncOperationStatus {
+	var raw struct {
+		Status            json.RawMessage     `json:"status"`
+		ProvisioningState string              `json:"provisioningState"`
+		Error             *azure.ServiceError `json:"error"`
+		Properties        *struct {
+			ProvisioningState string              `json:"provisioningState"`
+			Status            string              `json:"status"`
+			Error             *azure.ServiceError `json:"error"`
+		} `json:"properties"`
+	}
+	json.Unmarshal(body, &raw)
+
+	var status armAsyncOperationStatus
+	if len(raw.Status) > 0 {
+		var state string
+		if err := json.Unmarshal(raw.Status, &state); err == nil {
+			status.State = state
+		} else {
+			var nested struct {
+				State string `json:"state"`
+				Value string `json:"value"`
+			}
+			if err := json.Unmarshal(raw.Status, &nested); err == nil {
+				status.State = nested.State
+				if status.State == "" {
+					status.State = nested.Value
+				}
+			}
+		}
+	}
+
+	serviceError := raw.Error
+	if props := raw.Properties; props != nil {
+		if status.State == "" {
+			status.State = props.Status
+		}
+		if status.State == "" {
+			status.State = props.ProvisioningState
+		}
+		if serviceError == nil {
+			serviceError = props.Error
+		}
+	}
+	if status.State == "" {
+		status.State = raw.ProvisioningState
+	}
+
+	if status.State == "" {
+		switch statusCode {
+		case http.StatusAccepted:
+			status.State = "InProgress"
+		default:
+			status.State = "Succeeded"
+		}
+	}
+
+	status.Code, status.Message = "Unknown", "None"
+	if serviceError != nil {
+		status.Code = serviceError.Code
+		status.Message = serviceError.Message
+	}
+
+	return status
+}
@@ -0,0 +1,102 @@
+package azurerm
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+)
+
+func TestParseArmAsyncOperationStatus(t *testing.T) {
+	cases := []struct {
+		StatusCode int
+		Body       string
+		State      string
+		Code       string
+	}{
+		{StatusCode: 200, Body: `{"status":"InProgress"}`, State: "InProgress", Code: "Unknown"},
+		{StatusCode: 200, Body: `{"status":"Failed","error":{"code":"VMExtensionProvisioningError","message":"exit code 1"}}`, State: "Failed", Code: "VMExtensionProvisioningError"},
+		{StatusCode: 200, Body: `{"status":{"state":"succeeded"}}`, State: "succeeded", Code: "Unknown"},
+		{StatusCode: 200, Body: `{"status":{"value":"Running"}}`, State: "Running", Code: "Unknown"},
+		{StatusCode: 200, Body: `{"properties":{"status":"Failed","error":{"code":"Conflict"}}}`, State: "Failed", Code: "Conflict"},
+		{StatusCode: 201, Body: `{"name":"hostname","properties":{"provisioningState":"Creating"}}`, State: "Creating", Code: "Unknown"},
+		{StatusCode: 200, Body: `{"provisioningState":"Succeeded"}`, State: "Succeeded", Code: "Unknown"},
+		{StatusCode: 202, Body: ``, State: "InProgress", Code: "Unknown"},
+		{StatusCode: 204, Body: ``, State: "Succeeded", Code: "Unknown"},
+	}
+
+	for _, tc := range cases {
+		status := parseArmAsyncOperationStatus(tc.StatusCode, []byte(tc.Body))
+		if status.State != tc.State || status.Code != tc.Code {
+			t.Fatalf("%d %s: Expected state %q and code %q, got %+v", tc.StatusCode, tc.Body, tc.State, tc.Code, status)
+		}
+	}
+}
+
+func TestCreateOrUpdateArmVirtualMachineExtension_fallbackPoller(t *testing.T) {
+	cases := []struct {
+		Name           string
+		Final          string
+		ExpectCode     string
+		ExpectCanceled bool
+	}{
+		{Name: "succeeded", Final: `{"status":{"state":"Succeeded"}}`},
+		{Name: "failed", Final: `{"status":{"state":"Failed"},"properties":{"error":{"code":"VMExtensionProvisioningError","message":"exit code 1"}}}`, ExpectCode: "VMExtensionProvisioningError"},
+		{Name: "canceled", Final: `{"status":{"state":"Canceled"},"properties":{"error":{"code":"OperationCanceled","message":"exit code 1"}}}`, ExpectCode: "OperationCanceled", ExpectCanceled: true},
+	}
+
+	for _, tc := range cases {
+		var polls int32
+
+		var server *httptest.Server
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", "0")
+			switch {
+			case r.Method == "PUT" && strings.Contains(r.URL.Path, "/extensions/hostname"):
+				// neither autorest's operation resource nor a Location
+				w.Header().Set("Azure-AsyncOperation", server.URL+"/operations/1")
+				w.WriteHeader(http.StatusCreated)
+				fmt.Fprint(w, `{"name":"hostname","properties":{"provisioningState":"Creating"}}`)
+			case r.Method == "GET" && r.URL.Path == "/operations/1":
+				if atomic.AddInt32(&polls, 1) == 1 {
+					fmt.Fprint(w, `{"status":{"state":"InProgress"}}`)
+					return
+				}
+				fmt.Fprint(w, tc.Final)
+			default:
+				t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+
+		client := testArmClientWithBaseURI(server.URL)
+		client.extensionFallbackPoller = true
+
+		err := createOrUpdateArmVirtualMachineExtension(client, "acctestrg", "acctvm", "hostname", compute.VirtualMachineExtension{}, nil, nil)
+		server.Close()
+
+		if polls != 2 {
+			t.Fatalf("%s: Expected the operation to be polled until terminal, got %d polls", tc.Name, polls)
+		}
+		if tc.ExpectCode == "" {
+			if err != nil {
+				t.Fatalf("%s: Expected the extension to be created, got: %s", tc.Name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Fatalf("%s: Expected an error", tc.Name)
+		}
+		if code, message := flattenArmVirtualMachineExtensionError(err, nil); code != tc.ExpectCode || message != "exit code 1" {
+			t.Fatalf("%s: Expected the error to be parsed, got %q and %q from: %s", tc.Name, code, message, err)
+		}
+		if canceled := strings.Contains(err.Error(), "was canceled with status 'Canceled'"); canceled != tc.ExpectCanceled {
+			t.Fatalf("%s: Expected the error to say the operation was canceled to be %t, got: %s", tc.Name, tc.ExpectCanceled, err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package azurerm
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// armVirtualMachineExtensionSettingsMovedToProtected returns the (sorted)
+// top-level keys which were removed from the settings and added to
+// `protected_settings` by this change, as when hardening a configuration
+// which used to send a secret in plain text.
+func armVirtualMachineExtensionSettingsMovedToProtected(d *schema.ResourceData) []string {
+	if !d.HasChange("protected_settings") {
+		return nil
+	}
+
+	oldSettings, newSettings := d.GetChange("settings")
+	oldSettingsMap, newSettingsMap := d.GetChange("settings_map")
+	oldProtected, newProtected := d.GetChange("protected_settings")
+
+	before := armVirtualMachineExtensionSettingsTopLevelKeys(oldSettings.(string), oldSettingsMap.(map[string]interface{}))
+	after := armVirtualMachineExtensionSettingsTopLevelKeys(newSettings.(string), newSettingsMap.(map[string]interface{}))
+	protectedBefore := armVirtualMachineExtensionSettingsTopLevelKeys(oldProtected.(string), nil)
+	protectedAfter := armVirtualMachineExtensionSettingsTopLevelKeys(newProtected.(string), nil)
+
+	moved := make([]string, 0)
+	for k := range before {
+		if !after[k] && protectedAfter[k] && !protectedBefore[k] {
+			moved = append(moved, k)
+		}
+	}
+	sort.Strings(moved)
+	return moved
+}
+
+// armVirtualMachineExtensionSettingsTopLevelKeys returns the top-level keys of
+// the JSON settings and the settings map. Settings which can't be parsed have
+// no keys, since they're rejected before anything is sent anyway.
+func armVirtualMachineExtensionSettingsTopLevelKeys(settingsString string, settingsMap map[string]interface{}) map[string]bool {
+	keys := make(map[string]bool)
+	if settingsString != "" {
+		settings, err := expandArmVirtualMachineExtensionSettings(settingsString)
+		if err == nil {
+			for k := range settings {
+				keys[k] = true
+			}
+		}
+	}
+	for k := range settingsMap {
+		keys[k] = true
+	}
+	return keys
+}
+
+// armVirtualMachineExtensionSettingsMovedToProtectedError is returned when
+// keys moved to `protected_settings` without the replacement being opted into,
+// since the plan showed an update in place.
+func armVirtualMachineExtensionSettingsMovedToProtectedError(name string, moved []string) error {
+	return fmt.Errorf("%s of Virtual Machine Extension %q moved from `settings` to `protected_settings`, but the extension handler may keep the plain text value it was given until the Extension is created again. Either replace the Extension with `terraform taint`, or set `replace_on_settings_moved_to_protected` to have the apply delete and create it again", strings.Join(moved, ", "), name)
+}
+
+// resourceArmVirtualMachineExtensionsReplace deletes the Extension and creates
+// it again, which helper/schema can't plan for since the replacement depends
+// on comparing the settings with the protected settings.
+func resourceArmVirtualMachineExtensionsReplace(d *schema.ResourceData, meta interface{}, moved []string) error {
+	name := d.Get("name").(string)
+	log.Printf("[WARN] Replacing Virtual Machine Extension %q since %s moved from `settings` to `protected_settings`, so that no plain text copy is left in the extension handler's state", name, strings.Join(moved, ", "))
+
+	// the Extension must be gone before it's created again
+	if err := deleteArmVirtualMachineExtension(d, meta, true); err != nil {
+		return fmt.Errorf("Error replacing Virtual Machine Extension %q, whose %s moved to `protected_settings`: %s", name, strings.Join(moved, ", "), err)
+	}
+
+	d.MarkNewResource()
+	return resourceArmVirtualMachineExtensionsCreate(d, meta)
+}
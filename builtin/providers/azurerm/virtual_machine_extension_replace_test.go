@@ -0,0 +1,103 @@
+package azurerm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform/config"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestResourceArmVirtualMachineExtensionsUpdate_settingsMovedToProtected(t *testing.T) {
+	var requests []string
+	settings := `{}`
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "PUT" && strings.Contains(r.URL.Path, "/extensions/"):
+			requests = append(requests, r.Method)
+			var body struct {
+				Properties struct {
+					Settings json.RawMessage `json:"settings"`
+				} `json:"properties"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			settings = string(body.Properties.Settings)
+			fmt.Fprint(w, `{"name":"hostname","properties":{"provisioningState":"Succeeded"}}`)
+		case r.Method == "DELETE" && strings.Contains(r.URL.Path, "/extensions/"):
+			requests = append(requests, r.Method)
+			w.WriteHeader(http.StatusOK)
+		case strings.Contains(r.URL.Path, "/extensions/"):
+			fmt.Fprintf(w, `{"id":"/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/hostname","name":"hostname","location":"westus","properties":{"publisher":"Microsoft.OSTCExtensions","type":"CustomScriptForLinux","typeHandlerVersion":"1.2","settings":%s,"provisioningState":"Succeeded"}}`, settings)
+		default:
+			fmt.Fprint(w, `{"name":"acctvm","properties":{}}`)
+		}
+	}))
+	defer server.Close()
+
+	client := testArmClientWithBaseURI(server.URL)
+	resource := resourceArmVirtualMachineExtensions()
+
+	plan := func(state *terraform.InstanceState, settings, protectedSettings string, replace bool) *terraform.InstanceDiff {
+		raw, err := config.NewRawConfig(map[string]interface{}{
+			"name":                                   "hostname",
+			"location":                               "westus",
+			"resource_group_name":                    "acctestRG",
+			"virtual_machine_name":                   "acctvm",
+			"publisher":                              "Microsoft.OSTCExtensions",
+			"type":                                   "CustomScriptForLinux",
+			"type_handler_version":                   "1.2",
+			"settings":                               settings,
+			"protected_settings":                     protectedSettings,
+			"replace_on_settings_moved_to_protected": replace,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		diff, err := resource.Diff(state, terraform.NewResourceConfig(raw))
+		if err != nil {
+			t.Fatalf("Error planning the Extension: %s", err)
+		}
+		return diff
+	}
+	apply := func(state *terraform.InstanceState, settings, protectedSettings string, replace bool) *terraform.InstanceState {
+		state, err := resource.Apply(state, plan(state, settings, protectedSettings, replace), client)
+		if err != nil {
+			t.Fatalf("Error applying the Extension: %s", err)
+		}
+		return state
+	}
+
+	state := apply(nil, `{"fileUris": ["https://example.com/script.sh"], "commandToExecute": "sh script.sh secret"}`, "", false)
+
+	// a new protected setting alone is an update in place
+	requests = nil
+	state = apply(state, `{"fileUris": ["https://example.com/script.sh"], "commandToExecute": "sh script.sh secret"}`, `{"storageAccountName": "acctestsa"}`, false)
+	if expected := []string{"PUT"}; !reflect.DeepEqual(requests, expected) {
+		t.Fatalf("Expected %v, got %v", expected, requests)
+	}
+
+	// moving a key fails unless the replacement is opted into
+	requests = nil
+	diff := plan(state, `{"fileUris": ["https://example.com/script.sh"]}`, `{"storageAccountName": "acctestsa", "commandToExecute": "sh script.sh secret"}`, false)
+	_, err := resource.Apply(state, diff, client)
+	if err == nil || !strings.Contains(err.Error(), "commandToExecute") || !strings.Contains(err.Error(), "terraform taint") {
+		t.Fatalf("Expected an error naming the moved key, got: %v", err)
+	}
+	if len(requests) != 0 {
+		t.Fatalf("Expected nothing to be sent, got %v", requests)
+	}
+
+	requests = nil
+	apply(state, `{"fileUris": ["https://example.com/script.sh"]}`, `{"storageAccountName": "acctestsa", "commandToExecute": "sh script.sh secret"}`, true)
+	if expected := []string{"DELETE", "PUT"}; !reflect.DeepEqual(requests, expected) {
+		t.Fatalf("Expected the Extension to be replaced, got %v", requests)
+	}
+}
@@ -0,0 +1,92 @@
+package azurerm
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// expandArmVirtualMachineExtensionSettingsMap builds the settings object from
+// `settings_map`, a companion to expandArmVirtualMachineExtensionSettings for
+// the extensions whose settings are simple key/value pairs.
+func expandArmVirtualMachineExtensionSettingsMap(settingsMap map[string]interface{}) map[string]interface{} {
+	settings := make(map[string]interface{}, len(settingsMap))
+	for k, v := range settingsMap {
+		settings[k] = expandArmVirtualMachineExtensionSettingsMapValue(v.(string))
+	}
+	return settings
+}
+
+// expandArmVirtualMachineExtensionSettingsMapValue sends the values which are
+// JSON numbers or booleans as such, since the values of a map in the
+// configuration are always strings. Anything else, including a number with
+// leading zeros such as `007`, is sent as a string.
+func expandArmVirtualMachineExtensionSettingsMapValue(value string) interface{} {
+	switch value {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+
+	var number json.Number
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+	if err := decoder.Decode(&number); err == nil && number.String() == value {
+		return number
+	}
+
+	return value
+}
+
+// flattenArmVirtualMachineExtensionSettingsMap returns the settings returned
+// by Azure as `settings_map`, keeping the configured value of the keys whose
+// returned value is the same (e.g. `1.0` being returned as `1`).
+func flattenArmVirtualMachineExtensionSettingsMap(current, returned map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(returned))
+	for k, v := range returned {
+		if configured, ok := current[k].(string); ok && isArmVirtualMachineExtensionSettingsMapValueEqual(configured, v) {
+			result[k] = configured
+			continue
+		}
+		result[k] = flattenArmVirtualMachineExtensionSettingsMapValue(v)
+	}
+	return result
+}
+
+func flattenArmVirtualMachineExtensionSettingsMapValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	}
+
+	// numbers, and the nested values `settings_map` can't express otherwise
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
+
+func isArmVirtualMachineExtensionSettingsMapValueEqual(configured string, returned interface{}) bool {
+	configuredJSON, err := json.Marshal(expandArmVirtualMachineExtensionSettingsMapValue(configured))
+	if err != nil {
+		return false
+	}
+	returnedJSON, err := json.Marshal(returned)
+	if err != nil {
+		return false
+	}
+
+	configuredNormalized, err := normalizeJsonString(string(configuredJSON))
+	if err != nil {
+		return false
+	}
+	returnedNormalized, err := normalizeJsonString(string(returnedJSON))
+	if err != nil {
+		return false
+	}
+	return configuredNormalized == returnedNormalized
+}
@@ -0,0 +1,115 @@
+package azurerm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpandArmVirtualMachineExtensionSettingsMapValue(t *testing.T) {
+	cases := []struct {
+		Value    string
+		Expected interface{}
+	}{
+		{Value: "true", Expected: true},
+		{Value: "false", Expected: false},
+		{Value: "5", Expected: json.Number("5")},
+		{Value: "-1.5e3", Expected: json.Number("-1.5e3")},
+		{Value: "12345678901234567890", Expected: json.Number("12345678901234567890")},
+		{Value: "007", Expected: "007"},
+		{Value: " 5", Expected: " 5"},
+		{Value: "True", Expected: "True"},
+		{Value: `"5"`, Expected: `"5"`},
+		{Value: "null", Expected: "null"},
+		{Value: "", Expected: ""},
+		{Value: "Microsoft-Windows-Diagnostics", Expected: "Microsoft-Windows-Diagnostics"},
+	}
+
+	for _, tc := range cases {
+		if actual := expandArmVirtualMachineExtensionSettingsMapValue(tc.Value); !reflect.DeepEqual(actual, tc.Expected) {
+			t.Fatalf("Expected %q to be expanded to %#v, got %#v", tc.Value, tc.Expected, actual)
+		}
+	}
+}
+
+func TestFlattenArmVirtualMachineExtensionSettingsMap(t *testing.T) {
+	current := map[string]interface{}{
+		"sampleRate": "1.0",
+		"enabled":    "true",
+		"level":      "Verbose",
+	}
+	returned := map[string]interface{}{
+		"sampleRate": float64(1),
+		"enabled":    false,
+		"level":      "Verbose",
+		"retention":  float64(30),
+		"sinks":      []interface{}{"a"},
+	}
+
+	expected := map[string]interface{}{
+		"sampleRate": "1.0",
+		"enabled":    "false",
+		"level":      "Verbose",
+		"retention":  "30",
+		"sinks":      `["a"]`,
+	}
+	if actual := flattenArmVirtualMachineExtensionSettingsMap(current, returned); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, actual)
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionsCreate_settingsMap(t *testing.T) {
+	var sent string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "PUT" && strings.Contains(r.URL.Path, "/extensions/"):
+			body, _ := ioutil.ReadAll(r.Body)
+			sent = string(body)
+			fmt.Fprint(w, `{"name":"diagnostics","properties":{"provisioningState":"Succeeded"}}`)
+		case strings.Contains(r.URL.Path, "/extensions/"):
+			fmt.Fprint(w, `{"id":"/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/diagnostics","name":"diagnostics","location":"westus","properties":{"publisher":"Microsoft.Azure.Diagnostics","type":"LinuxDiagnostic","typeHandlerVersion":"3.0","settings":{"StorageAccount":"acctestsa","sampleRateInSeconds":15,"enabled":true},"provisioningState":"Succeeded"}}`)
+		default:
+			fmt.Fprint(w, `{"name":"acctvm","properties":{}}`)
+		}
+	}))
+	defer server.Close()
+
+	d := testArmResourceDataRaw(t, resourceArmVirtualMachineExtensions(), map[string]interface{}{
+		"name":                 "diagnostics",
+		"location":             "West US",
+		"resource_group_name":  "acctestRG",
+		"virtual_machine_name": "acctvm",
+		"publisher":            "Microsoft.Azure.Diagnostics",
+		"type":                 "LinuxDiagnostic",
+		"type_handler_version": "3.0",
+		"settings_map": map[string]interface{}{
+			"StorageAccount":      "acctestsa",
+			"sampleRateInSeconds": "15",
+			"enabled":             "true",
+		},
+	})
+	d.MarkNewResource()
+
+	if err := resourceArmVirtualMachineExtensionsCreate(d, testArmClientWithBaseURI(server.URL)); err != nil {
+		t.Fatalf("Error creating the Extension: %s", err)
+	}
+	if !strings.Contains(sent, `"settings":{"StorageAccount":"acctestsa","enabled":true,"sampleRateInSeconds":15}`) {
+		t.Fatalf("Expected the settings to be assembled from `settings_map`, got %s", sent)
+	}
+
+	expected := map[string]interface{}{
+		"StorageAccount":      "acctestsa",
+		"sampleRateInSeconds": "15",
+		"enabled":             "true",
+	}
+	if actual := d.Get("settings_map").(map[string]interface{}); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Expected `settings_map` to be read back as %+v, got %+v", expected, actual)
+	}
+}
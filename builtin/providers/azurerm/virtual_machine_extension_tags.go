@@ -0,0 +1,127 @@
+package azurerm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// armVirtualMachineExtensionUpdateAPIVersion is the API version the tags of an
+// extension are updated with, unless its `api_version` is later. The vendored
+// SDK's API version predates the extensions' Update (PATCH) operation, which
+// was added in 2017-03-30.
+const armVirtualMachineExtensionUpdateAPIVersion = "2017-03-30"
+
+// isArmVirtualMachineExtensionTagsOnlyChange returns whether `tags` are the
+// only attribute of the Extension which changed, in which case they're
+// updated without the extension handler being run again.
+func isArmVirtualMachineExtensionTagsOnlyChange(d *schema.ResourceData) bool {
+	if !d.HasChange("tags") || d.Get("skipped").(bool) {
+		return false
+	}
+
+	for k := range resourceArmVirtualMachineExtensions().Schema {
+		if k != "tags" && d.HasChange(k) {
+			return false
+		}
+	}
+	return true
+}
+
+// updateArmVirtualMachineExtensionTags updates only the tags of the extension,
+// which unlike a CreateOrUpdate doesn't reprovision it.
+func updateArmVirtualMachineExtensionTags(client *ArmClient, resGroup, vmName, name string, tags *map[string]*string, cancel <-chan struct{}) error {
+	extClient := client.vmExtensionClient
+
+	pathParameters := map[string]interface{}{
+		"resourceGroupName": autorest.Encode("path", resGroup),
+		"subscriptionId":    autorest.Encode("path", extClient.SubscriptionID),
+		"vmExtensionName":   autorest.Encode("path", name),
+		"vmName":            autorest.Encode("path", vmName),
+	}
+	// the API versions are dates, so compare as strings
+	apiVersion := armVirtualMachineExtensionUpdateAPIVersion
+	if extClient.APIVersion > apiVersion {
+		apiVersion = extClient.APIVersion
+	}
+	queryParameters := map[string]interface{}{
+		"api-version": apiVersion,
+	}
+	body := map[string]interface{}{
+		"tags": tags,
+	}
+
+	req, err := autorest.Prepare(&http.Request{Cancel: cancel},
+		autorest.AsJSON(),
+		autorest.AsPatch(),
+		autorest.WithBaseURL(extClient.BaseURI),
+		autorest.WithPathParameters("/subscriptions/{subscriptionId}/resourceGroups/{resourceGroupName}/providers/Microsoft.Compute/virtualMachines/{vmName}/extensions/{vmExtensionName}", pathParameters),
+		autorest.WithJSON(body),
+		autorest.WithQueryParameters(queryParameters))
+	if err != nil {
+		return autorest.NewErrorWithError(err, "compute.VirtualMachineExtensionsClient", "Update", nil, "Failure preparing request")
+	}
+
+	resp, err := autorest.SendWithSender(extClient, req)
+	if err != nil {
+		return autorest.NewErrorWithError(err, "compute.VirtualMachineExtensionsClient", "Update", resp, "Failure sending request")
+	}
+
+	if !autorest.ResponseHasStatusCode(resp, http.StatusOK, http.StatusAccepted) {
+		err = autorest.Respond(resp,
+			extClient.ByInspecting(),
+			azure.WithErrorUnlessStatusCode(http.StatusOK, http.StatusAccepted),
+			autorest.ByClosing())
+		return autorest.NewErrorWithError(err, "compute.VirtualMachineExtensionsClient", "Update", resp, "Failure responding to request")
+	}
+
+	if err := pollArmVirtualMachineExtensionOperation(extClient.Client, resp, extClient.PollingDelay, cancel); err != nil {
+		return autorest.NewErrorWithError(err, "compute.VirtualMachineExtensionsClient", "Update", nil, "Failure sending request")
+	}
+
+	return nil
+}
+
+// resourceArmVirtualMachineExtensionsUpdateTags is the lighter update path of
+// resourceArmVirtualMachineExtensionsUpdate, for a change of `tags` alone.
+func resourceArmVirtualMachineExtensionsUpdateTags(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*ArmClient)
+	name := d.Get("name").(string)
+	resGroup, vmName, err := armVirtualMachineExtensionVirtualMachine(d)
+	if err != nil {
+		return err
+	}
+
+	tags := expandTags(d.Get("tags").(map[string]interface{}))
+	if client.autoTagExtensions {
+		publisher, extensionType, err := armVirtualMachineExtensionPublisherAndType(d, client)
+		if err != nil {
+			return err
+		}
+		expandArmVirtualMachineExtensionMetadataTags(tags, publisher, extensionType, d.Get("type_handler_version").(string))
+	}
+	inheritedTags := make(map[string]interface{})
+	if d.Get("inherit_tags_from_vm").(bool) {
+		if inheritedTags, err = expandArmVirtualMachineExtensionInheritedTags(client, resGroup, vmName, name, tags); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(client.StopContext, d.Timeout(schema.TimeoutUpdate))
+	defer cancel()
+
+	lockKey := armVirtualMachineExtensionsLockKey(resGroup, vmName)
+	armMutexKV.Lock(lockKey)
+	err = updateArmVirtualMachineExtensionTags(client, resGroup, vmName, name, tags, ctx.Done())
+	armMutexKV.Unlock(lockKey)
+	if err != nil {
+		return fmt.Errorf("Error updating the tags of Virtual Machine Extension %q on Virtual Machine %q: %s", name, vmName, err)
+	}
+	d.Set("inherited_tags", inheritedTags)
+
+	return resourceArmVirtualMachineExtensionsRead(d, meta)
+}
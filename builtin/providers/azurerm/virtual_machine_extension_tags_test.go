@@ -0,0 +1,123 @@
+package azurerm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/hashicorp/terraform/config"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestResourceArmVirtualMachineExtensionsUpdate_tagsOnly(t *testing.T) {
+	var puts, patches int
+	var patched, apiVersion string
+	tags := `{}`
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "PUT" && strings.Contains(r.URL.Path, "/extensions/"):
+			puts++
+			fmt.Fprint(w, `{"name":"hostname","properties":{"provisioningState":"Succeeded"}}`)
+		case r.Method == "PATCH" && strings.Contains(r.URL.Path, "/extensions/"):
+			patches++
+			body, _ := ioutil.ReadAll(r.Body)
+			patched, apiVersion = string(body), r.URL.Query().Get("api-version")
+			tags = `{"environment":"production"}`
+			fmt.Fprint(w, `{"name":"hostname","properties":{"provisioningState":"Succeeded"}}`)
+		case strings.Contains(r.URL.Path, "/extensions/"):
+			fmt.Fprintf(w, `{"id":"/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/hostname","name":"hostname","location":"westus","tags":%s,"properties":{"publisher":"Microsoft.OSTCExtensions","type":"CustomScriptForLinux","typeHandlerVersion":"1.2","settings":{"commandToExecute":"hostname"},"provisioningState":"Succeeded"}}`, tags)
+		default:
+			fmt.Fprint(w, `{"name":"acctvm","properties":{}}`)
+		}
+	}))
+	defer server.Close()
+
+	client := testArmClientWithBaseURI(server.URL)
+	resource := resourceArmVirtualMachineExtensions()
+
+	apply := func(state *terraform.InstanceState, settings string, tags map[string]interface{}) *terraform.InstanceState {
+		raw, err := config.NewRawConfig(map[string]interface{}{
+			"name":                 "hostname",
+			"location":             "westus",
+			"resource_group_name":  "acctestRG",
+			"virtual_machine_name": "acctvm",
+			"publisher":            "Microsoft.OSTCExtensions",
+			"type":                 "CustomScriptForLinux",
+			"type_handler_version": "1.2",
+			"settings":             settings,
+			"tags":                 tags,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		diff, err := resource.Diff(state, terraform.NewResourceConfig(raw))
+		if err != nil {
+			t.Fatalf("Error planning the Extension: %s", err)
+		}
+		state, err = resource.Apply(state, diff, client)
+		if err != nil {
+			t.Fatalf("Error applying the Extension: %s", err)
+		}
+		return state
+	}
+
+	state := apply(nil, `{"commandToExecute": "hostname"}`, map[string]interface{}{})
+	if puts != 1 {
+		t.Fatalf("Expected the Extension to be created, got %d requests", puts)
+	}
+
+	state = apply(state, `{"commandToExecute": "hostname"}`, map[string]interface{}{"environment": "production"})
+	if puts != 1 || patches != 1 {
+		t.Fatalf("Expected only the tags to be updated, got %d PUT and %d PATCH requests", puts, patches)
+	}
+	if patched != `{"tags":{"environment":"production"}}` || apiVersion != armVirtualMachineExtensionUpdateAPIVersion {
+		t.Fatalf("Expected only the tags to be sent, got %s (api-version %q)", patched, apiVersion)
+	}
+	if state.Attributes["tags.environment"] != "production" {
+		t.Fatalf("Expected the tags to be read back, got %+v", state.Attributes)
+	}
+
+	apply(state, `{"commandToExecute": "uptime"}`, map[string]interface{}{"environment": "staging"})
+	if puts != 2 || patches != 1 {
+		t.Fatalf("Expected a change of the settings to update the whole Extension, got %d PUT and %d PATCH requests", puts, patches)
+	}
+}
+
+func TestUpdateArmVirtualMachineExtensionTags_apiVersion(t *testing.T) {
+	cases := []struct {
+		APIVersion string
+		Expected   string
+	}{
+		{APIVersion: compute.APIVersion, Expected: armVirtualMachineExtensionUpdateAPIVersion},
+		{APIVersion: "2017-03-30", Expected: "2017-03-30"},
+		{APIVersion: "2019-07-01", Expected: "2019-07-01"},
+	}
+
+	for _, tc := range cases {
+		var apiVersion string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			apiVersion = r.URL.Query().Get("api-version")
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"name":"hostname","properties":{"provisioningState":"Succeeded"}}`)
+		}))
+
+		client := testArmClientWithBaseURI(server.URL)
+		client.vmExtensionClient.APIVersion = tc.APIVersion
+		err := updateArmVirtualMachineExtensionTags(client, "acctestRG", "acctvm", "hostname", &map[string]*string{}, nil)
+		server.Close()
+
+		if err != nil {
+			t.Fatalf("Error updating the tags: %s", err)
+		}
+		if apiVersion != tc.Expected {
+			t.Fatalf("Expected the tags of an Extension managed with api-version %q to be updated with %q, got %q", tc.APIVersion, tc.Expected, apiVersion)
+		}
+	}
+}
@@ -0,0 +1,1150 @@
+package azurerm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/azure-sdk-for-go/arm/network"
+	"github.com/hashicorp/terraform/config"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestValidateArmVirtualMachineExtensionSettingsSecrets(t *testing.T) {
+	cases := []struct {
+		Settings    string
+		Patterns    []string
+		ExpectError bool
+	}{
+		{
+			Settings:    `{"commandToExecute": "hostname"}`,
+			Patterns:    defaultForbiddenSecretPatterns,
+			ExpectError: false,
+		},
+		{
+			Settings:    `{"adminPassword": "Password1234!"}`,
+			Patterns:    defaultForbiddenSecretPatterns,
+			ExpectError: true,
+		},
+		{
+			Settings:    `{"storage": {"connectionString": "DefaultEndpointsProtocol=https;AccountName=a;AccountKey=abc=="}}`,
+			Patterns:    defaultForbiddenSecretPatterns,
+			ExpectError: true,
+		},
+		{
+			Settings:    `{"fileUris": ["https://a.blob.core.windows.net/s/run.sh?sv=2015&sig=abc"]}`,
+			Patterns:    defaultForbiddenSecretPatterns,
+			ExpectError: true,
+		},
+		{
+			Settings:    `{"adminPassword": "Password1234!"}`,
+			Patterns:    []string{`^token$`},
+			ExpectError: false,
+		},
+		{
+			Settings:    `{"token": "abc"}`,
+			Patterns:    []string{`^token$`},
+			ExpectError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		settings, err := expandArmVirtualMachineExtensionSettings(tc.Settings)
+		if err != nil {
+			t.Fatalf("Unexpected error expanding %q: %s", tc.Settings, err)
+		}
+
+		err = validateArmVirtualMachineExtensionSettingsSecrets(settings, tc.Patterns)
+		if tc.ExpectError && err == nil {
+			t.Fatalf("Expected %q to be rejected by %v", tc.Settings, tc.Patterns)
+		}
+		if !tc.ExpectError && err != nil {
+			t.Fatalf("Expected %q not to be rejected by %v: %s", tc.Settings, tc.Patterns, err)
+		}
+	}
+}
+
+func TestFindArmVirtualMachineExtensionSettingsSecrets_paths(t *testing.T) {
+	settings, err := expandArmVirtualMachineExtensionSettings(`{"a": {"password": "x", "plain": "y"}, "b": ["ok", "secret-value"]}`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	patterns := make([]*regexp.Regexp, 0)
+	for _, p := range defaultForbiddenSecretPatterns {
+		patterns = append(patterns, regexp.MustCompile(p))
+	}
+	expected := []string{"a.password", "b.1"}
+	if actual := findArmVirtualMachineExtensionSettingsSecrets(settings, patterns); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Expected %v, got %v", expected, actual)
+	}
+}
+
+func TestFlattenArmVirtualMachineExtensionResourceJSON(t *testing.T) {
+	name := "hostname"
+	message := "Enable succeeded: password=hunter2"
+	code := "ProvisioningState/succeeded"
+	extension := compute.VirtualMachineExtension{
+		Name: &name,
+		VirtualMachineExtensionProperties: &compute.VirtualMachineExtensionProperties{
+			Settings: &map[string]interface{}{
+				"commandToExecute": "hostname",
+			},
+			ProtectedSettings: &map[string]interface{}{
+				"storageAccountKey": "c2VjcmV0",
+			},
+			InstanceView: &compute.VirtualMachineExtensionInstanceView{
+				Statuses: &[]compute.InstanceViewStatus{
+					{Code: &code, Message: &message},
+				},
+			},
+		},
+	}
+
+	actual, err := flattenArmVirtualMachineExtensionResourceJSON(extension)
+	if err != nil {
+		t.Fatalf("Error flattening resource JSON: %s", err)
+	}
+
+	for _, secret := range []string{"c2VjcmV0", "hunter2"} {
+		if strings.Contains(actual, secret) {
+			t.Fatalf("Expected %q to be redacted from the resource JSON, got %s", secret, actual)
+		}
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal([]byte(actual), &decoded); err != nil {
+		t.Fatalf("Expected valid JSON, got %s: %s", actual, err)
+	}
+	props := decoded["properties"].(map[string]interface{})
+	if v := props["protectedSettings"].(map[string]interface{})["storageAccountKey"]; v != redactedValue {
+		t.Fatalf("Expected the protected setting key to be kept and its value redacted, got %v", v)
+	}
+	if v := props["settings"].(map[string]interface{})["commandToExecute"]; v != "hostname" {
+		t.Fatalf("Expected the plaintext settings to be kept, got %v", v)
+	}
+
+	// the response itself mustn't be modified
+	if *(*extension.VirtualMachineExtensionProperties.InstanceView.Statuses)[0].Message != message {
+		t.Fatalf("Expected the original status message to be left untouched")
+	}
+	if (*extension.VirtualMachineExtensionProperties.ProtectedSettings)["storageAccountKey"] != "c2VjcmV0" {
+		t.Fatalf("Expected the original protected settings to be left untouched")
+	}
+}
+
+// testArmResourceDataRaw creates a ResourceData from a raw configuration like
+// schema.TestResourceDataRaw, but through the resource's Apply, so that the
+// default timeouts are decoded as they are outside of tests. The ResourceData
+// is marked as a new resource.
+func testArmResourceDataRaw(t *testing.T, r *schema.Resource, raw map[string]interface{}) *schema.ResourceData {
+	c, err := config.NewRawConfig(raw)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	diff, err := r.Diff(nil, terraform.NewResourceConfig(c))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if diff == nil {
+		diff = &terraform.InstanceDiff{}
+		if r.Timeouts != nil {
+			if err := r.Timeouts.DiffEncode(diff); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+		}
+	}
+
+	var result *schema.ResourceData
+	capture := *r
+	capture.Create = func(d *schema.ResourceData, meta interface{}) error {
+		result = d
+		return nil
+	}
+	if _, err := capture.Apply(nil, diff, nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	return result
+}
+
+// testArmClientWithBaseURI returns an ArmClient whose compute clients talk to
+// the given (test) server.
+func testArmClientWithBaseURI(baseURI string) *ArmClient {
+	return &ArmClient{
+		StopContext:       context.Background(),
+		vmClient:          compute.NewVirtualMachinesClientWithBaseURI(baseURI, "00000000-0000-0000-0000-000000000000"),
+		vmExtensionClient: compute.NewVirtualMachineExtensionsClientWithBaseURI(baseURI, "00000000-0000-0000-0000-000000000000"),
+		vmScaleSetClient:  compute.NewVirtualMachineScaleSetsClientWithBaseURI(baseURI, "00000000-0000-0000-0000-000000000000"),
+		ifaceClient:       network.NewInterfacesClientWithBaseURI(baseURI, "00000000-0000-0000-0000-000000000000"),
+
+		vmExtensionImageClient: compute.NewVirtualMachineExtensionImagesClientWithBaseURI(baseURI, "00000000-0000-0000-0000-000000000000"),
+	}
+}
+
+func TestCreateArmVirtualMachineExtension_retryAfterGuestAgentReady(t *testing.T) {
+	defer func(interval time.Duration) { guestAgentReadyPollInterval = interval }(guestAgentReadyPollInterval)
+	guestAgentReadyPollInterval = 10 * time.Millisecond
+
+	var extensionRequests, vmRequests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "PUT" && strings.Contains(r.URL.Path, "/extensions/"):
+			if atomic.AddInt32(&extensionRequests, 1) == 1 {
+				w.WriteHeader(http.StatusConflict)
+				fmt.Fprint(w, `{"error":{"code":"VMAgentStatusCommunicationError","message":"VM 'acctvm' has not reported status for VM agent or extensions."}}`)
+				return
+			}
+			fmt.Fprint(w, `{"name":"hostname","properties":{"provisioningState":"Succeeded"}}`)
+		case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/virtualMachines/acctvm"):
+			status := "Not Ready"
+			if atomic.AddInt32(&vmRequests, 1) > 1 {
+				status = "Ready"
+			}
+			fmt.Fprintf(w, `{"name":"acctvm","properties":{"instanceView":{"vmAgent":{"statuses":[{"code":"ProvisioningState/succeeded","displayStatus":%q}]}}}}`, status)
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	client := testArmClientWithBaseURI(server.URL)
+	extension := compute.VirtualMachineExtension{}
+
+	err := createArmVirtualMachineExtension(client, "acctestRG", "acctvm", "hostname", extension, nil, true, time.Minute, time.Time{}, nil)
+	if err != nil {
+		t.Fatalf("Expected the Extension to be created after the VM Agent became ready, got: %s", err)
+	}
+	if extensionRequests != 2 {
+		t.Fatalf("Expected the Extension to be created twice, got %d requests", extensionRequests)
+	}
+	if vmRequests != 2 {
+		t.Fatalf("Expected the VM instance view to be polled until ready, got %d requests", vmRequests)
+	}
+}
+
+// testArmGuestAgentNeverReadyServer rejects the Extension because the VM Agent
+// isn't ready, which it never reports.
+func testArmGuestAgentNeverReadyServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "PUT" && strings.Contains(r.URL.Path, "/extensions/"):
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, `{"error":{"code":"VMAgentStatusCommunicationError","message":"VM 'acctvm' has not reported status for VM agent or extensions."}}`)
+		case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/virtualMachines/acctvm"):
+			fmt.Fprint(w, `{"name":"acctvm","properties":{"instanceView":{"vmAgent":{"statuses":[{"code":"ProvisioningState/succeeded","displayStatus":"Not Ready"}]}}}}`)
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+}
+
+func TestCreateArmVirtualMachineExtension_guestAgentReadyDeadline(t *testing.T) {
+	defer func(interval time.Duration) { guestAgentReadyPollInterval = interval }(guestAgentReadyPollInterval)
+	guestAgentReadyPollInterval = 10 * time.Millisecond
+
+	server := testArmGuestAgentNeverReadyServer(t)
+	defer server.Close()
+	client := testArmClientWithBaseURI(server.URL)
+
+	// the wait for the VM Agent is bounded by the deadline, rather than only
+	// by guestAgentReadyTimeout
+	start := time.Now()
+	err := createArmVirtualMachineExtension(client, "acctestRG", "acctvm", "hostname", compute.VirtualMachineExtension{}, nil, true, guestAgentReadyTimeout, time.Now().Add(200*time.Millisecond), nil)
+	if err == nil {
+		t.Fatalf("Expected the Extension to fail once the deadline passed")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("Expected the wait to stop at the deadline, took %s", elapsed)
+	}
+}
+
+func TestCreateArmVirtualMachineExtension_guestAgentReadyCancel(t *testing.T) {
+	server := testArmGuestAgentNeverReadyServer(t)
+	defer server.Close()
+	client := testArmClientWithBaseURI(server.URL)
+
+	// closing cancel stops the wait without waiting for the next poll
+	cancel := make(chan struct{})
+	time.AfterFunc(200*time.Millisecond, func() { close(cancel) })
+
+	start := time.Now()
+	err := createArmVirtualMachineExtension(client, "acctestRG", "acctvm", "hostname", compute.VirtualMachineExtension{}, nil, true, guestAgentReadyTimeout, time.Time{}, cancel)
+	if err == nil || !strings.Contains(err.Error(), "Stopped waiting for the VM Agent") {
+		t.Fatalf("Expected the wait for the VM Agent to be stopped, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= guestAgentReadyPollInterval {
+		t.Fatalf("Expected the wait to stop once cancel was closed, took %s", elapsed)
+	}
+}
+
+func TestCreateArmVirtualMachineExtension_serializedPerVirtualMachine(t *testing.T) {
+	var inFlight, maxInFlight, requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if current <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, current) {
+				break
+			}
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"properties":{"provisioningState":"Succeeded"}}`)
+	}))
+	defer server.Close()
+
+	client := testArmClientWithBaseURI(server.URL)
+
+	var wg sync.WaitGroup
+	for _, name := range []string{"first", "second", "third"} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if err := createArmVirtualMachineExtension(client, "acctestRG", "acctvm", name, compute.VirtualMachineExtension{}, nil, false, time.Minute, time.Time{}, nil); err != nil {
+				t.Errorf("Error creating the Extension %q: %s", name, err)
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	if requests != 3 {
+		t.Fatalf("Expected each Extension to be created, got %d requests", requests)
+	}
+	if maxInFlight != 1 {
+		t.Fatalf("Expected the Extensions on the same VM to be created one at a time, got %d concurrent requests", maxInFlight)
+	}
+}
+
+func TestCreateArmVirtualMachineExtension_guestAgentNotReadyWithoutRetry(t *testing.T) {
+	var extensionRequests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&extensionRequests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, `{"error":{"code":"VMAgentStatusCommunicationError","message":"VM 'acctvm' has not reported status for VM agent or extensions."}}`)
+	}))
+	defer server.Close()
+
+	client := testArmClientWithBaseURI(server.URL)
+	err := createArmVirtualMachineExtension(client, "acctestRG", "acctvm", "hostname", compute.VirtualMachineExtension{}, nil, false, time.Minute, time.Time{}, nil)
+	if err == nil {
+		t.Fatalf("Expected an error when the VM Agent isn't ready")
+	}
+	if extensionRequests != 1 {
+		t.Fatalf("Expected no retry when retry_after_guest_agent_ready isn't set, got %d requests", extensionRequests)
+	}
+}
+
+func TestCreateArmVirtualMachineExtension_softDeletedNameInUse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, `{"error":{"code":"ResourceNameInUseBySoftDeletedResource","message":"The extension name 'hostname' is in use by a soft-deleted resource."}}`)
+	}))
+	defer server.Close()
+
+	client := testArmClientWithBaseURI(server.URL)
+	err := createArmVirtualMachineExtension(client, "acctestRG", "acctvm", "hostname", compute.VirtualMachineExtension{}, nil, true, time.Minute, time.Time{}, nil)
+	if err == nil {
+		t.Fatalf("Expected an error when the name is held by a soft-deleted Extension")
+	}
+	if !strings.Contains(err.Error(), "recently deleted") || !strings.Contains(err.Error(), "ResourceNameInUseBySoftDeletedResource") {
+		t.Fatalf("Expected an explanation along with the original error, got: %s", err)
+	}
+}
+
+func TestFlattenArmVirtualMachineExtensionError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		if strings.Contains(r.URL.Path, "/extensions/softdeleted") {
+			fmt.Fprint(w, `{"error":{"code":"ResourceNameInUseBySoftDeletedResource","message":"The name is in use by a \"soft-deleted\" resource."}}`)
+			return
+		}
+		fmt.Fprint(w, `{"error":{"code":"VMExtensionProvisioningError","message":"Command 'curl -H key:s3cr3t' exited with 1."}}`)
+	}))
+	defer server.Close()
+
+	client := testArmClientWithBaseURI(server.URL)
+	protectedSettings := &map[string]interface{}{
+		"storageAccountKey": "s3cr3t",
+		"nested":            map[string]interface{}{"empty": ""},
+	}
+
+	err := createArmVirtualMachineExtension(client, "acctestRG", "acctvm", "hostname", compute.VirtualMachineExtension{}, nil, false, time.Minute, time.Time{}, nil)
+	if err == nil {
+		t.Fatalf("Expected the Extension to fail")
+	}
+	code, message := flattenArmVirtualMachineExtensionError(err, protectedSettings)
+	if code != "VMExtensionProvisioningError" {
+		t.Fatalf("Expected the ARM error code, got %q", code)
+	}
+	if expected := "Command 'curl -H key:REDACTED' exited with 1."; message != expected {
+		t.Fatalf("Expected the message %q, got %q", expected, message)
+	}
+
+	// the original error is only available as text once it's been wrapped
+	err = createArmVirtualMachineExtension(client, "acctestRG", "acctvm", "softdeleted", compute.VirtualMachineExtension{}, nil, false, time.Minute, time.Time{}, nil)
+	if err == nil {
+		t.Fatalf("Expected the Extension to fail")
+	}
+	code, message = flattenArmVirtualMachineExtensionError(err, nil)
+	if code != "ResourceNameInUseBySoftDeletedResource" {
+		t.Fatalf("Expected the ARM error code, got %q", code)
+	}
+	if expected := `The name is in use by a "soft-deleted" resource.`; message != expected {
+		t.Fatalf("Expected the message %q, got %q", expected, message)
+	}
+
+	code, message = flattenArmVirtualMachineExtensionError(fmt.Errorf("something else"), protectedSettings)
+	if code != "" || message != "something else" {
+		t.Fatalf("Expected a non-ARM error to be used as is, got %q / %q", code, message)
+	}
+}
+
+func TestValidateArmVirtualMachineExtensionSettingsObject(t *testing.T) {
+	cases := []struct {
+		Value       string
+		ExpectError string
+	}{
+		{Value: ``},
+		{Value: `{}`},
+		{Value: `{"commandToExecute":"hostname","fileUris":[]}`},
+		{Value: `[{"commandToExecute":"hostname"}]`, ExpectError: "must be a JSON object (`{ ... }`), got an array"},
+		{Value: `"hostname"`, ExpectError: "got a string"},
+		{Value: `null`, ExpectError: "got null"},
+		{Value: "{\n  \"commandToExecute\": \"hostname\",\n}", ExpectError: "at line 3, column 1"},
+	}
+
+	for _, tc := range cases {
+		_, errors := validateArmVirtualMachineExtensionSettingsObject(tc.Value, "settings")
+		if tc.ExpectError == "" {
+			if len(errors) != 0 {
+				t.Fatalf("Expected %q not to trigger a validation error, got %v", tc.Value, errors)
+			}
+			continue
+		}
+		if len(errors) != 1 || !strings.Contains(errors[0].Error(), tc.ExpectError) {
+			t.Fatalf("Expected %q to trigger the error %q, got %v", tc.Value, tc.ExpectError, errors)
+		}
+	}
+}
+
+func TestValidateArmVirtualMachineExtensionPlaintextSettings(t *testing.T) {
+	cases := []struct {
+		Value         string
+		ExpectWarning string
+	}{
+		{Value: ``},
+		{Value: `{"fileUris":["https://example.com/script.sh"],"commandToExecute":"sh script.sh"}`},
+		{Value: `{"adminPassword":"hunter2"}`, ExpectWarning: "adminPassword"},
+		{Value: `{"storage":{"accountKey":"abc"},"sasToken":"?sv=1"}`, ExpectWarning: "sasToken, storage.accountKey"},
+		{Value: `{"ClientSecret":""}`, ExpectWarning: "ClientSecret"},
+	}
+
+	for _, tc := range cases {
+		ws, errors := validateArmVirtualMachineExtensionPlaintextSettings(tc.Value, "settings")
+		if len(errors) != 0 {
+			t.Fatalf("Expected %q not to trigger a validation error, got %v", tc.Value, errors)
+		}
+		if tc.ExpectWarning == "" {
+			if len(ws) != 0 {
+				t.Fatalf("Expected %q not to trigger a warning, got %v", tc.Value, ws)
+			}
+			continue
+		}
+		if len(ws) != 1 || !strings.Contains(ws[0], tc.ExpectWarning) || !strings.Contains(ws[0], "protected_settings") {
+			t.Fatalf("Expected %q to trigger a warning about %s, got %v", tc.Value, tc.ExpectWarning, ws)
+		}
+		for _, secret := range []string{"hunter2", "abc", "?sv=1"} {
+			if strings.Contains(ws[0], secret) {
+				t.Fatalf("Expected the warning not to contain the value %q, got %s", secret, ws[0])
+			}
+		}
+	}
+
+	// invalid settings are only an error
+	if ws, errors := validateArmVirtualMachineExtensionPlaintextSettings(`["password"]`, "settings"); len(ws) != 0 || len(errors) != 1 {
+		t.Fatalf("Expected only an error, got %v and %v", ws, errors)
+	}
+}
+
+func TestValidateArmVirtualMachineExtensionName(t *testing.T) {
+	cases := []struct {
+		Name     string
+		SetEnv   bool
+		Env      string
+		Warnings int
+	}{
+		{Name: "hostname", Warnings: 0},
+		{Name: "MDE.Linux", Warnings: 1},
+		{Name: "microsoftmonitoringagent", Warnings: 1},
+		{Name: "hostname", SetEnv: true, Env: "hostname, other", Warnings: 1},
+		{Name: "MDE.Linux", SetEnv: true, Env: "hostname, other", Warnings: 0},
+		{Name: "MDE.Linux", SetEnv: true, Env: "", Warnings: 0},
+	}
+
+	defer os.Unsetenv(reservedExtensionNamesEnvVar)
+	for _, tc := range cases {
+		if tc.SetEnv {
+			os.Setenv(reservedExtensionNamesEnvVar, tc.Env)
+		} else {
+			os.Unsetenv(reservedExtensionNamesEnvVar)
+		}
+
+		ws, errors := validateArmVirtualMachineExtensionName(tc.Name, "name")
+		if len(errors) != 0 {
+			t.Fatalf("Expected %q never to be an error, got %v", tc.Name, errors)
+		}
+		if len(ws) != tc.Warnings {
+			t.Fatalf("Expected %q to trigger %d warning(s), got %d", tc.Name, tc.Warnings, len(ws))
+		}
+	}
+}
+
+func TestMergeArmVirtualMachineExtensionSettings(t *testing.T) {
+	base := map[string]interface{}{
+		"fileUris": []interface{}{"https://example.com/baseline.sh"},
+		"logging": map[string]interface{}{
+			"level": "info",
+			"sinks": map[string]interface{}{"file": "/var/log/ext.log", "syslog": true},
+		},
+		"timeout": 300,
+	}
+	overrides := map[string]interface{}{
+		"fileUris": []interface{}{"https://example.com/vm.sh"},
+		"logging": map[string]interface{}{
+			"sinks": map[string]interface{}{"syslog": false},
+		},
+		"timeout":          map[string]interface{}{"seconds": 600},
+		"commandToExecute": "sh vm.sh",
+	}
+
+	expected := map[string]interface{}{
+		"fileUris": []interface{}{"https://example.com/vm.sh"},
+		"logging": map[string]interface{}{
+			"level": "info",
+			"sinks": map[string]interface{}{"file": "/var/log/ext.log", "syslog": false},
+		},
+		"timeout":          map[string]interface{}{"seconds": 600},
+		"commandToExecute": "sh vm.sh",
+	}
+
+	actual := mergeArmVirtualMachineExtensionSettings(base, overrides)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, actual)
+	}
+
+	if sinks := base["logging"].(map[string]interface{})["sinks"].(map[string]interface{}); sinks["syslog"] != true {
+		t.Fatalf("Expected the base settings not to be modified")
+	}
+}
+
+func TestArmVirtualMachineExtensionMetadataTags(t *testing.T) {
+	owner := "ops"
+	customType := "custom"
+	tags := &map[string]*string{
+		"owner":          &owner,
+		extensionTypeTag: &customType,
+	}
+
+	expandArmVirtualMachineExtensionMetadataTags(tags, "Microsoft.Azure.Extensions", "CustomScript", "2.0")
+
+	expected := map[string]string{
+		"owner":               "ops",
+		extensionTypeTag:      "custom",
+		extensionPublisherTag: "Microsoft.Azure.Extensions",
+		extensionVersionTag:   "2.0",
+	}
+	if len(*tags) != len(expected) {
+		t.Fatalf("Expected %d tags, got %d", len(expected), len(*tags))
+	}
+	for k, v := range expected {
+		if actual := (*tags)[k]; actual == nil || *actual != v {
+			t.Fatalf("Expected the tag %q to be %q, got %v", k, v, actual)
+		}
+	}
+
+	// only the configured tags are kept in the state
+	configured := map[string]interface{}{
+		"owner":          "ops",
+		extensionTypeTag: "custom",
+	}
+	flattened := flattenArmVirtualMachineExtensionMetadataTags(tags, configured)
+	if len(*flattened) != len(configured) {
+		t.Fatalf("Expected only the configured tags, got %d tags", len(*flattened))
+	}
+	for k := range configured {
+		if _, ok := (*flattened)[k]; !ok {
+			t.Fatalf("Expected the configured tag %q to be kept", k)
+		}
+	}
+
+	if flattenArmVirtualMachineExtensionMetadataTags(nil, configured) != nil {
+		t.Fatalf("Expected no tags when none are returned")
+	}
+}
+
+func TestResourceArmVirtualMachineExtensionsCreate_skipIfVMNotRunning(t *testing.T) {
+	cases := []struct {
+		PowerState string
+		Skipped    bool
+	}{
+		{PowerState: "deallocated", Skipped: true},
+		{PowerState: "stopped", Skipped: true},
+		{PowerState: "running", Skipped: false},
+	}
+
+	for _, tc := range cases {
+		var extensionRequests int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch {
+			case strings.Contains(r.URL.Path, "/extensions/"):
+				atomic.AddInt32(&extensionRequests, 1)
+				// fail the create, which is enough to show it was attempted
+				w.WriteHeader(http.StatusConflict)
+				fmt.Fprint(w, `{"error":{"code":"Conflict","message":"Not in this test."}}`)
+			default:
+				fmt.Fprintf(w, `{"name":"acctvm","properties":{"instanceView":{"statuses":[{"code":"ProvisioningState/succeeded"},{"code":"PowerState/%s"}]}}}`, tc.PowerState)
+			}
+		}))
+
+		d := testArmResourceDataRaw(t, resourceArmVirtualMachineExtensions(), map[string]interface{}{
+			"name":                   "hostname",
+			"location":               "westus",
+			"resource_group_name":    "acctestRG",
+			"virtual_machine_name":   "acctvm",
+			"publisher":              "Microsoft.Azure.Extensions",
+			"type":                   "CustomScript",
+			"type_handler_version":   "2.0",
+			"skip_if_vm_not_running": true,
+		})
+		d.MarkNewResource()
+
+		err := resourceArmVirtualMachineExtensionsCreate(d, testArmClientWithBaseURI(server.URL))
+		server.Close()
+
+		if tc.Skipped {
+			if err != nil {
+				t.Fatalf("%s: Expected the create to be skipped, got: %s", tc.PowerState, err)
+			}
+			if extensionRequests != 0 {
+				t.Fatalf("%s: Expected no requests to create the Extension, got %d", tc.PowerState, extensionRequests)
+			}
+			if !d.Get("skipped").(bool) || !strings.Contains(d.Get("skip_reason").(string), tc.PowerState) {
+				t.Fatalf("%s: Expected the skip to be recorded, got %t (%q)", tc.PowerState, d.Get("skipped").(bool), d.Get("skip_reason").(string))
+			}
+			if d.Id() == "" {
+				t.Fatalf("%s: Expected the ID to be set", tc.PowerState)
+			}
+			continue
+		}
+
+		if err == nil || extensionRequests == 0 {
+			t.Fatalf("%s: Expected the Extension to be created, got %d requests (%v)", tc.PowerState, extensionRequests, err)
+		}
+	}
+}
+
+func TestValidateArmVirtualMachineExtensionTypeHandlerVersion(t *testing.T) {
+	cases := map[string]bool{
+		"2.0":     true,
+		"1.10":    true,
+		"2.0.1":   true,
+		"2.*":     true,
+		"2.0.*":   true,
+		"2":       false,
+		"":        false,
+		"v2.0":    false,
+		"2.0.":    false,
+		"*":       false,
+		"2.0.1.4": false,
+		" 2.0":    false,
+	}
+
+	for version, valid := range cases {
+		_, errors := validateArmVirtualMachineExtensionTypeHandlerVersion(version, "type_handler_version")
+		if valid && len(errors) > 0 {
+			t.Fatalf("Expected %q to be valid, got %v", version, errors)
+		}
+		if !valid && len(errors) == 0 {
+			t.Fatalf("Expected %q to be invalid", version)
+		}
+	}
+}
+
+func TestValidateArmVirtualMachineExtensionMutuallyExclusiveKeys(t *testing.T) {
+	groups := defaultMutuallyExclusiveSettingsKeys["microsoft.azure.extensions/customscript"]
+
+	cases := []struct {
+		Settings          *map[string]interface{}
+		ProtectedSettings *map[string]interface{}
+		Groups            [][]string
+		ExpectError       bool
+	}{
+		{
+			Settings: &map[string]interface{}{"commandToExecute": "hostname"},
+			Groups:   groups,
+		},
+		{
+			Settings:          &map[string]interface{}{"fileUris": []interface{}{}},
+			ProtectedSettings: &map[string]interface{}{"script": "aG9zdG5hbWU="},
+			Groups:            groups,
+		},
+		{
+			Settings:    &map[string]interface{}{"commandToExecute": "hostname", "script": "aG9zdG5hbWU="},
+			Groups:      groups,
+			ExpectError: true,
+		},
+		{
+			Settings:          &map[string]interface{}{"commandToExecute": "hostname"},
+			ProtectedSettings: &map[string]interface{}{"script": "aG9zdG5hbWU="},
+			Groups:            groups,
+			ExpectError:       true,
+		},
+		{
+			Settings:    &map[string]interface{}{"a": 1, "c": 2},
+			Groups:      [][]string{{"a", "b"}, {"c", "d", "a"}},
+			ExpectError: true,
+		},
+		{
+			Settings: &map[string]interface{}{"a": 1, "c": 2},
+			Groups:   [][]string{{"a", "b"}, {"c", "d"}},
+		},
+		{
+			Groups: groups,
+		},
+	}
+
+	for i, tc := range cases {
+		err := validateArmVirtualMachineExtensionMutuallyExclusiveKeys(tc.Groups, tc.Settings, tc.ProtectedSettings)
+		if tc.ExpectError && err == nil {
+			t.Fatalf("Case %d: Expected an error", i)
+		}
+		if !tc.ExpectError && err != nil {
+			t.Fatalf("Case %d: Expected no error, got %s", i, err)
+		}
+	}
+}
+
+func TestValidateArmVirtualMachineExtensionOSSpecificKeys(t *testing.T) {
+	keys := osSpecificSettingsKeys["microsoft.azure.extensions/customscript"]
+
+	cases := []struct {
+		OSType            string
+		Settings          *map[string]interface{}
+		ProtectedSettings *map[string]interface{}
+		ExpectError       bool
+	}{
+		{
+			OSType:            "Linux",
+			ProtectedSettings: &map[string]interface{}{"script": "aG9zdG5hbWU="},
+		},
+		{
+			OSType:            "Windows",
+			ProtectedSettings: &map[string]interface{}{"script": "aG9zdG5hbWU="},
+			ExpectError:       true,
+		},
+		{
+			OSType:      "windows",
+			Settings:    &map[string]interface{}{"commandToExecute": "hostname", "skipDos2Unix": true},
+			ExpectError: true,
+		},
+		{
+			OSType:   "Windows",
+			Settings: &map[string]interface{}{"commandToExecute": "hostname"},
+		},
+		{
+			// the OS isn't known yet
+			Settings: &map[string]interface{}{"script": "aG9zdG5hbWU="},
+		},
+	}
+
+	for i, tc := range cases {
+		err := validateArmVirtualMachineExtensionOSSpecificKeys(keys, tc.OSType, tc.Settings, tc.ProtectedSettings)
+		if tc.ExpectError && err == nil {
+			t.Fatalf("Case %d: Expected an error", i)
+		}
+		if !tc.ExpectError && err != nil {
+			t.Fatalf("Case %d: Expected no error, got %s", i, err)
+		}
+	}
+}
+
+func TestCreateArmVirtualMachineExtension_failFast(t *testing.T) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, `{"error":{"code":"OperationNotAllowed","message":"The VM is deallocated."}}`)
+	}))
+	defer server.Close()
+
+	for _, enabled := range []bool{true, false} {
+		atomic.StoreInt32(&requests, 0)
+		client := testArmClientWithBaseURI(server.URL)
+		client.extensionFailFast = newExtensionFailFast(enabled)
+
+		if err := createArmVirtualMachineExtension(client, "acctestRG", "vm1", "hostname", compute.VirtualMachineExtension{}, nil, false, time.Minute, time.Time{}, nil); err == nil {
+			t.Fatalf("Expected the first Extension to fail")
+		}
+
+		err := createArmVirtualMachineExtension(client, "acctestRG", "vm2", "hostname", compute.VirtualMachineExtension{}, nil, false, time.Minute, time.Time{}, nil)
+		if err == nil {
+			t.Fatalf("Expected the second Extension to fail")
+		}
+
+		if enabled {
+			if requests != 1 || !strings.Contains(err.Error(), "fail_fast_on_extension_error") || !strings.Contains(err.Error(), "vm1") {
+				t.Fatalf("Expected the second Extension not to be sent, got %d requests and: %s", requests, err)
+			}
+			select {
+			case <-client.extensionFailFast.cancel():
+			default:
+				t.Fatalf("Expected the cancel channel to be closed after a failure")
+			}
+		} else if requests != 2 {
+			t.Fatalf("Expected both Extensions to be sent without fail fast, got %d requests", requests)
+		}
+	}
+}
+
+func TestSubstituteArmVirtualMachineExtensionSettingsEnv(t *testing.T) {
+	os.Setenv("ARM_TEST_SETTINGS_TOKEN", `s3cr"et`)
+	os.Setenv("ARM_TEST_SETTINGS_EMPTY", "")
+	defer os.Unsetenv("ARM_TEST_SETTINGS_TOKEN")
+	defer os.Unsetenv("ARM_TEST_SETTINGS_EMPTY")
+	os.Unsetenv("ARM_TEST_SETTINGS_UNSET")
+
+	settings, err := expandArmVirtualMachineExtensionSettings(`{"token":"Bearer ${env:ARM_TEST_SETTINGS_TOKEN}","nested":{"list":["${env:ARM_TEST_SETTINGS_EMPTY}x",1]},"literal":"${ARM_TEST_SETTINGS_TOKEN}"}`)
+	if err != nil {
+		t.Fatalf("Error expanding settings: %s", err)
+	}
+
+	substituted, err := substituteArmVirtualMachineExtensionSettingsEnv(settings)
+	if err != nil {
+		t.Fatalf("Error substituting settings: %s", err)
+	}
+
+	actual, err := flattenArmVirtualMachineExtensionSettings(substituted)
+	if err != nil {
+		t.Fatalf("Error flattening settings: %s", err)
+	}
+	expected := `{"literal":"${ARM_TEST_SETTINGS_TOKEN}","nested":{"list":["x",1]},"token":"Bearer s3cr\"et"}`
+	if actual != expected {
+		t.Fatalf("Expected %s, got %s", expected, actual)
+	}
+
+	// the template is left untouched
+	if settings["token"] != "Bearer ${env:ARM_TEST_SETTINGS_TOKEN}" {
+		t.Fatalf("Expected the template not to be modified, got %v", settings["token"])
+	}
+
+	if !armVirtualMachineExtensionSettingsTemplateMatches(`{"token":"Bearer ${env:ARM_TEST_SETTINGS_TOKEN}"}`, `{"token":"Bearer s3cr\"et"}`, true, nil) {
+		t.Fatalf("Expected the template to match the applied settings")
+	}
+	if armVirtualMachineExtensionSettingsTemplateMatches(`{"token":"Bearer ${env:ARM_TEST_SETTINGS_TOKEN}"}`, `{"token":"Bearer changed"}`, true, nil) {
+		t.Fatalf("Expected the template not to match changed settings")
+	}
+
+	missing, _ := expandArmVirtualMachineExtensionSettings(`{"a":"${env:ARM_TEST_SETTINGS_UNSET}"}`)
+	if _, err := substituteArmVirtualMachineExtensionSettingsEnv(missing); err == nil || !strings.Contains(err.Error(), "ARM_TEST_SETTINGS_UNSET") {
+		t.Fatalf("Expected an error naming the unset variable, got %v", err)
+	}
+}
+
+func TestCreateArmVirtualMachineExtension_maxConcurrentOperations(t *testing.T) {
+	var inFlight, maxInFlight int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if current <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, current) {
+				break
+			}
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"name":"hostname","properties":{"provisioningState":"Succeeded"}}`)
+	}))
+	defer server.Close()
+
+	client := testArmClientWithBaseURI(server.URL)
+	client.extensionOperations = newExtensionOperationLimiter(2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := createArmVirtualMachineExtension(client, "acctestRG", fmt.Sprintf("vm%d", i), "hostname", compute.VirtualMachineExtension{}, nil, false, time.Minute, time.Time{}, nil); err != nil {
+				t.Errorf("Error creating the Extension on vm%d: %s", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if maxInFlight == 0 || maxInFlight > 2 {
+		t.Fatalf("Expected at most 2 concurrent operations, got %d", maxInFlight)
+	}
+}
+
+func TestValidateArmVirtualMachineExtensionSettingsSize(t *testing.T) {
+	settings := map[string]interface{}{"script": strings.Repeat("a", 100)}
+
+	if err := validateArmVirtualMachineExtensionSettingsSize("settings", nil, 10); err != nil {
+		t.Fatalf("Expected no settings to be valid, got: %s", err)
+	}
+	if err := validateArmVirtualMachineExtensionSettingsSize("settings", &settings, 113); err != nil {
+		t.Fatalf("Expected settings at the limit to be valid, got: %s", err)
+	}
+
+	err := validateArmVirtualMachineExtensionSettingsSize("protected_settings", &settings, 112)
+	if err == nil {
+		t.Fatalf("Expected settings over the limit to be invalid")
+	}
+	for _, expected := range []string{"`protected_settings` are 113 bytes", "limit of 112 bytes", "fileUris"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("Expected the error to contain %q, got: %s", expected, err)
+		}
+	}
+}
+
+func TestWaitForArmVirtualMachineExtensionProvisioned(t *testing.T) {
+	defer func(interval time.Duration) { extensionProvisioningPollInterval = interval }(extensionProvisioningPollInterval)
+	extensionProvisioningPollInterval = 10 * time.Millisecond
+
+	cases := []struct {
+		Final         string
+		ExpectCode    string
+		ExpectMessage string
+		ExpectError   string
+	}{
+		{Final: `"provisioningState":"Succeeded"`},
+		{
+			Final:         `"provisioningState":"Failed","instanceView":{"statuses":[{"code":"ProvisioningState/failed/1","level":"Error","message":"Enable failed: exit status 1"},{"code":"ComponentStatus/StdErr","level":"Info","message":"curl: not found"}]}`,
+			ExpectCode:    "ProvisioningState/failed/1",
+			ExpectMessage: "Enable failed: exit status 1\ncurl: not found",
+			ExpectError:   `finished with provisioning state "Failed"`,
+		},
+		{
+			Final:         `"provisioningState":"Canceled"`,
+			ExpectCode:    "ProvisioningState/canceled",
+			ExpectMessage: "",
+			ExpectError:   `was canceled with provisioning state "Canceled"`,
+		},
+	}
+
+	for _, tc := range cases {
+		var requests int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("$expand") != "instanceView" {
+				t.Errorf("Expected the instance view to be requested")
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if atomic.AddInt32(&requests, 1) == 1 {
+				fmt.Fprint(w, `{"name":"hostname","properties":{"provisioningState":"Creating"}}`)
+				return
+			}
+			fmt.Fprintf(w, `{"name":"hostname","properties":{%s}}`, tc.Final)
+		}))
+
+		err := waitForArmVirtualMachineExtensionProvisioned(testArmClientWithBaseURI(server.URL), "acctestRG", "acctvm", "hostname", time.Minute, nil)
+		server.Close()
+
+		if requests != 2 {
+			t.Fatalf("Expected the Extension to be polled until provisioned, got %d requests", requests)
+		}
+		if tc.ExpectCode == "" {
+			if err != nil {
+				t.Fatalf("Expected the Extension to be provisioned, got: %s", err)
+			}
+			continue
+		}
+
+		if err == nil {
+			t.Fatalf("Expected an error for a failed Extension")
+		}
+		if code, message := flattenArmVirtualMachineExtensionError(err, nil); code != tc.ExpectCode || message != tc.ExpectMessage {
+			t.Fatalf("Expected the code %q and message %q, got %q and %q", tc.ExpectCode, tc.ExpectMessage, code, message)
+		}
+		if !strings.Contains(err.Error(), tc.ExpectError) {
+			t.Fatalf("Expected the error to contain %q, got: %s", tc.ExpectError, err)
+		}
+	}
+}
+
+func TestCreateArmVirtualMachineExtension_nonFatalErrorCodes(t *testing.T) {
+	defer func(interval time.Duration) { extensionProvisioningPollInterval = interval }(extensionProvisioningPollInterval)
+	extensionProvisioningPollInterval = 10 * time.Millisecond
+
+	cases := []struct {
+		Codes       []string
+		State       string
+		ExpectError bool
+	}{
+		{Codes: []string{"requestdisallowedbypolicy"}, State: "Succeeded"},
+		{Codes: []string{"RequestDisallowedByPolicy"}, State: "Failed", ExpectError: true},
+		{Codes: []string{"OperationNotAllowed"}, State: "Succeeded", ExpectError: true},
+		{State: "Succeeded", ExpectError: true},
+	}
+
+	for _, tc := range cases {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if r.Method == "PUT" {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error":{"code":"RequestDisallowedByPolicy","message":"The tags are disallowed by policy."}}`)
+				return
+			}
+			fmt.Fprintf(w, `{"name":"hostname","properties":{"provisioningState":%q}}`, tc.State)
+		}))
+
+		client := testArmClientWithBaseURI(server.URL)
+		client.nonFatalErrorCodes = tc.Codes
+
+		err := createArmVirtualMachineExtension(client, "acctestRG", "acctvm", "hostname", compute.VirtualMachineExtension{}, nil, false, time.Minute, time.Time{}, nil)
+		server.Close()
+
+		if tc.ExpectError && err == nil {
+			t.Fatalf("Expected an error with the codes %q and the state %q", tc.Codes, tc.State)
+		}
+		if !tc.ExpectError && err != nil {
+			t.Fatalf("Expected the error to be ignored with the codes %q, got: %s", tc.Codes, err)
+		}
+	}
+}
+
+func TestCreateArmVirtualMachineExtension_nonFatalErrorCodesDeadline(t *testing.T) {
+	defer func(interval time.Duration) { extensionProvisioningPollInterval = interval }(extensionProvisioningPollInterval)
+	extensionProvisioningPollInterval = 10 * time.Millisecond
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "PUT" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":{"code":"RequestDisallowedByPolicy","message":"The tags are disallowed by policy."}}`)
+			return
+		}
+		fmt.Fprint(w, `{"name":"hostname","properties":{"provisioningState":"Creating"}}`)
+	}))
+	defer server.Close()
+
+	client := testArmClientWithBaseURI(server.URL)
+	client.nonFatalErrorCodes = []string{"RequestDisallowedByPolicy"}
+
+	// the wait for the Extension to provision ends with the caller's deadline,
+	// rather than extensionProvisioningTimeout
+	start := time.Now()
+	err := createArmVirtualMachineExtension(client, "acctestRG", "acctvm", "hostname", compute.VirtualMachineExtension{}, nil, false, time.Minute, time.Now().Add(100*time.Millisecond), nil)
+	if err == nil || !strings.Contains(err.Error(), "wasn't provisioned") {
+		t.Fatalf("Expected the Extension not to be provisioned by the deadline, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("Expected the wait to end at the deadline, took %s", elapsed)
+	}
+
+	// and when the caller cancels
+	cancel := make(chan struct{})
+	time.AfterFunc(100*time.Millisecond, func() { close(cancel) })
+	start = time.Now()
+	err = createArmVirtualMachineExtension(client, "acctestRG", "acctvm", "hostname", compute.VirtualMachineExtension{}, nil, false, time.Minute, time.Time{}, cancel)
+	if err == nil || !strings.Contains(err.Error(), "wasn't provisioned") {
+		t.Fatalf("Expected the wait to be canceled, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("Expected the wait to end when canceled, took %s", elapsed)
+	}
+}
+
+func TestFlattenArmVirtualMachineExtensionScriptOutput(t *testing.T) {
+	code, message := "ComponentStatus/StdOut/succeeded", "a"+strings.Repeat("é", extensionScriptOutputSizeLimit)
+	instanceView := &compute.VirtualMachineExtensionInstanceView{
+		Substatuses: &[]compute.InstanceViewStatus{
+			{Code: &code, Message: &message},
+		},
+	}
+
+	output := flattenArmVirtualMachineExtensionScriptOutput(instanceView, "componentstatus/stdout/succeeded", nil)
+	kept := strings.TrimPrefix(output, "(truncated to the last 4096 bytes)\n")
+	if kept == output || len(kept) > extensionScriptOutputSizeLimit || strings.HasPrefix(kept, "a") || !strings.HasSuffix(kept, "é") {
+		t.Fatalf("Expected only the end of the output to be kept, got %q", output)
+	}
+	if !utf8.ValidString(output) {
+		t.Fatalf("Expected the output not to be truncated in the middle of a character")
+	}
+
+	if output := flattenArmVirtualMachineExtensionScriptOutput(instanceView, "ComponentStatus/StdErr/succeeded", nil); output != "" {
+		t.Fatalf("Expected no output for a missing substatus, got %q", output)
+	}
+	if output := flattenArmVirtualMachineExtensionScriptOutput(nil, code, nil); output != "" {
+		t.Fatalf("Expected no output without an instance view, got %q", output)
+	}
+}
+
+func TestIsArmVirtualMachineExtensionVersionBuildPinned(t *testing.T) {
+	cases := map[string]bool{
+		"2.0":   false,
+		"2.*":   false,
+		"2.0.*": false,
+		"2.0.1": true,
+	}
+
+	for version, expected := range cases {
+		if actual := isArmVirtualMachineExtensionVersionBuildPinned(version); actual != expected {
+			t.Fatalf("Expected %q to be build-pinned: %t, got %t", version, expected, actual)
+		}
+	}
+}
+
+func TestValidateArmVirtualMachineID(t *testing.T) {
+	cases := []struct {
+		Value    string
+		ErrCount int
+	}{
+		{Value: "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm", ErrCount: 0},
+		{Value: "/subscriptions/00000000-0000-0000-0000-000000000000/resourcegroups/acctestRG/providers/microsoft.compute/virtualmachines/acctvm", ErrCount: 0},
+		{Value: "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/virtualMachines/acctvm/extensions/hostname", ErrCount: 1},
+		{Value: "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG/providers/Microsoft.Compute/availabilitySets/acctavset", ErrCount: 1},
+		{Value: "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/acctestRG", ErrCount: 1},
+		{Value: "acctvm", ErrCount: 1},
+	}
+
+	for _, tc := range cases {
+		_, errors := validateArmVirtualMachineID(tc.Value, "virtual_machine_id")
+		if len(errors) != tc.ErrCount {
+			t.Fatalf("Expected %d errors validating %q, got %d: %v", tc.ErrCount, tc.Value, len(errors), errors)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package azurerm
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// settingsVMAttributeToken matches the `${vm:NAME}` tokens substituted in
+// settings with the Virtual Machine attributes of `vm_attribute_references`.
+var settingsVMAttributeToken = regexp.MustCompile(`\$\{vm:([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// armVirtualMachineReferenceableAttributes are the attributes of the Virtual
+// Machine which `vm_attribute_references` can reference.
+var armVirtualMachineReferenceableAttributes = []string{
+	"admin_username",
+	"computer_name",
+	"id",
+	"location",
+	"name",
+	"private_ip_address",
+	"vm_id",
+	"vm_size",
+}
+
+// expandArmVirtualMachineAttributeReferences returns the attribute each name
+// of `vm_attribute_references` references.
+func expandArmVirtualMachineAttributeReferences(d *schema.ResourceData) map[string]string {
+	references := make(map[string]string)
+	for _, v := range d.Get("vm_attribute_references").([]interface{}) {
+		reference := v.(map[string]interface{})
+		references[reference["name"].(string)] = reference["attribute"].(string)
+	}
+	return references
+}
+
+// resolveArmVirtualMachineAttributeReferences reads the Virtual Machine, so
+// that the attributes only known once it's been created (such as its private
+// IP address) are those of the VM the Extension is applied to. It's an error
+// for a referenced attribute not to be set.
+func resolveArmVirtualMachineAttributeReferences(client *ArmClient, resGroup, vmName, name string, references map[string]string) (map[string]string, error) {
+	vm, err := client.vmClient.Get(resGroup, vmName, "")
+	if err != nil {
+		if vm.StatusCode == http.StatusNotFound {
+			return nil, armVirtualMachineExtensionParentNotFoundError(resGroup, vmName, name)
+		}
+		return nil, fmt.Errorf("Error making Read request on Virtual Machine %s: %s", vmName, err)
+	}
+
+	values := make(map[string]string, len(references))
+	for reference, attribute := range references {
+		value, err := flattenArmVirtualMachineAttribute(client, vm, attribute)
+		if err != nil {
+			return nil, err
+		}
+		if value == "" {
+			return nil, fmt.Errorf("The attribute %q of Virtual Machine %q (referenced as `${vm:%s}`) is not set", attribute, vmName, reference)
+		}
+		values[reference] = value
+	}
+
+	return values, nil
+}
+
+func flattenArmVirtualMachineAttribute(client *ArmClient, vm compute.VirtualMachine, attribute string) (string, error) {
+	var value *string
+	switch attribute {
+	case "id":
+		value = vm.ID
+	case "name":
+		value = vm.Name
+	case "location":
+		value = vm.Location
+	case "private_ip_address":
+		return flattenArmVirtualMachinePrivateIPAddress(client, vm)
+	}
+
+	if props := vm.VirtualMachineProperties; props != nil {
+		switch attribute {
+		case "vm_id":
+			value = props.VMID
+		case "vm_size":
+			if props.HardwareProfile != nil {
+				size := string(props.HardwareProfile.VMSize)
+				value = &size
+			}
+		case "computer_name":
+			if props.OsProfile != nil {
+				value = props.OsProfile.ComputerName
+			}
+		case "admin_username":
+			if props.OsProfile != nil {
+				value = props.OsProfile.AdminUsername
+			}
+		}
+	}
+
+	if value == nil {
+		return "", nil
+	}
+	return *value, nil
+}
+
+// flattenArmVirtualMachinePrivateIPAddress returns the private IP address of
+// the primary IP configuration of the VM's primary network interface.
+func flattenArmVirtualMachinePrivateIPAddress(client *ArmClient, vm compute.VirtualMachine) (string, error) {
+	if vm.VirtualMachineProperties == nil || vm.NetworkProfile == nil || vm.NetworkProfile.NetworkInterfaces == nil {
+		return "", nil
+	}
+
+	var nicID string
+	for _, nic := range *vm.NetworkProfile.NetworkInterfaces {
+		if nic.ID == nil {
+			continue
+		}
+		// a VM with a single network interface doesn't have to mark it primary
+		if nicID == "" || (nic.NetworkInterfaceReferenceProperties != nil && nic.Primary != nil && *nic.Primary) {
+			nicID = *nic.ID
+		}
+	}
+	if nicID == "" {
+		return "", nil
+	}
+
+	id, err := parseAzureResourceID(nicID)
+	if err != nil {
+		return "", err
+	}
+	nicName := id.Path["networkInterfaces"]
+	nic, err := client.ifaceClient.Get(id.ResourceGroup, nicName, "")
+	if err != nil {
+		return "", fmt.Errorf("Error making Read request on Network Interface %s: %s", nicName, err)
+	}
+	if nic.InterfacePropertiesFormat == nil || nic.IPConfigurations == nil {
+		return "", nil
+	}
+
+	var address string
+	for _, config := range *nic.IPConfigurations {
+		props := config.InterfaceIPConfigurationPropertiesFormat
+		if props == nil || props.PrivateIPAddress == nil {
+			continue
+		}
+		if address == "" || (props.Primary != nil && *props.Primary) {
+			address = *props.PrivateIPAddress
+		}
+	}
+	return address, nil
+}
+
+// substituteArmVirtualMachineExtensionSettingsVMAttributes replaces the
+// `${vm:NAME}` tokens in the string values of the settings with the resolved
+// values. It's an error for a token's name not to be one of
+// `vm_attribute_references`.
+func substituteArmVirtualMachineExtensionSettingsVMAttributes(settings map[string]interface{}, values map[string]string) (map[string]interface{}, error) {
+	lookup := func(name string) (string, bool) {
+		value, ok := values[name]
+		return value, ok
+	}
+
+	unknown := make(map[string]bool)
+	result := substituteArmVirtualMachineExtensionSettingsTokens(settings, settingsVMAttributeToken, lookup, unknown)
+
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("the name(s) %s are not defined in `vm_attribute_references`", joinSortedArmVirtualMachineExtensionTokenNames(unknown))
+	}
+
+	return result.(map[string]interface{}), nil
+}
+
+// flattenArmVirtualMachineAttributeValues returns the values resolved by the
+// last apply, which the template is compared against.
+func flattenArmVirtualMachineAttributeValues(d *schema.ResourceData) map[string]string {
+	values := make(map[string]string)
+	for name, value := range d.Get("vm_attribute_values").(map[string]interface{}) {
+		values[name] = value.(string)
+	}
+	return values
+}
+
+func validateArmVirtualMachineAttributeReferenceName(v interface{}, k string) (ws []string, errors []error) {
+	value := v.(string)
+	if !regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`).MatchString(value) {
+		errors = append(errors, fmt.Errorf("%q may only contain letters, numbers and underscores, and can't start with a number: %q", k, value))
+	}
+	return
+}